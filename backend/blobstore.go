@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Buckets used by the app. Every BlobStore implementation maps these names
+// onto its own namespace.
+const (
+	avatarBucket    = "avatars"
+	postImageBucket = "feedposts"
+)
+
+// imageTypes are the images uploads may contain, by file extension.
+// Anything else could be served back as active content, like HTML.
+var imageTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+// imageUpload checks an uploaded image's file name and content and returns
+// the extension and content type to store it with. Files without an
+// extension get the one of their content.
+func imageUpload(filename string, data []byte) (ext, contentType string, err error) {
+	contentType = http.DetectContentType(data)
+	ext = strings.ToLower(filepath.Ext(filename))
+	if ext == "" {
+		for e, t := range imageTypes {
+			if t == contentType && e != ".jpeg" {
+				ext = e
+			}
+		}
+	}
+	if want, ok := imageTypes[ext]; !ok || want != contentType {
+		return "", "", fmt.Errorf("images must be JPEG, PNG, GIF or WebP files")
+	}
+	return ext, contentType, nil
+}
+
+// BlobStore stores user uploads such as avatars and post images.
+type BlobStore interface {
+	// Put creates or replaces the object at key.
+	Put(ctx context.Context, bucket, key string, body io.Reader, contentType string) error
+	// Delete removes the given keys; missing keys are not an error.
+	Delete(ctx context.Context, bucket string, keys ...string) error
+	// PublicURL is the permanent URL of an object in a public bucket.
+	PublicURL(bucket, key string) string
+	// SignedURL is a time-limited URL that works for private buckets too.
+	SignedURL(ctx context.Context, bucket, key string, expiry time.Duration) (string, error)
+	// List returns the objects whose keys start with prefix.
+	List(ctx context.Context, bucket, prefix string) ([]BlobObject, error)
+}
+
+type BlobObject struct {
+	Key       string    `json:"key"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// newBlobStoreFromEnv picks the backend from BLOB_STORE (supabase, local or
+// s3). Without it, Supabase is used when configured and local disk otherwise,
+// so the server runs offline with no extra setup.
+func newBlobStoreFromEnv() (BlobStore, error) {
+	kind := os.Getenv("BLOB_STORE")
+	if kind == "" {
+		kind = "local"
+		if os.Getenv("SUPABASE_URL") != "" {
+			kind = "supabase"
+		}
+	}
+
+	switch kind {
+	case "supabase":
+		supabaseUrl := os.Getenv("SUPABASE_URL")
+		supabaseKey := os.Getenv("SUPABASE_SERVICE_ROLE_KEY")
+		if supabaseUrl == "" || supabaseKey == "" {
+			return nil, fmt.Errorf("missing SUPABASE_URL or SUPABASE_SERVICE_ROLE_KEY in environment")
+		}
+		return newSupabaseBlobStore(supabaseUrl, supabaseKey)
+
+	case "local":
+		root := os.Getenv("BLOB_LOCAL_DIR")
+		if root == "" {
+			root = "uploads"
+		}
+		baseURL := os.Getenv("BLOB_PUBLIC_URL")
+		if baseURL == "" {
+			port := os.Getenv("PORT")
+			if port == "" {
+				port = "8080"
+			}
+			baseURL = "http://localhost:" + port
+		}
+		log.Printf("Storing uploads on local disk in %s", root)
+		return newLocalBlobStore(root, baseURL)
+
+	case "s3":
+		return newS3BlobStore(s3Config{
+			Endpoint:     os.Getenv("S3_ENDPOINT"),
+			Region:       os.Getenv("S3_REGION"),
+			AccessKey:    os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("S3_SECRET_ACCESS_KEY"),
+			BucketPrefix: os.Getenv("S3_BUCKET_PREFIX"),
+			PublicURL:    os.Getenv("S3_PUBLIC_URL"),
+		})
+
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q (want supabase, local or s3)", kind)
+	}
+}
+
+// isPublicBlobURL reports whether raw points at an object inside bucket of
+// the given store, as opposed to some arbitrary host.
+func isPublicBlobURL(store BlobStore, bucket, raw string) bool {
+	base, err := url.Parse(store.PublicURL(bucket, ""))
+	if err != nil {
+		return false
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	if u.Scheme != base.Scheme || u.Host != base.Host || u.User != nil {
+		return false
+	}
+	if strings.Contains(u.Path, "..") {
+		return false
+	}
+	return strings.HasPrefix(u.EscapedPath(), base.EscapedPath()) && len(u.Path) > len(base.Path)
+}
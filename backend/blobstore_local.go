@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// localBlobFilesPath is where the Go server serves files from a
+// localBlobStore.
+const localBlobFilesPath = "/files/"
+
+// localBlobStore keeps uploads on local disk under root/bucket/key and serves
+// them from the Go server. It is meant for development and tests: every
+// bucket is public, so signed URLs are plain public URLs.
+type localBlobStore struct {
+	root    string
+	baseURL string
+}
+
+func newLocalBlobStore(root, baseURL string) (*localBlobStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &localBlobStore{root: root, baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+// objectPath maps a bucket and key onto the filesystem, refusing anything
+// that would escape the store's root.
+func (s *localBlobStore) objectPath(bucket, key string) (string, error) {
+	if !filepath.IsLocal(bucket) || strings.ContainsAny(bucket, `/\`) || !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.root, bucket, filepath.FromSlash(key)), nil
+}
+
+func (s *localBlobStore) Put(ctx context.Context, bucket, key string, body io.Reader, contentType string) error {
+	dest, err := s.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partial upload
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, bucket string, keys ...string) error {
+	for _, key := range keys {
+		p, err := s.objectPath(bucket, key)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *localBlobStore) PublicURL(bucket, key string) string {
+	return s.baseURL + localBlobFilesPath + url.PathEscape(bucket) + "/" + escapeKeyPath(key)
+}
+
+func (s *localBlobStore) SignedURL(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	return s.PublicURL(bucket, key), nil
+}
+
+func (s *localBlobStore) List(ctx context.Context, bucket, prefix string) ([]BlobObject, error) {
+	bucketRoot, err := s.objectPath(bucket, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []BlobObject{}
+	err = filepath.WalkDir(bucketRoot, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return err
+		}
+
+		rel, err := filepath.Rel(bucketRoot, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, BlobObject{Key: key, Size: info.Size(), UpdatedAt: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+// Handler serves stored files. It is mounted at localBlobFilesPath. Files
+// are served from the API's origin, so only images are shown inline;
+// anything else is downloaded and sandboxed, never run as a page.
+func (s *localBlobStore) Handler() http.Handler {
+	files := http.StripPrefix(localBlobFilesPath, http.FileServer(http.Dir(s.root)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r) // no directory listings
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if contentType, ok := imageTypes[strings.ToLower(path.Ext(r.URL.Path))]; ok {
+			w.Header().Set("Content-Type", contentType)
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", "attachment")
+			w.Header().Set("Content-Security-Policy", "sandbox")
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// escapeKeyPath escapes each segment of a slash-separated object key.
+func escapeKeyPath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segments, "/")
+}
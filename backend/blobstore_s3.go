@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3BlobStore talks to any S3-compatible service (AWS, MinIO, R2, ...) using
+// path-style requests signed with AWS Signature Version 4.
+type s3BlobStore struct {
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	bucketPrefix string
+	publicURL    string
+	client       *http.Client
+}
+
+type s3Config struct {
+	Endpoint  string // e.g. https://s3.us-west-2.amazonaws.com
+	Region    string
+	AccessKey string
+	SecretKey string
+	// BucketPrefix is prepended to app bucket names, e.g. "divenet-" maps
+	// "avatars" to the S3 bucket "divenet-avatars".
+	BucketPrefix string
+	// PublicURL is the base for public object URLs, e.g. a CDN. It defaults
+	// to the endpoint.
+	PublicURL string
+}
+
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+func newS3BlobStore(cfg s3Config) (*s3BlobStore, error) {
+	if cfg.Endpoint == "" || cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("missing S3_ENDPOINT, S3_ACCESS_KEY_ID or S3_SECRET_ACCESS_KEY in environment")
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.PublicURL == "" {
+		cfg.PublicURL = endpoint.String()
+	}
+
+	return &s3BlobStore{
+		endpoint:     endpoint,
+		region:       cfg.Region,
+		accessKey:    cfg.AccessKey,
+		secretKey:    cfg.SecretKey,
+		bucketPrefix: cfg.BucketPrefix,
+		publicURL:    strings.TrimSuffix(cfg.PublicURL, "/"),
+		client:       &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+func (s *s3BlobStore) objectURL(bucket, key string) *url.URL {
+	u := *s.endpoint
+	u.Path = "/" + s.bucketPrefix + bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	// Send exactly the escaping that the signature covers
+	u.RawPath = s3CanonicalURI(&u)
+	return &u
+}
+
+func (s *s3BlobStore) do(ctx context.Context, method string, u *url.URL, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, u.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, bucket, key string, body io.Reader, contentType string) error {
+	// Buffer the upload so the request has a known length; uploads are
+	// already capped by the multipart limits in the handlers
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPut, s.objectURL(bucket, key), bytes.NewReader(data), contentType)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, bucket string, keys ...string) error {
+	for _, key := range keys {
+		resp, err := s.do(ctx, http.MethodDelete, s.objectURL(bucket, key), nil, "")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (s *s3BlobStore) PublicURL(bucket, key string) string {
+	return s.publicURL + "/" + url.PathEscape(s.bucketPrefix+bucket) + "/" + escapeKeyPath(key)
+}
+
+// SignedURL returns a presigned GET URL.
+func (s *s3BlobStore) SignedURL(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	return s.presign(bucket, key, expiry, time.Now().UTC()), nil
+}
+
+func (s *s3BlobStore) presign(bucket, key string, expiry time.Duration, now time.Time) string {
+	u := s.objectURL(bucket, key)
+
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", s.accessKey+"/"+s.credentialScope(now))
+	q.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expiry.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = q.Encode()
+
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		s3CanonicalURI(u),
+		s3CanonicalQuery(u.Query()),
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+
+	q.Set("X-Amz-Signature", s.signature(now, canonical))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3BlobStore) List(ctx context.Context, bucket, prefix string) ([]BlobObject, error) {
+	objects := []BlobObject{}
+	continuation := ""
+
+	for {
+		u := s.objectURL(bucket, "")
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if continuation != "" {
+			q.Set("continuation-token", continuation)
+		}
+		u.RawQuery = q.Encode()
+
+		resp, err := s.do(ctx, http.MethodGet, u, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			objects = append(objects, BlobObject{Key: c.Key, Size: c.Size, UpdatedAt: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		continuation = result.NextContinuationToken
+	}
+}
+
+// sign adds a SigV4 Authorization header. Payloads are sent unsigned, which
+// S3 accepts over TLS, unless the caller already set X-Amz-Content-Sha256.
+func (s *s3BlobStore) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = s3UnsignedPayload
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		headers["content-type"] = ct
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		s3CanonicalURI(req.URL),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, s.credentialScope(now), signedHeaders, s.signature(now, canonical),
+	))
+}
+
+func (s *s3BlobStore) credentialScope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+func (s *s3BlobStore) signature(now time.Time, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		s.credentialScope(now),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape is the RFC 3986 escaping SigV4 requires: everything except
+// unreserved characters is percent-encoded.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalURI(u *url.URL) string {
+	segments := strings.Split(u.Path, "/")
+	for i, seg := range segments {
+		segments[i] = s3Escape(seg)
+	}
+	if p := strings.Join(segments, "/"); p != "" {
+		return p
+	}
+	return "/"
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
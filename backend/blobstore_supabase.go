@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	storage_go "github.com/supabase-community/storage-go"
+	"github.com/supabase-community/supabase-go"
+)
+
+// supabaseBlobStore keeps uploads in Supabase Storage buckets.
+type supabaseBlobStore struct {
+	storage *storage_go.Client
+}
+
+func newSupabaseBlobStore(supabaseUrl, supabaseKey string) (*supabaseBlobStore, error) {
+	client, err := supabase.NewClient(supabaseUrl, supabaseKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Supabase: %w", err)
+	}
+	return &supabaseBlobStore{storage: client.Storage}, nil
+}
+
+func (s *supabaseBlobStore) Put(ctx context.Context, bucket, key string, body io.Reader, contentType string) error {
+	upsert := true
+	options := storage_go.FileOptions{ContentType: &contentType, Upsert: &upsert}
+	_, err := s.storage.UploadFile(bucket, key, body, options)
+	return err
+}
+
+func (s *supabaseBlobStore) Delete(ctx context.Context, bucket string, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := s.storage.RemoveFile(bucket, keys)
+	return err
+}
+
+func (s *supabaseBlobStore) PublicURL(bucket, key string) string {
+	return s.storage.GetPublicUrl(bucket, key).SignedURL
+}
+
+func (s *supabaseBlobStore) SignedURL(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	resp, err := s.storage.CreateSignedUrl(bucket, key, int(expiry.Seconds()))
+	if err != nil {
+		return "", err
+	}
+	return resp.SignedURL, nil
+}
+
+func (s *supabaseBlobStore) List(ctx context.Context, bucket, prefix string) ([]BlobObject, error) {
+	// Supabase lists one folder at a time; split the prefix into the folder
+	// and a name filter applied below
+	folder, namePrefix := path.Split(prefix)
+	folder = strings.TrimSuffix(folder, "/")
+
+	files, err := s.storage.ListFiles(bucket, folder, storage_go.FileSearchOptions{Limit: 1000})
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []BlobObject{}
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name, namePrefix) || f.Id == "" { // folders have no id
+			continue
+		}
+		obj := BlobObject{Key: path.Join(folder, f.Name)}
+		if meta, ok := f.Metadata.(map[string]interface{}); ok {
+			if size, ok := meta["size"].(float64); ok {
+				obj.Size = int64(size)
+			}
+		}
+		obj.UpdatedAt, _ = time.Parse(time.RFC3339, f.UpdatedAt)
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
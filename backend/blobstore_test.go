@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLocalBlobStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store, err := newLocalBlobStore(t.TempDir(), "http://localhost:8080")
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+
+	if err := store.Put(ctx, avatarBucket, "7/profile.png", strings.NewReader("png-bytes"), "image/png"); err != nil {
+		t.Fatalf("Error storing object: %v", err)
+	}
+
+	objects, err := store.List(ctx, avatarBucket, "7/")
+	if err != nil || len(objects) != 1 || objects[0].Key != "7/profile.png" || objects[0].Size != 9 {
+		t.Fatalf("Expected one 9 byte object at 7/profile.png, got %+v (%v)", objects, err)
+	}
+
+	publicURL := store.PublicURL(avatarBucket, "7/profile.png")
+	if publicURL != "http://localhost:8080/files/avatars/7/profile.png" {
+		t.Errorf("Unexpected public URL %s", publicURL)
+	}
+	if !isPublicBlobURL(store, avatarBucket, publicURL) {
+		t.Error("Expected public URL to be recognised as part of the avatars bucket")
+	}
+	if isPublicBlobURL(store, postImageBucket, publicURL) {
+		t.Error("Expected avatar URL not to belong to the post images bucket")
+	}
+
+	// The Go server serves the file back
+	req := httptest.NewRequest("GET", "/files/avatars/7/profile.png", nil)
+	rr := httptest.NewRecorder()
+	store.Handler().ServeHTTP(rr, req)
+	body, _ := io.ReadAll(rr.Body)
+	if rr.Code != http.StatusOK || string(body) != "png-bytes" {
+		t.Errorf("Expected stored bytes from file handler, got %d %q", rr.Code, body)
+	}
+
+	if err := store.Delete(ctx, avatarBucket, "7/profile.png", "7/missing.png"); err != nil {
+		t.Fatalf("Error deleting objects: %v", err)
+	}
+	if objects, _ := store.List(ctx, avatarBucket, ""); len(objects) != 0 {
+		t.Errorf("Expected bucket to be empty after delete, got %+v", objects)
+	}
+}
+
+func TestLocalBlobStoreRejectsPathTraversal(t *testing.T) {
+	store, err := newLocalBlobStore(t.TempDir(), "http://localhost:8080")
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+
+	for _, key := range []string{"../escape.txt", "a/../../escape.txt", "/etc/passwd"} {
+		if err := store.Put(context.Background(), avatarBucket, key, strings.NewReader("x"), "text/plain"); err == nil {
+			t.Errorf("Expected key %q to be rejected", key)
+		}
+	}
+}
+
+func TestImageUploadAcceptsOnlyImages(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	html := []byte("<html><script>alert(1)</script></html>")
+
+	for _, c := range []struct {
+		filename string
+		data     []byte
+		wantExt  string
+	}{
+		{"dive.png", png, ".png"},
+		{"DIVE.PNG", png, ".png"},
+		{"dive", png, ".png"},
+		{"image1.html", html, ""},
+		{"dive.png", html, ""},
+		{"dive.html", png, ""},
+		{"dive.svg", []byte("<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>"), ""},
+	} {
+		ext, contentType, err := imageUpload(c.filename, c.data)
+		if c.wantExt == "" {
+			if err == nil {
+				t.Errorf("Expected %s to be rejected, got %s %s", c.filename, ext, contentType)
+			}
+			continue
+		}
+		if err != nil || ext != c.wantExt || contentType != "image/png" {
+			t.Errorf("imageUpload(%q) = %q, %q, %v", c.filename, ext, contentType, err)
+		}
+	}
+}
+
+func TestLocalBlobStoreServesOnlyImagesInline(t *testing.T) {
+	ctx := context.Background()
+	store, err := newLocalBlobStore(t.TempDir(), "http://localhost:8080")
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	store.Put(ctx, postImageBucket, "7/1/image1.png", strings.NewReader("<html>not really</html>"), "image/png")
+	store.Put(ctx, postImageBucket, "7/1/image2.html", strings.NewReader("<script>alert(1)</script>"), "text/html")
+
+	rr := httptest.NewRecorder()
+	store.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/files/feedposts/7/1/image1.png", nil))
+	if rr.Header().Get("Content-Type") != "image/png" || rr.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Expected a nosniff image/png response, got %v", rr.Header())
+	}
+
+	// Files stored before uploads were checked are downloaded, not rendered
+	rr = httptest.NewRecorder()
+	store.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/files/feedposts/7/1/image2.html", nil))
+	if rr.Code != http.StatusOK || strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") ||
+		rr.Header().Get("Content-Disposition") != "attachment" || rr.Header().Get("Content-Security-Policy") != "sandbox" {
+		t.Errorf("Expected a sandboxed attachment, got %d %v", rr.Code, rr.Header())
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Location visibility settings. Locations are hidden until their user
+// opts in.
+const (
+	locationHidden      = "hidden"
+	locationApproximate = "approximate"
+	locationExact       = "exact"
+)
+
+var locationVisibilities = []string{locationHidden, locationApproximate, locationExact}
+
+// certificationLevels are the recreational certifications, from entry
+// level up.
+var certificationLevels = []string{"open_water", "advanced_open_water", "rescue", "divemaster", "instructor"}
+
+const (
+	// locationGridDegrees is the size of the grid cells approximate
+	// locations are snapped to, about 11 km of latitude.
+	locationGridDegrees = 0.1
+	// locationGridSlackKm covers the distance from anywhere in a cell to
+	// its middle, so the index search doesn't miss snapped locations.
+	locationGridSlackKm   = 8
+	defaultNearbyRadiusKm = 50
+	maxNearbyRadiusKm     = 500
+	defaultNearbyPageSize = 20
+	maxNearbyPageSize     = 50
+	// nearbyActivities is how many of their activities nearby divers list.
+	nearbyActivities = 3
+)
+
+// shownCoordinate is the SQL for the latitude or longitude of users u as
+// other people see it: NULL when hidden, and the middle of its grid cell
+// when approximate.
+func shownCoordinate(column string) string {
+	return fmt.Sprintf(`CASE u.location_visibility WHEN '%[3]s' THEN u.%[1]s
+		WHEN '%[4]s' THEN (floor(u.%[1]s / %[2]g) + 0.5) * %[2]g END`,
+		column, locationGridDegrees, locationExact, locationApproximate)
+}
+
+// userLocationColumns selects the latitude and longitude of users u as the
+// user at callerArg sees them. People always see their own location.
+func userLocationColumns(callerArg string) string {
+	return fmt.Sprintf("COALESCE(CASE WHEN u.id = %[1]s THEN u.latitude ELSE %[2]s END, 0), COALESCE(CASE WHEN u.id = %[1]s THEN u.longitude ELSE %[3]s END, 0)",
+		callerArg, shownCoordinate("latitude"), shownCoordinate("longitude"))
+}
+
+// certificationsFrom returns the certification level and those above it.
+func certificationsFrom(level string) ([]string, error) {
+	for i, l := range certificationLevels {
+		if l == level {
+			return certificationLevels[i:], nil
+		}
+	}
+	return nil, fmt.Errorf("certification must be one of %s", strings.Join(certificationLevels, ", "))
+}
+
+type nearbyUser struct {
+	Id            int      `json:"id"`
+	FirstName     string   `json:"first_name"`
+	LastName      string   `json:"last_name"`
+	Username      string   `json:"username"`
+	Avatar        string   `json:"avatar,omitempty"`
+	Age           int      `json:"age,omitempty"`
+	Certification string   `json:"certification,omitempty"`
+	Latitude      float64  `json:"latitude"`
+	Longitude     float64  `json:"longitude"`
+	Approximate   bool     `json:"approximate"` // the location is the middle of a grid cell
+	DistanceKm    float64  `json:"distance_km"`
+	Activities    []string `json:"activities"` // what they post about most
+}
+
+type nearbyPage struct {
+	Users      []nearbyUser `json:"users"` // nearest first
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// nearbyCursor is the position after the last diver of a page.
+type nearbyCursor struct {
+	DistanceKm float64 `json:"d"`
+	Id         int     `json:"id"`
+}
+
+func encodeNearbyCursor(c nearbyCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeNearbyCursor(raw string) (nearbyCursor, error) {
+	var c nearbyCursor
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil || json.Unmarshal(data, &c) != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	return c, nil
+}
+
+// nearbyFilters are the query parameters of GET /users/nearby.
+type nearbyFilters struct {
+	RadiusKm       float64
+	Certifications []string // accepted levels; empty means any
+	Activities     []string // lower case
+	MinAge, MaxAge int
+	Limit          int
+	Cursor         *nearbyCursor
+}
+
+func parseNearbyFilters(r *http.Request) (nearbyFilters, error) {
+	params := r.URL.Query()
+	f := nearbyFilters{RadiusKm: defaultNearbyRadiusKm, Limit: defaultNearbyPageSize}
+
+	if raw := params.Get("radius_km"); raw != "" {
+		radius, err := strconv.ParseFloat(raw, 64)
+		if err != nil || radius <= 0 || radius > maxNearbyRadiusKm {
+			return f, fmt.Errorf("radius_km must be greater than 0 and at most %d", maxNearbyRadiusKm)
+		}
+		f.RadiusKm = radius
+	}
+	if raw := params.Get("certification"); raw != "" {
+		levels, err := certificationsFrom(raw)
+		if err != nil {
+			return f, err
+		}
+		f.Certifications = levels
+	}
+	if raw := params.Get("activities"); raw != "" {
+		for _, a := range strings.Split(raw, ",") {
+			if a = strings.ToLower(strings.TrimSpace(a)); a != "" && !oneOf(a, f.Activities) {
+				f.Activities = append(f.Activities, a)
+			}
+		}
+	}
+	for _, age := range []struct {
+		name string
+		dest *int
+	}{{"min_age", &f.MinAge}, {"max_age", &f.MaxAge}} {
+		if raw := params.Get(age.name); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > 120 {
+				return f, fmt.Errorf("%s must be between 1 and 120", age.name)
+			}
+			*age.dest = n
+		}
+	}
+	if f.MaxAge > 0 && f.MinAge > f.MaxAge {
+		return f, fmt.Errorf("min_age can't be greater than max_age")
+	}
+	if raw := params.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxNearbyPageSize {
+			return f, fmt.Errorf("limit must be between 1 and %d", maxNearbyPageSize)
+		}
+		f.Limit = n
+	}
+	if raw := params.Get("cursor"); raw != "" {
+		cursor, err := decodeNearbyCursor(raw)
+		if err != nil {
+			return f, err
+		}
+		f.Cursor = &cursor
+	}
+	return f, nil
+}
+
+// loadNearbyActivities fills in the activities each diver posts about
+// most.
+func loadNearbyActivities(db *sql.DB, users []nearbyUser) error {
+	if len(users) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(users))
+	for i, u := range users {
+		ids[i] = int64(u.Id)
+	}
+
+	rows, err := db.Query(`
+		SELECT user_id, activity FROM (
+			SELECT user_id, activity, row_number() OVER (PARTITION BY user_id ORDER BY COUNT(*) DESC, activity) AS n
+			FROM posts
+			WHERE user_id = ANY($1) AND activity IS NOT NULL AND activity <> ''
+			GROUP BY user_id, activity
+		) a
+		WHERE n <= $2
+		ORDER BY user_id, n`, pq.Array(ids), nearbyActivities)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	activities := map[int][]string{}
+	for rows.Next() {
+		var userID int
+		var activity string
+		if err := rows.Scan(&userID, &activity); err != nil {
+			return err
+		}
+		activities[userID] = append(activities[userID], activity)
+	}
+	for i := range users {
+		users[i].Activities = activities[users[i].Id]
+		if users[i].Activities == nil {
+			users[i].Activities = []string{}
+		}
+	}
+	return rows.Err()
+}
+
+// getNearbyUsers handles GET /users/nearby: divers who share their
+// location within ?radius_km= of the caller's home, nearest first.
+// ?certification= keeps those certified at that level or above,
+// ?activities= those who have posted any of the activities, and ?min_age=
+// and ?max_age= an age range. ?limit= and ?cursor= paginate.
+//
+// Approximate locations are searched, and distances measured, from the
+// middle of their grid cell, so the distance gives nothing more away.
+func getNearbyUsers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		f, err := parseNearbyFilters(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var lat, lon sql.NullFloat64
+		if err := db.QueryRow("SELECT latitude, longitude FROM users WHERE id = $1", callerID).Scan(&lat, &lon); err != nil {
+			http.Error(w, "Failed to find nearby divers", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		if !lat.Valid || !lon.Valid || (lat.Float64 == 0 && lon.Float64 == 0) {
+			http.Error(w, "Set your home location to find divers near you", http.StatusBadRequest)
+			return
+		}
+
+		args := queryArgs{lat.Float64, lon.Float64, callerID}
+		conditions := []string{
+			"u.location_visibility <> '" + locationHidden + "'",
+			"u.latitude IS NOT NULL AND u.longitude IS NOT NULL AND NOT (u.latitude = 0 AND u.longitude = 0)",
+			"u.id <> $3",
+			"earth_box(ll_to_earth($1, $2), " + args.add((f.RadiusKm+locationGridSlackKm)*1000) + ") @> ll_to_earth(u.latitude, u.longitude)",
+			"NOT EXISTS (SELECT 1 FROM blocks b WHERE (b.blocker_id = $3 AND b.blocked_id = u.id) OR (b.blocker_id = u.id AND b.blocked_id = $3))",
+		}
+		if len(f.Certifications) > 0 {
+			conditions = append(conditions, "u.certification = ANY("+args.add(pq.Array(f.Certifications))+")")
+		}
+		if len(f.Activities) > 0 {
+			conditions = append(conditions, "EXISTS (SELECT 1 FROM posts p WHERE p.user_id = u.id AND lower(p.activity) = ANY("+args.add(pq.Array(f.Activities))+"))")
+		}
+		// An age of 0 means the user never gave one
+		if f.MinAge > 0 || f.MaxAge > 0 {
+			conditions = append(conditions, "u.age > 0")
+		}
+		if f.MinAge > 0 {
+			conditions = append(conditions, "u.age >= "+args.add(f.MinAge))
+		}
+		if f.MaxAge > 0 {
+			conditions = append(conditions, "u.age <= "+args.add(f.MaxAge))
+		}
+		outer := "d.distance_km <= " + args.add(f.RadiusKm)
+		if f.Cursor != nil {
+			outer += fmt.Sprintf(" AND (d.distance_km, d.id) > (%s, %s)", args.add(f.Cursor.DistanceKm), args.add(f.Cursor.Id))
+		}
+
+		rows, err := db.Query(`
+			SELECT id, first_name, last_name, username, avatar, age, certification, latitude, longitude, approximate, distance_km
+			FROM (
+				SELECT s.*, earth_distance(ll_to_earth($1, $2), ll_to_earth(s.latitude, s.longitude)) / 1000.0 AS distance_km
+				FROM (
+					SELECT u.id, u.first_name, u.last_name, u.username, COALESCE(u.avatar, '') AS avatar, COALESCE(u.age, 0) AS age,
+						COALESCE(u.certification, '') AS certification,
+						`+shownCoordinate("latitude")+` AS latitude, `+shownCoordinate("longitude")+` AS longitude,
+						u.location_visibility = '`+locationApproximate+`' AS approximate
+					FROM users u
+					WHERE `+strings.Join(conditions, " AND ")+`
+				) s
+			) d
+			WHERE `+outer+`
+			ORDER BY d.distance_km, d.id
+			LIMIT `+strconv.Itoa(f.Limit+1), args...)
+		if err != nil {
+			http.Error(w, "Failed to find nearby divers", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		defer rows.Close()
+
+		page := nearbyPage{Users: []nearbyUser{}}
+		var lastDistance float64
+		for rows.Next() {
+			var u nearbyUser
+			var distance float64
+			if err := rows.Scan(&u.Id, &u.FirstName, &u.LastName, &u.Username, &u.Avatar, &u.Age, &u.Certification,
+				&u.Latitude, &u.Longitude, &u.Approximate, &distance); err != nil {
+				http.Error(w, "Error scanning user data", http.StatusInternalServerError)
+				log.Println("Scan error:", err)
+				return
+			}
+			// The extra row only tells us there is another page
+			if len(page.Users) == f.Limit {
+				page.NextCursor = encodeNearbyCursor(nearbyCursor{DistanceKm: lastDistance, Id: page.Users[f.Limit-1].Id})
+				break
+			}
+			if u.Approximate {
+				u.DistanceKm = math.Round(distance)
+			} else {
+				u.DistanceKm = roundTo(distance, 1)
+			}
+			page.Users = append(page.Users, u)
+			lastDistance = distance
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error processing user data", http.StatusInternalServerError)
+			log.Println("Rows iteration error:", err)
+			return
+		}
+		rows.Close()
+
+		if err := loadNearbyActivities(db, page.Users); err != nil {
+			http.Error(w, "Failed to find nearby divers", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(page)
+	}
+}
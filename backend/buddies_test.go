@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCertificationsFrom(t *testing.T) {
+	levels, err := certificationsFrom("divemaster")
+	if err != nil || !reflect.DeepEqual(levels, []string{"divemaster", "instructor"}) {
+		t.Errorf("certificationsFrom(divemaster) = %v, %v", levels, err)
+	}
+	if _, err := certificationsFrom("snorkeler"); err == nil {
+		t.Error("certificationsFrom should reject unknown levels")
+	}
+}
+
+func TestParseNearbyFilters(t *testing.T) {
+	r := httptest.NewRequest("GET", "/users/nearby?radius_km=25&activities=Spearfishing,%20lobstering,spearfishing&min_age=20&max_age=40", nil)
+	f, err := parseNearbyFilters(r)
+	if err != nil {
+		t.Fatalf("parseNearbyFilters: %v", err)
+	}
+	if f.RadiusKm != 25 || f.MinAge != 20 || f.MaxAge != 40 || f.Limit != defaultNearbyPageSize {
+		t.Errorf("parseNearbyFilters = %+v", f)
+	}
+	if !reflect.DeepEqual(f.Activities, []string{"spearfishing", "lobstering"}) {
+		t.Errorf("Activities = %v, want distinct lower case activities", f.Activities)
+	}
+
+	for _, query := range []string{"radius_km=0", "radius_km=5000", "certification=snorkeler", "min_age=50&max_age=30", "max_age=abc", "cursor=!"} {
+		if _, err := parseNearbyFilters(httptest.NewRequest("GET", "/users/nearby?"+query, nil)); err == nil {
+			t.Errorf("parseNearbyFilters(%s) should fail", query)
+		}
+	}
+}
+
+func TestNearbyCursorRoundTrip(t *testing.T) {
+	c := nearbyCursor{DistanceKm: 12.3456789, Id: 42}
+	got, err := decodeNearbyCursor(encodeNearbyCursor(c))
+	if err != nil || got != c {
+		t.Errorf("decodeNearbyCursor(encodeNearbyCursor(%+v)) = %+v, %v", c, got, err)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultConditionsDays = 30
+	maxConditionsDays     = 365
+	// conditionsMonths is how far back the monthly averages go.
+	conditionsMonths = 24
+	// maxConditionsReports caps the recent reports returned.
+	maxConditionsReports = 50
+	// conditionsCacheTTL bounds how stale cached conditions can get, since
+	// the "recent" window moves with the clock and divers' names can change
+	// without touching the site's posts.
+	conditionsCacheTTL = time.Hour
+)
+
+// A trend is the change in average between the last N days and the N days
+// before. Changes smaller than these count as steady.
+const (
+	visibilityTrendThreshold = 1.0  // meters
+	ratingTrendThreshold     = 0.25 // stars
+)
+
+type conditionsMonth struct {
+	Month         string   `json:"month"` // YYYY-MM
+	Dives         int      `json:"dives"`
+	AvgVisibility *float64 `json:"avg_visibility,omitempty"`
+	AvgRating     *float64 `json:"avg_rating,omitempty"`
+	AvgWaterTemp  *float64 `json:"avg_water_temp,omitempty"`
+}
+
+// conditionsReport is one recent post at the site.
+type conditionsReport struct {
+	PostId     int       `json:"post_id"`
+	UserId     int       `json:"user_id"`
+	UserName   string    `json:"user_name"`
+	Date       time.Time `json:"date"`
+	Visibility *float64  `json:"visibility,omitempty"`
+	Rating     *float64  `json:"rating,omitempty"`
+	Depth      *float64  `json:"depth,omitempty"`
+	WaterTemp  *float64  `json:"water_temp,omitempty"`
+	Current    string    `json:"current,omitempty"`
+}
+
+// conditionsTrend compares the last Days days with the Days days before.
+// Each direction is improving, worsening, steady, or unknown when either
+// period has no reports.
+type conditionsTrend struct {
+	Visibility          string   `json:"visibility"`
+	Rating              string   `json:"rating"`
+	RecentAvgVisibility *float64 `json:"recent_avg_visibility,omitempty"`
+	PriorAvgVisibility  *float64 `json:"prior_avg_visibility,omitempty"`
+	RecentAvgRating     *float64 `json:"recent_avg_rating,omitempty"`
+	PriorAvgRating      *float64 `json:"prior_avg_rating,omitempty"`
+}
+
+type siteConditions struct {
+	SiteId      int                `json:"site_id"`
+	Days        int                `json:"days"`
+	Months      []conditionsMonth  `json:"months"` // oldest first
+	Recent      []conditionsReport `json:"recent"` // newest first
+	Trend       conditionsTrend    `json:"trend"`
+	GeneratedAt time.Time          `json:"generated_at"`
+}
+
+// trendDirection classifies the change from prior to recent.
+func trendDirection(recent, prior *float64, threshold float64) string {
+	if recent == nil || prior == nil {
+		return "unknown"
+	}
+	switch change := *recent - *prior; {
+	case change >= threshold:
+		return "improving"
+	case change <= -threshold:
+		return "worsening"
+	default:
+		return "steady"
+	}
+}
+
+// loadSiteConditions computes a site's conditions from its posts. Values
+// a post didn't record (a visibility or rating of 0) are left out of the
+// averages.
+func loadSiteConditions(db *sql.DB, siteID, days int) (siteConditions, error) {
+	c := siteConditions{SiteId: siteID, Days: days, Months: []conditionsMonth{}, Recent: []conditionsReport{}, GeneratedAt: time.Now()}
+
+	rows, err := db.Query(`
+		SELECT to_char(date_trunc('month', date), 'YYYY-MM'), COUNT(*),
+			AVG(visibility) FILTER (WHERE visibility > 0), AVG(rating) FILTER (WHERE rating > 0), AVG(water_temp)
+		FROM posts
+		WHERE site_id = $1 AND date >= date_trunc('month', CURRENT_DATE) - make_interval(months => $2)
+		GROUP BY 1
+		ORDER BY 1`, siteID, conditionsMonths-1)
+	if err != nil {
+		return c, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m conditionsMonth
+		if err := rows.Scan(&m.Month, &m.Dives, &m.AvgVisibility, &m.AvgRating, &m.AvgWaterTemp); err != nil {
+			return c, err
+		}
+		m.AvgVisibility, m.AvgRating, m.AvgWaterTemp = roundOptional(m.AvgVisibility), roundOptional(m.AvgRating), roundOptional(m.AvgWaterTemp)
+		c.Months = append(c.Months, m)
+	}
+	if err := rows.Err(); err != nil {
+		return c, err
+	}
+
+	rows, err = db.Query(`
+		SELECT p.id, p.user_id, u.first_name || ' ' || u.last_name, p.date,
+			NULLIF(p.visibility, 0), NULLIF(p.rating, 0), NULLIF(p.depth, 0), p.water_temp, COALESCE(p.current, '')
+		FROM posts p
+		JOIN users u ON p.user_id = u.id
+		WHERE p.site_id = $1 AND p.date >= CURRENT_DATE - $2::int
+		ORDER BY p.date DESC, p.id DESC
+		LIMIT $3`, siteID, days, maxConditionsReports)
+	if err != nil {
+		return c, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r conditionsReport
+		if err := rows.Scan(&r.PostId, &r.UserId, &r.UserName, &r.Date, &r.Visibility, &r.Rating, &r.Depth, &r.WaterTemp, &r.Current); err != nil {
+			return c, err
+		}
+		c.Recent = append(c.Recent, r)
+	}
+	if err := rows.Err(); err != nil {
+		return c, err
+	}
+
+	t := &c.Trend
+	err = db.QueryRow(`
+		SELECT
+			AVG(visibility) FILTER (WHERE date >= CURRENT_DATE - $2::int AND visibility > 0),
+			AVG(visibility) FILTER (WHERE date < CURRENT_DATE - $2::int AND visibility > 0),
+			AVG(rating) FILTER (WHERE date >= CURRENT_DATE - $2::int AND rating > 0),
+			AVG(rating) FILTER (WHERE date < CURRENT_DATE - $2::int AND rating > 0)
+		FROM posts
+		WHERE site_id = $1 AND date >= CURRENT_DATE - 2 * $2::int`, siteID, days,
+	).Scan(&t.RecentAvgVisibility, &t.PriorAvgVisibility, &t.RecentAvgRating, &t.PriorAvgRating)
+	if err != nil {
+		return c, err
+	}
+	t.RecentAvgVisibility, t.PriorAvgVisibility = roundOptional(t.RecentAvgVisibility), roundOptional(t.PriorAvgVisibility)
+	t.RecentAvgRating, t.PriorAvgRating = roundOptional(t.RecentAvgRating), roundOptional(t.PriorAvgRating)
+	t.Visibility = trendDirection(t.RecentAvgVisibility, t.PriorAvgVisibility, visibilityTrendThreshold)
+	t.Rating = trendDirection(t.RecentAvgRating, t.PriorAvgRating, ratingTrendThreshold)
+	return c, nil
+}
+
+// conditionsCache keeps computed site conditions while the site's
+// conditions_version, which the database bumps whenever a post at the site
+// changes, stays the same and conditionsCacheTTL hasn't passed. Reading the
+// version from SQL keeps instances from serving conditions that another
+// instance's writes made stale.
+type conditionsCache struct {
+	mu      sync.Mutex
+	entries map[int]conditionsCacheSite
+}
+
+// conditionsCacheSite is the cached conditions of one site version, by days.
+type conditionsCacheSite struct {
+	version int64
+	byDays  map[int]siteConditions
+}
+
+var siteConditionsCache = &conditionsCache{entries: map[int]conditionsCacheSite{}}
+
+func (c *conditionsCache) get(siteID, days int, version int64) (siteConditions, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	site, ok := c.entries[siteID]
+	if !ok || site.version != version {
+		return siteConditions{}, false
+	}
+	entry, ok := site.byDays[days]
+	if !ok || time.Since(entry.GeneratedAt) > conditionsCacheTTL {
+		return siteConditions{}, false
+	}
+	return entry, true
+}
+
+// put stores entry, computed at version of its site. Conditions of a newer
+// version replace the site's older ones, which are never read again;
+// conditions of an older version are dropped.
+func (c *conditionsCache) put(entry siteConditions, version int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	site, ok := c.entries[entry.SiteId]
+	if ok && site.version > version {
+		return
+	}
+	if !ok || site.version < version {
+		site = conditionsCacheSite{version: version, byDays: map[int]siteConditions{}}
+		c.entries[entry.SiteId] = site
+	}
+	site.byDays[entry.Days] = entry
+}
+
+// invalidate drops the cached conditions of the given sites; nil ids (a
+// post without a site) are ignored. The version already tells instances
+// that conditions are stale, so this only frees memory sooner.
+func (c *conditionsCache) invalidate(siteIDs ...*int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range siteIDs {
+		if id != nil {
+			delete(c.entries, *id)
+		}
+	}
+}
+
+// getSiteConditions handles GET /sites/{id}/conditions?days=N, where N
+// (default 30) is the window for recent reports and the trend.
+func getSiteConditions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		siteID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid site ID", http.StatusBadRequest)
+			return
+		}
+		days := defaultConditionsDays
+		if raw := r.URL.Query().Get("days"); raw != "" {
+			days, err = strconv.Atoi(raw)
+			if err != nil || days < 1 || days > maxConditionsDays {
+				http.Error(w, "days must be between 1 and "+strconv.Itoa(maxConditionsDays), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var version int64
+		err = db.QueryRow("SELECT conditions_version FROM dive_sites WHERE id = $1", siteID).Scan(&version)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Dive site not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to retrieve site conditions", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		if cached, ok := siteConditionsCache.get(siteID, days, version); ok {
+			json.NewEncoder(w).Encode(cached)
+			return
+		}
+
+		conditions, err := loadSiteConditions(db, siteID, days)
+		if err != nil {
+			http.Error(w, "Failed to retrieve site conditions", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		// A post that changed while loading bumped the version past this
+		// one, so the next request reloads
+		siteConditionsCache.put(conditions, version)
+
+		json.NewEncoder(w).Encode(conditions)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrendDirection(t *testing.T) {
+	for _, c := range []struct {
+		recent, prior *float64
+		want          string
+	}{
+		{float64Ptr(12), float64Ptr(8), "improving"},
+		{float64Ptr(8), float64Ptr(12), "worsening"},
+		{float64Ptr(10.5), float64Ptr(10), "steady"},
+		{nil, float64Ptr(10), "unknown"},
+		{float64Ptr(10), nil, "unknown"},
+	} {
+		if got := trendDirection(c.recent, c.prior, visibilityTrendThreshold); got != c.want {
+			t.Errorf("trendDirection(%v, %v) = %s, want %s", c.recent, c.prior, got, c.want)
+		}
+	}
+}
+
+func TestConditionsCacheVersions(t *testing.T) {
+	cache := &conditionsCache{entries: map[int]conditionsCacheSite{}}
+	siteID := 7
+
+	cache.put(siteConditions{SiteId: siteID, Days: 30, GeneratedAt: time.Now()}, 1)
+	cache.put(siteConditions{SiteId: siteID, Days: 7, GeneratedAt: time.Now()}, 1)
+	if _, ok := cache.get(siteID, 30, 1); !ok {
+		t.Fatal("Expected cached conditions")
+	}
+	if _, ok := cache.get(siteID, 90, 1); ok {
+		t.Error("Expected a miss for another window")
+	}
+	if _, ok := cache.get(siteID, 30, 2); ok {
+		t.Error("Expected a miss once the site's version moved on")
+	}
+
+	// A newer version replaces every window of the old one
+	cache.put(siteConditions{SiteId: siteID, Days: 30, GeneratedAt: time.Now()}, 2)
+	if len(cache.entries[siteID].byDays) != 1 {
+		t.Errorf("Expected the old version's windows to be dropped, got %+v", cache.entries[siteID].byDays)
+	}
+
+	// Conditions computed at an older version are stale and not stored
+	cache.put(siteConditions{SiteId: siteID, Days: 7, GeneratedAt: time.Now()}, 1)
+	if _, ok := cache.get(siteID, 7, 1); ok {
+		t.Error("Expected conditions from an old version to be dropped")
+	}
+
+	cache.invalidate(nil, &siteID)
+	if _, ok := cache.get(siteID, 30, 2); ok || len(cache.entries) != 0 {
+		t.Error("Expected invalidation to drop the site's conditions")
+	}
+}
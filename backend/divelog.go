@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DiveLog holds the structured dive-log fields of a post. It is embedded in
+// Post and CombinedPost, so its fields appear at the top level of the JSON.
+// Every field is optional; numbers are pointers so that 0 (a 0 °C dive, an
+// empty tank) is distinguishable from "not logged". The post's Depth is the
+// maximum depth of the dive.
+type DiveLog struct {
+	BottomTime    *int     `json:"bottom_time,omitempty"`    // in minutes
+	AvgDepth      *float64 `json:"avg_depth,omitempty"`      // in meters
+	WaterTemp     *float64 `json:"water_temp,omitempty"`     // in °C
+	AirTemp       *float64 `json:"air_temp,omitempty"`       // in °C
+	GasMix        string   `json:"gas_mix,omitempty"`        // air, nitrox or trimix
+	O2Percent     *float64 `json:"o2_percent,omitempty"`     // fraction of oxygen in %
+	HePercent     *float64 `json:"he_percent,omitempty"`     // fraction of helium in %
+	TankSize      *float64 `json:"tank_size,omitempty"`      // water capacity in liters
+	StartPressure *float64 `json:"start_pressure,omitempty"` // in bar
+	EndPressure   *float64 `json:"end_pressure,omitempty"`   // in bar
+	Suit          string   `json:"suit,omitempty"`           // none, rashguard, shorty, wetsuit, semidry or drysuit
+	Weights       *float64 `json:"weights,omitempty"`        // in kg
+	Current       string   `json:"current,omitempty"`        // none, light, moderate or strong
+	EntryType     string   `json:"entry_type,omitempty"`     // shore, boat or other
+}
+
+var (
+	gasMixes   = []string{"air", "nitrox", "trimix"}
+	suitTypes  = []string{"none", "rashguard", "shorty", "wetsuit", "semidry", "drysuit"}
+	currents   = []string{"none", "light", "moderate", "strong"}
+	entryTypes = []string{"shore", "boat", "other"}
+)
+
+// diveLogColumns are the posts columns behind DiveLog, in the order used by
+// values and scanTargets.
+var diveLogColumns = []string{
+	"bottom_time", "avg_depth", "water_temp", "air_temp", "gas_mix", "o2_percent", "he_percent",
+	"tank_size", "start_pressure", "end_pressure", "suit", "weights", "current", "entry_type",
+}
+
+// diveLogSelect lists the dive-log columns of posts aliased as p. Text
+// columns are coalesced so they scan into plain strings.
+func diveLogSelect() string {
+	cols := make([]string, len(diveLogColumns))
+	for i, col := range diveLogColumns {
+		switch col {
+		case "gas_mix", "suit", "current", "entry_type":
+			cols[i] = fmt.Sprintf("COALESCE(p.%s, '') AS %s", col, col)
+		default:
+			cols[i] = "p." + col
+		}
+	}
+	return strings.Join(cols, ", ")
+}
+
+// values returns the column values in diveLogColumns order, with empty
+// strings stored as NULL.
+func (d DiveLog) values() []interface{} {
+	return []interface{}{
+		d.BottomTime, d.AvgDepth, d.WaterTemp, d.AirTemp, nullIfEmpty(d.GasMix), d.O2Percent, d.HePercent,
+		d.TankSize, d.StartPressure, d.EndPressure, nullIfEmpty(d.Suit), d.Weights, nullIfEmpty(d.Current), nullIfEmpty(d.EntryType),
+	}
+}
+
+func (d *DiveLog) scanTargets() []interface{} {
+	return []interface{}{
+		&d.BottomTime, &d.AvgDepth, &d.WaterTemp, &d.AirTemp, &d.GasMix, &d.O2Percent, &d.HePercent,
+		&d.TankSize, &d.StartPressure, &d.EndPressure, &d.Suit, &d.Weights, &d.Current, &d.EntryType,
+	}
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func oneOf(v string, allowed []string) bool {
+	for _, a := range allowed {
+		if v == a {
+			return true
+		}
+	}
+	return false
+}
+
+func inRange(v *float64, min, max float64) bool {
+	return v == nil || (*v >= min && *v <= max)
+}
+
+// validate checks the dive log of a post whose maximum depth is maxDepth. It
+// also normalizes it: enum values are lowercased and the oxygen and helium
+// fractions of a plain air fill are filled in.
+func (d *DiveLog) validate(maxDepth float64) error {
+	d.GasMix = strings.ToLower(strings.TrimSpace(d.GasMix))
+	d.Suit = strings.ToLower(strings.TrimSpace(d.Suit))
+	d.Current = strings.ToLower(strings.TrimSpace(d.Current))
+	d.EntryType = strings.ToLower(strings.TrimSpace(d.EntryType))
+
+	if d.BottomTime != nil && (*d.BottomTime < 0 || *d.BottomTime > 24*60) {
+		return fmt.Errorf("bottom_time must be between 0 and 1440 minutes")
+	}
+	if !inRange(d.AvgDepth, 0, 350) {
+		return fmt.Errorf("avg_depth must be between 0 and 350 meters")
+	}
+	if d.AvgDepth != nil && maxDepth > 0 && *d.AvgDepth > maxDepth {
+		return fmt.Errorf("avg_depth must not exceed depth")
+	}
+	if !inRange(d.WaterTemp, -2, 40) {
+		return fmt.Errorf("water_temp must be between -2 and 40 °C")
+	}
+	if !inRange(d.AirTemp, -60, 60) {
+		return fmt.Errorf("air_temp must be between -60 and 60 °C")
+	}
+	if err := d.validateGas(); err != nil {
+		return err
+	}
+	if d.TankSize != nil && !(*d.TankSize > 0 && *d.TankSize <= 50) {
+		return fmt.Errorf("tank_size must be between 0 and 50 liters")
+	}
+	if !inRange(d.StartPressure, 0, 400) || !inRange(d.EndPressure, 0, 400) {
+		return fmt.Errorf("tank pressures must be between 0 and 400 bar")
+	}
+	if d.StartPressure != nil && d.EndPressure != nil && *d.EndPressure > *d.StartPressure {
+		return fmt.Errorf("end_pressure must not exceed start_pressure")
+	}
+	if !inRange(d.Weights, 0, 50) {
+		return fmt.Errorf("weights must be between 0 and 50 kg")
+	}
+	if d.Suit != "" && !oneOf(d.Suit, suitTypes) {
+		return fmt.Errorf("suit must be one of %s", strings.Join(suitTypes, ", "))
+	}
+	if d.Current != "" && !oneOf(d.Current, currents) {
+		return fmt.Errorf("current must be one of %s", strings.Join(currents, ", "))
+	}
+	if d.EntryType != "" && !oneOf(d.EntryType, entryTypes) {
+		return fmt.Errorf("entry_type must be one of %s", strings.Join(entryTypes, ", "))
+	}
+	return nil
+}
+
+func (d *DiveLog) validateGas() error {
+	if d.GasMix == "" {
+		if d.O2Percent != nil || d.HePercent != nil {
+			return fmt.Errorf("gas_mix is required with o2_percent or he_percent")
+		}
+		return nil
+	}
+	if !oneOf(d.GasMix, gasMixes) {
+		return fmt.Errorf("gas_mix must be one of %s", strings.Join(gasMixes, ", "))
+	}
+
+	if d.O2Percent == nil && d.GasMix == "air" {
+		air := 21.0
+		d.O2Percent = &air
+	}
+	if d.HePercent == nil && d.GasMix != "trimix" {
+		none := 0.0
+		d.HePercent = &none
+	}
+	if d.O2Percent == nil {
+		return fmt.Errorf("o2_percent is required for %s", d.GasMix)
+	}
+	o2 := *d.O2Percent
+	he := 0.0
+	if d.HePercent != nil {
+		he = *d.HePercent
+	}
+
+	switch d.GasMix {
+	case "air":
+		if o2 != 21 || he != 0 {
+			return fmt.Errorf("air is 21%% oxygen and no helium; use nitrox or trimix")
+		}
+	case "nitrox":
+		if o2 <= 21 || o2 > 100 || he != 0 {
+			return fmt.Errorf("nitrox needs o2_percent above 21 and at most 100, with no helium")
+		}
+	case "trimix":
+		if d.HePercent == nil || he <= 0 {
+			return fmt.Errorf("he_percent is required for trimix")
+		}
+		if o2 <= 0 || o2+he > 100 {
+			return fmt.Errorf("trimix needs o2_percent above 0 and o2_percent plus he_percent at most 100")
+		}
+	}
+	return nil
+}
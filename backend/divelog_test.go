@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func intPtr(v int) *int { return &v }
+
+func TestDiveLogValidateFillsInAir(t *testing.T) {
+	d := DiveLog{GasMix: " Air ", Suit: "Wetsuit", StartPressure: float64Ptr(200), EndPressure: float64Ptr(50)}
+	if err := d.validate(18); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if d.GasMix != "air" || d.Suit != "wetsuit" {
+		t.Errorf("Expected enums to be normalized, got %q and %q", d.GasMix, d.Suit)
+	}
+	if d.O2Percent == nil || *d.O2Percent != 21 || d.HePercent == nil || *d.HePercent != 0 {
+		t.Errorf("Expected air to be 21%% oxygen and no helium, got %v and %v", d.O2Percent, d.HePercent)
+	}
+}
+
+func TestDiveLogValidateRejectsBadLogs(t *testing.T) {
+	cases := map[string]DiveLog{
+		"negative bottom time":    {BottomTime: intPtr(-1)},
+		"average below max depth": {AvgDepth: float64Ptr(25)},
+		"frozen water":            {WaterTemp: float64Ptr(-5)},
+		"oxygen without a gas":    {O2Percent: float64Ptr(32)},
+		"air with extra oxygen":   {GasMix: "air", O2Percent: float64Ptr(32)},
+		"nitrox at 21 percent":    {GasMix: "nitrox", O2Percent: float64Ptr(21)},
+		"trimix without helium":   {GasMix: "trimix", O2Percent: float64Ptr(18)},
+		"trimix over 100 percent": {GasMix: "trimix", O2Percent: float64Ptr(60), HePercent: float64Ptr(45)},
+		"pressure went up":        {StartPressure: float64Ptr(50), EndPressure: float64Ptr(200)},
+		"unknown entry type":      {EntryType: "helicopter"},
+	}
+	for name, d := range cases {
+		if err := d.validate(20); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+}
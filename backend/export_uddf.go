@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A UDDF file defines its gas mixes and sites before the dives that link to
+// them, so the export makes three passes: the distinct mixes, one site per
+// dive (named after the post, so the title survives a re-import), and the
+// dives with their profiles.
+
+func uddfMixID(gasMix string, o2, he *float64) string {
+	return fmt.Sprintf("mix-%s-%s-%s", gasMix, formatOptionalFloat(o2), formatOptionalFloat(he))
+}
+
+func celsiusToKelvin(c *float64) *float64 {
+	if c == nil {
+		return nil
+	}
+	k := roundTo(*c+273.15, 2)
+	return &k
+}
+
+func barToPascal(bar *float64) *float64 {
+	if bar == nil {
+		return nil
+	}
+	pa := *bar * 1e5
+	return &pa
+}
+
+func positive(v float64) *float64 {
+	if v <= 0 {
+		return nil
+	}
+	return &v
+}
+
+func writeUDDFExport(ctx context.Context, w io.Writer, db *sql.DB, search postSearchQuery) error {
+	if _, err := io.WriteString(w, xml.Header+`<uddf version="3.2.0">`+"\n"+
+		"  <generator>\n    <name>dive-net</name>\n  </generator>\n"); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("  ", "  ")
+
+	if err := writeUDDFMixes(ctx, enc, db, search); err != nil {
+		return err
+	}
+	if err := writeUDDFSites(ctx, enc, w, db, search); err != nil {
+		return err
+	}
+	if err := writeUDDFDives(ctx, enc, w, db, search); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n</uddf>\n")
+	return err
+}
+
+func startElement(name string, attrs ...xml.Attr) xml.StartElement {
+	return xml.StartElement{Name: xml.Name{Local: name}, Attr: attrs}
+}
+
+func writeUDDFMixes(ctx context.Context, enc *xml.Encoder, db *sql.DB, search postSearchQuery) error {
+	conditions := append([]string{"p.gas_mix IS NOT NULL", "p.o2_percent IS NOT NULL"}, search.Conditions...)
+	rows, err := db.QueryContext(ctx, `SELECT DISTINCT p.gas_mix, p.o2_percent, p.he_percent FROM posts p WHERE `+
+		strings.Join(conditions, " AND "), search.Args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	section := startElement("gasdefinitions")
+	if err := enc.EncodeToken(section); err != nil {
+		return err
+	}
+	for rows.Next() {
+		var gasMix string
+		var o2, he *float64
+		if err := rows.Scan(&gasMix, &o2, &he); err != nil {
+			return err
+		}
+		mix := uddfMix{ID: uddfMixID(gasMix, o2, he), Name: gasMix}
+		mix.O2 = new(float64)
+		*mix.O2 = *o2 / 100
+		if he != nil {
+			mix.He = new(float64)
+			*mix.He = *he / 100
+		}
+		if err := enc.EncodeElement(mix, startElement("mix")); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return enc.EncodeToken(section.End())
+}
+
+func writeUDDFSites(ctx context.Context, enc *xml.Encoder, w io.Writer, db *sql.DB, search postSearchQuery) error {
+	rows, err := db.QueryContext(ctx, "SELECT p.id, p.title, p.latitude, p.longitude FROM posts p"+
+		search.where()+" ORDER BY p.date, p.id", search.Args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	section := startElement("divesite")
+	if err := enc.EncodeToken(section); err != nil {
+		return err
+	}
+	f := flusher{w: w, buffered: func() { enc.Flush() }}
+	for rows.Next() {
+		var id int
+		var site uddfSite
+		if err := rows.Scan(&id, &site.Name, &site.Latitude, &site.Longitude); err != nil {
+			return err
+		}
+		site.ID = "site-" + strconv.Itoa(id)
+		if err := enc.EncodeElement(site, startElement("site")); err != nil {
+			return err
+		}
+		f.dive()
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return enc.EncodeToken(section.End())
+}
+
+// writeUDDFDives streams each dive with its samples, which are joined in so
+// no profile is held in memory.
+func writeUDDFDives(ctx context.Context, enc *xml.Encoder, w io.Writer, db *sql.DB, search postSearchQuery) error {
+	rows, err := db.QueryContext(ctx, "SELECT "+exportColumns+", "+diveLogSelect()+
+		`, s.time_offset, s.depth, s.temperature, s.tank_pressure, s.ndl
+		FROM posts p LEFT JOIN dive_samples s ON s.post_id = p.id`+search.where()+
+		" ORDER BY p.date, p.id, s.time_offset", search.Args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	profile, group := startElement("profiledata"), startElement("repetitiongroup", xml.Attr{Name: xml.Name{Local: "id"}, Value: "export"})
+	for _, start := range []xml.StartElement{profile, group} {
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+	}
+
+	f := flusher{w: w, buffered: func() { enc.Flush() }}
+	var current *exportDive
+	samplesOpen := false
+	for rows.Next() {
+		var d exportDive
+		var sample struct {
+			Time                             *int
+			Depth, Temperature, TankPressure *float64
+			NDL                              *int
+		}
+		dest := append(d.scanTargets(), &sample.Time, &sample.Depth, &sample.Temperature, &sample.TankPressure, &sample.NDL)
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+
+		if current == nil || current.Id != d.Id {
+			if current != nil {
+				if err := endUDDFDive(enc, current, samplesOpen); err != nil {
+					return err
+				}
+				f.dive()
+			}
+			current, samplesOpen = &d, false
+			if err := startUDDFDive(enc, current); err != nil {
+				return err
+			}
+		}
+
+		if sample.Time == nil || sample.Depth == nil {
+			continue
+		}
+		if !samplesOpen {
+			if err := enc.EncodeToken(startElement("samples")); err != nil {
+				return err
+			}
+			samplesOpen = true
+		}
+		wp := uddfWaypoint{
+			DiveTime:     float64(*sample.Time),
+			Depth:        sample.Depth,
+			Temperature:  celsiusToKelvin(sample.Temperature),
+			TankPressure: barToPascal(sample.TankPressure),
+		}
+		if sample.NDL != nil {
+			ndl := float64(*sample.NDL)
+			wp.NoDecoTime = &ndl
+		}
+		if err := enc.EncodeElement(wp, startElement("waypoint")); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if current != nil {
+		if err := endUDDFDive(enc, current, samplesOpen); err != nil {
+			return err
+		}
+	}
+
+	if err := enc.EncodeToken(group.End()); err != nil {
+		return err
+	}
+	if err := enc.EncodeToken(profile.End()); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+func startUDDFDive(enc *xml.Encoder, d *exportDive) error {
+	id := strconv.Itoa(d.Id)
+	if err := enc.EncodeToken(startElement("dive", xml.Attr{Name: xml.Name{Local: "id"}, Value: "dive-" + id})); err != nil {
+		return err
+	}
+
+	before := uddfBefore{
+		Links:      []uddfLink{{Ref: "site-" + id}},
+		DateTime:   d.Date.Format("2006-01-02T15:04:05"),
+		DiveNumber: id,
+		AirTemp:    celsiusToKelvin(d.AirTemp),
+	}
+	if err := enc.EncodeElement(before, startElement("informationbeforedive")); err != nil {
+		return err
+	}
+
+	tank := uddfTank{
+		PressureBegin: barToPascal(d.StartPressure),
+		PressureEnd:   barToPascal(d.EndPressure),
+	}
+	if d.GasMix != "" && d.O2Percent != nil {
+		tank.Links = []uddfLink{{Ref: uddfMixID(d.GasMix, d.O2Percent, d.HePercent)}}
+	}
+	if d.TankSize != nil {
+		m3 := *d.TankSize / 1000
+		tank.Volume = &m3
+	}
+	if tank.Links == nil && tank.Volume == nil && tank.PressureBegin == nil && tank.PressureEnd == nil {
+		return nil
+	}
+	return enc.EncodeElement(tank, startElement("tankdata"))
+}
+
+func endUDDFDive(enc *xml.Encoder, d *exportDive, samplesOpen bool) error {
+	if samplesOpen {
+		if err := enc.EncodeToken(startElement("samples").End()); err != nil {
+			return err
+		}
+	}
+
+	after := uddfAfter{
+		GreatestDepth:     positive(d.Depth),
+		AverageDepth:      d.AvgDepth,
+		LowestTemperature: celsiusToKelvin(d.WaterTemp),
+		Visibility:        positive(d.Visibility),
+		Rating:            positive(d.Rating * 2),
+	}
+	if d.BottomTime != nil {
+		seconds := float64(*d.BottomTime * 60)
+		after.DiveDuration = &seconds
+	}
+	if d.Description != "" {
+		after.Notes = []string{d.Description}
+	}
+	if err := enc.EncodeElement(after, startElement("informationafterdive")); err != nil {
+		return err
+	}
+	return enc.EncodeToken(startElement("dive").End())
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Exports stream rows straight from the database to the response, so a
+// logbook of any size is written in constant memory. Rows are flushed to the
+// client every exportFlushEvery dives.
+const exportFlushEvery = 100
+
+// exportWriter runs its query over the caller's filtered posts and streams
+// the result to w.
+type exportWriter func(ctx context.Context, w io.Writer, db *sql.DB, search postSearchQuery) error
+
+var exportFormats = map[string]struct {
+	ContentType string
+	Extension   string
+	Write       exportWriter
+}{
+	"csv":     {"text/csv; charset=utf-8", "csv", writeCSVExport},
+	"geojson": {"application/geo+json", "geojson", writeGeoJSONExport},
+	"gpx":     {"application/gpx+xml", "gpx", writeGPXExport},
+	"uddf":    {"application/xml", "uddf", writeUDDFExport},
+}
+
+// exportDive is one post as exported.
+type exportDive struct {
+	Id          int
+	Title       string
+	Date        time.Time
+	Latitude    sql.NullFloat64
+	Longitude   sql.NullFloat64
+	Depth       float64
+	Visibility  float64
+	Activity    string
+	Description string
+	Rating      float64
+	DiveLog
+}
+
+const exportColumns = `p.id, p.title, p.date, p.latitude, p.longitude, COALESCE(p.depth, 0), COALESCE(p.visibility, 0),
+	COALESCE(p.activity, ''), COALESCE(p.description, ''), COALESCE(p.rating, 0)`
+
+func (d *exportDive) scanTargets() []interface{} {
+	dest := []interface{}{
+		&d.Id, &d.Title, &d.Date, &d.Latitude, &d.Longitude, &d.Depth, &d.Visibility,
+		&d.Activity, &d.Description, &d.Rating,
+	}
+	return append(dest, d.DiveLog.scanTargets()...)
+}
+
+func (d *exportDive) hasLocation() bool {
+	return d.Latitude.Valid && d.Longitude.Valid
+}
+
+// queryExportDives selects the filtered posts, oldest first.
+func queryExportDives(ctx context.Context, db *sql.DB, search postSearchQuery) (*sql.Rows, error) {
+	return db.QueryContext(ctx, "SELECT "+exportColumns+", "+diveLogSelect()+
+		" FROM posts p"+search.where()+" ORDER BY p.date, p.id", search.Args...)
+}
+
+// exportResponse notes whether any of the export has been sent yet.
+type exportResponse struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (r *exportResponse) Write(p []byte) (int, error) {
+	r.started = true
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *exportResponse) Flush() {
+	if fl, ok := r.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// flusher sends what has been written to the client every exportFlushEvery
+// dives. buffered, if set, empties a writer's own buffer first.
+type flusher struct {
+	w        io.Writer
+	buffered func()
+	count    int
+}
+
+func (f *flusher) dive() {
+	f.count++
+	if f.count%exportFlushEvery != 0 {
+		return
+	}
+	if f.buffered != nil {
+		f.buffered()
+	}
+	if fl, ok := f.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// exportDives handles GET /exports/{format}. The query string takes the same
+// filters as a post search, e.g. ?activity=Spearfishing&depth_min=20, and
+// always applies to the caller's own dives, oldest first.
+func exportDives(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		name := mux.Vars(r)["format"]
+		format, ok := exportFormats[name]
+		if !ok {
+			http.Error(w, "Unknown export format; use csv, geojson, gpx or uddf", http.StatusNotFound)
+			return
+		}
+
+		var filters postSearchFilters
+		if err := decodeQueryFilters(r.URL.Query(), &filters); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filters.UserID = callerID
+		filters.Sort, filters.Limit, filters.Cursor = "", 0, ""
+		search, err := buildPostSearch(filters)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if name == "gpx" || name == "geojson" {
+			search.Conditions = append(search.Conditions, "p.latitude IS NOT NULL AND p.longitude IS NOT NULL")
+		}
+
+		w.Header().Set("Content-Type", format.ContentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="dives-%s.%s"`, time.Now().Format("2006-01-02"), format.Extension))
+
+		// The status goes out with the first bytes, so a failure part way
+		// through can only cut the file short
+		out := &exportResponse{ResponseWriter: w}
+		if err := format.Write(r.Context(), out, db, search); err != nil {
+			if !out.started {
+				http.Error(w, "Failed to export dives", http.StatusInternalServerError)
+			}
+			log.Println("Database error:", err)
+		}
+	}
+}
+
+// decodeQueryFilters fills postSearchFilters from query parameters named
+// like its JSON fields.
+func decodeQueryFilters(q url.Values, f *postSearchFilters) error {
+	v := reflect.ValueOf(f).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		raw := q.Get(name)
+		if raw == "" {
+			continue
+		}
+
+		field := v.Field(i)
+		target := field
+		if field.Kind() == reflect.Ptr {
+			target = reflect.New(field.Type().Elem()).Elem()
+		}
+		switch target.Kind() {
+		case reflect.String:
+			target.SetString(raw)
+		case reflect.Int:
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				return fmt.Errorf("%s must be a whole number", name)
+			}
+			target.SetInt(int64(n))
+		case reflect.Float64:
+			n, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return fmt.Errorf("%s must be a number", name)
+			}
+			target.SetFloat(n)
+		}
+		if field.Kind() == reflect.Ptr {
+			field.Set(target.Addr())
+		}
+	}
+	return nil
+}
+
+// exportCSVHeader matches the field names the CSV importer reads by
+// default, so an export imports back without a mapping.
+var exportCSVHeader = []string{
+	"ref", "date", "time", "title", "activity", "description", "latitude", "longitude", "depth",
+	"visibility", "rating", "bottom_time", "avg_depth", "water_temp", "air_temp", "gas_mix",
+	"o2_percent", "he_percent", "tank_size", "start_pressure", "end_pressure", "suit", "weights",
+	"current", "entry_type",
+}
+
+func formatOptionalFloat(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+func formatNullFloat(v sql.NullFloat64) string {
+	if !v.Valid {
+		return ""
+	}
+	return strconv.FormatFloat(v.Float64, 'f', -1, 64)
+}
+
+func writeCSVExport(ctx context.Context, w io.Writer, db *sql.DB, search postSearchQuery) error {
+	rows, err := queryExportDives(ctx, db, search)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	out := csv.NewWriter(w)
+	if err := out.Write(exportCSVHeader); err != nil {
+		return err
+	}
+
+	f := flusher{w: w, buffered: out.Flush}
+	for rows.Next() {
+		var d exportDive
+		if err := rows.Scan(d.scanTargets()...); err != nil {
+			return err
+		}
+
+		bottomTime := ""
+		if d.BottomTime != nil {
+			bottomTime = strconv.Itoa(*d.BottomTime)
+		}
+		record := []string{
+			strconv.Itoa(d.Id), d.Date.Format("2006-01-02"), d.Date.Format("15:04"), d.Title, d.Activity, d.Description,
+			formatNullFloat(d.Latitude), formatNullFloat(d.Longitude),
+			strconv.FormatFloat(d.Depth, 'f', -1, 64), strconv.FormatFloat(d.Visibility, 'f', -1, 64),
+			strconv.FormatFloat(d.Rating, 'f', -1, 64), bottomTime,
+			formatOptionalFloat(d.AvgDepth), formatOptionalFloat(d.WaterTemp), formatOptionalFloat(d.AirTemp), d.GasMix,
+			formatOptionalFloat(d.O2Percent), formatOptionalFloat(d.HePercent), formatOptionalFloat(d.TankSize),
+			formatOptionalFloat(d.StartPressure), formatOptionalFloat(d.EndPressure), d.Suit,
+			formatOptionalFloat(d.Weights), d.Current, d.EntryType,
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+		f.dive()
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return err
+	}
+	return rows.Err()
+}
+
+type geoJSONFeature struct {
+	Type     string `json:"type"`
+	Geometry struct {
+		Type        string     `json:"type"`
+		Coordinates [2]float64 `json:"coordinates"` // longitude, latitude
+	} `json:"geometry"`
+	Properties struct {
+		Id          int     `json:"id"`
+		Title       string  `json:"title"`
+		Date        string  `json:"date"`
+		Depth       float64 `json:"depth"`
+		Visibility  float64 `json:"visibility"`
+		Activity    string  `json:"activity"`
+		Description string  `json:"description,omitempty"`
+		Rating      float64 `json:"rating,omitempty"`
+		DiveLog
+	} `json:"properties"`
+}
+
+func writeGeoJSONExport(ctx context.Context, w io.Writer, db *sql.DB, search postSearchQuery) error {
+	rows, err := queryExportDives(ctx, db, search)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if _, err := io.WriteString(w, `{"type":"FeatureCollection","features":[`); err != nil {
+		return err
+	}
+
+	f := flusher{w: w}
+	for rows.Next() {
+		var d exportDive
+		if err := rows.Scan(d.scanTargets()...); err != nil {
+			return err
+		}
+
+		var feature geoJSONFeature
+		feature.Type = "Feature"
+		feature.Geometry.Type = "Point"
+		feature.Geometry.Coordinates = [2]float64{d.Longitude.Float64, d.Latitude.Float64}
+		p := &feature.Properties
+		p.Id, p.Title, p.Date = d.Id, d.Title, d.Date.Format("2006-01-02T15:04:05")
+		p.Depth, p.Visibility, p.Activity, p.Description, p.Rating = d.Depth, d.Visibility, d.Activity, d.Description, d.Rating
+		p.DiveLog = d.DiveLog
+
+		data, err := json.Marshal(feature)
+		if err != nil {
+			return err
+		}
+		if f.count > 0 {
+			data = append([]byte{','}, data...)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		f.dive()
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]}\n")
+	return err
+}
+
+type gpxWaypoint struct {
+	XMLName xml.Name `xml:"wpt"`
+	Lat     float64  `xml:"lat,attr"`
+	Lon     float64  `xml:"lon,attr"`
+	Ele     *float64 `xml:"ele,omitempty"` // negative: below the surface
+	Time    string   `xml:"time"`
+	Name    string   `xml:"name"`
+	Desc    string   `xml:"desc,omitempty"`
+	Type    string   `xml:"type"`
+}
+
+func writeGPXExport(ctx context.Context, w io.Writer, db *sql.DB, search postSearchQuery) error {
+	rows, err := queryExportDives(ctx, db, search)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if _, err := io.WriteString(w, xml.Header+
+		`<gpx version="1.1" creator="dive-net" xmlns="http://www.topografix.com/GPX/1/1">`+"\n"); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("  ", "  ")
+
+	f := flusher{w: w}
+	for rows.Next() {
+		var d exportDive
+		if err := rows.Scan(d.scanTargets()...); err != nil {
+			return err
+		}
+
+		wpt := gpxWaypoint{
+			Lat:  d.Latitude.Float64,
+			Lon:  d.Longitude.Float64,
+			Time: d.Date.Format("2006-01-02T15:04:05Z"),
+			Name: d.Title,
+			Desc: d.Description,
+			Type: "dive",
+		}
+		if d.Depth > 0 {
+			ele := -d.Depth
+			wpt.Ele = &ele
+		}
+		if err := enc.Encode(wpt); err != nil {
+			return err
+		}
+		if err := enc.Flush(); err != nil {
+			return err
+		}
+		f.dive()
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n</gpx>\n")
+	return err
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestDecodeQueryFilters(t *testing.T) {
+	q := url.Values{
+		"activity":        {"Spearfishing"},
+		"depth_min":       {"20"},
+		"bottom_time_max": {"45"},
+		"radius_km":       {"2.5"},
+	}
+	var f postSearchFilters
+	if err := decodeQueryFilters(q, &f); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if f.Activity != "Spearfishing" || f.RadiusKm != 2.5 {
+		t.Errorf("Expected plain fields to be set, got %+v", f)
+	}
+	if f.DepthMin == nil || *f.DepthMin != 20 || f.BottomTimeMax == nil || *f.BottomTimeMax != 45 {
+		t.Errorf("Expected optional fields to be set, got %+v", f)
+	}
+	if f.DepthMax != nil || f.Latitude != nil {
+		t.Errorf("Expected missing fields to stay unset, got %+v", f)
+	}
+
+	if err := decodeQueryFilters(url.Values{"bottom_time_min": {"ten"}}, &f); err == nil {
+		t.Error("Expected an error for a non-numeric value")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// newestCursorSort names the order of the feed and other lists of posts
+// that are always newest first, like the default post search.
+const newestCursorSort = "newest"
+
+// newestPostsAfter is the condition for posts after cursor in newest first
+// order, or "" without a cursor.
+func newestPostsAfter(args *queryArgs, cursor *postCursor) string {
+	if cursor == nil {
+		return ""
+	}
+	return fmt.Sprintf("AND (p.timestamp, p.id) < (%s::timestamp, %s)", args.add(cursor.Value), args.add(cursor.Id))
+}
+
+// scanNewestPosts reads a page of posts, newest first, from rows selecting
+// combinedPostColumns and one row past limit, and attaches their comments.
+func scanNewestPosts(db *sql.DB, rows *sql.Rows, limit int) (postSearchPage, error) {
+	defer rows.Close()
+	page := postSearchPage{Posts: []CombinedPost{}}
+	for rows.Next() {
+		var post CombinedPost
+		var images []string
+		if err := rows.Scan(post.scanTargets(&images)...); err != nil {
+			return page, err
+		}
+
+		// The extra row only tells us there is another page
+		if len(page.Posts) == limit {
+			last := page.Posts[limit-1]
+			page.NextCursor = encodePostCursor(postCursor{Sort: newestCursorSort, Value: cursorValue(last.Timestamp), Id: last.Id})
+			break
+		}
+
+		post.Images = images
+		page.Posts = append(page.Posts, post)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+	return page, attachComments(db, page.Posts)
+}
+
+// getFeed handles GET /feed: the newest posts of the users the caller
+// follows and of the caller, paginated with ?limit= and ?cursor=.
+//
+// Rather than scanning all posts for ones by followed users, the query
+// takes at most a page of posts from each followed user through the
+// posts (user_id, timestamp, id) index and merges those. The work grows
+// with the number of users followed times the page size, not with the
+// size of the posts table.
+func getFeed(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		limit, cursor, err := pageParams(r, newestCursorSort, defaultPostPageSize, maxPostPageSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		args := queryArgs{callerID, limit + 1}
+		after := newestPostsAfter(&args, cursor)
+		query := `
+		SELECT ` + combinedPostColumns() + `
+		FROM (
+			SELECT followee_id AS user_id FROM follows WHERE follower_id = $1
+			UNION ALL SELECT $1
+		) authors
+		CROSS JOIN LATERAL (
+			SELECT * FROM posts p
+			WHERE p.user_id = authors.user_id ` + after + `
+			ORDER BY p.timestamp DESC, p.id DESC
+			LIMIT $2
+		) p
+		JOIN users u ON p.user_id = u.id
+		ORDER BY p.timestamp DESC, p.id DESC
+		LIMIT $2`
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			http.Error(w, "Failed to retrieve feed", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		page, err := scanNewestPosts(db, rows, limit)
+		if err != nil {
+			http.Error(w, "Failed to retrieve feed", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
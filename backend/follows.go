@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultFollowPageSize = 50
+	maxFollowPageSize     = 200
+)
+
+// followEntry is a user as listed among someone's followers or followees.
+type followEntry struct {
+	Id         int       `json:"id"`
+	FirstName  string    `json:"first_name"`
+	LastName   string    `json:"last_name"`
+	Avatar     string    `json:"avatar,omitempty"`
+	FollowedAt time.Time `json:"followed_at"`
+}
+
+type followPage struct {
+	Users      []followEntry `json:"users"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// pageParams reads ?limit= and ?cursor= for a keyset-paginated list whose
+// cursors carry sortName.
+func pageParams(r *http.Request, sortName string, defaultSize, maxSize int) (int, *postCursor, error) {
+	limit := defaultSize
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxSize {
+			return 0, nil, fmt.Errorf("limit must be between 1 and %d", maxSize)
+		}
+		limit = n
+	}
+
+	raw := r.URL.Query().Get("cursor")
+	if raw == "" {
+		return limit, nil, nil
+	}
+	cursor, err := decodePostCursor(raw)
+	if err != nil {
+		return 0, nil, err
+	}
+	if cursor.Sort != sortName {
+		return 0, nil, fmt.Errorf("invalid cursor")
+	}
+	if _, err := time.Parse(time.RFC3339Nano, cursor.Value); err != nil {
+		return 0, nil, fmt.Errorf("invalid cursor")
+	}
+	return limit, &cursor, nil
+}
+
+// followUser makes the caller follow the user in the path. Following
+// someone twice is not an error.
+func followUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		followeeID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		if followeeID == callerID {
+			http.Error(w, "You can't follow yourself", http.StatusBadRequest)
+			return
+		}
+
+		result, err := db.Exec(`
+			INSERT INTO follows (follower_id, followee_id) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING`, callerID, followeeID)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" { // foreign_key_violation
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to follow user", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		// Only a new follow is news to the followee
+		if n, _ := result.RowsAffected(); n == 1 {
+			if err := notify(db, notifyFollow, followeeID, callerID, nil, nil); err != nil {
+				log.Println("Notification error:", err)
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// unfollowUser stops the caller following the user in the path.
+func unfollowUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		followeeID := mux.Vars(r)["id"]
+		_, err = db.Exec("DELETE FROM follows WHERE follower_id = $1 AND followee_id = $2", callerID, followeeID)
+		if err != nil {
+			http.Error(w, "Failed to unfollow user", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		_, err = db.Exec("DELETE FROM notifications WHERE type = $1 AND actor_id = $2 AND user_id = $3", notifyFollow, callerID, followeeID)
+		if err != nil {
+			log.Println("Notification error:", err)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// listFollows handles the followers and following lists of the user in the
+// path, most recent first. Followers are the users following them; with
+// followers false, the list is the users they follow.
+func listFollows(db *sql.DB, followers bool) http.HandlerFunc {
+	// Both lists read one side of follows and join the other to users
+	self, other, sortName := "followee_id", "follower_id", "followers"
+	if !followers {
+		self, other, sortName = "follower_id", "followee_id", "following"
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		limit, cursor, err := pageParams(r, sortName, defaultFollowPageSize, maxFollowPageSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		args := queryArgs{userID}
+		where := "f." + self + " = $1"
+		if cursor != nil {
+			where += fmt.Sprintf(" AND (f.timestamp, f.%s) < (%s::timestamp, %s)", other, args.add(cursor.Value), args.add(cursor.Id))
+		}
+		rows, err := db.Query(`
+			SELECT u.id, u.first_name, u.last_name, COALESCE(u.avatar, ''), f.timestamp
+			FROM follows f
+			JOIN users u ON u.id = f.`+other+`
+			WHERE `+where+`
+			ORDER BY f.timestamp DESC, f.`+other+` DESC
+			LIMIT `+strconv.Itoa(limit+1), args...)
+		if err != nil {
+			http.Error(w, "Failed to retrieve users", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		defer rows.Close()
+
+		page := followPage{Users: []followEntry{}}
+		for rows.Next() {
+			var u followEntry
+			if err := rows.Scan(&u.Id, &u.FirstName, &u.LastName, &u.Avatar, &u.FollowedAt); err != nil {
+				http.Error(w, "Error scanning user data", http.StatusInternalServerError)
+				log.Println("Scan error:", err)
+				return
+			}
+			// The extra row only tells us there is another page
+			if len(page.Users) == limit {
+				last := page.Users[limit-1]
+				page.NextCursor = encodePostCursor(postCursor{Sort: sortName, Value: cursorValue(last.FollowedAt), Id: last.Id})
+				break
+			}
+			page.Users = append(page.Users, u)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error processing user data", http.StatusInternalServerError)
+			log.Println("Rows iteration error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(page)
+	}
+}
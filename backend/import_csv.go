@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// csvMapping describes a CSV dive log. It is sent as JSON in the "mapping"
+// option, for example:
+//
+//	{"columns": {"date": "Dive Date", "depth": "Max Depth (m)", "bottom_time": "Duration"},
+//	 "delimiter": ";", "date_format": "eu"}
+//
+// Columns maps post fields to CSV headers; fields left out are read from a
+// header with the field's own name, if there is one. Values are metric.
+type csvMapping struct {
+	Columns    map[string]string `json:"columns"`
+	Delimiter  string            `json:"delimiter"`   // defaults to ","
+	DateFormat string            `json:"date_format"` // iso (default), us (MM/DD/YYYY) or eu (DD.MM.YYYY or DD/MM/YYYY)
+}
+
+// csvField reads one cell into a dive.
+type csvField func(d *importedDive, raw string, dateFormat string) error
+
+func csvFloat(set func(p *Post, v float64)) csvField {
+	return func(d *importedDive, raw string, _ string) error {
+		// Spreadsheets in many locales write decimal commas
+		if !strings.Contains(raw, ".") {
+			raw = strings.Replace(raw, ",", ".", 1)
+		}
+		v, ok := unitValue(raw)
+		if !ok {
+			return fmt.Errorf("%q is not a number", raw)
+		}
+		set(&d.Post, v)
+		return nil
+	}
+}
+
+func csvOptionalFloat(field func(p *Post) **float64) csvField {
+	return csvFloat(func(p *Post, v float64) { *field(p) = &v })
+}
+
+func csvText(set func(p *Post, v string)) csvField {
+	return func(d *importedDive, raw string, _ string) error {
+		set(&d.Post, raw)
+		return nil
+	}
+}
+
+var csvFields = map[string]csvField{
+	"ref": func(d *importedDive, raw string, _ string) error {
+		d.Ref = raw
+		return nil
+	},
+	"date": func(d *importedDive, raw string, dateFormat string) error {
+		date, err := parseCSVDate(raw, dateFormat)
+		d.Date = date
+		return err
+	},
+	"time": func(d *importedDive, raw string, _ string) error {
+		for _, layout := range []string{"15:04:05", "15:04", "3:04 PM", "3:04PM"} {
+			if t, err := time.Parse(layout, raw); err == nil {
+				d.Date = time.Date(d.Date.Year(), d.Date.Month(), d.Date.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+				return nil
+			}
+		}
+		return fmt.Errorf("unrecognized time %q", raw)
+	},
+	"title":       csvText(func(p *Post, v string) { p.Title = v }),
+	"activity":    csvText(func(p *Post, v string) { p.Activity = v }),
+	"description": csvText(func(p *Post, v string) { p.Description = v }),
+	"latitude":    csvFloat(func(p *Post, v float64) { p.Latitude = v }),
+	"longitude":   csvFloat(func(p *Post, v float64) { p.Longitude = v }),
+	"depth":       csvFloat(func(p *Post, v float64) { p.Depth = v }),
+	"visibility":  csvFloat(func(p *Post, v float64) { p.Visibility = v }),
+	"rating":      csvFloat(func(p *Post, v float64) { p.Rating = v }),
+	"bottom_time": func(d *importedDive, raw string, _ string) error {
+		seconds, ok := parseMinutesSeconds(raw)
+		if !ok {
+			return fmt.Errorf("%q is not a duration", raw)
+		}
+		minutes := (seconds + 30) / 60
+		d.Post.BottomTime = &minutes
+		return nil
+	},
+	"avg_depth":      csvOptionalFloat(func(p *Post) **float64 { return &p.AvgDepth }),
+	"water_temp":     csvOptionalFloat(func(p *Post) **float64 { return &p.WaterTemp }),
+	"air_temp":       csvOptionalFloat(func(p *Post) **float64 { return &p.AirTemp }),
+	"gas_mix":        csvText(func(p *Post, v string) { p.GasMix = v }),
+	"o2_percent":     csvOptionalFloat(func(p *Post) **float64 { return &p.O2Percent }),
+	"he_percent":     csvOptionalFloat(func(p *Post) **float64 { return &p.HePercent }),
+	"tank_size":      csvOptionalFloat(func(p *Post) **float64 { return &p.TankSize }),
+	"start_pressure": csvOptionalFloat(func(p *Post) **float64 { return &p.StartPressure }),
+	"end_pressure":   csvOptionalFloat(func(p *Post) **float64 { return &p.EndPressure }),
+	"suit":           csvText(func(p *Post, v string) { p.Suit = v }),
+	"weights":        csvOptionalFloat(func(p *Post) **float64 { return &p.Weights }),
+	"current":        csvText(func(p *Post, v string) { p.Current = v }),
+	"entry_type":     csvText(func(p *Post, v string) { p.EntryType = v }),
+}
+
+// csvFieldOrder applies time after date, whatever the column order, so a
+// separate time column sets the time of day.
+var csvFieldOrder = []string{
+	"ref", "date", "time", "title", "activity", "description", "latitude", "longitude", "depth",
+	"visibility", "rating", "bottom_time", "avg_depth", "water_temp", "air_temp", "gas_mix",
+	"o2_percent", "he_percent", "tank_size", "start_pressure", "end_pressure", "suit", "weights",
+	"current", "entry_type",
+}
+
+func parseCSVDate(raw, format string) (time.Time, error) {
+	var layouts []string
+	switch format {
+	case "", "iso":
+		return parseDiveTime(raw)
+	case "us":
+		layouts = []string{"01/02/2006", "1/2/2006", "01/02/2006 15:04", "1/2/2006 15:04"}
+	case "eu":
+		layouts = []string{"02.01.2006", "2.1.2006", "02/01/2006", "2/1/2006", "02.01.2006 15:04", "02/01/2006 15:04"}
+	}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %q", raw)
+}
+
+func (m *csvMapping) validate() error {
+	switch m.DateFormat {
+	case "", "iso", "us", "eu":
+	default:
+		return fmt.Errorf("date_format must be iso, us or eu")
+	}
+	if m.Delimiter == "" {
+		m.Delimiter = ","
+	}
+	if r, size := utf8.DecodeRuneInString(m.Delimiter); size != len(m.Delimiter) || r == '"' || r == '\n' {
+		return fmt.Errorf("delimiter must be a single character")
+	}
+	for field, column := range m.Columns {
+		if _, ok := csvFields[field]; !ok {
+			return fmt.Errorf("unknown field %q in mapping", field)
+		}
+		if strings.TrimSpace(column) == "" {
+			return fmt.Errorf("no column given for field %q", field)
+		}
+	}
+	return nil
+}
+
+// parseCSV reads a CSV dive log, one dive per row after the header row,
+// using the column mapping in options.
+func parseCSV(data []byte, options url.Values) ([]importedDive, error) {
+	var mapping csvMapping
+	if raw := options.Get("mapping"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &mapping); err != nil {
+			return nil, fmt.Errorf("invalid mapping: %v", err)
+		}
+	}
+	if err := mapping.validate(); err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	reader.Comma, _ = utf8.DecodeRuneInString(mapping.Delimiter)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("missing header row")
+	}
+	headerIndex := make(map[string]int, len(header))
+	for i, name := range header {
+		headerIndex[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	// Resolve each field to a column index
+	columns := make(map[string]int)
+	for _, field := range csvFieldOrder {
+		column, mapped := mapping.Columns[field]
+		if !mapped {
+			column = field
+		}
+		i, ok := headerIndex[strings.ToLower(strings.TrimSpace(column))]
+		if !ok {
+			if mapped {
+				return nil, fmt.Errorf("column %q for field %s is not in the header", column, field)
+			}
+			continue
+		}
+		columns[field] = i
+	}
+	if _, ok := columns["date"]; !ok {
+		return nil, fmt.Errorf("no date column; map one with {\"columns\": {\"date\": \"...\"}}")
+	}
+
+	var dives []importedDive
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue // blank line
+		}
+		dives = append(dives, csvDive(record, columns, mapping.DateFormat, line))
+	}
+	if len(dives) == 0 {
+		return nil, fmt.Errorf("no dives found")
+	}
+	return dives, nil
+}
+
+func csvDive(record []string, columns map[string]int, dateFormat string, line int) importedDive {
+	dive := importedDive{Ref: strconv.Itoa(line)}
+	for _, field := range csvFieldOrder {
+		i, ok := columns[field]
+		if !ok || i >= len(record) {
+			continue
+		}
+		raw := strings.TrimSpace(record[i])
+		if raw == "" {
+			continue
+		}
+		if err := csvFields[field](&dive, raw, dateFormat); err != nil {
+			dive.Err = fmt.Errorf("%s: %v", field, err)
+			return dive
+		}
+	}
+
+	p := &dive.Post
+	if p.Activity == "" {
+		p.Activity = "Scuba Diving"
+	}
+	if p.Title == "" {
+		p.Title = "Imported dive"
+		if _, ok := columns["ref"]; ok {
+			p.Title = "Dive #" + dive.Ref
+		}
+	}
+	// A bare oxygen percentage is enough to tell the gas
+	if p.GasMix == "" && p.O2Percent != nil {
+		o2 := *p.O2Percent / 100
+		var he *float64
+		if p.HePercent != nil {
+			v := *p.HePercent / 100
+			he = &v
+		}
+		p.GasMix, p.O2Percent, p.HePercent = classifyGas(&o2, he)
+	}
+	return dive
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseCSVWithMapping(t *testing.T) {
+	data := []byte("Dive;Datum;Zeit;Ort;Tiefe (m);Dauer;O2 %\n" +
+		"12;03.08.2024;10:15;Walchensee;24,5;48:00;32\n" +
+		"13;04.08.2024;;Kochelsee;abc;40;\n")
+	options := url.Values{"mapping": {`{
+		"columns": {"ref": "Dive", "date": "Datum", "time": "Zeit", "title": "Ort", "depth": "Tiefe (m)", "bottom_time": "Dauer", "o2_percent": "O2 %"},
+		"delimiter": ";",
+		"date_format": "eu"
+	}`}}
+
+	dives, err := parseCSV(data, options)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(dives) != 2 {
+		t.Fatalf("Expected 2 dives, got %d", len(dives))
+	}
+
+	first := dives[0]
+	if first.Err != nil {
+		t.Fatalf("Unexpected error in first dive: %v", first.Err)
+	}
+	if !first.Date.Equal(time.Date(2024, 8, 3, 10, 15, 0, 0, time.UTC)) || first.Ref != "12" {
+		t.Errorf("Expected dive 12 on 3 August at 10:15, got %q at %v", first.Ref, first.Date)
+	}
+	p := first.Post
+	if p.Title != "Walchensee" || p.Depth != 24.5 || *p.BottomTime != 48 || p.GasMix != "nitrox" || *p.O2Percent != 32 {
+		t.Errorf("Expected a 48 minute EAN32 dive to 24.5 m, got %+v", p)
+	}
+
+	if dives[1].Err == nil {
+		t.Error("Expected an error for a depth that is not a number")
+	}
+}
+
+func TestParseCSVDefaultsToFieldNames(t *testing.T) {
+	data := []byte("date,title,depth,gas_mix\n2024-05-01 09:00,Cove,12,air\n")
+	dives, err := parseCSV(data, url.Values{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(dives) != 1 || dives[0].Post.Title != "Cove" || dives[0].Post.GasMix != "air" {
+		t.Errorf("Expected one air dive at the Cove, got %+v", dives)
+	}
+}
+
+func TestParseCSVRejectsBadMappings(t *testing.T) {
+	data := []byte("when,where\n2024-05-01,Cove\n")
+	cases := map[string]string{
+		"unknown field":  `{"columns": {"date": "when", "colour": "where"}}`,
+		"missing column": `{"columns": {"date": "Date"}}`,
+		"no date":        `{"columns": {"title": "where"}}`,
+		"bad format":     `{"columns": {"date": "when"}, "date_format": "yyyy"}`,
+	}
+	for name, mapping := range cases {
+		if _, err := parseCSV(data, url.Values{"mapping": {mapping}}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
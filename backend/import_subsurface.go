@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Subsurface (https://subsurface-divelog.org) exports its own XML format.
+// Values carry their unit as a suffix ("18.4 m", "45:00 min", "15.0 C",
+// "200.0 bar", "32.0%") and are always metric.
+
+type subsurfaceDocument struct {
+	XMLName xml.Name         `xml:"divelog"`
+	Sites   []subsurfaceSite `xml:"divesites>site"`
+	Dives   []subsurfaceDive `xml:"dives>dive"`
+	Trips   []struct {
+		Dives []subsurfaceDive `xml:"dive"`
+	} `xml:"dives>trip"`
+}
+
+type subsurfaceSite struct {
+	UUID string `xml:"uuid,attr"`
+	Name string `xml:"name,attr"`
+	GPS  string `xml:"gps,attr"`
+}
+
+type subsurfaceDive struct {
+	Number     string `xml:"number,attr"`
+	Date       string `xml:"date,attr"`
+	Time       string `xml:"time,attr"`
+	Duration   string `xml:"duration,attr"`
+	Rating     string `xml:"rating,attr"` // 0 to 5 stars
+	Tags       string `xml:"tags,attr"`
+	DiveSiteID string `xml:"divesiteid,attr"`
+	GPS        string `xml:"gps,attr"` // older files put the location on the dive
+	Location   struct {
+		Name string `xml:",chardata"`
+		GPS  string `xml:"gps,attr"`
+	} `xml:"location"`
+	Notes     string `xml:"notes"`
+	Suit      string `xml:"suit"`
+	Cylinders []struct {
+		Size  string `xml:"size,attr"`
+		O2    string `xml:"o2,attr"`
+		He    string `xml:"he,attr"`
+		Start string `xml:"start,attr"`
+		End   string `xml:"end,attr"`
+	} `xml:"cylinder"`
+	Weights []struct {
+		Weight string `xml:"weight,attr"`
+	} `xml:"weightsystem"`
+	Computers []struct {
+		Depth struct {
+			Max  string `xml:"max,attr"`
+			Mean string `xml:"mean,attr"`
+		} `xml:"depth"`
+		Temperature struct {
+			Air   string `xml:"air,attr"`
+			Water string `xml:"water,attr"`
+		} `xml:"temperature"`
+		Samples []struct {
+			Time      string `xml:"time,attr"`
+			Depth     string `xml:"depth,attr"`
+			Temp      string `xml:"temp,attr"`
+			Pressure  string `xml:"pressure,attr"`
+			NDL       string `xml:"ndl,attr"`
+			StopDepth string `xml:"stopdepth,attr"` // current decompression stop
+		} `xml:"sample"`
+	} `xml:"divecomputer"`
+}
+
+// parseSubsurface reads the dives of a Subsurface XML export, including
+// dives grouped into trips. It takes no options.
+func parseSubsurface(data []byte, options url.Values) ([]importedDive, error) {
+	var doc subsurfaceDocument
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	sites := make(map[string]subsurfaceSite, len(doc.Sites))
+	for _, s := range doc.Sites {
+		sites[s.UUID] = s
+	}
+
+	all := doc.Dives
+	for _, trip := range doc.Trips {
+		all = append(all, trip.Dives...)
+	}
+	if len(all) == 0 {
+		return nil, fmt.Errorf("no dives found")
+	}
+
+	dives := make([]importedDive, len(all))
+	for i, d := range all {
+		dives[i] = d.toImportedDive(sites)
+	}
+	return dives, nil
+}
+
+func (d subsurfaceDive) toImportedDive(sites map[string]subsurfaceSite) importedDive {
+	dive := importedDive{Ref: d.Number}
+
+	date, err := parseDiveTime(strings.TrimSpace(d.Date + " " + d.Time))
+	if err != nil {
+		dive.Err = err
+		return dive
+	}
+	dive.Date = date
+
+	p := &dive.Post
+	p.Activity = "Scuba Diving"
+	p.Title = "Imported dive"
+	if d.Number != "" {
+		p.Title = "Dive #" + d.Number
+	}
+	p.Description = strings.TrimSpace(d.Notes)
+
+	gps := d.GPS
+	if d.Location.GPS != "" {
+		gps = d.Location.GPS
+	}
+	if site, ok := sites[d.DiveSiteID]; ok {
+		if site.Name != "" {
+			p.Title = site.Name
+		}
+		if site.GPS != "" {
+			gps = site.GPS
+		}
+	} else if loc := strings.TrimSpace(d.Location.Name); loc != "" {
+		p.Title = loc
+	}
+	if lat, lon, ok := parseSubsurfaceGPS(gps); ok {
+		p.Latitude, p.Longitude = lat, lon
+	}
+
+	if rating, ok := unitValue(d.Rating); ok {
+		p.Rating = rating
+	}
+	if seconds, ok := parseMinutesSeconds(d.Duration); ok {
+		minutes := int(math.Round(float64(seconds) / 60))
+		p.BottomTime = &minutes
+	}
+	p.Suit = subsurfaceSuit(d.Suit)
+	for _, tag := range strings.Split(d.Tags, ",") {
+		switch tag = strings.ToLower(strings.TrimSpace(tag)); tag {
+		case "boat", "shore":
+			p.EntryType = tag
+		}
+	}
+
+	if len(d.Cylinders) > 0 {
+		c := d.Cylinders[0]
+		p.TankSize = unitPointer(c.Size)
+		p.StartPressure = unitPointer(c.Start)
+		p.EndPressure = unitPointer(c.End)
+
+		// Subsurface leaves out o2 for air
+		o2 := 0.21
+		if v, ok := unitValue(c.O2); ok {
+			o2 = v / 100
+		}
+		var he *float64
+		if v, ok := unitValue(c.He); ok {
+			v /= 100
+			he = &v
+		}
+		p.GasMix, p.O2Percent, p.HePercent = classifyGas(&o2, he)
+	}
+
+	var weights float64
+	for _, ws := range d.Weights {
+		if v, ok := unitValue(ws.Weight); ok {
+			weights += v
+		}
+	}
+	if weights > 0 {
+		p.Weights = &weights
+	}
+
+	if len(d.Computers) > 0 {
+		dc := d.Computers[0]
+		if v, ok := unitValue(dc.Depth.Max); ok {
+			p.Depth = v
+		}
+		p.AvgDepth = unitPointer(dc.Depth.Mean)
+		p.WaterTemp = unitPointer(dc.Temperature.Water)
+		p.AirTemp = unitPointer(dc.Temperature.Air)
+
+		for _, s := range dc.Samples {
+			seconds, ok := parseMinutesSeconds(s.Time)
+			depth, ok2 := unitValue(s.Depth)
+			if !ok || !ok2 {
+				continue
+			}
+			sample := diveSample{
+				Time:         seconds,
+				Depth:        depth,
+				Temperature:  unitPointer(s.Temp),
+				TankPressure: unitPointer(s.Pressure),
+				Ceiling:      unitPointer(s.StopDepth),
+			}
+			if ndl, ok := parseMinutesSeconds(s.NDL); ok {
+				sample.NDL = &ndl
+			}
+			dive.Samples = append(dive.Samples, sample)
+		}
+	}
+
+	dive.fillFromSamples()
+	return dive
+}
+
+// unitValue parses a number followed by an optional unit, such as
+// "18.4 m" or "32.0%".
+func unitValue(raw string) (float64, bool) {
+	raw = strings.TrimSpace(raw)
+	end := 0
+	for end < len(raw) && strings.IndexByte("+-.0123456789", raw[end]) >= 0 {
+		end++
+	}
+	v, err := strconv.ParseFloat(raw[:end], 64)
+	return v, err == nil
+}
+
+func unitPointer(raw string) *float64 {
+	if v, ok := unitValue(raw); ok {
+		return &v
+	}
+	return nil
+}
+
+// parseMinutesSeconds parses durations like "45:00 min" or "1:02:30 min"
+// into seconds. A bare number is minutes.
+func parseMinutesSeconds(raw string) (int, bool) {
+	raw = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(raw), "min"))
+	if raw == "" {
+		return 0, false
+	}
+	if !strings.Contains(raw, ":") {
+		minutes, err := strconv.ParseFloat(raw, 64)
+		return int(math.Round(minutes * 60)), err == nil
+	}
+
+	seconds := 0
+	for _, part := range strings.Split(raw, ":") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, true
+}
+
+// parseSubsurfaceGPS parses "17.315950 -87.535017".
+func parseSubsurfaceGPS(raw string) (float64, float64, bool) {
+	fields := strings.Fields(raw)
+	if len(fields) != 2 {
+		return 0, 0, false
+	}
+	lat, err1 := strconv.ParseFloat(fields[0], 64)
+	lon, err2 := strconv.ParseFloat(fields[1], 64)
+	if err1 != nil || err2 != nil || !validLatitude(lat) || !validLongitude(lon) {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// subsurfaceSuit maps a free-text suit description onto a suit type.
+func subsurfaceSuit(raw string) string {
+	s := strings.ToLower(raw)
+	switch {
+	case s == "":
+		return ""
+	case strings.Contains(s, "dry"):
+		return "drysuit"
+	case strings.Contains(s, "semi"):
+		return "semidry"
+	case strings.Contains(s, "shorty"):
+		return "shorty"
+	case strings.Contains(s, "rash") || strings.Contains(s, "skin"):
+		return "rashguard"
+	default:
+		return "wetsuit"
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseSubsurface(t *testing.T) {
+	data, err := os.ReadFile("testdata/sample.ssrf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dives, err := parseSubsurface(data, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(dives) != 2 {
+		t.Fatalf("Expected 2 dives, got %d", len(dives))
+	}
+
+	// Dives outside trips come first
+	hol := dives[0].Post
+	if hol.Title != "Hol Chan" || hol.Latitude != 17.497 || hol.GasMix != "air" || hol.Depth != 9.8 {
+		t.Errorf("Expected an air dive at Hol Chan, got %+v", hol)
+	}
+
+	blue := dives[1]
+	p := blue.Post
+	if !blue.Date.Equal(time.Date(2024, 3, 10, 8, 45, 0, 0, time.UTC)) || blue.Ref != "7" {
+		t.Errorf("Expected dive 7 at 08:45, got %q at %v", blue.Ref, blue.Date)
+	}
+	if p.Title != "Blue Hole" || p.Longitude != -87.535017 || p.EntryType != "boat" || p.Suit != "wetsuit" {
+		t.Errorf("Expected the Blue Hole by boat in a wetsuit, got %+v", p)
+	}
+	if p.Depth != 40.2 || *p.AvgDepth != 21.7 || *p.BottomTime != 39 || *p.WaterTemp != 26 || *p.AirTemp != 29 {
+		t.Errorf("Expected the dive computer summary, got %+v", p.DiveLog)
+	}
+	if p.GasMix != "nitrox" || *p.O2Percent != 28 || *p.StartPressure != 210 || *p.Weights != 6 {
+		t.Errorf("Expected EAN28 from 210 bar with 6 kg, got %+v", p.DiveLog)
+	}
+	if len(blue.Samples) != 3 || blue.Samples[1].Time != 480 {
+		t.Errorf("Expected 3 samples, got %+v", blue.Samples)
+	}
+}
+
+func TestParseMinutesSeconds(t *testing.T) {
+	cases := map[string]int{"45:00 min": 2700, "0:10 min": 10, "1:02:30": 3750, "42": 2520}
+	for raw, want := range cases {
+		if got, ok := parseMinutesSeconds(raw); !ok || got != want {
+			t.Errorf("%q: expected %d seconds, got %d", raw, want, got)
+		}
+	}
+}
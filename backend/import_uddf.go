@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// UDDF (Universal Dive Data Format, https://www.uddf.org) stores everything
+// in SI units: meters, seconds, Kelvin, Pascal and cubic meters.
+
+type uddfDocument struct {
+	XMLName xml.Name   `xml:"uddf"`
+	Mixes   []uddfMix  `xml:"gasdefinitions>mix"`
+	Sites   []uddfSite `xml:"divesite>site"`
+	Groups  []struct {
+		Dives []uddfDive `xml:"dive"`
+	} `xml:"profiledata>repetitiongroup"`
+}
+
+type uddfLink struct {
+	Ref string `xml:"ref,attr"`
+}
+
+type uddfMix struct {
+	ID   string   `xml:"id,attr"`
+	Name string   `xml:"name,omitempty"`
+	O2   *float64 `xml:"o2"` // fractions, e.g. 0.32
+	He   *float64 `xml:"he"`
+}
+
+type uddfSite struct {
+	ID        string   `xml:"id,attr"`
+	Name      string   `xml:"name,omitempty"`
+	Location  string   `xml:"geography>location,omitempty"`
+	Latitude  *float64 `xml:"geography>latitude"`
+	Longitude *float64 `xml:"geography>longitude"`
+}
+
+type uddfDive struct {
+	ID        string         `xml:"id,attr"`
+	Before    uddfBefore     `xml:"informationbeforedive"`
+	Tanks     []uddfTank     `xml:"tankdata"`
+	Waypoints []uddfWaypoint `xml:"samples>waypoint"`
+	After     uddfAfter      `xml:"informationafterdive"`
+}
+
+type uddfBefore struct {
+	Links      []uddfLink `xml:"link"`
+	DateTime   string     `xml:"datetime,omitempty"`
+	DiveNumber string     `xml:"divenumber,omitempty"`
+	AirTemp    *float64   `xml:"airtemperature"`
+}
+
+type uddfTank struct {
+	Links         []uddfLink `xml:"link"`
+	Volume        *float64   `xml:"tankvolume"`
+	PressureBegin *float64   `xml:"tankpressurebegin"`
+	PressureEnd   *float64   `xml:"tankpressureend"`
+}
+
+type uddfWaypoint struct {
+	DiveTime     float64    `xml:"divetime"`
+	Depth        *float64   `xml:"depth"`
+	Temperature  *float64   `xml:"temperature"`
+	TankPressure *float64   `xml:"tankpressure"`
+	NoDecoTime   *float64   `xml:"nodecotime"` // seconds
+	SwitchMix    []uddfLink `xml:"switchmix"`
+}
+
+type uddfAfter struct {
+	GreatestDepth     *float64 `xml:"greatestdepth"`
+	AverageDepth      *float64 `xml:"averagedepth"`
+	DiveDuration      *float64 `xml:"diveduration"`
+	LowestTemperature *float64 `xml:"lowesttemperature"`
+	Visibility        *float64 `xml:"visibility"`
+	Rating            *float64 `xml:"rating>ratingvalue"` // 1 to 10
+	Notes             []string `xml:"notes>para"`
+}
+
+// uddfCharsetReader decodes the non-UTF-8 encodings exporters declare:
+// US-ASCII, which is already UTF-8, and ISO-8859-1.
+func uddfCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "us-ascii", "ascii":
+		return input, nil
+	case "iso-8859-1", "iso8859-1", "iso_8859-1", "latin1", "latin-1", "l1":
+		data, err := io.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		// Each ISO-8859-1 byte is the code point of the same value
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return strings.NewReader(string(runes)), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", charset)
+}
+
+// parseUDDF reads the dives of a UDDF document. It takes no options.
+func parseUDDF(data []byte, options url.Values) ([]importedDive, error) {
+	var doc uddfDocument
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.CharsetReader = uddfCharsetReader
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	mixes := make(map[string]uddfMix, len(doc.Mixes))
+	for _, m := range doc.Mixes {
+		mixes[m.ID] = m
+	}
+	sites := make(map[string]uddfSite, len(doc.Sites))
+	for _, s := range doc.Sites {
+		sites[s.ID] = s
+	}
+
+	var dives []importedDive
+	for _, group := range doc.Groups {
+		for _, d := range group.Dives {
+			dives = append(dives, d.toImportedDive(mixes, sites))
+		}
+	}
+	if len(dives) == 0 {
+		return nil, fmt.Errorf("no dives found")
+	}
+	return dives, nil
+}
+
+func (d uddfDive) toImportedDive(mixes map[string]uddfMix, sites map[string]uddfSite) importedDive {
+	dive := importedDive{Ref: d.ID}
+	if d.Before.DiveNumber != "" {
+		dive.Ref = d.Before.DiveNumber
+	}
+
+	date, err := parseDiveTime(d.Before.DateTime)
+	if err != nil {
+		dive.Err = err
+		return dive
+	}
+	dive.Date = date
+
+	p := &dive.Post
+	p.Activity = "Scuba Diving"
+	p.Title = "Imported dive"
+	if d.Before.DiveNumber != "" {
+		p.Title = "Dive #" + d.Before.DiveNumber
+	}
+	for _, link := range d.Before.Links {
+		site, ok := sites[link.Ref]
+		if !ok {
+			continue
+		}
+		if site.Name != "" {
+			p.Title = site.Name
+		} else if site.Location != "" {
+			p.Title = site.Location
+		}
+		if site.Latitude != nil && site.Longitude != nil {
+			p.Latitude, p.Longitude = *site.Latitude, *site.Longitude
+		}
+	}
+
+	var notes []string
+	for _, para := range d.After.Notes {
+		if para = strings.TrimSpace(para); para != "" {
+			notes = append(notes, para)
+		}
+	}
+	p.Description = strings.Join(notes, "\n\n")
+
+	if v := d.After.GreatestDepth; v != nil {
+		p.Depth = roundTo(*v, 1)
+	}
+	if v := d.After.AverageDepth; v != nil {
+		avg := roundTo(*v, 1)
+		p.AvgDepth = &avg
+	}
+	if v := d.After.DiveDuration; v != nil {
+		minutes := int(math.Round(*v / 60))
+		p.BottomTime = &minutes
+	}
+	if v := d.After.LowestTemperature; v != nil {
+		p.WaterTemp = kelvinToCelsius(*v)
+	}
+	if v := d.Before.AirTemp; v != nil {
+		p.AirTemp = kelvinToCelsius(*v)
+	}
+	if v := d.After.Visibility; v != nil {
+		p.Visibility = *v
+	}
+	if v := d.After.Rating; v != nil {
+		p.Rating = math.Max(0, math.Min(5, *v/2))
+	}
+
+	// Gas and pressures come from the first tank; the mix may instead only
+	// appear as the first gas switch of the profile
+	mixRef := ""
+	if len(d.Tanks) > 0 {
+		tank := d.Tanks[0]
+		for _, link := range tank.Links {
+			if _, ok := mixes[link.Ref]; ok {
+				mixRef = link.Ref
+			}
+		}
+		if v := tank.Volume; v != nil && *v > 0 {
+			liters := *v
+			if liters < 1 { // cubic meters, as the spec says
+				liters *= 1000
+			}
+			liters = roundTo(liters, 1)
+			p.TankSize = &liters
+		}
+		p.StartPressure = pascalToBar(tank.PressureBegin)
+		p.EndPressure = pascalToBar(tank.PressureEnd)
+	}
+
+	for _, wp := range d.Waypoints {
+		if mixRef == "" && len(wp.SwitchMix) > 0 {
+			mixRef = wp.SwitchMix[0].Ref
+		}
+		if wp.Depth == nil {
+			continue
+		}
+		sample := diveSample{Time: int(math.Round(wp.DiveTime)), Depth: *wp.Depth}
+		if wp.Temperature != nil {
+			sample.Temperature = kelvinToCelsius(*wp.Temperature)
+		}
+		sample.TankPressure = pascalToBar(wp.TankPressure)
+		if wp.NoDecoTime != nil {
+			ndl := int(math.Round(*wp.NoDecoTime))
+			sample.NDL = &ndl
+		}
+		dive.Samples = append(dive.Samples, sample)
+	}
+	if mix, ok := mixes[mixRef]; ok {
+		p.GasMix, p.O2Percent, p.HePercent = classifyGas(mix.O2, mix.He)
+	}
+
+	dive.fillFromSamples()
+	return dive
+}
+
+// parseDiveTime accepts the date-time layouts seen in dive-log exports.
+// Times without a zone are the local time of the dive and kept as is.
+func parseDiveTime(raw string) (time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	layouts := []string{
+		time.RFC3339,
+		"2006-01-02T15:04:05",
+		"2006-01-02T15:04",
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04",
+		"2006-01-02",
+	}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, raw); err == nil {
+			// Keep the wall-clock time the diver saw
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC), nil
+		}
+	}
+	if raw == "" {
+		return time.Time{}, fmt.Errorf("dive has no date")
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %q", raw)
+}
+
+// classifyGas maps oxygen and helium fractions (0 to 1) onto a gas mix.
+// Hypoxic mixes without helium aren't something we log and are dropped.
+func classifyGas(o2, he *float64) (string, *float64, *float64) {
+	if o2 == nil {
+		return "", nil, nil
+	}
+	o2Percent := roundTo(*o2*100, 1)
+	hePercent := 0.0
+	if he != nil {
+		hePercent = roundTo(*he*100, 1)
+	}
+
+	switch {
+	case hePercent > 0:
+		return "trimix", &o2Percent, &hePercent
+	case math.Abs(o2Percent-21) < 0.5:
+		air := 21.0
+		return "air", &air, &hePercent
+	case o2Percent > 21:
+		return "nitrox", &o2Percent, &hePercent
+	default:
+		return "", nil, nil
+	}
+}
+
+func kelvinToCelsius(k float64) *float64 {
+	c := roundTo(k-273.15, 1)
+	return &c
+}
+
+func pascalToBar(pa *float64) *float64 {
+	if pa == nil {
+		return nil
+	}
+	bar := roundTo(*pa/1e5, 0)
+	return &bar
+}
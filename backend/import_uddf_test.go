@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseUDDF(t *testing.T) {
+	data, err := os.ReadFile("testdata/sample.uddf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dives, err := parseUDDF(data, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(dives) != 3 {
+		t.Fatalf("Expected 3 dives, got %d", len(dives))
+	}
+
+	first := dives[0]
+	p := first.Post
+	if first.Ref != "101" || !first.Date.Equal(time.Date(2024, 6, 1, 9, 30, 0, 0, time.UTC)) {
+		t.Errorf("Expected dive 101 at 09:30, got %q at %v", first.Ref, first.Date)
+	}
+	if p.Title != "La Jolla Cove" || p.Latitude != 32.8503 || p.Longitude != -117.2713 {
+		t.Errorf("Expected the linked site, got %q at %v,%v", p.Title, p.Latitude, p.Longitude)
+	}
+	if p.Depth != 18.4 || p.BottomTime == nil || *p.BottomTime != 45 || p.Rating != 4 {
+		t.Errorf("Expected 18.4 m for 45 min rated 4, got %v m, %v min, rated %v", p.Depth, p.BottomTime, p.Rating)
+	}
+	if p.GasMix != "nitrox" || *p.O2Percent != 32 || *p.TankSize != 11.1 || *p.StartPressure != 200 || *p.EndPressure != 60 {
+		t.Errorf("Expected EAN32 in an 11.1 l tank from 200 to 60 bar, got %+v", p.DiveLog)
+	}
+	if p.WaterTemp == nil || *p.WaterTemp != 15 || p.AirTemp == nil || *p.AirTemp != 22 {
+		t.Errorf("Expected 15 °C water and 22 °C air, got %v and %v", p.WaterTemp, p.AirTemp)
+	}
+	if len(first.Samples) != 4 || first.Samples[1].Depth != 18.4 {
+		t.Errorf("Expected the profile samples, got %+v", first.Samples)
+	}
+
+	// The second dive only has a profile
+	second := dives[1].Post
+	if second.Depth != 9 || second.GasMix != "air" || second.BottomTime == nil || *second.BottomTime != 40 {
+		t.Errorf("Expected summary derived from samples, got depth %v, gas %q, %v min", second.Depth, second.GasMix, second.BottomTime)
+	}
+	if second.AvgDepth == nil || *second.AvgDepth != 4.5 {
+		t.Errorf("Expected a time-weighted average depth of 4.5 m, got %v", second.AvgDepth)
+	}
+
+	if dives[2].Err == nil {
+		t.Error("Expected an error for an unreadable date")
+	}
+}
+
+func TestParseUDDFRejectsOtherXML(t *testing.T) {
+	if _, err := parseUDDF([]byte(`<divelog><dives/></divelog>`), nil); err == nil {
+		t.Error("Expected an error for a non-UDDF document")
+	}
+}
+
+func TestParseUDDFDecodesLatin1(t *testing.T) {
+	doc := "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n" +
+		"<uddf><divesite><site id=\"s\"><name>Baie des Tr\xe9passes</name></site></divesite>" +
+		"<profiledata><repetitiongroup><dive><informationbeforedive><link ref=\"s\"/>" +
+		"<datetime>2024-06-01T09:30:00</datetime></informationbeforedive></dive></repetitiongroup></profiledata></uddf>"
+	dives, err := parseUDDF([]byte(doc), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(dives) != 1 || dives[0].Post.Title != "Baie des Trépasses" {
+		t.Errorf("Expected the accented site name, got %+v", dives)
+	}
+
+	if _, err := parseUDDF([]byte(`<?xml version="1.0" encoding="EBCDIC"?><uddf/>`), nil); err == nil {
+		t.Error("Expected an error for an unsupported encoding")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxImportSize caps an uploaded dive-log file.
+const maxImportSize = 20 << 20 // 20MB
+
+// duplicateDiveWindow is how far apart two timed dives may start and still
+// count as the same dive, allowing for dive computer clock drift.
+const duplicateDiveWindow = 10 * time.Minute
+
+// importedDive is one dive read from a dive-log file, ready to become a
+// post. Importers fill in Post without UserId; the dive's start time is
+// Date, since Post.Date only holds a day.
+type importedDive struct {
+	Ref     string // the dive's id or number in the source file
+	Date    time.Time
+	Post    Post
+	Samples []diveSample
+	Err     error // set when the dive could not be read
+}
+
+// importDiveResult reports what happened to one dive of an import.
+type importDiveResult struct {
+	Index       int    `json:"index"`
+	Ref         string `json:"ref,omitempty"`
+	Date        string `json:"date,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Status      string `json:"status"`            // imported, duplicate or invalid
+	PostId      int    `json:"post_id,omitempty"` // unset in a dry run
+	DuplicateOf int    `json:"duplicate_of,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type importReport struct {
+	Format     string             `json:"format"`
+	DryRun     bool               `json:"dry_run"`
+	Imported   int                `json:"imported"`
+	Duplicates int                `json:"duplicates"`
+	Invalid    int                `json:"invalid"`
+	Dives      []importDiveResult `json:"dives"`
+}
+
+// fillFromSamples derives the summary fields a file left out from the dive
+// profile.
+func (d *importedDive) fillFromSamples() {
+	if len(d.Samples) == 0 {
+		return
+	}
+	p := &d.Post
+
+	var maxDepth, weighted float64
+	var minTemp *float64
+	for i, s := range d.Samples {
+		maxDepth = math.Max(maxDepth, s.Depth)
+		if s.Temperature != nil && (minTemp == nil || *s.Temperature < *minTemp) {
+			t := *s.Temperature
+			minTemp = &t
+		}
+		if i > 0 {
+			prev := d.Samples[i-1]
+			weighted += (prev.Depth + s.Depth) / 2 * float64(s.Time-prev.Time)
+		}
+	}
+	duration := d.Samples[len(d.Samples)-1].Time - d.Samples[0].Time
+
+	if p.Depth == 0 {
+		p.Depth = roundTo(maxDepth, 1)
+	}
+	if p.AvgDepth == nil && duration > 0 {
+		avg := roundTo(weighted/float64(duration), 1)
+		p.AvgDepth = &avg
+	}
+	if p.BottomTime == nil && duration > 0 {
+		minutes := int(math.Round(float64(duration) / 60))
+		p.BottomTime = &minutes
+	}
+	if p.WaterTemp == nil && minTemp != nil {
+		t := roundTo(*minTemp, 1)
+		p.WaterTemp = &t
+	}
+}
+
+func roundTo(v float64, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(v*scale) / scale
+}
+
+// findDuplicateDive returns the id of an existing post of the user that
+// looks like the same dive, or 0. A post counts as the same dive if it
+// starts within duplicateDiveWindow, or if it is logged for the same day
+// without a time and has about the same depth (a dive typed in by hand).
+func findDuplicateDive(ctx context.Context, tx *sql.Tx, userID int, date time.Time, depth float64) (int, error) {
+	var id int
+	err := tx.QueryRowContext(ctx, `
+		SELECT id FROM posts
+		WHERE user_id = $1 AND (
+			date BETWEEN $2::timestamp - $3::interval AND $2::timestamp + $3::interval
+			OR (date = date_trunc('day', $2::timestamp) AND abs(COALESCE(depth, 0) - $4) <= 1)
+		)
+		ORDER BY id LIMIT 1`,
+		userID, date, fmt.Sprintf("%d seconds", int(duplicateDiveWindow.Seconds())), depth,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// importDives creates posts for the dives in one transaction, so a file is
+// imported completely or not at all. Dives that fail validation or that
+// duplicate an existing post are skipped and reported. A dry run does the
+// same work and rolls it back, so the report matches a real import exactly,
+// down to duplicates within the file.
+func importDives(ctx context.Context, db *sql.DB, userID int, format string, dives []importedDive, dryRun bool) (importReport, error) {
+	report := importReport{Format: format, DryRun: dryRun, Dives: []importDiveResult{}}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	var imported []Post
+	for i, dive := range dives {
+		result := importDiveResult{Index: i, Ref: dive.Ref, Title: dive.Post.Title}
+		if !dive.Date.IsZero() {
+			result.Date = dive.Date.Format("2006-01-02T15:04:05")
+		}
+
+		p := dive.Post
+		p.UserId = userID
+		p.Date = dive.Date.Format("2006-01-02")
+
+		err := dive.Err
+		if err == nil && dive.Date.IsZero() {
+			err = fmt.Errorf("dive has no date")
+		}
+		if err == nil {
+			err = validatePost(&p)
+		}
+		samples := normalizeSamples(dive.Samples)
+		if err == nil {
+			err = validateDiveSamples(samples)
+		}
+		if err != nil {
+			result.Status, result.Error = "invalid", err.Error()
+			report.Invalid++
+			report.Dives = append(report.Dives, result)
+			continue
+		}
+
+		duplicateOf, err := findDuplicateDive(ctx, tx, userID, dive.Date, p.Depth)
+		if err != nil {
+			return report, err
+		}
+		if duplicateOf != 0 {
+			result.Status, result.DuplicateOf = "duplicate", duplicateOf
+			report.Duplicates++
+			report.Dives = append(report.Dives, result)
+			continue
+		}
+
+		if err := insertPost(tx, &p, dive.Date); err != nil {
+			return report, err
+		}
+		if err := storeDiveSamples(ctx, tx, p.Id, samples); err != nil {
+			return report, err
+		}
+		result.Status = "imported"
+		if !dryRun {
+			result.PostId = p.Id
+		}
+		report.Imported++
+		report.Dives = append(report.Dives, result)
+		imported = append(imported, p)
+	}
+
+	if dryRun {
+		return report, tx.Rollback()
+	}
+	if err := tx.Commit(); err != nil {
+		return report, err
+	}
+
+	// Hashtags and mentions are linked as for a new post, once the posts
+	// exist for the people mentioned to see
+	for _, p := range imported {
+		if err := syncTextLinks(db, userID, p.Id, nil, p.Description); err != nil {
+			log.Println("Database error:", err)
+		}
+	}
+	return report, nil
+}
+
+// readImportFile returns the uploaded file, sent either as the "file" field
+// of a multipart form or as the raw request body, along with the import
+// options from the query string and form fields.
+func readImportFile(w http.ResponseWriter, r *http.Request) ([]byte, url.Values, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(maxImportSize); err != nil {
+			return nil, nil, err
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		return data, r.Form, err
+	}
+	data, err := io.ReadAll(r.Body)
+	return data, r.URL.Query(), err
+}
+
+// diveParser reads every dive of a dive-log file. Errors are for files that
+// can't be read at all; problems with single dives go in importedDive.Err.
+// options holds format-specific settings such as a CSV column mapping.
+type diveParser func(data []byte, options url.Values) ([]importedDive, error)
+
+// importDiveLog handles an upload in one dive-log format. With
+// dry_run=true it reports what would be imported without writing anything.
+func importDiveLog(db *sql.DB, format string, parse diveParser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		data, options, err := readImportFile(w, r)
+		if err != nil {
+			http.Error(w, "Failed to read upload", http.StatusBadRequest)
+			log.Println("Import read error:", err)
+			return
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			http.Error(w, "No file provided", http.StatusBadRequest)
+			return
+		}
+
+		dryRun := false
+		if raw := options.Get("dry_run"); raw != "" {
+			if dryRun, err = strconv.ParseBool(raw); err != nil {
+				http.Error(w, "dry_run must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+
+		dives, err := parse(data, options)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid %s file: %v", strings.ToUpper(format), err), http.StatusBadRequest)
+			return
+		}
+
+		report, err := importDives(r.Context(), db, callerID, format, dives, dryRun)
+		if err != nil {
+			http.Error(w, "Failed to import dives", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
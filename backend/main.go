@@ -10,14 +10,11 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
-	storage_go "github.com/supabase-community/storage-go"
-	"github.com/supabase-community/supabase-go"
 
 	"github.com/gorilla/mux"
 	"github.com/lib/pq"
@@ -25,13 +22,11 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-// Global Supabase client
-var supabaseClient *supabase.Client
-
 type User struct {
 	Id        int    `json:"id"`
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
+	Username  string `json:"username"` // the handle @mentions refer to
 	Email     string `json:"email"`
     Latitude  float64 `json:"latitude"`
     Longitude float64 `json:"longitude"`
@@ -39,6 +34,11 @@ type User struct {
 	Password  string `json:"password"`
 	Bio       string `json:"bio,omitempty"`
 	Avatar    string `json:"avatar,omitempty"` // URL to profile picture
+	Certification      string `json:"certification,omitempty"`       // highest certification level
+	LocationVisibility string `json:"location_visibility,omitempty"` // who sees the location: hidden, approximate or exact
+	FollowerCount  int   `json:"follower_count"`
+	FollowingCount int   `json:"following_count"`
+	Following      *bool `json:"following,omitempty"` // whether the caller follows this user; set by getUser
 }
 
 type Post struct {
@@ -57,6 +57,8 @@ type Post struct {
 	Rating      float64   `json:"rating,omitempty"` // User-rated experience of the dive
 	Comments    []Comment `json:"comments,omitempty"`
 	Likes       int       `json:"likes"`
+	SiteId      *int      `json:"site_id,omitempty"` // dive site the post was logged at
+	DiveLog
 }
 
 type Comment struct {
@@ -90,7 +92,10 @@ type CombinedPost struct {
 	Timestamp   time.Time `json:"timestamp"`
 	Rating      float64   `json:"rating,omitempty"`
 	Likes       int       `json:"likes"`
+	SiteId      *int      `json:"site_id,omitempty"`
+	DistanceKm  *float64  `json:"distance_km,omitempty"` // set by location searches
 	Comments    []CombinedComment `json:"comments"`
+	DiveLog
 }
 
 type CombinedComment struct {
@@ -105,26 +110,35 @@ type CombinedComment struct {
 
 func main() {
 
+	// `api migrate up|down [n]|status` manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+		if err != nil {
+			log.Fatal("Failed to connect to the database:", err)
+		}
+		defer db.Close()
+
+		if err := runMigrateCommand(db, os.Args[2:]); err != nil {
+			log.Fatal("Migration failed: ", err)
+		}
+		return
+	}
+
 	// Retrieve environment variables
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080" // Default to 8080 if no PORT variable is set
 	}
 
-	// Supabase client initialization
-	supabaseUrl := os.Getenv("SUPABASE_URL")
-	supabaseKey := os.Getenv("SUPABASE_SERVICE_ROLE_KEY")
-
-	if supabaseUrl == "" || supabaseKey == "" {
-		log.Fatal("Missing SUPABASE_URL or SUPABASE_SERVICE_ROLE_KEY in environment")
-	}
+	// Load JWT signing keys up front so bad configuration fails at boot
+	getKeyRing()
 
-	var err error
-	supabaseClient, err = supabase.NewClient(supabaseUrl, supabaseKey, nil)
+	// Blob storage for avatars and post images (Supabase, local disk or S3)
+	store, err := newBlobStoreFromEnv()
 	if err != nil {
-		log.Fatal("Failed to initialize Supabase:", err)
+		log.Fatal("Failed to initialize blob storage: ", err)
 	}
-	fmt.Println("Supabase client initialized")
+	fmt.Printf("Blob storage initialized (%T)\n", store)
 
 	// Connect to the database
 	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
@@ -134,7 +148,7 @@ func main() {
 	defer db.Close()
 	fmt.Println("Connecting to DB:", os.Getenv("DATABASE_URL"))
 
-	// Ensure tables are created
+	// Apply pending schema migrations
 	initializeDatabase(db)
 
 	// Create the main router
@@ -143,43 +157,131 @@ func main() {
 	// Public routes
 	router.HandleFunc("/login", handleLogin(db)).Methods("POST")
 	router.HandleFunc("/sign-up", handleSignUp(db)).Methods("POST")
-	router.HandleFunc("/verify-token", handleVerifyToken()).Methods("POST")
-	router.HandleFunc("/users/{id}", updateUserAvatar(db)).Methods("PUT")
+	router.HandleFunc("/verify-token", handleVerifyToken(db)).Methods("POST")
+	router.HandleFunc("/.well-known/jwks.json", handleJWKS()).Methods("GET")
+	router.HandleFunc("/token/refresh", handleRefreshToken(db)).Methods("POST")
+	router.Handle("/logout", authMiddleware(db)(handleLogout(db))).Methods("POST")
+	router.Handle("/logout/all", authMiddleware(db)(handleLogoutAll(db))).Methods("POST")
+	router.Handle("/users/{id:[0-9]+}", authMiddleware(db)(updateUserAvatar(store, db))).Methods("PUT")
+
+	// Files uploaded to local disk are served by the Go server itself
+	if local, ok := store.(*localBlobStore); ok {
+		router.PathPrefix(localBlobFilesPath).Handler(local.Handler()).Methods("GET", "HEAD")
+	}
+
+	// Real-time events. EventSource can't send an Authorization header, so
+	// this route also takes the access token from the query string.
+	hub := newEventHub(db)
+	go hub.listen(os.Getenv("DATABASE_URL"))
+	router.Handle("/api/go/events", queryTokenAuth(authMiddleware(db)(streamEvents(db, hub)))).Methods("GET")
 
 	// Private routes (require authentication)
 	privateRouter := router.PathPrefix("/api/go").Subrouter()
-	privateRouter.Use(authMiddleware)
+	privateRouter.Use(authMiddleware(db))
 
 	// User routes
 	privateRouter.HandleFunc("/users/search", searchUsers(db)).Methods("GET")
+	privateRouter.HandleFunc("/users/nearby", getNearbyUsers(db)).Methods("GET")
 	privateRouter.HandleFunc("/users", getUsers(db)).Methods("GET")
 	privateRouter.HandleFunc("/users", createUser(db)).Methods("POST")
-	privateRouter.HandleFunc("/users/{id}", getUser(db)).Methods("GET")
-	privateRouter.HandleFunc("/users/{id}", updateUser(db)).Methods("PUT")
-	privateRouter.HandleFunc("/users/{id}", deleteUser(db)).Methods("DELETE")
+	privateRouter.HandleFunc("/users/{id:[0-9]+}", getUser(db)).Methods("GET")
+	privateRouter.HandleFunc("/users/{id:[0-9]+}", updateUser(store, db)).Methods("PUT")
+	privateRouter.HandleFunc("/users/{id:[0-9]+}", deleteUser(db)).Methods("DELETE")
+
+	// Follow routes
+	privateRouter.HandleFunc("/users/{id:[0-9]+}/follow", followUser(db)).Methods("POST")
+	privateRouter.HandleFunc("/users/{id:[0-9]+}/follow", unfollowUser(db)).Methods("DELETE")
+	privateRouter.HandleFunc("/users/{id:[0-9]+}/followers", listFollows(db, true)).Methods("GET")
+	privateRouter.HandleFunc("/users/{id:[0-9]+}/following", listFollows(db, false)).Methods("GET")
+	privateRouter.HandleFunc("/feed", getFeed(db)).Methods("GET")
+
+	// Notification routes
+	privateRouter.HandleFunc("/notifications", getNotifications(db)).Methods("GET")
+	privateRouter.HandleFunc("/notifications/unread-count", getUnreadNotificationCount(db)).Methods("GET")
+	privateRouter.HandleFunc("/notifications/read-all", markAllNotificationsRead(db)).Methods("POST")
+	privateRouter.HandleFunc("/notifications/{id:[0-9]+}/read", markNotificationRead(db)).Methods("POST")
+
+	// Hashtag routes
+	privateRouter.HandleFunc("/hashtags/trending", getTrendingHashtags(db)).Methods("GET")
+	privateRouter.HandleFunc("/hashtags/{tag}/posts", getHashtagPosts(db)).Methods("GET")
+
+	// Search across posts, dive sites and users
+	privateRouter.HandleFunc("/search", searchAll(db)).Methods("GET")
+
+	// Direct message routes
+	privateRouter.HandleFunc("/conversations", getConversations(db)).Methods("GET")
+	privateRouter.HandleFunc("/conversations", createConversation(db)).Methods("POST")
+	privateRouter.HandleFunc("/conversations/unread-count", getUnreadMessageCount(db)).Methods("GET")
+	privateRouter.HandleFunc("/conversations/{id:[0-9]+}/messages", getMessages(db)).Methods("GET")
+	privateRouter.HandleFunc("/conversations/{id:[0-9]+}/messages", sendMessage(db)).Methods("POST")
+	privateRouter.HandleFunc("/conversations/{id:[0-9]+}/read", markConversationRead(db)).Methods("POST")
+	privateRouter.HandleFunc("/users/{id:[0-9]+}/block", blockUser(db)).Methods("POST")
+	privateRouter.HandleFunc("/users/{id:[0-9]+}/block", unblockUser(db)).Methods("DELETE")
+
+	// Trip routes
+	privateRouter.HandleFunc("/trips", getTrips(db)).Methods("GET")
+	privateRouter.HandleFunc("/trips", createTrip(db)).Methods("POST")
+	privateRouter.HandleFunc("/trips/{id:[0-9]+}", getTrip(db)).Methods("GET")
+	privateRouter.HandleFunc("/trips/{id:[0-9]+}", updateTrip(db)).Methods("PUT")
+	privateRouter.HandleFunc("/trips/{id:[0-9]+}", deleteTrip(db)).Methods("DELETE")
+	privateRouter.HandleFunc("/trips/{id:[0-9]+}/rsvp", rsvpTrip(db)).Methods("POST")
+	privateRouter.HandleFunc("/trips/{id:[0-9]+}/rsvp", cancelRSVP(db)).Methods("DELETE")
+	privateRouter.HandleFunc("/trips/{id:[0-9]+}/attendees", getTripAttendees(db)).Methods("GET")
+	privateRouter.HandleFunc("/trips/{id:[0-9]+}/posts", getTripPosts(db)).Methods("GET")
+	privateRouter.HandleFunc("/trips/{id:[0-9]+}/posts/{post_id:[0-9]+}", linkTripPost(db)).Methods("PUT")
+	privateRouter.HandleFunc("/trips/{id:[0-9]+}/posts/{post_id:[0-9]+}", unlinkTripPost(db)).Methods("DELETE")
 
 	// Post routes
 	privateRouter.HandleFunc("/posts/search", getPosts(db)).Methods("POST") // Fetch posts with filters (JSON body)
 	privateRouter.HandleFunc("/posts", createPost(db)).Methods("POST")
-	privateRouter.HandleFunc("/posts/{id}", getPost(db)).Methods("GET")
-	privateRouter.HandleFunc("/posts/{id}", updatePost(db)).Methods("PUT")
-	privateRouter.HandleFunc("/posts/{id}", deletePost(db)).Methods("DELETE")
+	privateRouter.HandleFunc("/posts/{id:[0-9]+}", getPost(db)).Methods("GET")
+	privateRouter.HandleFunc("/posts/{id:[0-9]+}", updatePost(db)).Methods("PUT")
+	privateRouter.HandleFunc("/posts/{id:[0-9]+}", deletePost(db)).Methods("DELETE")
 
 	// Comment routes
-	privateRouter.HandleFunc("/posts/{post_id}/comments", getCommentsHandler(db)).Methods("GET")
-	privateRouter.HandleFunc("/posts/{post_id}/comments", createComment(db)).Methods("POST")
-	privateRouter.HandleFunc("/comments/{id}", updateComment(db)).Methods("PUT")
-	privateRouter.HandleFunc("/comments/{id}", deleteComment(db)).Methods("DELETE")
+	privateRouter.HandleFunc("/posts/{post_id:[0-9]+}/comments", getCommentsHandler(db)).Methods("GET")
+	privateRouter.HandleFunc("/posts/{post_id:[0-9]+}/comments", createComment(db)).Methods("POST")
+	privateRouter.HandleFunc("/comments/{id:[0-9]+}", updateComment(db)).Methods("PUT")
+	privateRouter.HandleFunc("/comments/{id:[0-9]+}", deleteComment(db)).Methods("DELETE")
 
 	// Like routes
-	privateRouter.HandleFunc("/posts/{post_id}/likes", getLikesByPostID(db)).Methods("GET")
-	privateRouter.HandleFunc("/posts/{post_id}/likes", createLike(db)).Methods("POST")
-	privateRouter.HandleFunc("/posts/{post_id}/likes", deleteLike(db)).Methods("DELETE")
-
-	// SupaBase Avatar
-	privateRouter.HandleFunc("/users/avatar", uploadAvatar(supabaseClient, db)).Methods("POST")
-	//SupaBase Feed Posts
-	privateRouter.HandleFunc("/posts/images/upload", uploadPostImage(supabaseClient, db)).Methods("POST")
+	privateRouter.HandleFunc("/posts/{post_id:[0-9]+}/likes", getLikesByPostID(db)).Methods("GET")
+	privateRouter.HandleFunc("/posts/{post_id:[0-9]+}/likes", createLike(db)).Methods("POST")
+	privateRouter.HandleFunc("/posts/{post_id:[0-9]+}/likes", deleteLike(db)).Methods("DELETE")
+
+	// Preference routes (saved filters)
+	privateRouter.HandleFunc("/preferences", getPreferences(db)).Methods("GET")
+	privateRouter.HandleFunc("/preferences", createPreference(db)).Methods("POST")
+	privateRouter.HandleFunc("/preferences/{id:[0-9]+}", getPreference(db)).Methods("GET")
+	privateRouter.HandleFunc("/preferences/{id:[0-9]+}", updatePreference(db)).Methods("PUT")
+	privateRouter.HandleFunc("/preferences/{id:[0-9]+}", deletePreference(db)).Methods("DELETE")
+
+	// Avatar upload
+	privateRouter.HandleFunc("/users/avatar", uploadAvatar(store, db)).Methods("POST")
+	// Feed post images
+	privateRouter.HandleFunc("/posts/images/upload", uploadPostImage(store, db)).Methods("POST")
+
+	// Dive sites
+	privateRouter.HandleFunc("/sites", getSites(db)).Methods("GET")
+	privateRouter.HandleFunc("/sites", createSite(db)).Methods("POST")
+	privateRouter.HandleFunc("/sites/suggest", suggestSites(db)).Methods("GET")
+	privateRouter.HandleFunc("/sites/{id:[0-9]+}", getSite(db)).Methods("GET")
+	privateRouter.HandleFunc("/sites/{id:[0-9]+}", updateSite(db)).Methods("PUT")
+	privateRouter.HandleFunc("/sites/{id:[0-9]+}", deleteSite(db)).Methods("DELETE")
+	privateRouter.HandleFunc("/sites/{id:[0-9]+}/conditions", getSiteConditions(db)).Methods("GET")
+
+	// Dive profiles
+	privateRouter.HandleFunc("/posts/{id:[0-9]+}/samples", getDiveSamples(db)).Methods("GET")
+	privateRouter.HandleFunc("/posts/{id:[0-9]+}/samples", putDiveSamples(db)).Methods("PUT")
+	privateRouter.HandleFunc("/posts/{id:[0-9]+}/samples", deleteDiveSamples(db)).Methods("DELETE")
+
+	// Dive-log imports
+	privateRouter.HandleFunc("/imports/uddf", importDiveLog(db, "uddf", parseUDDF)).Methods("POST")
+	privateRouter.HandleFunc("/imports/subsurface", importDiveLog(db, "subsurface", parseSubsurface)).Methods("POST")
+	privateRouter.HandleFunc("/imports/csv", importDiveLog(db, "csv", parseCSV)).Methods("POST")
+
+	// Dive-log exports
+	privateRouter.HandleFunc("/exports/{format}", exportDives(db)).Methods("GET")
 
 
 	// Wrap the main router with middlewares
@@ -193,136 +295,77 @@ func main() {
 
 
 
+// initializeDatabase brings the schema up to date by applying any pending
+// migrations. Existing data is preserved; see migrate.go.
 func initializeDatabase(db *sql.DB) error {
-	// drop all tables
-	_, err := db.Exec(`
-	DROP TABLE IF EXISTS likes;
-	DROP TABLE IF EXISTS comments;
-	DROP TABLE IF EXISTS posts;
-	DROP TABLE IF EXISTS users;
-	`)
-
-	if err != nil {
-		log.Fatalf("Error dropping tables: %v", err)
-	}
-	
-	// Create the users table
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS users (
-		id SERIAL PRIMARY KEY,
-		first_name TEXT NOT NULL,
-		last_name TEXT NOT NULL,
-		email TEXT UNIQUE NOT NULL,
-		latitude FLOAT,
-		longitude FLOAT,
-		age INT CHECK (age >= 0),
-		password TEXT NOT NULL,
-		bio TEXT,
-		avatar TEXT
-	)`)
-	if err != nil {
-		log.Fatalf("Error creating users table: %v", err)
-	}
-
-	// Create the posts table
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS posts (
-		id SERIAL PRIMARY KEY,
-		user_id INT REFERENCES users(id) ON DELETE CASCADE,
-		title TEXT NOT NULL,
-		date TIMESTAMP NOT NULL,
-		latitude FLOAT,
-		longitude FLOAT,
-		depth FLOAT CHECK (depth >= 0),
-		visibility FLOAT CHECK (visibility >= 0),
-		activity TEXT,
-		description TEXT,
-		images TEXT[],  -- Array of image URLs
-		timestamp TIMESTAMP DEFAULT now(),
-		rating FLOAT CHECK (rating >= 0 AND rating <= 5),
-		likes INT DEFAULT 0
-	)`)
-	if err != nil {
-		log.Fatalf("Error creating posts table: %v", err)
-	}
-
-	// Create the comments table
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS comments (
-		id SERIAL PRIMARY KEY,
-		post_id INT REFERENCES posts(id) ON DELETE CASCADE,
-		user_id INT REFERENCES users(id) ON DELETE CASCADE,
-		content TEXT NOT NULL,
-		timestamp TIMESTAMP DEFAULT now()
-	)`)
-	if err != nil {
-		log.Fatalf("Error creating comments table: %v", err)
-	}
-
-	// Create the likes table
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS likes (
-		id SERIAL PRIMARY KEY,
-		post_id INT REFERENCES posts(id) ON DELETE CASCADE,
-		user_id INT REFERENCES users(id) ON DELETE CASCADE,
-		UNIQUE(post_id, user_id) -- Ensures a user can only like a post once
-	)`)
-	if err != nil {
-		log.Fatalf("Error creating likes table: %v", err)
+	if err := migrateUp(context.Background(), db); err != nil {
+		log.Fatalf("Error migrating database: %v", err)
 	}
 
 	return nil
 }
 
-func authMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+func authMiddleware(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenString := r.Header.Get("Authorization")
+			if tokenString == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 
-		tokenString = strings.Replace(tokenString, "Bearer ", "", 1)
+			tokenString = strings.Replace(tokenString, "Bearer ", "", 1)
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method")
+			token, err := parseToken(tokenString)
+
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
 			}
-			return []byte("secret"), nil
-		})
 
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+			if !token.Valid {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 
-		if !token.Valid {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+			claims, ok := token.Claims.(jwt.MapClaims)
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+			userID, ok := claims["user_id"].(string)
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 
-		userID, ok := claims["user_id"].(string)
-		if !ok {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+			ctx := context.WithValue(r.Context(), "user_id", userID)
 
-		ctx := context.WithValue(r.Context(), "user_id", userID)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+			sessionID, active, err := tokenSession(r.Context(), db, claims)
+			if err != nil {
+				log.Println("Error checking session:", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !active {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if sessionID != "" {
+				ctx = context.WithValue(ctx, "session_id", sessionID)
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
 }
 func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Set CORS headers
 		w.Header().Set("Access-Control-Allow-Origin", "*") // Allow any origin
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization") // Add Authorization here
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Last-Event-ID") // Add Authorization here
 
 		// Handle preflight requests
 		if r.Method == "OPTIONS" {
@@ -369,15 +412,16 @@ func getUserByEmail(db *sql.DB, email string) (User, error) {
 }
 
 
-func createToken(userID int, email string) (string, error) {
+func createToken(userID int, email string, sessionID string) (string, error) {
+	now := time.Now()
 	claims := jwt.MapClaims{
 		"user_id": strconv.Itoa(userID),
 		"email":   email,
-		"exp":     time.Now().Add(24 * time.Hour).Unix(),
+		"sid":     sessionID,
+		"iat":     now.Unix(),
+		"exp":     now.Add(accessTokenTTL()).Unix(),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	fmt.Println("Token: ", token)
-	return token.SignedString([]byte("secret"))
+	return getKeyRing().sign(claims)
 }
 
 func getUserIDFromContext(ctx context.Context) (string, error) {
@@ -387,7 +431,9 @@ func getUserIDFromContext(ctx context.Context) (string, error) {
 	}
 	return userID, nil
 }
-func handleVerifyToken() http.HandlerFunc {
+// handleVerifyToken reports whether a token is still good, which includes
+// its session not having been logged out or revoked.
+func handleVerifyToken(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Extract token from Authorization header
 		authHeader := r.Header.Get("Authorization")
@@ -408,12 +454,7 @@ func handleVerifyToken() http.HandlerFunc {
 		fmt.Println("Verifying token: ", tokenString)
 
 		// Parse and validate the token
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method")
-			}
-			return []byte("secret"), nil
-		})
+		token, err := parseToken(tokenString)
 
 		if err != nil || !token.Valid {
 			fmt.Println("Invalid token: ", err)
@@ -429,6 +470,16 @@ func handleVerifyToken() http.HandlerFunc {
 			return
 		}
 
+		// The same check authMiddleware makes
+		if _, active, err := tokenSession(r.Context(), db, claims); err != nil {
+			log.Println("Error checking session:", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		} else if !active {
+			http.Error(w, "Session has ended", http.StatusUnauthorized)
+			return
+		}
+
 		// Debug: Log valid token claims
 		fmt.Println("Valid token - claims: ", claims)
 
@@ -468,8 +519,8 @@ func handleSignUp(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Generate token
-		token, err := createToken(user.Id, user.Email)
+		// Start a session and generate tokens
+		tokens, err := issueSession(db, r, user)
 		if err != nil {
 			fmt.Println("Error generating token: ", err)
 			http.Error(w, "Server error", http.StatusInternalServerError)
@@ -478,12 +529,10 @@ func handleSignUp(db *sql.DB) http.HandlerFunc {
 
 		fmt.Println("Generated token for NEW user: ", user.Email)
 
-		// Respond with token
+		// Respond with tokens
+		tokens["userId"] = strconv.Itoa(user.Id)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"token": token,
-			"userId": strconv.Itoa(user.Id),
-		})
+		json.NewEncoder(w).Encode(tokens)
 	}
 }
 
@@ -518,8 +567,8 @@ func handleLogin(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Generate token
-		token, err := createToken(user.Id, user.Email)
+		// Start a session and generate tokens
+		tokens, err := issueSession(db, r, user)
 		if err != nil {
 			fmt.Println("Error generating token: ", err)
 			http.Error(w, "Server error", http.StatusInternalServerError)
@@ -528,11 +577,9 @@ func handleLogin(db *sql.DB) http.HandlerFunc {
 
 		fmt.Println("Generated token for user: ", user.Email)
 
-		// Respond with token
+		// Respond with tokens
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"token": token,
-		})
+		json.NewEncoder(w).Encode(tokens)
 	}
 }
 
@@ -555,10 +602,11 @@ func searchUsers(db *sql.DB) http.HandlerFunc {
 
         // Build SQL query with proper parameterization
         sqlQuery := `
-            SELECT id, first_name, last_name, email, avatar 
+            SELECT id, first_name, last_name, username, email, avatar 
             FROM users 
             WHERE LOWER(first_name) LIKE LOWER($1) 
                OR LOWER(last_name) LIKE LOWER($1)
+               OR LOWER(username) LIKE LOWER($1)
             LIMIT 10`
         
         searchTerm := "%" + query + "%"
@@ -575,7 +623,7 @@ func searchUsers(db *sql.DB) http.HandlerFunc {
         var users []User
         for rows.Next() {
             var user User
-            if err := rows.Scan(&user.Id, &user.FirstName, &user.LastName, &user.Email, &user.Avatar); err != nil {
+            if err := rows.Scan(&user.Id, &user.FirstName, &user.LastName, &user.Username, &user.Email, &user.Avatar); err != nil {
                 log.Printf("Row scan error: %v", err)
                 continue
             }
@@ -599,8 +647,13 @@ func searchUsers(db *sql.DB) http.HandlerFunc {
 // Get all users
 func getUsers(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, _ := getCallerID(r)
+
+		// Other people's locations are shown as their owners chose
 		rows, err := db.Query(`
-			SELECT id, first_name, last_name, email, latitude, longitude, age, bio, avatar FROM users`)
+			SELECT u.id, u.first_name, u.last_name, u.username, u.email, `+userLocationColumns("$1")+`, u.age, u.bio, u.avatar,
+				COALESCE(u.certification, ''), u.follower_count, u.following_count
+			FROM users u`, callerID)
 		if err != nil {
 			http.Error(w, "Failed to retrieve users", http.StatusInternalServerError)
 			log.Println("Database error:", err)
@@ -612,8 +665,8 @@ func getUsers(db *sql.DB) http.HandlerFunc {
 		for rows.Next() {
 			var u User
 			if err := rows.Scan(
-				&u.Id, &u.FirstName, &u.LastName, &u.Email, 
-				&u.Latitude, &u.Longitude, &u.Age, &u.Bio, &u.Avatar,
+				&u.Id, &u.FirstName, &u.LastName, &u.Username, &u.Email, 
+				&u.Latitude, &u.Longitude, &u.Age, &u.Bio, &u.Avatar, &u.Certification, &u.FollowerCount, &u.FollowingCount,
 			); err != nil {
 				http.Error(w, "Error scanning user data", http.StatusInternalServerError)
 				log.Println("Scan error:", err)
@@ -640,19 +693,26 @@ func getUser(db *sql.DB) http.HandlerFunc {
 		vars := mux.Vars(r)
 		id := vars["id"]
 
+		callerID, _ := getCallerID(r)
+
 		var user User
+		var following bool
 		err := db.QueryRow(`
-			SELECT id, first_name, last_name, email, latitude, longitude, age, bio, avatar 
-			FROM users 
-			WHERE id = $1`, id).Scan(
-			&user.Id, &user.FirstName, &user.LastName, 
+			SELECT u.id, u.first_name, u.last_name, u.username, u.email, `+userLocationColumns("$2")+`, u.age, u.bio, u.avatar,
+				COALESCE(u.certification, ''), u.location_visibility, u.follower_count, u.following_count,
+				EXISTS (SELECT 1 FROM follows WHERE follower_id = $2 AND followee_id = u.id)
+			FROM users u
+			WHERE u.id = $1`, id, callerID).Scan(
+			&user.Id, &user.FirstName, &user.LastName, &user.Username,
 			&user.Email, &user.Latitude, &user.Longitude, &user.Age, 
-			&user.Bio, &user.Avatar,
+			&user.Bio, &user.Avatar, &user.Certification, &user.LocationVisibility,
+			&user.FollowerCount, &user.FollowingCount, &following,
 		)
 		if err != nil {
 			http.Error(w, "User not found", http.StatusNotFound)
 			return
 		}
+		user.Following = &following
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(user)
@@ -894,7 +954,7 @@ func createUser(db *sql.DB) http.HandlerFunc {
 }
 
 // Update user
-func updateUser(db *sql.DB) http.HandlerFunc {
+func updateUser(store BlobStore, db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var user User
 		err := json.NewDecoder(r.Body).Decode(&user)
@@ -906,13 +966,58 @@ func updateUser(db *sql.DB) http.HandlerFunc {
 		vars := mux.Vars(r)
 		id := vars["id"]
 
+		if _, ok := authorizeOwner(w, r, db, id, userOwner); !ok {
+			return
+		}
+
+		// The username is kept when the body leaves it out
+		if user.Username != "" {
+			if err := validateUsername(user.Username); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// The profile form sends the current avatar back; a new one must be
+		// an upload of ours, like on the avatar route
+		if err := validateAvatarURL(store, user.Avatar); err != nil {
+			var current string
+			if err := db.QueryRow("SELECT COALESCE(avatar, '') FROM users WHERE id = $1", id).Scan(&current); err != nil {
+				http.Error(w, "Failed to update user", http.StatusInternalServerError)
+				log.Println("Database error:", err)
+				return
+			}
+			if user.Avatar != current {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// So are the certification and location visibility
+		if user.Certification != "" && !oneOf(user.Certification, certificationLevels) {
+			http.Error(w, "certification must be one of "+strings.Join(certificationLevels, ", "), http.StatusBadRequest)
+			return
+		}
+		if user.LocationVisibility != "" && !oneOf(user.LocationVisibility, locationVisibilities) {
+			http.Error(w, "location_visibility must be one of "+strings.Join(locationVisibilities, ", "), http.StatusBadRequest)
+			return
+		}
+
 		// Update user data
 		_, err = db.Exec(`
 			UPDATE users 
-			SET first_name = $1, last_name = $2, email = $3, latitude = $4, longitude = $5, age = $6, bio = $7, avatar = $8 
+			SET first_name = $1, last_name = $2, email = $3, latitude = $4, longitude = $5, age = $6, bio = $7, avatar = $8,
+				username = COALESCE(NULLIF($10, ''), username),
+				certification = COALESCE(NULLIF($11, ''), certification),
+				location_visibility = COALESCE(NULLIF($12, ''), location_visibility)
 			WHERE id = $9`,
-			user.FirstName, user.LastName, user.Email, user.Latitude, user.Longitude, user.Age, user.Bio, user.Avatar, id,
+			user.FirstName, user.LastName, user.Email, user.Latitude, user.Longitude, user.Age, user.Bio, user.Avatar, id, user.Username,
+			user.Certification, user.LocationVisibility,
 		)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" && pqErr.Constraint == "users_username_idx" { // unique_violation
+			http.Error(w, "Username is already taken", http.StatusConflict)
+			return
+		}
 		if err != nil {
 			http.Error(w, "Failed to update user", http.StatusInternalServerError)
 			log.Println("Database error:", err)
@@ -922,11 +1027,12 @@ func updateUser(db *sql.DB) http.HandlerFunc {
 		// Retrieve updated user
 		var updatedUser User
 		err = db.QueryRow(`
-			SELECT id, first_name, last_name, email, latitude, longitude, age, bio, avatar 
+			SELECT id, first_name, last_name, username, email, latitude, longitude, age, bio, avatar,
+				COALESCE(certification, ''), location_visibility
 			FROM users WHERE id = $1`, id).Scan(
-			&updatedUser.Id, &updatedUser.FirstName, &updatedUser.LastName, 
+			&updatedUser.Id, &updatedUser.FirstName, &updatedUser.LastName, &updatedUser.Username,
 			&updatedUser.Email, &updatedUser.Latitude, &updatedUser.Longitude, &updatedUser.Age, 
-			&updatedUser.Bio, &updatedUser.Avatar,
+			&updatedUser.Bio, &updatedUser.Avatar, &updatedUser.Certification, &updatedUser.LocationVisibility,
 		)
 		if err != nil {
 			http.Error(w, "User not found after update", http.StatusNotFound)
@@ -944,6 +1050,10 @@ func deleteUser(db *sql.DB) http.HandlerFunc {
 		vars := mux.Vars(r)
 		id := vars["id"]
 
+		if _, ok := authorizeOwner(w, r, db, id, userOwner); !ok {
+			return
+		}
+
 		// Check if user exists
 		var user User
 		err := db.QueryRow(`
@@ -970,16 +1080,30 @@ func deleteUser(db *sql.DB) http.HandlerFunc {
 
 // POST FUNCTIONS
 
+// combinedPostColumns selects a CombinedPost from posts p joined with its
+// author u, in scanTargets order.
+func combinedPostColumns() string {
+	return `p.id, p.user_id, u.first_name || ' ' || u.last_name AS user_name, u.avatar AS user_avatar,
+		p.title, p.date, p.latitude, p.longitude, p.depth,
+		p.visibility, p.activity, p.description, p.images, p.timestamp, p.rating,
+		p.likes, p.site_id, ` + diveLogSelect()
+}
+
+// scanTargets returns the scan destinations for combinedPostColumns; the
+// images array is read into images.
+func (post *CombinedPost) scanTargets(images *[]string) []interface{} {
+	dest := []interface{}{
+		&post.Id, &post.UserId, &post.UserName, &post.UserAvatar, &post.Title, &post.Date,
+		&post.Latitude, &post.Longitude, &post.Depth,
+		&post.Visibility, &post.Activity, &post.Description, pq.Array(images), &post.Timestamp,
+		&post.Rating, &post.Likes, &post.SiteId,
+	}
+	return append(dest, post.DiveLog.scanTargets()...)
+}
+
 func getPosts(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var filters struct {
-			UserID    int     `json:"user_id"`
-			Latitude  float64 `json:"latitude"`
-			Longitude float64 `json:"longitude"`
-			Date      string  `json:"date"`
-			Activity  string  `json:"activity"`
-		}
-
+		var filters postSearchFilters
 		if err := json.NewDecoder(r.Body).Decode(&filters); err != nil {
 			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
 			log.Println("JSON decode error:", err)
@@ -987,43 +1111,23 @@ func getPosts(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Build query dynamically
-		conditions := []string{}
-		args := []interface{}{}
-		argIndex := 1
-
-		if filters.UserID > 0 {
-			conditions = append(conditions, fmt.Sprintf("p.user_id = $%d", argIndex))
-			args = append(args, filters.UserID)
-			argIndex++
-		}
-		if filters.Latitude != 0 && filters.Longitude != 0 {
-			conditions = append(conditions, fmt.Sprintf("p.latitude = $%d AND p.longitude = $%d", argIndex, argIndex+1))
-			args = append(args, filters.Latitude, filters.Longitude)
-			argIndex += 2
-		}
-		if filters.Date != "" {
-			conditions = append(conditions, fmt.Sprintf("p.date = $%d", argIndex))
-			args = append(args, filters.Date)
-			argIndex++
+		search, err := buildPostSearch(filters)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		if filters.Activity != "" {
-			conditions = append(conditions, fmt.Sprintf("p.activity = $%d", argIndex))
-			args = append(args, filters.Activity)
-			argIndex++
+
+		distance := "NULL::float"
+		if search.hasDistance() {
+			distance = search.distance()
 		}
 
 		// SQL query using JOIN to fetch user name
 		query := `
-		SELECT p.id, p.user_id, u.first_name || ' ' || u.last_name AS user_name, u.avatar AS user_avatar,
-			   p.title, p.date, p.latitude, p.longitude, p.depth, 
-			   p.visibility, p.activity, p.description, p.images, p.timestamp, p.rating, 
-			   (SELECT COUNT(*) FROM likes WHERE likes.post_id = p.id) AS likes
+		SELECT ` + combinedPostColumns() + `, ` + distance + ` AS distance_km, ` + search.sortKey() + ` AS sort_key
 		FROM posts p
-		JOIN users u ON p.user_id = u.id`
-
-		if len(conditions) > 0 {
-			query += " WHERE " + strings.Join(conditions, " AND ")
-		}
+		JOIN users u ON p.user_id = u.id` + search.where() + search.orderBy()
+		args := search.Args
 
 		log.Println("Executing query:", query, "with args:", args)
 
@@ -1035,39 +1139,53 @@ func getPosts(db *sql.DB) http.HandlerFunc {
 		}
 		defer rows.Close()
 
-		var posts []CombinedPost
+		page := postSearchPage{Posts: []CombinedPost{}}
+		var lastSortKey interface{}
 		
 		for rows.Next() {
 			var post CombinedPost
 			var images []string // Temporary variable to hold the images array
+			var distanceKm sql.NullFloat64
+			var sortKey interface{}
 
 
-			if err := rows.Scan(
-				&post.Id, &post.UserId, &post.UserName, &post.UserAvatar, &post.Title, &post.Date,
-				&post.Latitude, &post.Longitude, &post.Depth,
-				&post.Visibility, &post.Activity, &post.Description, pq.Array(&images), &post.Timestamp,
-				&post.Rating, &post.Likes,
-			); err != nil {
+			dest := post.scanTargets(&images)
+			if err := rows.Scan(append(dest, &distanceKm, &sortKey)...); err != nil {
 				http.Error(w, "Error scanning post data", http.StatusInternalServerError)
 				log.Println("Scan error:", err)
 				return
 			}
 
+			// The extra row only tells us there is another page
+			if len(page.Posts) == search.PageSize {
+				last := page.Posts[len(page.Posts)-1]
+				page.NextCursor = encodePostCursor(postCursor{Sort: search.Sort, Value: cursorValue(lastSortKey), Id: last.Id})
+				break
+			}
+
 			post.Images = images // Assign the images array to the post
+			if distanceKm.Valid {
+				post.DistanceKm = &distanceKm.Float64
+			}
 
+			page.Posts = append(page.Posts, post)
+			lastSortKey = sortKey
+		}
 
-			// Fetch comments
-			comments, err := getCommentsByPostID(db, post.Id)
-			if err != nil {
-				log.Println("Error fetching comments:", err)
-			}
-			post.Comments = comments
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error processing post data", http.StatusInternalServerError)
+			log.Println("Rows iteration error:", err)
+			return
+		}
 
-			posts = append(posts, post)
+		if err := attachComments(db, page.Posts); err != nil {
+			http.Error(w, "Failed to retrieve comments", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(posts)
+		json.NewEncoder(w).Encode(page)
 	}
 }
 
@@ -1082,20 +1200,12 @@ func getPost(db *sql.DB) http.HandlerFunc {
 		var images []string // Temporary variable to hold the images array
 
 		query := `
-		SELECT p.id, p.user_id, u.first_name || ' ' || u.last_name AS user_name, u.avatar AS user_avatar,
-		   p.title, p.date, p.latitude, p.longitude, p.depth, 
-		   p.visibility, p.activity, p.description, p.images, p.timestamp, p.rating, 
-		   (SELECT COUNT(*) FROM likes WHERE likes.post_id = p.id) AS likes
+		SELECT ` + combinedPostColumns() + `
 		FROM posts p
 		JOIN users u ON p.user_id = u.id
 		WHERE p.id = $1`
 
-		err := db.QueryRow(query, id).Scan(
-			&post.Id, &post.UserId, &post.UserName, &post.UserAvatar, &post.Title, &post.Date,
-			&post.Latitude, &post.Longitude, &post.Depth,
-			&post.Visibility, &post.Activity, &post.Description, pq.Array(&images), &post.Timestamp,
-			&post.Rating, &post.Likes,
-		)
+		err := db.QueryRow(query, id).Scan(post.scanTargets(&images)...)
 		if err != nil {
 			http.Error(w, "Post not found", http.StatusNotFound)
 			log.Println("Database error:", err)
@@ -1107,7 +1217,9 @@ func getPost(db *sql.DB) http.HandlerFunc {
 		// Fetch comments
 		comments, err := getCommentsByPostID(db, post.Id)
 		if err != nil {
-			log.Println("Error fetching comments:", err)
+			http.Error(w, "Failed to retrieve comments", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
 		}
 		post.Comments = comments
 
@@ -1126,38 +1238,58 @@ func createPost(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		parsedDate, err := time.Parse("2006-01-02", p.Date)
+		// The author is always the caller, whatever the body says
+		callerID, err := getCallerID(r)
 		if err != nil {
-			http.Error(w, "Invalid date format. Use YYYY-MM-DD", http.StatusBadRequest)
-			log.Println("Date parse error:", err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		p.UserId = callerID
 
-		if p.Timestamp.IsZero() {
-			p.Timestamp = time.Now()
+		if err := validatePost(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok := checkPostSite(w, db, p.SiteId); !ok {
+			return
 		}
 
-		err = db.QueryRow(`
-			INSERT INTO posts 
-			(user_id, title, date, latitude, longitude, depth, visibility, activity, description, images, timestamp, rating, likes) 
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
-			RETURNING id`,
-			p.UserId, p.Title, parsedDate, p.Latitude, p.Longitude,
-			p.Depth, p.Visibility, p.Activity, p.Description, pq.Array(p.Images),
-			p.Timestamp, p.Rating, 0,
-		).Scan(&p.Id)
-
+		parsedDate, err := time.Parse("2006-01-02", p.Date)
 		if err != nil {
+			http.Error(w, "Invalid date format. Use YYYY-MM-DD", http.StatusBadRequest)
+			log.Println("Date parse error:", err)
+			return
+		}
+
+		if err := insertPost(db, &p, parsedDate); err != nil {
 			log.Println("INSERT error:", err)
 			http.Error(w, "Failed to create post", http.StatusInternalServerError)
 			return
 		}
 
 		log.Println("Successfully created post with ID:", p.Id)
+		siteConditionsCache.invalidate(p.SiteId)
+		if err := syncTextLinks(db, p.UserId, p.Id, nil, p.Description); err != nil {
+			log.Println("Database error:", err)
+		}
+
+		// Send the ID back, along with the nearest known dive site when the
+		// post isn't linked to one so the client can offer to link it
+		resp := struct {
+			Id            int       `json:"id"`
+			SuggestedSite *DiveSite `json:"suggested_site,omitempty"`
+		}{Id: p.Id}
+		if p.SiteId == nil && (p.Latitude != 0 || p.Longitude != 0) {
+			sites, err := findNearbySites(db, p.Latitude, p.Longitude, siteSuggestRadius, 1)
+			if err != nil {
+				log.Println("Database error:", err)
+			} else if len(sites) > 0 {
+				resp.SuggestedSite = &sites[0]
+			}
+		}
 
-		// Send only the ID back to client as JSON
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(map[string]int{"id": p.Id}); err != nil {
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
 			log.Println("JSON encode error:", err)
 			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 			return
@@ -1170,6 +1302,49 @@ func createPost(db *sql.DB) http.HandlerFunc {
 
 
 
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// validatePost checks the fields of a post that the database would
+// otherwise reject, plus its dive log.
+func validatePost(p *Post) error {
+	if p.Depth < 0 || p.Visibility < 0 {
+		return fmt.Errorf("depth and visibility must not be negative")
+	}
+	if p.Rating < 0 || p.Rating > 5 {
+		return fmt.Errorf("rating must be between 0 and 5")
+	}
+	return p.DiveLog.validate(p.Depth)
+}
+
+// insertPost stores a validated post dated date and sets its id. It is
+// shared by createPost and the dive-log importers. The timestamp is always
+// the time of posting, since newest-first lists and the feed order by it;
+// the dive itself is dated by date.
+func insertPost(q queryRower, p *Post, date time.Time) error {
+	p.Timestamp = time.Now()
+
+	args := queryArgs{
+		p.UserId, p.Title, date, p.Latitude, p.Longitude,
+		p.Depth, p.Visibility, p.Activity, p.Description, pq.Array(p.Images),
+		p.Timestamp, p.Rating, 0, p.SiteId,
+	}
+	placeholders := "$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14"
+	for _, v := range p.DiveLog.values() {
+		placeholders += ", " + args.add(v)
+	}
+
+	return q.QueryRow(`
+		INSERT INTO posts 
+		(user_id, title, date, latitude, longitude, depth, visibility, activity, description, images, timestamp, rating, likes, site_id, `+strings.Join(diveLogColumns, ", ")+`) 
+		VALUES (`+placeholders+`)
+		RETURNING id`,
+		args...,
+	).Scan(&p.Id)
+}
+
 func updatePost(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var p Post
@@ -1181,21 +1356,56 @@ func updatePost(db *sql.DB) http.HandlerFunc {
 		vars := mux.Vars(r)
 		id := vars["id"]
 
-		_, err := db.Exec(
-			"UPDATE posts SET user_id = $1, title = $2, date = $3, latitude = $4, longitude = $5, depth = $6, visibility = $7, activity = $8, description = $9, timestamp = $10, rating = $11, likes = $12 WHERE id = $13",
-			p.UserId, p.Title, p.Date, p.Latitude, p.Longitude, p.Depth, p.Visibility, p.Activity, p.Description, p.Timestamp, p.Rating, p.Likes, id,
-		)
+		callerID, ok := authorizeOwner(w, r, db, id, postOwner)
+		if !ok {
+			return
+		}
+
+		if err := validatePost(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok := checkPostSite(w, db, p.SiteId); !ok {
+			return
+		}
+
+		// The conditions of the site the post leaves change too
+		var previousSite *int
+		if err := db.QueryRow("SELECT site_id FROM posts WHERE id = $1", id).Scan(&previousSite); err != nil {
+			http.Error(w, "Failed to update post", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		// Ownership can't be transferred, so user_id is not updatable,
+		// likes is a counter maintained by the database, and timestamp stays
+		// the creation time that newest-first lists page on
+		args := queryArgs{p.Title, p.Date, p.Latitude, p.Longitude, p.Depth, p.Visibility, p.Activity, p.Description, p.Rating, id}
+		set := "title = $1, date = $2, latitude = $3, longitude = $4, depth = $5, visibility = $6, activity = $7, description = $8, rating = $9"
+		set += ", site_id = " + args.add(p.SiteId)
+		for i, v := range p.DiveLog.values() {
+			set += ", " + diveLogColumns[i] + " = " + args.add(v)
+		}
+		_, err := db.Exec("UPDATE posts SET "+set+" WHERE id = $10", args...)
 		if err != nil {
 			http.Error(w, "Failed to update post", http.StatusInternalServerError)
 			log.Println("Database error:", err)
 			return
 		}
+		siteConditionsCache.invalidate(previousSite, p.SiteId)
+		postID, _ := strconv.Atoi(id)
+		if err := syncTextLinks(db, callerID, postID, nil, p.Description); err != nil {
+			log.Println("Database error:", err)
+		}
 
 		var updatedPost Post
-		err = db.QueryRow(
-			"SELECT id, user_id, title, date, latitude, longitude, depth, visibility, activity, description, timestamp, rating, likes FROM posts WHERE id = $1", id).Scan(
+		dest := []interface{}{
 			&updatedPost.Id, &updatedPost.UserId, &updatedPost.Title, &updatedPost.Date, &updatedPost.Latitude, &updatedPost.Longitude, &updatedPost.Depth,
-			&updatedPost.Visibility, &updatedPost.Activity, &updatedPost.Description, &updatedPost.Timestamp, &updatedPost.Rating, &updatedPost.Likes,
+			&updatedPost.Visibility, &updatedPost.Activity, &updatedPost.Description, &updatedPost.Timestamp, &updatedPost.Rating, &updatedPost.Likes, &updatedPost.SiteId,
+		}
+		err = db.QueryRow(
+			"SELECT p.id, p.user_id, p.title, p.date, p.latitude, p.longitude, p.depth, p.visibility, p.activity, p.description, p.timestamp, p.rating, p.likes, p.site_id, "+diveLogSelect()+" FROM posts p WHERE p.id = $1", id).Scan(
+			append(dest, updatedPost.DiveLog.scanTargets()...)...,
 		)
 		if err != nil {
 			http.Error(w, "Post not found after update", http.StatusNotFound)
@@ -1212,18 +1422,24 @@ func deletePost(db *sql.DB) http.HandlerFunc {
 		vars := mux.Vars(r)
 		id := vars["id"]
 
-		_, err := db.Exec("DELETE FROM posts WHERE id = $1", id)
+		if _, ok := authorizeOwner(w, r, db, id, postOwner); !ok {
+			return
+		}
+
+		var siteID *int
+		err := db.QueryRow("DELETE FROM posts WHERE id = $1 RETURNING site_id", id).Scan(&siteID)
 		if err != nil {
 			http.Error(w, "Failed to delete post", http.StatusInternalServerError)
 			return
 		}
+		siteConditionsCache.invalidate(siteID)
 
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-//SupaBase Post Upload
-func uploadPostImage(supabaseClient *supabase.Client, db *sql.DB) http.HandlerFunc {
+// Post image upload
+func uploadPostImage(store BlobStore, db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Received post image upload request")
 
@@ -1247,13 +1463,16 @@ func uploadPostImage(supabaseClient *supabase.Client, db *sql.DB) http.HandlerFu
 			return
 		}
 
+		if _, ok := authorizeOwner(w, r, db, postID, postOwner); !ok {
+			return
+		}
+
 		files := r.MultipartForm.File["images"]
 		if len(files) == 0 {
 			http.Error(w, "No images provided", http.StatusBadRequest)
 			return
 		}
 
-		storageClient := supabaseClient.Storage
 		var imageURLs []string
 
 		for i, fileHeader := range files {
@@ -1272,25 +1491,23 @@ func uploadPostImage(supabaseClient *supabase.Client, db *sql.DB) http.HandlerFu
 				return
 			}
 
-			ext := filepath.Ext(fileHeader.Filename)
-			if ext == "" {
-				ext = ".jpeg"
+			ext, contentType, err := imageUpload(fileHeader.Filename, fileBytes)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
 
 			// NEW STRUCTURE: userID/postID/image1.png
 			filePath := fmt.Sprintf("%s/%s/image%d%s", userID, postID, i+1, ext)
 
-			contentType := fileHeader.Header.Get("Content-Type")
-			options := storage_go.FileOptions{ContentType: &contentType}
-			_, err = storageClient.UploadFile("feedposts", filePath, bytes.NewReader(fileBytes), options)
+			err = store.Put(r.Context(), postImageBucket, filePath, bytes.NewReader(fileBytes), contentType)
 			if err != nil {
-				log.Println("Error uploading image to Supabase:", err)
+				log.Println("Error uploading image:", err)
 				http.Error(w, "Failed to upload image", http.StatusInternalServerError)
 				return
 			}
 
-			url := storageClient.GetPublicUrl("feedposts", filePath).SignedURL
-			imageURLs = append(imageURLs, url)
+			imageURLs = append(imageURLs, store.PublicURL(postImageBucket, filePath))
 		}
 
 		_, err = db.Exec("UPDATE posts SET images = $1 WHERE id = $2", pq.Array(imageURLs), postID)
@@ -1331,6 +1548,12 @@ func createLike(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		actorID, _ := strconv.Atoi(userID)
+		likedID, _ := strconv.Atoi(postID)
+		if err := notifyPostAuthor(db, notifyLike, actorID, likedID, nil); err != nil {
+			log.Println("Notification error:", err)
+		}
+
 		w.WriteHeader(http.StatusCreated)
 	}
 }
@@ -1379,6 +1602,12 @@ func deleteLike(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// A like that was taken back is no longer news
+		_, err = db.Exec("DELETE FROM notifications WHERE type = $1 AND actor_id = $2 AND post_id = $3", notifyLike, userID, postID)
+		if err != nil {
+			log.Println("Notification error:", err)
+		}
+
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
@@ -1386,22 +1615,57 @@ func deleteLike(db *sql.DB) http.HandlerFunc {
 
 
 func getCommentsByPostID(db *sql.DB, postID int) ([]CombinedComment, error) {
+	comments, err := getCommentsByPostIDs(db, []int{postID})
+	if err != nil {
+		return nil, err
+	}
+	return comments[postID], nil
+}
+
+// attachComments loads the comments of a page of posts in one query.
+func attachComments(db *sql.DB, posts []CombinedPost) error {
+	postIDs := make([]int, len(posts))
+	for i, post := range posts {
+		postIDs[i] = post.Id
+	}
+	comments, err := getCommentsByPostIDs(db, postIDs)
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		posts[i].Comments = comments[posts[i].Id]
+	}
+	return nil
+}
+
+// getCommentsByPostIDs loads the comments of several posts in a single query,
+// keyed by post id and oldest first.
+func getCommentsByPostIDs(db *sql.DB, postIDs []int) (map[int][]CombinedComment, error) {
+	comments := make(map[int][]CombinedComment)
+	if len(postIDs) == 0 {
+		return comments, nil
+	}
+
+	ids := make([]int64, len(postIDs))
+	for i, id := range postIDs {
+		ids[i] = int64(id)
+	}
+
 	query := `
 	SELECT c.id, c.post_id, c.user_id, u.first_name || ' ' || u.last_name AS user_name, 
 		   u.avatar AS user_avatar, c.content, c.timestamp
 	FROM comments c
 	JOIN users u ON c.user_id = u.id
-	WHERE c.post_id = $1
-	ORDER BY c.timestamp ASC;
+	WHERE c.post_id = ANY($1)
+	ORDER BY c.post_id, c.timestamp ASC, c.id ASC;
 	`
 
-	rows, err := db.Query(query, postID)
+	rows, err := db.Query(query, pq.Array(ids))
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var comments []CombinedComment
 	for rows.Next() {
 		var comment CombinedComment
 		if err := rows.Scan(
@@ -1410,9 +1674,9 @@ func getCommentsByPostID(db *sql.DB, postID int) ([]CombinedComment, error) {
 		); err != nil {
 			return nil, err
 		}
-		comments = append(comments, comment)
+		comments[comment.PostId] = append(comments[comment.PostId], comment)
 	}
-	return comments, nil
+	return comments, rows.Err()
 }
 
 
@@ -1438,6 +1702,11 @@ func createComment(db *sql.DB) http.HandlerFunc {
 		}
 		c.UserId = userIDInt
 
+		// The post comes from the URL, not the body
+		if postID, err := strconv.Atoi(mux.Vars(r)["post_id"]); err == nil {
+			c.PostId = postID
+		}
+
 		err = db.QueryRow(`
 			INSERT INTO comments (post_id, user_id, content, timestamp)
 			VALUES ($1, $2, $3, NOW()) RETURNING id`, c.PostId, c.UserId, c.Content).Scan(&c.Id)
@@ -1446,6 +1715,13 @@ func createComment(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		if err := notifyPostAuthor(db, notifyComment, c.UserId, c.PostId, &c.Id); err != nil {
+			log.Println("Notification error:", err)
+		}
+		if err := syncTextLinks(db, c.UserId, c.PostId, &c.Id, c.Content); err != nil {
+			log.Println("Database error:", err)
+		}
+
 		json.NewEncoder(w).Encode(c)
 	}
 }
@@ -1481,6 +1757,11 @@ func updateComment(db *sql.DB) http.HandlerFunc {
 		vars := mux.Vars(r)
 		id := vars["id"]
 
+		callerID, ok := authorizeOwner(w, r, db, id, commentOwner)
+		if !ok {
+			return
+		}
+
 		_, err := db.Exec(`
 			UPDATE comments 
 			SET content = $1, timestamp = NOW() 
@@ -1503,6 +1784,9 @@ func updateComment(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Comment not found after update", http.StatusNotFound)
 			return
 		}
+		if err := syncTextLinks(db, callerID, updatedComment.PostId, &updatedComment.Id, updatedComment.Content); err != nil {
+			log.Println("Database error:", err)
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(updatedComment)
@@ -1514,6 +1798,11 @@ func deleteComment(db *sql.DB) http.HandlerFunc {
 		vars := mux.Vars(r)
 		id := vars["id"]
 
+		// Comment authors and the owner of the post may remove a comment
+		if _, ok := authorizeOwner(w, r, db, id, commentOwner, commentModerator); !ok {
+			return
+		}
+
 		_, err := db.Exec("DELETE FROM comments WHERE id = $1", id)
 		if err != nil {
 			http.Error(w, "Failed to delete comment", http.StatusInternalServerError)
@@ -1524,7 +1813,7 @@ func deleteComment(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func uploadAvatar(supabaseClient *supabase.Client, db *sql.DB) http.HandlerFunc {
+func uploadAvatar(store BlobStore, db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Received avatar upload request")
 
@@ -1559,14 +1848,6 @@ func uploadAvatar(supabaseClient *supabase.Client, db *sql.DB) http.HandlerFunc
 
 		log.Println("Uploaded file:", handler.Filename)
 
-		ext := filepath.Ext(handler.Filename)
-		if ext == "" {
-			ext = ".png"
-		}
-
-		filePath := fmt.Sprintf("%d/profile%s", userIDInt, ext)
-		log.Println("Generated file path:", filePath)
-
 		fileBytes, err := io.ReadAll(file)
 		if err != nil {
 			log.Println("Error reading file bytes:", err)
@@ -1574,28 +1855,26 @@ func uploadAvatar(supabaseClient *supabase.Client, db *sql.DB) http.HandlerFunc
 			return
 		}
 
-		contentType := handler.Header.Get("Content-Type")
-		storageClient := supabaseClient.Storage
-		options := storage_go.FileOptions{ContentType: &contentType}
-
-		// Delete old file before uploading
-		log.Println("Attempting to delete existing avatar:", filePath)
-		_, err = storageClient.RemoveFile("avatars", []string{filePath})
+		ext, contentType, err := imageUpload(handler.Filename, fileBytes)
 		if err != nil {
-			log.Println("Warning: Failed to delete existing avatar (might not exist):", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		// Upload new file
-		_, err = storageClient.UploadFile("avatars", filePath, bytes.NewReader(fileBytes), options)
+		filePath := fmt.Sprintf("%d/profile%s", userIDInt, ext)
+		log.Println("Generated file path:", filePath)
+
+		// Upload new file, replacing any existing avatar at the same path
+		err = store.Put(r.Context(), avatarBucket, filePath, bytes.NewReader(fileBytes), contentType)
 		if err != nil {
-			log.Println("Error uploading to Supabase:", err)
+			log.Println("Error uploading avatar:", err)
 			http.Error(w, "Failed to upload avatar", http.StatusInternalServerError)
 			return
 		}
 		log.Println("File uploaded successfully")
 
 		// Get public URL
-		avatarURL := storageClient.GetPublicUrl("avatars", filePath).SignedURL
+		avatarURL := store.PublicURL(avatarBucket, filePath)
 		log.Println("Generated avatar URL:", avatarURL)
 
 		var updatedAvatar string
@@ -1613,11 +1892,28 @@ func uploadAvatar(supabaseClient *supabase.Client, db *sql.DB) http.HandlerFunc
 }
 
 
-func updateUserAvatar(db *sql.DB) http.HandlerFunc {
+// validateAvatarURL only accepts avatars served from our own avatars bucket,
+// so profiles can't be pointed at arbitrary third-party URLs. An empty URL
+// clears the avatar.
+func validateAvatarURL(store BlobStore, raw string) error {
+	if raw == "" {
+		return nil
+	}
+	if !isPublicBlobURL(store, avatarBucket, raw) {
+		return fmt.Errorf("avatar must be stored in the avatars bucket")
+	}
+	return nil
+}
+
+func updateUserAvatar(store BlobStore, db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		userID := vars["id"]
 
+		if _, ok := authorizeOwner(w, r, db, userID, userOwner); !ok {
+			return
+		}
+
 		var input struct {
 			Avatar string `json:"avatar"`
 		}
@@ -1626,6 +1922,11 @@ func updateUserAvatar(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		if err := validateAvatarURL(store, input.Avatar); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		_, err := db.Exec("UPDATE users SET avatar = $1 WHERE id = $2", input.Avatar, userID)
 		if err != nil {
 			log.Println("Failed to update avatar:", err)
@@ -2,21 +2,35 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"math"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 var testDB *sql.DB
+var testStore *localBlobStore
 
 // Set up once for all tests
 func TestMain(m *testing.M) {
+	// Tokens only need to verify within the test process
+	os.Setenv("JWT_DEV_RANDOM_KEY", "1")
+
 	var err error
 	testDB, err = sql.Open("postgres", os.Getenv("TEST_DATABASE_URL"))
 	if err != nil {
@@ -24,10 +38,24 @@ func TestMain(m *testing.M) {
 	}
 
 	// Reset database state before running tests
+	if err := migrateDown(context.Background(), testDB, 0); err != nil {
+		panic(err)
+	}
 	initializeDatabase(testDB)
 
+	// Uploads go to a throwaway directory
+	storeDir, err := os.MkdirTemp("", "divenet-blobs-*")
+	if err != nil {
+		panic(err)
+	}
+	testStore, err = newLocalBlobStore(storeDir, "http://localhost:8080")
+	if err != nil {
+		panic(err)
+	}
+
 	code := m.Run()
 
+	os.RemoveAll(storeDir)
 	testDB.Close()
 	os.Exit(code)
 }
@@ -39,20 +67,173 @@ func getTestRouter(db *sql.DB) http.Handler {
 	// Public endpoints
 	router.HandleFunc("/sign-up", handleSignUp(db)).Methods("POST")
 	router.HandleFunc("/login", handleLogin(db)).Methods("POST")
-	router.HandleFunc("/verify-token", handleVerifyToken()).Methods("POST")
+	router.HandleFunc("/verify-token", handleVerifyToken(db)).Methods("POST")
+	router.HandleFunc("/token/refresh", handleRefreshToken(db)).Methods("POST")
+	router.Handle("/logout", authMiddleware(db)(handleLogout(db))).Methods("POST")
+	router.Handle("/logout/all", authMiddleware(db)(handleLogoutAll(db))).Methods("POST")
+	router.Handle("/users/{id:[0-9]+}", authMiddleware(db)(updateUserAvatar(testStore, db))).Methods("PUT")
+
+	router.Handle("/api/go/events", queryTokenAuth(authMiddleware(db)(streamEvents(db, newEventHub(db))))).Methods("GET")
 
 	// Private endpoints
 	api := router.PathPrefix("/api/go").Subrouter()
 
-	api.Use(authMiddleware)
+	api.Use(authMiddleware(db))
 
 	api.HandleFunc("/users", getUsers(db)).Methods("GET")
-	api.HandleFunc("/users/{id:[0-9]+}", updateUser(db)).Methods("PUT")
+	api.HandleFunc("/users/nearby", getNearbyUsers(db)).Methods("GET")
+	api.HandleFunc("/users/{id:[0-9]+}", updateUser(testStore, db)).Methods("PUT")
 	api.HandleFunc("/users/{id:[0-9]+}", deleteUser(db)).Methods("DELETE")
+	api.HandleFunc("/users/{id:[0-9]+}", getUser(db)).Methods("GET")
+	api.HandleFunc("/users/{id:[0-9]+}/follow", followUser(db)).Methods("POST")
+	api.HandleFunc("/users/{id:[0-9]+}/follow", unfollowUser(db)).Methods("DELETE")
+	api.HandleFunc("/users/{id:[0-9]+}/followers", listFollows(db, true)).Methods("GET")
+	api.HandleFunc("/users/{id:[0-9]+}/following", listFollows(db, false)).Methods("GET")
+	api.HandleFunc("/feed", getFeed(db)).Methods("GET")
+	api.HandleFunc("/notifications", getNotifications(db)).Methods("GET")
+	api.HandleFunc("/notifications/unread-count", getUnreadNotificationCount(db)).Methods("GET")
+	api.HandleFunc("/notifications/read-all", markAllNotificationsRead(db)).Methods("POST")
+	api.HandleFunc("/notifications/{id:[0-9]+}/read", markNotificationRead(db)).Methods("POST")
+	api.HandleFunc("/hashtags/trending", getTrendingHashtags(db)).Methods("GET")
+	api.HandleFunc("/hashtags/{tag}/posts", getHashtagPosts(db)).Methods("GET")
+	api.HandleFunc("/search", searchAll(db)).Methods("GET")
+	api.HandleFunc("/conversations", getConversations(db)).Methods("GET")
+	api.HandleFunc("/conversations", createConversation(db)).Methods("POST")
+	api.HandleFunc("/conversations/unread-count", getUnreadMessageCount(db)).Methods("GET")
+	api.HandleFunc("/conversations/{id:[0-9]+}/messages", getMessages(db)).Methods("GET")
+	api.HandleFunc("/conversations/{id:[0-9]+}/messages", sendMessage(db)).Methods("POST")
+	api.HandleFunc("/conversations/{id:[0-9]+}/read", markConversationRead(db)).Methods("POST")
+	api.HandleFunc("/users/{id:[0-9]+}/block", blockUser(db)).Methods("POST")
+	api.HandleFunc("/users/{id:[0-9]+}/block", unblockUser(db)).Methods("DELETE")
+	api.HandleFunc("/trips", getTrips(db)).Methods("GET")
+	api.HandleFunc("/trips", createTrip(db)).Methods("POST")
+	api.HandleFunc("/trips/{id:[0-9]+}", getTrip(db)).Methods("GET")
+	api.HandleFunc("/trips/{id:[0-9]+}", updateTrip(db)).Methods("PUT")
+	api.HandleFunc("/trips/{id:[0-9]+}", deleteTrip(db)).Methods("DELETE")
+	api.HandleFunc("/trips/{id:[0-9]+}/rsvp", rsvpTrip(db)).Methods("POST")
+	api.HandleFunc("/trips/{id:[0-9]+}/rsvp", cancelRSVP(db)).Methods("DELETE")
+	api.HandleFunc("/trips/{id:[0-9]+}/attendees", getTripAttendees(db)).Methods("GET")
+	api.HandleFunc("/trips/{id:[0-9]+}/posts", getTripPosts(db)).Methods("GET")
+	api.HandleFunc("/trips/{id:[0-9]+}/posts/{post_id:[0-9]+}", linkTripPost(db)).Methods("PUT")
+	api.HandleFunc("/trips/{id:[0-9]+}/posts/{post_id:[0-9]+}", unlinkTripPost(db)).Methods("DELETE")
+
+	api.HandleFunc("/posts/search", getPosts(db)).Methods("POST")
+	api.HandleFunc("/posts", createPost(db)).Methods("POST")
+	api.HandleFunc("/posts/{id:[0-9]+}", getPost(db)).Methods("GET")
+	api.HandleFunc("/posts/{id:[0-9]+}", updatePost(db)).Methods("PUT")
+	api.HandleFunc("/posts/{id:[0-9]+}", deletePost(db)).Methods("DELETE")
+	api.HandleFunc("/posts/{post_id:[0-9]+}/comments", createComment(db)).Methods("POST")
+	api.HandleFunc("/posts/{post_id:[0-9]+}/likes", createLike(db)).Methods("POST")
+	api.HandleFunc("/posts/{post_id:[0-9]+}/likes", deleteLike(db)).Methods("DELETE")
+	api.HandleFunc("/comments/{id:[0-9]+}", updateComment(db)).Methods("PUT")
+	api.HandleFunc("/comments/{id:[0-9]+}", deleteComment(db)).Methods("DELETE")
+
+	api.HandleFunc("/sites", getSites(db)).Methods("GET")
+	api.HandleFunc("/sites", createSite(db)).Methods("POST")
+	api.HandleFunc("/sites/suggest", suggestSites(db)).Methods("GET")
+	api.HandleFunc("/sites/{id:[0-9]+}", getSite(db)).Methods("GET")
+	api.HandleFunc("/sites/{id:[0-9]+}", updateSite(db)).Methods("PUT")
+	api.HandleFunc("/sites/{id:[0-9]+}", deleteSite(db)).Methods("DELETE")
+	api.HandleFunc("/sites/{id:[0-9]+}/conditions", getSiteConditions(db)).Methods("GET")
+	api.HandleFunc("/posts/{id:[0-9]+}/samples", getDiveSamples(db)).Methods("GET")
+	api.HandleFunc("/posts/{id:[0-9]+}/samples", putDiveSamples(db)).Methods("PUT")
+	api.HandleFunc("/imports/uddf", importDiveLog(db, "uddf", parseUDDF)).Methods("POST")
+	api.HandleFunc("/imports/csv", importDiveLog(db, "csv", parseCSV)).Methods("POST")
+	api.HandleFunc("/exports/{format}", exportDives(db)).Methods("GET")
+
+	api.HandleFunc("/preferences", getPreferences(db)).Methods("GET")
+	api.HandleFunc("/preferences", createPreference(db)).Methods("POST")
+	api.HandleFunc("/preferences/{id:[0-9]+}", getPreference(db)).Methods("GET")
+	api.HandleFunc("/preferences/{id:[0-9]+}", updatePreference(db)).Methods("PUT")
+	api.HandleFunc("/preferences/{id:[0-9]+}", deletePreference(db)).Methods("DELETE")
 
 	return enableCORS(jsonContentTypeMiddleware(router))
 }
 
+// Helper to sign up a fresh user and return their token and id
+func signUpTestUser(t *testing.T, router http.Handler, email string) (string, string) {
+	t.Helper()
+
+	resp := signUpTestUserResponse(t, router, email)
+	return resp["token"], resp["userId"]
+}
+
+// Helper to sign up a fresh user and return the whole sign-up response
+func signUpTestUserResponse(t *testing.T, router http.Handler, email string) map[string]string {
+	t.Helper()
+
+	body, _ := json.Marshal(User{
+		FirstName: "Test",
+		LastName:  "Diver",
+		Email:     email,
+		Password:  "testpass123",
+		Age:       30,
+	})
+	req, _ := http.NewRequest("POST", "/sign-up", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK for sign-up of %s, got %d", email, rr.Code)
+	}
+
+	var resp map[string]string
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("Error decoding sign-up response: %v", err)
+	}
+	return resp
+}
+
+// Helper to exchange a refresh token, returning the status and response
+func refreshTestToken(router http.Handler, refreshToken string) (int, map[string]string) {
+	body, _ := json.Marshal(map[string]string{"refresh_token": refreshToken})
+	req, _ := http.NewRequest("POST", "/token/refresh", bytes.NewBuffer(body))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var resp map[string]string
+	json.NewDecoder(rr.Body).Decode(&resp)
+	return rr.Code, resp
+}
+
+// Helper to send an authenticated JSON request
+func doAuthRequest(router http.Handler, method, url, token string, payload interface{}) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	if payload != nil {
+		json.NewEncoder(&body).Encode(payload)
+	}
+	req, _ := http.NewRequest(method, url, &body)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// Helper to create a post as the given user and return its id
+func createTestPost(t *testing.T, router http.Handler, token string, post Post) int {
+	t.Helper()
+
+	if post.Date == "" {
+		post.Date = "2025-01-15"
+	}
+	rr := doAuthRequest(router, "POST", "/api/go/posts", token, post)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK creating post, got %d", rr.Code)
+	}
+
+	var created struct {
+		Id int `json:"id"`
+	}
+	json.NewDecoder(rr.Body).Decode(&created)
+	return created.Id
+}
+
 // ========== TESTS ==========
 
 func TestSignUpLoginUpdateAndDelete(t *testing.T) {
@@ -146,20 +327,1501 @@ func TestSignUpLoginUpdateAndDelete(t *testing.T) {
 }
 
 func TestGetUsersWithAuth(t *testing.T) {
-	// Get the JWT token from the environment (from the login test)
-	token := os.Getenv("JWT_TOKEN")
-	if token == "" {
-		t.Fatal("JWT token not set. Did the login test run successfully?")
-	}
+	router := getTestRouter(testDB) // Use the actual router with auth middleware
+
+	// The login test deletes its user, which revokes that user's sessions,
+	// so sign up a user of our own
+	token, _ := signUpTestUser(t, router, "getusers@example.com")
 
 	req, _ := http.NewRequest("GET", "/api/go/users", nil)
 	req.Header.Set("Authorization", "Bearer "+token) // Attach JWT token for auth
 
 	rr := httptest.NewRecorder()
-	router := getTestRouter(testDB) // Use the actual router with auth middleware
 	router.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK from authenticated route, got %d", rr.Code)
 	}
 }
+
+func TestPreferencesAreScopedToUser(t *testing.T) {
+	router := getTestRouter(testDB)
+	ownerToken, _ := signUpTestUser(t, router, "prefowner@example.com")
+	otherToken, _ := signUpTestUser(t, router, "prefother@example.com")
+
+	// Create a preference as the owner
+	createBody, _ := json.Marshal(Preference{DepthMin: 0, DepthMax: 30, MagnitudeMin: 1, MagnitudeMax: 5})
+	createReq, _ := http.NewRequest("POST", "/api/go/preferences", bytes.NewBuffer(createBody))
+	createReq.Header.Set("Authorization", "Bearer "+ownerToken)
+
+	createRR := httptest.NewRecorder()
+	router.ServeHTTP(createRR, createReq)
+	if createRR.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 Created for preference, got %d", createRR.Code)
+	}
+
+	var created Preference
+	if err := json.NewDecoder(createRR.Body).Decode(&created); err != nil {
+		t.Fatalf("Error decoding preference: %v", err)
+	}
+	prefURL := "/api/go/preferences/" + strconv.Itoa(created.Id)
+
+	// Without a time range the times are stored as NULL, not the zero time
+	var timesNull bool
+	testDB.QueryRow("SELECT time_start IS NULL AND time_end IS NULL FROM preferences WHERE id = $1", created.Id).Scan(&timesNull)
+	if !timesNull || created.TimeStart != nil || created.TimeEnd != nil {
+		t.Errorf("Expected an open time range to be NULL, got %v to %v", created.TimeStart, created.TimeEnd)
+	}
+
+	// The owner sees it in their list
+	listReq, _ := http.NewRequest("GET", "/api/go/preferences", nil)
+	listReq.Header.Set("Authorization", "Bearer "+ownerToken)
+
+	listRR := httptest.NewRecorder()
+	router.ServeHTTP(listRR, listReq)
+
+	var prefs []Preference
+	json.NewDecoder(listRR.Body).Decode(&prefs)
+	if len(prefs) != 1 || prefs[0].Id != created.Id {
+		t.Errorf("Expected owner to list 1 preference, got %v", prefs)
+	}
+
+	// Another user can neither read nor delete it
+	otherGetReq, _ := http.NewRequest("GET", prefURL, nil)
+	otherGetReq.Header.Set("Authorization", "Bearer "+otherToken)
+
+	otherGetRR := httptest.NewRecorder()
+	router.ServeHTTP(otherGetRR, otherGetReq)
+	if otherGetRR.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another user's preference, got %d", otherGetRR.Code)
+	}
+
+	otherDeleteReq, _ := http.NewRequest("DELETE", prefURL, nil)
+	otherDeleteReq.Header.Set("Authorization", "Bearer "+otherToken)
+
+	otherDeleteRR := httptest.NewRecorder()
+	router.ServeHTTP(otherDeleteRR, otherDeleteReq)
+	if otherDeleteRR.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting another user's preference, got %d", otherDeleteRR.Code)
+	}
+
+	// The owner can delete it
+	deleteReq, _ := http.NewRequest("DELETE", prefURL, nil)
+	deleteReq.Header.Set("Authorization", "Bearer "+ownerToken)
+
+	deleteRR := httptest.NewRecorder()
+	router.ServeHTTP(deleteRR, deleteReq)
+	if deleteRR.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 No Content deleting preference, got %d", deleteRR.Code)
+	}
+}
+
+func TestRefreshTokenRotationAndReuseDetection(t *testing.T) {
+	router := getTestRouter(testDB)
+	tokens := signUpTestUserResponse(t, router, "refresh@example.com")
+
+	// Rotating the refresh token yields a new pair
+	code, rotated := refreshTestToken(router, tokens["refresh_token"])
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200 OK refreshing token, got %d", code)
+	}
+	if rotated["refresh_token"] == "" || rotated["refresh_token"] == tokens["refresh_token"] {
+		t.Fatal("Expected a new refresh token after rotation")
+	}
+
+	// Replaying the old refresh token is rejected and kills the family
+	if code, _ := refreshTestToken(router, tokens["refresh_token"]); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 replaying a rotated refresh token, got %d", code)
+	}
+	if code, _ := refreshTestToken(router, rotated["refresh_token"]); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for the newest refresh token after reuse, got %d", code)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/go/users", nil)
+	req.Header.Set("Authorization", "Bearer "+rotated["token"])
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for access token of a revoked session, got %d", rr.Code)
+	}
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	router := getTestRouter(testDB)
+	tokens := signUpTestUserResponse(t, router, "logout@example.com")
+
+	logoutReq, _ := http.NewRequest("POST", "/logout", nil)
+	logoutReq.Header.Set("Authorization", "Bearer "+tokens["token"])
+
+	logoutRR := httptest.NewRecorder()
+	router.ServeHTTP(logoutRR, logoutReq)
+	if logoutRR.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 No Content for logout, got %d", logoutRR.Code)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/go/users", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens["token"])
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 after logout, got %d", rr.Code)
+	}
+
+	if code, _ := refreshTestToken(router, tokens["refresh_token"]); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 refreshing after logout, got %d", code)
+	}
+
+	// The frontend asks /verify-token whether the user is still logged in
+	verifyReq, _ := http.NewRequest("POST", "/verify-token", nil)
+	verifyReq.Header.Set("Authorization", "Bearer "+tokens["token"])
+
+	verifyRR := httptest.NewRecorder()
+	router.ServeHTTP(verifyRR, verifyReq)
+	if verifyRR.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 verifying a logged out token, got %d", verifyRR.Code)
+	}
+}
+
+func TestSidlessTokensStopAtCutoff(t *testing.T) {
+	router := getTestRouter(testDB)
+	_, userID := signUpTestUser(t, router, "sidless@example.com")
+
+	// A token minted before sessions existed
+	token, err := getKeyRing().sign(jwt.MapClaims{
+		"user_id": userID,
+		"email":   "sidless@example.com",
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+
+	defer func(cutoff time.Time) { sidlessTokenCutoff = cutoff }(sidlessTokenCutoff)
+	sidlessTokenCutoff = time.Now().Add(time.Hour)
+	if rr := doAuthRequest(router, "GET", "/api/go/users/"+userID, token, nil); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a sid-less token before the cutoff, got %d", rr.Code)
+	}
+
+	sidlessTokenCutoff = time.Now().Add(-time.Hour)
+	if rr := doAuthRequest(router, "GET", "/api/go/users/"+userID, token, nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a sid-less token after the cutoff, got %d", rr.Code)
+	}
+}
+
+func TestOwnershipIsEnforcedOnMutations(t *testing.T) {
+	router := getTestRouter(testDB)
+	ownerToken, ownerID := signUpTestUser(t, router, "owner@example.com")
+	otherToken, otherID := signUpTestUser(t, router, "intruder@example.com")
+
+	// The author comes from the token, not the body
+	otherIDInt, _ := strconv.Atoi(otherID)
+	postID := createTestPost(t, router, ownerToken, Post{Title: "Kelp forest", UserId: otherIDInt})
+	postURL := "/api/go/posts/" + strconv.Itoa(postID)
+
+	getRR := doAuthRequest(router, "GET", postURL, ownerToken, nil)
+	var post CombinedPost
+	json.NewDecoder(getRR.Body).Decode(&post)
+	if strconv.Itoa(post.UserId) != ownerID {
+		t.Errorf("Expected post author %s, got %d", ownerID, post.UserId)
+	}
+
+	if rr := doAuthRequest(router, "PUT", postURL, otherToken, Post{Title: "Hijacked", Date: "2025-01-15"}); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 updating another user's post, got %d", rr.Code)
+	}
+	if rr := doAuthRequest(router, "DELETE", postURL, otherToken, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 deleting another user's post, got %d", rr.Code)
+	}
+	if rr := doAuthRequest(router, "PUT", "/api/go/users/"+ownerID, otherToken, User{FirstName: "Hijacked"}); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 updating another user, got %d", rr.Code)
+	}
+	if rr := doAuthRequest(router, "DELETE", "/api/go/users/"+ownerID, otherToken, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 deleting another user, got %d", rr.Code)
+	}
+
+	// Comments: only the author may edit; the author or post owner may delete
+	commentRR := doAuthRequest(router, "POST", postURL+"/comments", otherToken, Comment{Content: "Nice dive"})
+	var comment Comment
+	json.NewDecoder(commentRR.Body).Decode(&comment)
+	commentURL := "/api/go/comments/" + strconv.Itoa(comment.Id)
+
+	if rr := doAuthRequest(router, "PUT", commentURL, ownerToken, Comment{Content: "Edited"}); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 editing another user's comment, got %d", rr.Code)
+	}
+	if rr := doAuthRequest(router, "DELETE", commentURL, ownerToken, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected post owner to delete a comment on their post, got %d", rr.Code)
+	}
+
+	if rr := doAuthRequest(router, "DELETE", postURL, ownerToken, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 deleting own post, got %d", rr.Code)
+	}
+}
+
+func TestUpdateUserAvatarRequiresOwner(t *testing.T) {
+	router := getTestRouter(testDB)
+	ownerToken, ownerID := signUpTestUser(t, router, "avatarowner@example.com")
+	otherToken, _ := signUpTestUser(t, router, "avatarother@example.com")
+
+	avatarURL := "/users/" + ownerID
+	valid := map[string]string{"avatar": testStore.PublicURL(avatarBucket, ownerID+"/profile.png")}
+
+	if rr := doAuthRequest(router, "PUT", avatarURL, "", valid); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for anonymous avatar update, got %d", rr.Code)
+	}
+	if rr := doAuthRequest(router, "PUT", avatarURL, otherToken, valid); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 updating another user's avatar, got %d", rr.Code)
+	}
+
+	foreign := map[string]string{"avatar": "https://evil.example.com/files/avatars/" + ownerID + "/profile.png"}
+	if rr := doAuthRequest(router, "PUT", avatarURL, ownerToken, foreign); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for avatar on a foreign host, got %d", rr.Code)
+	}
+
+	if rr := doAuthRequest(router, "PUT", avatarURL, ownerToken, valid); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 updating own avatar, got %d", rr.Code)
+	}
+
+	// The profile update can't bypass the check, but may send the current
+	// avatar back unchanged
+	profileURL := "/api/go/users/" + ownerID
+	profile := User{FirstName: "Test", LastName: "Diver", Email: "avatarowner@example.com", Avatar: foreign["avatar"]}
+	if rr := doAuthRequest(router, "PUT", profileURL, ownerToken, profile); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a foreign avatar in a profile update, got %d", rr.Code)
+	}
+	profile.Avatar = valid["avatar"]
+	if rr := doAuthRequest(router, "PUT", profileURL, ownerToken, profile); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a profile update keeping the avatar, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestSearchPostsByRadius(t *testing.T) {
+	router := getTestRouter(testDB)
+	token, userID := signUpTestUser(t, router, "geosearch@example.com")
+	userIDInt, _ := strconv.Atoi(userID)
+
+	// Two dives around La Jolla Cove a few hundred meters apart, one in Cozumel
+	nearID := createTestPost(t, router, token, Post{Title: "Cove", Latitude: 32.8503, Longitude: -117.2713})
+	nextID := createTestPost(t, router, token, Post{Title: "Canyon", Latitude: 32.8530, Longitude: -117.2600})
+	createTestPost(t, router, token, Post{Title: "Palancar", Latitude: 20.3356, Longitude: -87.0286})
+
+	rr := doAuthRequest(router, "POST", "/api/go/posts/search", token, map[string]interface{}{
+		"user_id":   userIDInt,
+		"latitude":  32.8500,
+		"longitude": -117.2710,
+		"radius_km": 5,
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK for radius search, got %d", rr.Code)
+	}
+
+	var page postSearchPage
+	json.NewDecoder(rr.Body).Decode(&page)
+	posts := page.Posts
+	if len(posts) != 2 || posts[0].Id != nearID || posts[1].Id != nextID {
+		t.Fatalf("Expected the two La Jolla dives nearest first, got %+v", posts)
+	}
+	if posts[0].DistanceKm == nil || *posts[0].DistanceKm > *posts[1].DistanceKm {
+		t.Errorf("Expected ascending distance_km on results")
+	}
+}
+
+func TestSearchPostsPaginatesWithCursor(t *testing.T) {
+	router := getTestRouter(testDB)
+	token, userID := signUpTestUser(t, router, "pagination@example.com")
+	userIDInt, _ := strconv.Atoi(userID)
+
+	depths := []float64{12, 30, 5, 30, 18}
+	for i, depth := range depths {
+		createTestPost(t, router, token, Post{Title: "Dive " + strconv.Itoa(i), Depth: depth})
+	}
+
+	// Walk the deepest-first order two posts at a time
+	var seen []CombinedPost
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		rr := doAuthRequest(router, "POST", "/api/go/posts/search", token, map[string]interface{}{
+			"user_id": userIDInt,
+			"sort":    "deepest",
+			"limit":   2,
+			"cursor":  cursor,
+		})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200 OK for page %d, got %d", pages, rr.Code)
+		}
+
+		var page postSearchPage
+		json.NewDecoder(rr.Body).Decode(&page)
+		if len(page.Posts) > 2 {
+			t.Fatalf("Expected at most 2 posts per page, got %d", len(page.Posts))
+		}
+		seen = append(seen, page.Posts...)
+
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if len(seen) != len(depths) {
+		t.Fatalf("Expected %d posts across pages, got %d", len(depths), len(seen))
+	}
+	for i := 1; i < len(seen); i++ {
+		if seen[i].Depth > seen[i-1].Depth || (seen[i].Depth == seen[i-1].Depth && seen[i].Id > seen[i-1].Id) {
+			t.Errorf("Posts out of order at %d: %v then %v", i, seen[i-1].Depth, seen[i].Depth)
+		}
+	}
+
+	if rr := doAuthRequest(router, "POST", "/api/go/posts/search", token, map[string]interface{}{"limit": 1000}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an oversized page, got %d", rr.Code)
+	}
+}
+
+func TestCreatePostIgnoresClientTimestamp(t *testing.T) {
+	router := getTestRouter(testDB)
+	token, _ := signUpTestUser(t, router, "futuredate@example.com")
+
+	// A post dated into the future would stay on top of "newest"
+	postID := createTestPost(t, router, token, Post{Title: "Pinned", Timestamp: time.Now().AddDate(1, 0, 0)})
+
+	var post CombinedPost
+	json.NewDecoder(doAuthRequest(router, "GET", "/api/go/posts/"+strconv.Itoa(postID), token, nil).Body).Decode(&post)
+	if d := time.Since(post.Timestamp); d < -time.Minute || d > time.Minute {
+		t.Errorf("Expected the post to be stamped now, got %v", post.Timestamp)
+	}
+}
+
+func TestUpdatePostKeepsTimestamp(t *testing.T) {
+	router := getTestRouter(testDB)
+	token, _ := signUpTestUser(t, router, "timestamp@example.com")
+	postID := createTestPost(t, router, token, Post{Title: "Morning dive", Depth: 10})
+	postURL := "/api/go/posts/" + strconv.Itoa(postID)
+
+	var before CombinedPost
+	json.NewDecoder(doAuthRequest(router, "GET", postURL, token, nil).Body).Decode(&before)
+
+	// The client doesn't send a timestamp on edits
+	if rr := doAuthRequest(router, "PUT", postURL, token, Post{Title: "Morning dive, edited", Date: "2025-01-15", Depth: 12}); rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 updating own post, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var after CombinedPost
+	json.NewDecoder(doAuthRequest(router, "GET", postURL, token, nil).Body).Decode(&after)
+	if after.Title != "Morning dive, edited" {
+		t.Errorf("Expected the title to be updated, got %q", after.Title)
+	}
+	if !after.Timestamp.Equal(before.Timestamp) {
+		t.Errorf("Expected timestamp %v to survive the update, got %v", before.Timestamp, after.Timestamp)
+	}
+}
+
+func TestDiveLogFieldsAreStoredAndFilterable(t *testing.T) {
+	router := getTestRouter(testDB)
+	token, userID := signUpTestUser(t, router, "divelog@example.com")
+	userIDInt, _ := strconv.Atoi(userID)
+
+	nitrox := Post{Title: "Nitrox wreck dive", Depth: 28}
+	nitrox.BottomTime = intPtr(42)
+	nitrox.GasMix = "nitrox"
+	nitrox.O2Percent = float64Ptr(32)
+	nitrox.EntryType = "boat"
+	nitroxID := createTestPost(t, router, token, nitrox)
+
+	air := Post{Title: "Shore dive", Depth: 8}
+	air.GasMix = "air"
+	air.EntryType = "shore"
+	createTestPost(t, router, token, air)
+
+	bad := Post{Title: "Bad mix", Date: "2025-01-15"}
+	bad.GasMix = "nitrox"
+	bad.O2Percent = float64Ptr(10)
+	if rr := doAuthRequest(router, "POST", "/api/go/posts", token, bad); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid gas mix, got %d", rr.Code)
+	}
+
+	rr := doAuthRequest(router, "POST", "/api/go/posts/search", token, map[string]interface{}{
+		"user_id":   userIDInt,
+		"gas_mix":   "nitrox",
+		"depth_min": 20,
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK for search, got %d", rr.Code)
+	}
+	var page postSearchPage
+	json.NewDecoder(rr.Body).Decode(&page)
+	if len(page.Posts) != 1 || page.Posts[0].Id != nitroxID {
+		t.Fatalf("Expected only the nitrox dive, got %+v", page.Posts)
+	}
+	if got := page.Posts[0]; got.BottomTime == nil || *got.BottomTime != 42 || got.O2Percent == nil || *got.O2Percent != 32 || got.EntryType != "boat" {
+		t.Errorf("Expected dive-log fields to round-trip, got %+v", got.DiveLog)
+	}
+}
+
+func TestImportUDDFReportsDuplicates(t *testing.T) {
+	router := getTestRouter(testDB)
+	token, _ := signUpTestUser(t, router, "uddf@example.com")
+
+	// A dive typed in by hand that the file also contains
+	manualID := createTestPost(t, router, token, Post{Title: "Cove", Date: "2024-06-01", Depth: 9})
+
+	data, err := os.ReadFile("testdata/sample.uddf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", "/api/go/imports/uddf", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK for import, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var report importReport
+	json.NewDecoder(rr.Body).Decode(&report)
+	if report.Imported != 1 || report.Duplicates != 1 || report.Invalid != 1 {
+		t.Fatalf("Expected 1 imported, 1 duplicate and 1 invalid dive, got %+v", report)
+	}
+	if report.Dives[1].DuplicateOf != manualID {
+		t.Errorf("Expected dive 102 to duplicate post %d, got %+v", manualID, report.Dives[1])
+	}
+
+	rr = doAuthRequest(router, "GET", "/api/go/posts/"+strconv.Itoa(report.Dives[0].PostId), token, nil)
+	var post CombinedPost
+	json.NewDecoder(rr.Body).Decode(&post)
+	if post.Title != "La Jolla Cove" || post.GasMix != "nitrox" || post.Date.Hour() != 9 {
+		t.Errorf("Expected the imported dive with its time, got %+v", post)
+	}
+
+	// Importing the same file again creates nothing
+	req, _ = http.NewRequest("POST", "/api/go/imports/uddf", bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	json.NewDecoder(rr.Body).Decode(&report)
+	if report.Imported != 0 || report.Duplicates != 2 {
+		t.Errorf("Expected a re-import to find only duplicates, got %+v", report)
+	}
+}
+
+func TestImportCSVDryRunWritesNothing(t *testing.T) {
+	router := getTestRouter(testDB)
+	token, userID := signUpTestUser(t, router, "csv@example.com")
+	userIDInt, _ := strconv.Atoi(userID)
+
+	csvData := "date,time,title,depth,description\n2024-07-01,10:00,Cove,12,Seahorses #cove\n2024-07-01,10:05,Cove again,12,\n2024-07-02,09:00,Canyon,30,#canyon wall\n"
+	importCSV := func(dryRun string) importReport {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "log.csv")
+		part.Write([]byte(csvData))
+		form.WriteField("dry_run", dryRun)
+		form.Close()
+
+		req, _ := http.NewRequest("POST", "/api/go/imports/csv", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200 OK for import, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var report importReport
+		json.NewDecoder(rr.Body).Decode(&report)
+		return report
+	}
+	countPosts := func() int {
+		var n int
+		testDB.QueryRow("SELECT COUNT(*) FROM posts WHERE user_id = $1", userIDInt).Scan(&n)
+		return n
+	}
+	countHashtags := func() int {
+		var n int
+		testDB.QueryRow("SELECT COUNT(*) FROM hashtags h JOIN posts p ON p.id = h.post_id WHERE p.user_id = $1", userIDInt).Scan(&n)
+		return n
+	}
+
+	// The second row starts five minutes after the first, so it is the same dive
+	report := importCSV("true")
+	if !report.DryRun || report.Imported != 2 || report.Duplicates != 1 || report.Dives[0].PostId != 0 {
+		t.Errorf("Expected a dry run of 2 new dives and 1 duplicate, got %+v", report)
+	}
+	if n := countPosts(); n != 0 || countHashtags() != 0 {
+		t.Fatalf("Expected a dry run to write nothing, found %d posts", n)
+	}
+
+	report = importCSV("false")
+	if report.DryRun || report.Imported != 2 || report.Dives[0].PostId == 0 {
+		t.Errorf("Expected 2 imported dives, got %+v", report)
+	}
+	if n := countPosts(); n != 2 {
+		t.Errorf("Expected 2 posts after import, found %d", n)
+	}
+	if n := countHashtags(); n != 2 {
+		t.Errorf("Expected the imported descriptions' 2 hashtags, found %d", n)
+	}
+}
+
+func TestDiveSamplesUploadAndDownsample(t *testing.T) {
+	router := getTestRouter(testDB)
+	ownerToken, _ := signUpTestUser(t, router, "samples-owner@example.com")
+	otherToken, _ := signUpTestUser(t, router, "samples-other@example.com")
+	postID := createTestPost(t, router, ownerToken, Post{Title: "Profiled dive", Depth: 18})
+	url := "/api/go/posts/" + strconv.Itoa(postID) + "/samples"
+
+	samples := make([]diveSample, 0, 300)
+	for i := 0; i < 300; i++ {
+		depth := 18.0
+		if i < 30 {
+			depth = float64(i) * 0.6
+		}
+		samples = append(samples, diveSample{Time: i * 10, Depth: depth})
+	}
+
+	if rr := doAuthRequest(router, "PUT", url, otherToken, map[string]interface{}{"samples": samples}); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 uploading samples to another user's post, got %d", rr.Code)
+	}
+	rr := doAuthRequest(router, "PUT", url, ownerToken, map[string]interface{}{"samples": samples})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK uploading samples, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = doAuthRequest(router, "GET", url+"?points=50", otherToken, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK fetching samples, got %d", rr.Code)
+	}
+	var profile diveProfile
+	json.NewDecoder(rr.Body).Decode(&profile)
+	if profile.Total != 300 || len(profile.Samples) != 50 {
+		t.Errorf("Expected 50 of 300 samples, got %d of %d", len(profile.Samples), profile.Total)
+	}
+	if profile.Stats == nil || profile.Stats.MaxDepth != 18 || profile.Stats.Duration != 2990 {
+		t.Errorf("Expected stats over the full profile, got %+v", profile.Stats)
+	}
+}
+
+func TestExportRoundTripsThroughImport(t *testing.T) {
+	router := getTestRouter(testDB)
+	token, _ := signUpTestUser(t, router, "export@example.com")
+	importer, _ := signUpTestUser(t, router, "export-import@example.com")
+
+	data, err := os.ReadFile("testdata/sample.uddf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", "/api/go/imports/uddf", bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	export := func(path string) *httptest.ResponseRecorder {
+		rr := doAuthRequest(router, "GET", "/api/go/exports/"+path, token, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200 OK exporting %s, got %d: %s", path, rr.Code, rr.Body.String())
+		}
+		return rr
+	}
+
+	// Only the first dive has a location
+	var collection struct {
+		Features []geoJSONFeature `json:"features"`
+	}
+	json.NewDecoder(export("geojson").Body).Decode(&collection)
+	if len(collection.Features) != 1 || collection.Features[0].Properties.GasMix != "nitrox" {
+		t.Errorf("Expected one located nitrox dive, got %+v", collection.Features)
+	}
+
+	rr := export("csv?depth_min=10")
+	if lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n"); len(lines) != 2 {
+		t.Errorf("Expected a header and one dive deeper than 10m, got %q", rr.Body.String())
+	}
+
+	// Both exports import back as the same dives
+	for _, format := range []string{"csv", "uddf"} {
+		body := export(format).Body.Bytes()
+		req, _ := http.NewRequest("POST", "/api/go/imports/"+format+"?dry_run=true", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+importer)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var report importReport
+		json.NewDecoder(rr.Body).Decode(&report)
+		if report.Imported != 2 || report.Invalid != 0 || report.Dives[0].Title != "La Jolla Cove" {
+			t.Errorf("Expected the %s export to import as 2 dives, got %d: %+v", format, rr.Code, report)
+		}
+	}
+
+	// Bounding box filters work in every format
+	for _, format := range []string{"csv", "geojson", "gpx", "uddf"} {
+		rr := export(format + "?latitude_min=32&latitude_max=33&longitude_min=-118&longitude_max=-117")
+		if !strings.Contains(rr.Body.String(), "La Jolla Cove") {
+			t.Errorf("Expected the dive inside the box in the %s export, got %q", format, rr.Body.String())
+		}
+	}
+	if rr := export("csv?latitude_min=40&longitude_max=-117"); strings.Contains(rr.Body.String(), "La Jolla Cove") {
+		t.Errorf("Expected no dives north of the box, got %q", rr.Body.String())
+	}
+
+	if rr := doAuthRequest(router, "GET", "/api/go/exports/kml", token, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown format, got %d", rr.Code)
+	}
+}
+
+func TestDiveSitesDeduplicateAndAggregate(t *testing.T) {
+	router := getTestRouter(testDB)
+	ownerToken, _ := signUpTestUser(t, router, "sites-owner@example.com")
+	otherToken, _ := signUpTestUser(t, router, "sites-other@example.com")
+
+	createSite := func(token string, site DiveSite) *httptest.ResponseRecorder {
+		return doAuthRequest(router, "POST", "/api/go/sites", token, site)
+	}
+	rr := createSite(ownerToken, DiveSite{Name: "Blue Hole", Latitude: 17.3159, Longitude: -87.5350, Aliases: []string{"Great Blue Hole", " "}})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 creating a site, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var site DiveSite
+	json.NewDecoder(rr.Body).Decode(&site)
+	if len(site.Aliases) != 1 {
+		t.Errorf("Expected the blank alias to be dropped, got %q", site.Aliases)
+	}
+
+	// 50m away, or 300m away under one of its names, is the same site
+	if rr := createSite(otherToken, DiveSite{Name: "The Hole", Latitude: 17.3163, Longitude: -87.5350}); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a site 50m away, got %d", rr.Code)
+	}
+	if rr := createSite(otherToken, DiveSite{Name: "great blue hole", Latitude: 17.3186, Longitude: -87.5350}); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a site named like an alias nearby, got %d", rr.Code)
+	}
+	if rr := createSite(otherToken, DiveSite{Name: "Lighthouse Wall", Latitude: 17.3186, Longitude: -87.5350}); rr.Code != http.StatusCreated {
+		t.Errorf("Expected 201 for a differently named site 300m away, got %d", rr.Code)
+	}
+
+	// A post close to the site gets it suggested
+	rr = doAuthRequest(router, "POST", "/api/go/posts", otherToken,
+		Post{Title: "Unlinked", Date: "2025-03-01", Latitude: 17.3160, Longitude: -87.5351, Depth: 30, Rating: 3})
+	var created struct {
+		Id            int       `json:"id"`
+		SuggestedSite *DiveSite `json:"suggested_site"`
+	}
+	json.NewDecoder(rr.Body).Decode(&created)
+	if created.SuggestedSite == nil || created.SuggestedSite.Id != site.Id {
+		t.Errorf("Expected the Blue Hole to be suggested, got %+v", created.SuggestedSite)
+	}
+
+	if rr := doAuthRequest(router, "POST", "/api/go/posts", ownerToken, Post{Title: "Nowhere", Date: "2025-03-01", SiteId: intPtr(999999)}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 linking a post to a missing site, got %d", rr.Code)
+	}
+	linked := createTestPost(t, router, ownerToken, Post{Title: "Linked", Date: "2025-03-02", Depth: 40, Rating: 5, SiteId: &site.Id})
+	createTestPost(t, router, otherToken, Post{Title: "Linked too", Date: "2025-03-03", Depth: 30, Rating: 4, SiteId: &site.Id})
+
+	rr = doAuthRequest(router, "GET", "/api/go/sites/"+strconv.Itoa(site.Id), otherToken, nil)
+	var detail siteDetail
+	json.NewDecoder(rr.Body).Decode(&detail)
+	if detail.Stats.Dives != 2 || detail.Stats.Divers != 2 || detail.Stats.MaxDepth == nil || *detail.Stats.MaxDepth != 40 {
+		t.Errorf("Expected stats over both linked posts, got %+v", detail.Stats)
+	}
+	if detail.Stats.AvgRating == nil || *detail.Stats.AvgRating != 4.5 || len(detail.RecentPosts) != 2 || detail.RecentPosts[0].Title != "Linked too" {
+		t.Errorf("Expected the linked posts newest first, got %+v %+v", detail.Stats, detail.RecentPosts)
+	}
+
+	rr = doAuthRequest(router, "POST", "/api/go/posts/search", ownerToken, postSearchFilters{SiteID: site.Id})
+	var page postSearchPage
+	json.NewDecoder(rr.Body).Decode(&page)
+	if len(page.Posts) != 2 {
+		t.Errorf("Expected 2 posts searching by site, got %d", len(page.Posts))
+	}
+
+	// Only the creator may change the site
+	site.Description = "Famous sinkhole"
+	if rr := doAuthRequest(router, "PUT", "/api/go/sites/"+strconv.Itoa(site.Id), otherToken, site); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 updating someone else's site, got %d", rr.Code)
+	}
+	if rr := doAuthRequest(router, "PUT", "/api/go/sites/"+strconv.Itoa(site.Id), ownerToken, site); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 updating own site, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := doAuthRequest(router, "DELETE", "/api/go/sites/"+strconv.Itoa(site.Id), ownerToken, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 deleting a site, got %d", rr.Code)
+	}
+	rr = doAuthRequest(router, "GET", "/api/go/posts/"+strconv.Itoa(linked), ownerToken, nil)
+	var post CombinedPost
+	json.NewDecoder(rr.Body).Decode(&post)
+	if post.SiteId != nil {
+		t.Errorf("Expected the post to be unlinked from the deleted site, got site %d", *post.SiteId)
+	}
+}
+
+func TestSiteConditionsFollowNewPosts(t *testing.T) {
+	router := getTestRouter(testDB)
+	token, _ := signUpTestUser(t, router, "conditions@example.com")
+
+	rr := doAuthRequest(router, "POST", "/api/go/sites", token, DiveSite{Name: "Casino Point", Latitude: 33.3485, Longitude: -118.3252})
+	var site DiveSite
+	json.NewDecoder(rr.Body).Decode(&site)
+	url := "/api/go/sites/" + strconv.Itoa(site.Id) + "/conditions?days=30"
+
+	daysAgo := func(n int) string { return time.Now().AddDate(0, 0, -n).Format("2006-01-02") }
+	createTestPost(t, router, token, Post{Title: "Murky", Date: daysAgo(45), Visibility: 4, Rating: 2, SiteId: &site.Id})
+	createTestPost(t, router, token, Post{Title: "Clear", Date: daysAgo(5), Visibility: 15, Rating: 5, SiteId: &site.Id})
+
+	getConditions := func() siteConditions {
+		rr := doAuthRequest(router, "GET", url, token, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200 OK for conditions, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var c siteConditions
+		json.NewDecoder(rr.Body).Decode(&c)
+		return c
+	}
+
+	c := getConditions()
+	if len(c.Recent) != 1 || c.Recent[0].Visibility == nil || *c.Recent[0].Visibility != 15 {
+		t.Errorf("Expected one recent report, got %+v", c.Recent)
+	}
+	if c.Trend.Visibility != "improving" || c.Trend.Rating != "improving" {
+		t.Errorf("Expected improving conditions, got %+v", c.Trend)
+	}
+	if len(c.Months) == 0 {
+		t.Error("Expected monthly averages")
+	}
+
+	// A new post at the site replaces the cached conditions
+	createTestPost(t, router, token, Post{Title: "Clear again", Date: daysAgo(1), Visibility: 13, SiteId: &site.Id})
+	if c := getConditions(); len(c.Recent) != 2 {
+		t.Errorf("Expected the new post in the recent reports, got %+v", c.Recent)
+	}
+
+	// So does a change made by another server instance, which never
+	// touches this one's cache
+	if _, err := testDB.Exec("UPDATE posts SET visibility = 2 WHERE site_id = $1 AND title = 'Clear again'", site.Id); err != nil {
+		t.Fatalf("Error updating post: %v", err)
+	}
+	if c := getConditions(); len(c.Recent) != 2 || c.Recent[0].Visibility == nil || *c.Recent[0].Visibility != 2 {
+		t.Errorf("Expected the edited visibility in the recent reports, got %+v", c.Recent)
+	}
+
+	if rr := doAuthRequest(router, "GET", "/api/go/sites/999999/conditions", token, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing site, got %d", rr.Code)
+	}
+}
+
+func TestFollowsAndFeed(t *testing.T) {
+	router := getTestRouter(testDB)
+	aliceToken, aliceID := signUpTestUser(t, router, "feed-alice@example.com")
+	bobToken, bobID := signUpTestUser(t, router, "feed-bob@example.com")
+	carolToken, carolID := signUpTestUser(t, router, "feed-carol@example.com")
+
+	for _, id := range []string{bobID, carolID} {
+		if rr := doAuthRequest(router, "POST", "/api/go/users/"+id+"/follow", aliceToken, nil); rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected 204 No Content for follow, got %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+	// Following twice is harmless; following yourself is not allowed
+	if rr := doAuthRequest(router, "POST", "/api/go/users/"+bobID+"/follow", aliceToken, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 No Content for a repeated follow, got %d", rr.Code)
+	}
+	if rr := doAuthRequest(router, "POST", "/api/go/users/"+aliceID+"/follow", aliceToken, nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 Bad Request for a self-follow, got %d", rr.Code)
+	}
+	if rr := doAuthRequest(router, "POST", "/api/go/users/999999/follow", aliceToken, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 Not Found for a missing user, got %d", rr.Code)
+	}
+
+	rr := doAuthRequest(router, "GET", "/api/go/users/"+bobID, aliceToken, nil)
+	var bob User
+	json.NewDecoder(rr.Body).Decode(&bob)
+	if bob.FollowerCount != 1 || bob.Following == nil || !*bob.Following {
+		t.Errorf("Expected bob to have one follower, followed by the caller, got %+v", bob)
+	}
+
+	rr = doAuthRequest(router, "GET", "/api/go/users/"+aliceID+"/following?limit=1", aliceToken, nil)
+	var page followPage
+	json.NewDecoder(rr.Body).Decode(&page)
+	if len(page.Users) != 1 || page.NextCursor == "" {
+		t.Fatalf("Expected one followee and a cursor, got %+v", page)
+	}
+	rr = doAuthRequest(router, "GET", "/api/go/users/"+aliceID+"/following?limit=1&cursor="+page.NextCursor, aliceToken, nil)
+	var next followPage
+	json.NewDecoder(rr.Body).Decode(&next)
+	if len(next.Users) != 1 || next.NextCursor != "" || next.Users[0].Id == page.Users[0].Id {
+		t.Errorf("Expected the other followee on the last page, got %+v", next)
+	}
+
+	createTestPost(t, router, aliceToken, Post{Title: "Own dive", Date: "2024-03-01"})
+	createTestPost(t, router, bobToken, Post{Title: "Bob's dive", Date: "2024-03-02"})
+	createTestPost(t, router, carolToken, Post{Title: "Carol's dive", Date: "2024-03-03"})
+	daveToken, _ := signUpTestUser(t, router, "feed-dave@example.com")
+	createTestPost(t, router, daveToken, Post{Title: "Stranger's dive", Date: "2024-03-04"})
+
+	// Unfollowing carol drops her posts from the feed
+	if rr := doAuthRequest(router, "DELETE", "/api/go/users/"+carolID+"/follow", aliceToken, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 No Content for unfollow, got %d", rr.Code)
+	}
+
+	var titles []string
+	url := "/api/go/feed?limit=1"
+	for {
+		rr := doAuthRequest(router, "GET", url, aliceToken, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200 OK for the feed, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var feed postSearchPage
+		json.NewDecoder(rr.Body).Decode(&feed)
+		for _, p := range feed.Posts {
+			titles = append(titles, p.Title)
+		}
+		if feed.NextCursor == "" {
+			break
+		}
+		url = "/api/go/feed?limit=1&cursor=" + feed.NextCursor
+	}
+	if strings.Join(titles, ",") != "Bob's dive,Own dive" {
+		t.Errorf("Expected bob's post then alice's own, newest first, got %v", titles)
+	}
+}
+
+func TestNotificationsCoalesceAndMarkRead(t *testing.T) {
+	router := getTestRouter(testDB)
+	authorToken, authorID := signUpTestUser(t, router, "notify-author@example.com")
+	postID := createTestPost(t, router, authorToken, Post{Title: "Popular dive", Date: "2024-05-01"})
+	likeURL := "/api/go/posts/" + strconv.Itoa(postID) + "/likes"
+
+	// Three likes, one taken back, a comment and a follow
+	var fanTokens []string
+	for _, email := range []string{"notify-maya@example.com", "notify-tom@example.com", "notify-ana@example.com"} {
+		token, _ := signUpTestUser(t, router, email)
+		fanTokens = append(fanTokens, token)
+		if rr := doAuthRequest(router, "POST", likeURL, token, nil); rr.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 Created for like, got %d", rr.Code)
+		}
+	}
+	doAuthRequest(router, "DELETE", likeURL, fanTokens[2], nil)
+	doAuthRequest(router, "POST", "/api/go/posts/"+strconv.Itoa(postID)+"/comments", fanTokens[0], Comment{Content: "Great dive!"})
+	doAuthRequest(router, "POST", "/api/go/users/"+authorID+"/follow", fanTokens[1], nil)
+	// Liking your own post is not news
+	doAuthRequest(router, "POST", likeURL, authorToken, nil)
+
+	getPage := func() notificationPage {
+		rr := doAuthRequest(router, "GET", "/api/go/notifications", authorToken, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200 OK for notifications, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var page notificationPage
+		json.NewDecoder(rr.Body).Decode(&page)
+		return page
+	}
+
+	page := getPage()
+	if page.UnreadCount != 3 || len(page.Notifications) != 3 {
+		t.Fatalf("Expected three unread notification groups, got %+v", page)
+	}
+	byType := map[string]notification{}
+	for _, n := range page.Notifications {
+		byType[n.Type] = n
+	}
+	if like := byType[notifyLike]; like.ActorCount != 2 || like.Read {
+		t.Errorf("Expected an unread like from two users, got %+v", like)
+	}
+	if page.Notifications[0].Type != notifyFollow {
+		t.Errorf("Expected the follow first, got %+v", page.Notifications[0])
+	}
+
+	if rr := doAuthRequest(router, "POST", "/api/go/notifications/"+strconv.Itoa(byType[notifyLike].Id)+"/read", authorToken, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 No Content for mark read, got %d", rr.Code)
+	}
+	// Somebody else can't see or mark the author's notifications
+	if rr := doAuthRequest(router, "POST", "/api/go/notifications/"+strconv.Itoa(byType[notifyLike].Id)+"/read", fanTokens[0], nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 Not Found for another user's notification, got %d", rr.Code)
+	}
+	if page := getPage(); page.UnreadCount != 2 {
+		t.Errorf("Expected two unread groups after marking the likes read, got %d", page.UnreadCount)
+	}
+
+	doAuthRequest(router, "POST", "/api/go/notifications/read-all", authorToken, nil)
+	rr := doAuthRequest(router, "GET", "/api/go/notifications/unread-count", authorToken, nil)
+	var count map[string]int
+	json.NewDecoder(rr.Body).Decode(&count)
+	if count["unread_count"] != 0 {
+		t.Errorf("Expected no unread notifications after read-all, got %v", count)
+	}
+}
+
+func TestEventStreamReplaysMissedEvents(t *testing.T) {
+	router := getTestRouter(testDB)
+	authorToken, _ := signUpTestUser(t, router, "stream-author@example.com")
+	fanToken, _ := signUpTestUser(t, router, "stream-fan@example.com")
+	postID := createTestPost(t, router, authorToken, Post{Title: "Watched dive", Date: "2024-06-01"})
+
+	var lastID int64
+	testDB.QueryRow("SELECT COALESCE(MAX(id), 0) FROM stream_events").Scan(&lastID)
+
+	doAuthRequest(router, "POST", "/api/go/posts/"+strconv.Itoa(postID)+"/comments", fanToken, Comment{Content: "Nice!"})
+	doAuthRequest(router, "POST", "/api/go/posts/"+strconv.Itoa(postID)+"/likes", fanToken, nil)
+
+	// The author reconnects through EventSource, which sends the token in
+	// the query and the last event it saw as Last-Event-ID
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("GET", "/api/go/events?posts="+strconv.Itoa(postID)+"&access_token="+authorToken, nil).WithContext(ctx)
+	req.Header.Set("Last-Event-ID", strconv.FormatInt(lastID, 10))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d %q: %s", rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+	body := rr.Body.String()
+	for _, event := range []string{"event: comment", "event: likes", "event: notification"} {
+		if !strings.Contains(body, event) {
+			t.Errorf("Expected %q in the replay, got %s", event, body)
+		}
+	}
+
+	// A stranger watching the post sees its comments but not the author's notifications
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req = httptest.NewRequest("GET", "/api/go/events?posts="+strconv.Itoa(postID)+"&last_event_id="+strconv.FormatInt(lastID, 10), nil).WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+fanToken)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if body := rr.Body.String(); !strings.Contains(body, "event: comment") || strings.Contains(body, "event: notification") {
+		t.Errorf("Expected only post events for another user, got %s", body)
+	}
+}
+
+func TestDefaultUsernamesAreMentionable(t *testing.T) {
+	for _, c := range []struct{ first, last, want string }{
+		{"Maya", "Lopez", "maya.lopez"},
+		{"John", "", "john"},
+		{"", "Smith", ".smith"},
+		{"Ann", "Élan.", "ann.lan"},
+		{"", "", "diver"},
+	} {
+		var got string
+		if err := testDB.QueryRow("SELECT username_base($1, $2)", c.first, c.last).Scan(&got); err != nil {
+			t.Fatalf("Error computing username: %v", err)
+		}
+		if got != c.want {
+			t.Errorf("username_base(%q, %q) = %q, want %q", c.first, c.last, got, c.want)
+		}
+		if names := parseMentions("@" + got); len(names) != 1 || names[0] != got {
+			t.Errorf("Expected @%s to mention %s, got %v", got, got, names)
+		}
+	}
+}
+
+func TestMentionsAndHashtags(t *testing.T) {
+	router := getTestRouter(testDB)
+	authorToken, _ := signUpTestUser(t, router, "tags-author@example.com")
+	mayaToken, mayaID := signUpTestUser(t, router, "tags-maya@example.com")
+	otherToken, otherID := signUpTestUser(t, router, "tags-other@example.com")
+
+	profile := User{FirstName: "Maya", LastName: "Lopez", Email: "tags-maya@example.com", Username: "mention_maya"}
+	if rr := doAuthRequest(router, "PUT", "/api/go/users/"+mayaID, mayaToken, profile); rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK for choosing a username, got %d: %s", rr.Code, rr.Body.String())
+	}
+	profile.Email = "tags-other@example.com"
+	if rr := doAuthRequest(router, "PUT", "/api/go/users/"+otherID, otherToken, profile); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 Conflict for a taken username, got %d", rr.Code)
+	}
+
+	postID := createTestPost(t, router, authorToken, Post{Title: "Mantas", Date: "2024-07-01", Description: "Night dive with @Mention_Maya #MantaNight"})
+	commentURL := "/api/go/posts/" + strconv.Itoa(postID) + "/comments"
+	rr := doAuthRequest(router, "POST", commentURL, otherToken, Comment{Content: "Jealous! #mantanight"})
+	var comment Comment
+	json.NewDecoder(rr.Body).Decode(&comment)
+
+	rr = doAuthRequest(router, "GET", "/api/go/notifications", mayaToken, nil)
+	var page notificationPage
+	json.NewDecoder(rr.Body).Decode(&page)
+	if len(page.Notifications) != 1 || page.Notifications[0].Type != notifyMention || page.Notifications[0].PostId == nil || *page.Notifications[0].PostId != postID {
+		t.Errorf("Expected a mention notification for maya, got %+v", page.Notifications)
+	}
+
+	// Editing the post without changing the mention doesn't notify again
+	doAuthRequest(router, "PUT", "/api/go/posts/"+strconv.Itoa(postID), authorToken, Post{Title: "Mantas", Date: "2024-07-01", Description: "Night dive with @mention_maya #MantaNight!"})
+	rr = doAuthRequest(router, "GET", "/api/go/notifications/unread-count", mayaToken, nil)
+	var count map[string]int
+	json.NewDecoder(rr.Body).Decode(&count)
+	if count["unread_count"] != 1 {
+		t.Errorf("Expected one unread notification after the edit, got %v", count)
+	}
+
+	rr = doAuthRequest(router, "GET", "/api/go/hashtags/%23MantaNight/posts", mayaToken, nil)
+	var posts postSearchPage
+	json.NewDecoder(rr.Body).Decode(&posts)
+	if len(posts.Posts) != 1 || posts.Posts[0].Id != postID {
+		t.Errorf("Expected the tagged post, got %+v", posts.Posts)
+	}
+
+	trendingUsers := func() int {
+		rr := doAuthRequest(router, "GET", "/api/go/hashtags/trending?hours=1&limit=50", mayaToken, nil)
+		var trending []trendingHashtag
+		json.NewDecoder(rr.Body).Decode(&trending)
+		for _, tag := range trending {
+			if tag.Tag == "mantanight" {
+				return tag.Users
+			}
+		}
+		return 0
+	}
+	if n := trendingUsers(); n != 2 {
+		t.Errorf("Expected #mantanight used by two users, got %d", n)
+	}
+
+	// Taking the tag out of the comment drops its use
+	doAuthRequest(router, "PUT", "/api/go/comments/"+strconv.Itoa(comment.Id), otherToken, Comment{Content: "Jealous!"})
+	if n := trendingUsers(); n != 1 {
+		t.Errorf("Expected #mantanight used by one user after the edit, got %d", n)
+	}
+}
+
+func TestSearchAcrossPostsSitesAndUsers(t *testing.T) {
+	router := getTestRouter(testDB)
+	token, userID := signUpTestUser(t, router, "search-diver@example.com")
+	profile := User{FirstName: "Guadalupe", LastName: "Esquivel", Email: "search-diver@example.com"}
+	doAuthRequest(router, "PUT", "/api/go/users/"+userID, token, profile)
+
+	rr := doAuthRequest(router, "POST", "/api/go/sites", token, DiveSite{Name: "Kelp Cathedral", Latitude: 36.61, Longitude: -121.89, Description: "Towering kelp <forest>"})
+	var site DiveSite
+	json.NewDecoder(rr.Body).Decode(&site)
+	postID := createTestPost(t, router, token, Post{Title: "Morning dive", Date: "2024-08-01", Description: "Sea lions everywhere", SiteId: &site.Id})
+
+	search := func(query string) searchPage {
+		rr := doAuthRequest(router, "GET", "/api/go/search?"+query, token, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200 OK for search %q, got %d: %s", query, rr.Code, rr.Body.String())
+		}
+		var page searchPage
+		json.NewDecoder(rr.Body).Decode(&page)
+		return page
+	}
+	has := func(page searchPage, kind string, id int) bool {
+		for _, r := range page.Results {
+			if r.Type == kind && r.Id == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The site name finds the site and the posts logged there
+	page := search("q=kelp+cathedral")
+	if !has(page, "site", site.Id) || !has(page, "post", postID) {
+		t.Errorf("Expected the site and its post, got %+v", page.Results)
+	}
+	for _, r := range page.Results {
+		if r.Type != "site" || r.Id != site.Id {
+			continue
+		}
+		if !strings.Contains(r.Snippet, "<mark>kelp</mark>") && !strings.Contains(r.Snippet, "<mark>Kelp</mark>") || strings.Contains(r.Snippet, "<forest>") {
+			t.Errorf("Expected an escaped, highlighted snippet, got %q", r.Snippet)
+		}
+	}
+
+	// A misspelled name still finds the user, and type filters apply
+	id, _ := strconv.Atoi(userID)
+	page = search("q=Esquivell&types=users")
+	if !has(page, "user", id) {
+		t.Errorf("Expected a fuzzy match on the user's name, got %+v", page.Results)
+	}
+	for _, r := range page.Results {
+		if r.Type != "user" {
+			t.Errorf("Expected only users, got %+v", r)
+		}
+	}
+
+	// Pages don't overlap
+	first := search("q=kelp+cathedral&limit=1")
+	if len(first.Results) != 1 || first.NextCursor == "" {
+		t.Fatalf("Expected one result and a cursor, got %+v", first)
+	}
+	second := search("q=kelp+cathedral&limit=1&cursor=" + first.NextCursor)
+	if len(second.Results) != 1 || second.Results[0] == first.Results[0] {
+		t.Errorf("Expected a different second result, got %+v", second.Results)
+	}
+
+	if rr := doAuthRequest(router, "GET", "/api/go/search?q=", token, nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 Bad Request for an empty query, got %d", rr.Code)
+	}
+}
+
+func TestDirectMessagingWithReceiptsAndBlocks(t *testing.T) {
+	router := getTestRouter(testDB)
+	aliceToken, aliceID := signUpTestUser(t, router, "dm-alice@example.com")
+	bobToken, bobID := signUpTestUser(t, router, "dm-bob@example.com")
+	bob, _ := strconv.Atoi(bobID)
+	alice, _ := strconv.Atoi(aliceID)
+
+	rr := doAuthRequest(router, "POST", "/api/go/conversations", aliceToken, map[string][]int{"user_ids": {bob}})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 Created, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var conv conversation
+	json.NewDecoder(rr.Body).Decode(&conv)
+	if conv.IsGroup || len(conv.Members) != 2 {
+		t.Errorf("Expected a one-to-one conversation with two members, got %+v", conv)
+	}
+
+	// Starting it again from either side returns the same conversation
+	rr = doAuthRequest(router, "POST", "/api/go/conversations", bobToken, map[string][]int{"user_ids": {alice}})
+	var again conversation
+	json.NewDecoder(rr.Body).Decode(&again)
+	if rr.Code != http.StatusOK || again.Id != conv.Id {
+		t.Errorf("Expected 200 OK with conversation %d, got %d and %+v", conv.Id, rr.Code, again)
+	}
+
+	messagesURL := "/api/go/conversations/" + strconv.Itoa(conv.Id) + "/messages"
+	for _, text := range []string{"Diving Saturday?", "Thinking the wreck", "Bring a torch"} {
+		if rr := doAuthRequest(router, "POST", messagesURL, aliceToken, message{Content: text}); rr.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 Created, got %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	unread := func(token string) int {
+		var counts struct {
+			Messages int `json:"unread_count"`
+		}
+		json.NewDecoder(doAuthRequest(router, "GET", "/api/go/conversations/unread-count", token, nil).Body).Decode(&counts)
+		return counts.Messages
+	}
+	if n := unread(bobToken); n != 3 {
+		t.Errorf("Expected 3 unread messages for Bob, got %d", n)
+	}
+	if n := unread(aliceToken); n != 0 {
+		t.Errorf("Expected no unread messages for the sender, got %d", n)
+	}
+
+	// History pages go from newest to oldest without overlapping
+	rr = doAuthRequest(router, "GET", messagesURL+"?limit=2", bobToken, nil)
+	var first messagePage
+	json.NewDecoder(rr.Body).Decode(&first)
+	if len(first.Messages) != 2 || first.Messages[0].Content != "Bring a torch" || first.NextCursor == "" {
+		t.Fatalf("Expected the two newest messages and a cursor, got %+v", first)
+	}
+	rr = doAuthRequest(router, "GET", messagesURL+"?limit=2&cursor="+first.NextCursor, bobToken, nil)
+	var second messagePage
+	json.NewDecoder(rr.Body).Decode(&second)
+	if len(second.Messages) != 1 || second.Messages[0].Content != "Diving Saturday?" {
+		t.Errorf("Expected the oldest message on the second page, got %+v", second.Messages)
+	}
+
+	// Reading clears the count and shows up as a read receipt
+	readURL := "/api/go/conversations/" + strconv.Itoa(conv.Id) + "/read"
+	if rr := doAuthRequest(router, "POST", readURL, bobToken, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 No Content, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if n := unread(bobToken); n != 0 {
+		t.Errorf("Expected no unread messages after reading, got %d", n)
+	}
+	rr = doAuthRequest(router, "GET", messagesURL, aliceToken, nil)
+	var page messagePage
+	json.NewDecoder(rr.Body).Decode(&page)
+	if len(page.Messages) == 0 || len(page.Messages[0].ReadBy) != 1 || page.Messages[0].ReadBy[0] != bob {
+		t.Errorf("Expected Bob's read receipt on the newest message, got %+v", page.Messages)
+	}
+
+	// Outsiders can't see the conversation
+	outsiderToken, _ := signUpTestUser(t, router, "dm-outsider@example.com")
+	if rr := doAuthRequest(router, "GET", messagesURL, outsiderToken, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 Not Found for a non-member, got %d", rr.Code)
+	}
+
+	// Once Bob blocks Alice, neither can message the other
+	if rr := doAuthRequest(router, "POST", "/api/go/users/"+aliceID+"/block", bobToken, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 No Content, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := doAuthRequest(router, "POST", messagesURL, aliceToken, message{Content: "Hello?"}); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 Forbidden messaging a user who blocked you, got %d", rr.Code)
+	}
+	if rr := doAuthRequest(router, "POST", messagesURL, bobToken, message{Content: "Hello?"}); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 Forbidden messaging a user you blocked, got %d", rr.Code)
+	}
+
+	doAuthRequest(router, "DELETE", "/api/go/users/"+aliceID+"/block", bobToken, nil)
+	if rr := doAuthRequest(router, "POST", messagesURL, aliceToken, message{Content: "Hello?"}); rr.Code != http.StatusCreated {
+		t.Errorf("Expected 201 Created after unblocking, got %d", rr.Code)
+	}
+}
+
+func TestNearbyUsersRespectVisibility(t *testing.T) {
+	router := getTestRouter(testDB)
+	setProfile := func(email string, u User) (string, int) {
+		token, userID := signUpTestUser(t, router, email)
+		u.FirstName, u.LastName, u.Email = "Nearby", "Diver", email
+		if rr := doAuthRequest(router, "PUT", "/api/go/users/"+userID, token, u); rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200 OK updating %s, got %d: %s", email, rr.Code, rr.Body.String())
+		}
+		id, _ := strconv.Atoi(userID)
+		return token, id
+	}
+
+	// Around La Jolla; the others are a few km away, one is across the world
+	token, _ := setProfile("nearby-me@example.com", User{Latitude: 32.8503, Longitude: -117.2713, Age: 30})
+	exactToken, exactID := setProfile("nearby-exact@example.com",
+		User{Latitude: 32.8530, Longitude: -117.2600, Age: 35, Certification: "rescue", LocationVisibility: locationExact})
+	_, fuzzyID := setProfile("nearby-fuzzy@example.com",
+		User{Latitude: 32.8712, Longitude: -117.2519, Age: 52, Certification: "open_water", LocationVisibility: locationApproximate})
+	_, hiddenID := setProfile("nearby-hidden@example.com", User{Latitude: 32.8510, Longitude: -117.2700, Age: 28})
+	_, farID := setProfile("nearby-far@example.com", User{Latitude: 20.3356, Longitude: -87.0286, Age: 40, LocationVisibility: locationExact})
+	createTestPost(t, router, exactToken, Post{Title: "Shore dive", Activity: "Spearfishing"})
+
+	nearby := func(query string) nearbyPage {
+		rr := doAuthRequest(router, "GET", "/api/go/users/nearby?"+query, token, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200 OK for %q, got %d: %s", query, rr.Code, rr.Body.String())
+		}
+		var page nearbyPage
+		json.NewDecoder(rr.Body).Decode(&page)
+		return page
+	}
+	find := func(page nearbyPage, id int) *nearbyUser {
+		for i := range page.Users {
+			if page.Users[i].Id == id {
+				return &page.Users[i]
+			}
+		}
+		return nil
+	}
+
+	page := nearby("radius_km=20")
+	exact, fuzzy := find(page, exactID), find(page, fuzzyID)
+	if exact == nil || fuzzy == nil || find(page, hiddenID) != nil || find(page, farID) != nil {
+		t.Fatalf("Expected only the visible divers nearby, got %+v", page.Users)
+	}
+	if exact.Latitude != 32.8530 || exact.Approximate || !reflect.DeepEqual(exact.Activities, []string{"Spearfishing"}) {
+		t.Errorf("Expected the exact location and activities, got %+v", exact)
+	}
+	if !fuzzy.Approximate || fuzzy.Latitude == 32.8712 || fuzzy.DistanceKm != math.Round(fuzzy.DistanceKm) {
+		t.Errorf("Expected a snapped location and a whole-km distance, got %+v", fuzzy)
+	}
+
+	// Filters
+	if page := nearby("radius_km=20&certification=advanced_open_water"); find(page, exactID) == nil || find(page, fuzzyID) != nil {
+		t.Errorf("Expected only divers certified rescue and up, got %+v", page.Users)
+	}
+	if page := nearby("radius_km=20&activities=spearfishing"); find(page, exactID) == nil || find(page, fuzzyID) != nil {
+		t.Errorf("Expected only spearfishers, got %+v", page.Users)
+	}
+	if page := nearby("radius_km=20&min_age=50"); find(page, fuzzyID) == nil || find(page, exactID) != nil {
+		t.Errorf("Expected only divers 50 and over, got %+v", page.Users)
+	}
+
+	// Other people see hidden locations as unset, but owners see their own
+	rr := doAuthRequest(router, "GET", "/api/go/users/"+strconv.Itoa(hiddenID), token, nil)
+	var hidden User
+	json.NewDecoder(rr.Body).Decode(&hidden)
+	if hidden.Latitude != 0 || hidden.Longitude != 0 {
+		t.Errorf("Expected a hidden location, got %v, %v", hidden.Latitude, hidden.Longitude)
+	}
+
+	// Blocked divers don't show up
+	doAuthRequest(router, "POST", "/api/go/users/"+strconv.Itoa(exactID)+"/block", token, nil)
+	if page := nearby("radius_km=20"); find(page, exactID) != nil {
+		t.Errorf("Expected a blocked diver to be left out, got %+v", page.Users)
+	}
+
+	noLocationToken, _ := signUpTestUser(t, router, "nearby-nowhere@example.com")
+	if rr := doAuthRequest(router, "GET", "/api/go/users/nearby", noLocationToken, nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 Bad Request without a home location, got %d", rr.Code)
+	}
+}
+
+func TestTripRSVPWaitlistAndPosts(t *testing.T) {
+	router := getTestRouter(testDB)
+	organizerToken, _ := signUpTestUser(t, router, "trip-organizer@example.com")
+	firstToken, firstID := signUpTestUser(t, router, "trip-first@example.com")
+	secondToken, secondID := signUpTestUser(t, router, "trip-second@example.com")
+	noviceToken, _ := signUpTestUser(t, router, "trip-novice@example.com")
+	for _, diver := range []struct{ token, id, email string }{
+		{firstToken, firstID, "trip-first@example.com"},
+		{secondToken, secondID, "trip-second@example.com"},
+	} {
+		doAuthRequest(router, "PUT", "/api/go/users/"+diver.id, diver.token,
+			User{FirstName: "Trip", LastName: "Diver", Email: diver.email, Certification: "rescue"})
+	}
+
+	// The organizer takes one of the two spots
+	rr := doAuthRequest(router, "POST", "/api/go/trips", organizerToken,
+		Trip{Title: "Wreck weekend", StartsAt: time.Now().Add(72 * time.Hour), Capacity: 2, RequiredCertification: "advanced_open_water"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 Created, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var trip Trip
+	json.NewDecoder(rr.Body).Decode(&trip)
+	if trip.GoingCount != 1 || trip.RSVP != rsvpGoing {
+		t.Errorf("Expected the organizer to be going, got %+v", trip)
+	}
+	tripURL := "/api/go/trips/" + strconv.Itoa(trip.Id)
+
+	rsvp := func(token string) (int, tripRSVP) {
+		rr := doAuthRequest(router, "POST", tripURL+"/rsvp", token, nil)
+		var r tripRSVP
+		json.NewDecoder(rr.Body).Decode(&r)
+		return rr.Code, r
+	}
+	if code, r := rsvp(firstToken); code != http.StatusCreated || r.Status != rsvpGoing {
+		t.Errorf("Expected the first diver to get the last spot, got %d %+v", code, r)
+	}
+	if code, r := rsvp(secondToken); code != http.StatusCreated || r.Status != rsvpWaitlisted || r.WaitlistPosition != 1 {
+		t.Errorf("Expected the second diver to be first on the waitlist, got %d %+v", code, r)
+	}
+	if code, r := rsvp(secondToken); code != http.StatusOK || r.Status != rsvpWaitlisted {
+		t.Errorf("Expected answering again to keep the place, got %d %+v", code, r)
+	}
+	if code, _ := rsvp(noviceToken); code != http.StatusForbidden {
+		t.Errorf("Expected 403 Forbidden without the required certification, got %d", code)
+	}
+
+	// The organizer can't shrink the trip below who's going
+	update := Trip{Title: "Wreck weekend", StartsAt: time.Now().Add(72 * time.Hour), Capacity: 1}
+	if rr := doAuthRequest(router, "PUT", tripURL, organizerToken, update); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 Conflict shrinking below the divers going, got %d", rr.Code)
+	}
+
+	// Nor raise the certification past what the divers on it hold
+	update = Trip{Title: "Wreck weekend", StartsAt: time.Now().Add(72 * time.Hour), Capacity: 2, RequiredCertification: "divemaster"}
+	if rr := doAuthRequest(router, "PUT", tripURL, organizerToken, update); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 Conflict raising the required certification, got %d", rr.Code)
+	}
+	update.RequiredCertification = "rescue"
+	if rr := doAuthRequest(router, "PUT", tripURL, organizerToken, update); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 OK requiring what the divers hold, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Cancelling promotes the waitlist
+	if rr := doAuthRequest(router, "DELETE", tripURL+"/rsvp", firstToken, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 No Content, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var attendees tripAttendees
+	json.NewDecoder(doAuthRequest(router, "GET", tripURL+"/attendees", organizerToken, nil).Body).Decode(&attendees)
+	if len(attendees.Going) != 2 || len(attendees.Waitlist) != 0 || strconv.Itoa(attendees.Going[1].Id) != secondID {
+		t.Errorf("Expected the waitlisted diver to be promoted, got %+v", attendees)
+	}
+
+	// After the dive, those who went link their posts
+	postID := createTestPost(t, router, secondToken, Post{Title: "Wreck day one"})
+	linkURL := tripURL + "/posts/" + strconv.Itoa(postID)
+	if rr := doAuthRequest(router, "PUT", linkURL, secondToken, nil); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 Conflict linking before the trip, got %d", rr.Code)
+	}
+	if _, err := testDB.Exec("UPDATE trips SET starts_at = now() - interval '1 day' WHERE id = $1", trip.Id); err != nil {
+		t.Fatalf("Failed to move the trip into the past: %v", err)
+	}
+	if rr := doAuthRequest(router, "PUT", linkURL, secondToken, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 No Content linking the post, got %d: %s", rr.Code, rr.Body.String())
+	}
+	firstPostID := createTestPost(t, router, firstToken, Post{Title: "Not there"})
+	if rr := doAuthRequest(router, "PUT", tripURL+"/posts/"+strconv.Itoa(firstPostID), firstToken, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 Forbidden for a diver who didn't go, got %d", rr.Code)
+	}
+
+	var posts postSearchPage
+	json.NewDecoder(doAuthRequest(router, "GET", tripURL+"/posts", firstToken, nil).Body).Decode(&posts)
+	if len(posts.Posts) != 1 || posts.Posts[0].Id != postID {
+		t.Errorf("Expected the linked post, got %+v", posts.Posts)
+	}
+	if rr := doAuthRequest(router, "DELETE", tripURL+"/rsvp", secondToken, nil); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 Conflict cancelling after the trip started, got %d", rr.Code)
+	}
+}
+
+// countingConnector wraps the Postgres driver and counts the queries sent
+// through it, so tests can catch N+1 query patterns.
+type countingConnector struct {
+	driver.Connector
+	queries *atomic.Int64
+}
+
+func (c countingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{Conn: conn, queries: c.queries}, nil
+}
+
+type countingConn struct {
+	driver.Conn
+	queries *atomic.Int64
+}
+
+func (c countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.queries.Add(1)
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c countingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.queries.Add(1)
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c countingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+// Helper to open a second handle on the test database that counts queries
+func openCountingDB(tb testing.TB) (*sql.DB, *atomic.Int64) {
+	tb.Helper()
+
+	connector, err := pq.NewConnector(os.Getenv("TEST_DATABASE_URL"))
+	if err != nil {
+		tb.Fatalf("Error creating connector: %v", err)
+	}
+	queries := new(atomic.Int64)
+	db := sql.OpenDB(countingConnector{Connector: connector, queries: queries})
+	tb.Cleanup(func() { db.Close() })
+	return db, queries
+}
+
+// BenchmarkGetPostsQueryCount searches pages of growing size, each post with
+// several comments, and fails if the number of queries grows with the page.
+func BenchmarkGetPostsQueryCount(b *testing.B) {
+	var userID int
+	err := testDB.QueryRow(`INSERT INTO users (first_name, last_name, email, password, avatar)
+		VALUES ('Bench', 'Diver', 'bench-comments@example.com', 'x', '') RETURNING id`).Scan(&userID)
+	if err != nil {
+		b.Fatalf("Error creating user: %v", err)
+	}
+	b.Cleanup(func() { testDB.Exec(`DELETE FROM users WHERE id = $1`, userID) })
+
+	_, err = testDB.Exec(`
+		WITH new_posts AS (
+			INSERT INTO posts (user_id, title, date, latitude, longitude, depth, visibility, activity, description, images, rating)
+			SELECT $1, 'Bench dive ' || n, '2025-01-15', 0, 0, 10, 10, 'Diving', '', '{}', 0
+			FROM generate_series(1, $2) AS n
+			RETURNING id
+		)
+		INSERT INTO comments (post_id, user_id, content)
+		SELECT id, $1, 'Comment ' || n FROM new_posts, generate_series(1, 3) AS n`,
+		userID, maxPostPageSize)
+	if err != nil {
+		b.Fatalf("Error seeding posts: %v", err)
+	}
+
+	db, queries := openCountingDB(b)
+	handler := getPosts(db)
+
+	perRequest := int64(-1)
+	for _, size := range []int{1, 10, maxPostPageSize} {
+		b.Run("page_size_"+strconv.Itoa(size), func(b *testing.B) {
+			body, _ := json.Marshal(map[string]int{"user_id": userID, "limit": size})
+			queries.Store(0)
+
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest("POST", "/api/go/posts/search", bytes.NewReader(body))
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				if rr.Code != http.StatusOK {
+					b.Fatalf("Expected 200 OK, got %d", rr.Code)
+				}
+			}
+
+			n := queries.Load() / int64(b.N)
+			b.ReportMetric(float64(n), "queries/op")
+			if perRequest == -1 {
+				perRequest = n
+			} else if n != perRequest {
+				b.Errorf("Expected %d queries per request at every page size, got %d with %d posts", perRequest, n, size)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	maxHashtagLength     = 50
+	defaultTrendingHours = 24
+	maxTrendingHours     = 24 * 30
+	defaultTrendingLimit = 10
+	maxTrendingLimit     = 50
+	maxLinksPerText      = 30
+	minUsernameLength    = 2
+	maxUsernameLength    = 30
+)
+
+var (
+	// A hashtag or mention starts a word, so e-mail addresses, URL fragments
+	// and HTML entities like &#39; are left alone.
+	hashtagPattern  = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&/])#([\p{L}\p{N}_]+)`)
+	mentionPattern  = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_.])@([A-Za-z0-9_.]+)`)
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.]+$`)
+	hasLetter       = regexp.MustCompile(`\p{L}`)
+)
+
+// parseHashtags returns the distinct hashtags in text, lower case and
+// without the #, in order of appearance. Tags without a letter, like
+// "#1", are not hashtags.
+func parseHashtags(text string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, m := range hashtagPattern.FindAllStringSubmatch(text, -1) {
+		tag := strings.ToLower(m[1])
+		if seen[tag] || !hasLetter.MatchString(tag) || len([]rune(tag)) > maxHashtagLength {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+		if len(tags) == maxLinksPerText {
+			break
+		}
+	}
+	return tags
+}
+
+// parseMentions returns the distinct usernames mentioned in text, lower
+// case and in order of appearance. A full stop ending a sentence is not
+// part of the username.
+func parseMentions(text string) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := strings.ToLower(strings.TrimRight(m[1], "."))
+		if seen[name] || len(name) < minUsernameLength || len(name) > maxUsernameLength {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+		if len(names) == maxLinksPerText {
+			break
+		}
+	}
+	return names
+}
+
+// validateUsername checks a username chosen by its user. A trailing dot
+// would read as the end of a sentence, which parseMentions drops.
+func validateUsername(name string) error {
+	if len(name) < minUsernameLength || len(name) > maxUsernameLength || !usernamePattern.MatchString(name) {
+		return fmt.Errorf("username must be %d to %d letters, digits, dots or underscores", minUsernameLength, maxUsernameLength)
+	}
+	if strings.HasSuffix(name, ".") {
+		return fmt.Errorf("username must not end with a dot")
+	}
+	return nil
+}
+
+// syncTextLinks stores the hashtags and mentions of a post's description
+// (commentID nil) or of a comment, replacing those of an earlier version,
+// and notifies the users mentioned for the first time.
+func syncTextLinks(db *sql.DB, authorID, postID int, commentID *int, text string) error {
+	tags, names := parseHashtags(text), parseMentions(text)
+
+	_, err := db.Exec(`
+		DELETE FROM hashtags
+		WHERE post_id = $1 AND comment_id IS NOT DISTINCT FROM $2 AND tag <> ALL($3)`,
+		postID, commentID, pq.Array(tags))
+	if err != nil {
+		return err
+	}
+	// Tags kept through an edit keep their original timestamp, so editing
+	// doesn't push a tag up the trending list
+	_, err = db.Exec(`
+		INSERT INTO hashtags (tag, post_id, comment_id, user_id)
+		SELECT tag, $2::int, $3::int, $4::int FROM unnest($1::text[]) tag
+		ON CONFLICT DO NOTHING`,
+		pq.Array(tags), postID, commentID, authorID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		DELETE FROM mentions m USING users u
+		WHERE m.user_id = u.id AND m.post_id = $1 AND m.comment_id IS NOT DISTINCT FROM $2 AND lower(u.username) <> ALL($3)`,
+		postID, commentID, pq.Array(names))
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query(`
+		INSERT INTO mentions (user_id, post_id, comment_id)
+		SELECT id, $2::int, $3::int FROM users WHERE lower(username) = ANY($1)
+		ON CONFLICT DO NOTHING
+		RETURNING user_id`,
+		pq.Array(names), postID, commentID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var mentioned []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return err
+		}
+		mentioned = append(mentioned, userID)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, userID := range mentioned {
+		if err := notify(db, notifyMention, userID, authorID, &postID, commentID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeHashtag turns a tag from a URL into its stored form.
+func normalizeHashtag(raw string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(raw), "#"))
+}
+
+// getHashtagPosts handles GET /hashtags/{tag}/posts: the posts whose
+// description or comments use the tag, newest first, paginated with
+// ?limit= and ?cursor=.
+func getHashtagPosts(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tag := normalizeHashtag(mux.Vars(r)["tag"])
+		if tag == "" {
+			http.Error(w, "Invalid hashtag", http.StatusBadRequest)
+			return
+		}
+		limit, cursor, err := pageParams(r, newestCursorSort, defaultPostPageSize, maxPostPageSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		args := queryArgs{tag, limit + 1}
+		rows, err := db.Query(`
+			SELECT `+combinedPostColumns()+`
+			FROM posts p
+			JOIN users u ON p.user_id = u.id
+			WHERE p.id IN (SELECT post_id FROM hashtags WHERE tag = $1) `+newestPostsAfter(&args, cursor)+`
+			ORDER BY p.timestamp DESC, p.id DESC
+			LIMIT $2`, args...)
+		if err != nil {
+			http.Error(w, "Failed to retrieve posts", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		page, err := scanNewestPosts(db, rows, limit)
+		if err != nil {
+			http.Error(w, "Failed to retrieve posts", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+type trendingHashtag struct {
+	Tag   string `json:"tag"`
+	Users int    `json:"users"` // distinct users who used it
+	Uses  int    `json:"uses"`
+	Posts int    `json:"posts"`
+}
+
+// getTrendingHashtags handles GET /hashtags/trending: the hashtags used
+// by the most people in the last ?hours= (default 24), up to ?limit=.
+// Ranking by people rather than uses keeps one prolific user from
+// trending on their own.
+func getTrendingHashtags(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		hours, limit := defaultTrendingHours, defaultTrendingLimit
+		if raw := params.Get("hours"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxTrendingHours {
+				http.Error(w, fmt.Sprintf("hours must be between 1 and %d", maxTrendingHours), http.StatusBadRequest)
+				return
+			}
+			hours = n
+		}
+		if raw := params.Get("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxTrendingLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxTrendingLimit), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		rows, err := db.Query(`
+			SELECT tag, COUNT(DISTINCT user_id), COUNT(*), COUNT(DISTINCT post_id)
+			FROM hashtags
+			WHERE timestamp >= now() - make_interval(hours => $1)
+			GROUP BY tag
+			ORDER BY 2 DESC, 3 DESC, tag
+			LIMIT $2`, hours, limit)
+		if err != nil {
+			http.Error(w, "Failed to retrieve hashtags", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		defer rows.Close()
+
+		trending := []trendingHashtag{}
+		for rows.Next() {
+			var t trendingHashtag
+			if err := rows.Scan(&t.Tag, &t.Users, &t.Uses, &t.Posts); err != nil {
+				http.Error(w, "Error scanning hashtag data", http.StatusInternalServerError)
+				log.Println("Scan error:", err)
+				return
+			}
+			trending = append(trending, t)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error processing hashtag data", http.StatusInternalServerError)
+			log.Println("Rows iteration error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(trending)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHashtags(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want []string
+	}{
+		{"Night dive #Manta #nightdive at #manta point", []string{"manta", "nightdive"}},
+		{"#Höhlentauchen first, then #reef_life.", []string{"höhlentauchen", "reef_life"}},
+		{"dive #1 of the day, see example.com/log#top &#39;", []string{}},
+		{"no tags here", []string{}},
+	} {
+		if got := parseHashtags(c.text); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseHashtags(%q) = %v, want %v", c.text, got, c.want)
+		}
+	}
+}
+
+func TestParseMentions(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want []string
+	}{
+		{"Great buddies @Maya.Lopez and @tom_k, thanks @maya.lopez.", []string{"maya.lopez", "tom_k"}},
+		{"Mail me at diver@example.com", []string{}},
+		{"@a is too short, (@sam) is fine", []string{"sam"}},
+	} {
+		if got := parseMentions(c.text); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseMentions(%q) = %v, want %v", c.text, got, c.want)
+		}
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	for _, name := range []string{"maya.lopez", "tom_k", "X1"} {
+		if err := validateUsername(name); err != nil {
+			t.Errorf("validateUsername(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"a", "has space", "émile", "waytoolongusername_waytoolongusername", "john.", "maya.."} {
+		if err := validateUsername(name); err == nil {
+			t.Errorf("validateUsername(%q) should fail", name)
+		}
+	}
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	maxConversationMembers      = 10 // including the creator
+	maxConversationTitle        = 100
+	maxMessageLength            = 4000
+	defaultConversationPageSize = 20
+	maxConversationPageSize     = 100
+	defaultMessagePageSize      = 50
+	maxMessagePageSize          = 200
+)
+
+type conversationMember struct {
+	Id                int    `json:"id"`
+	FirstName         string `json:"first_name"`
+	LastName          string `json:"last_name"`
+	Avatar            string `json:"avatar,omitempty"`
+	LastReadMessageId int    `json:"last_read_message_id"`
+}
+
+type message struct {
+	Id             int       `json:"id"`
+	ConversationId int       `json:"conversation_id"`
+	SenderId       *int      `json:"sender_id"` // nil once the sender's account is gone
+	Content        string    `json:"content"`
+	Timestamp      time.Time `json:"timestamp"`
+	ReadBy         []int     `json:"read_by,omitempty"` // the other members who have read it
+}
+
+type conversation struct {
+	Id           int                  `json:"id"`
+	IsGroup      bool                 `json:"is_group"`
+	Title        string               `json:"title,omitempty"`
+	Members      []conversationMember `json:"members"`
+	LastMessage  *message             `json:"last_message,omitempty"`
+	UnreadCount  int                  `json:"unread_count"`
+	LastActivity time.Time            `json:"last_activity"`
+}
+
+type conversationPage struct {
+	Conversations []conversation `json:"conversations"`
+	NextCursor    string         `json:"next_cursor,omitempty"`
+}
+
+type messagePage struct {
+	Messages   []message `json:"messages"` // newest first
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// visibleTo is a condition on messages m leaving out those sent by users
+// that the user at the placeholder has blocked.
+func visibleTo(userArg string) string {
+	return "NOT EXISTS (SELECT 1 FROM blocks b WHERE b.blocker_id = " + userArg + " AND b.blocked_id = m.sender_id)"
+}
+
+// directKey identifies the one-to-one conversation between two users.
+func directKey(a, b int) string {
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("%d:%d", a, b)
+}
+
+// blockedAmong reports whether userID has blocked, or was blocked by, any
+// of others.
+func blockedAmong(db *sql.DB, userID int, others []int64) (bool, error) {
+	var blocked bool
+	err := db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM blocks
+			WHERE (blocker_id = $1 AND blocked_id = ANY($2)) OR (blocked_id = $1 AND blocker_id = ANY($2))
+		)`, userID, pq.Array(others)).Scan(&blocked)
+	return blocked, err
+}
+
+// queryConversations lists the conversations of the user in $1 that match
+// cond, most recently active first, with their last visible message and
+// the user's unread count.
+func queryConversations(db *sql.DB, cond string, args queryArgs, limit int) ([]conversation, error) {
+	rows, err := db.Query(`
+		SELECT c.id, c.is_group, COALESCE(c.title, ''), c.last_activity,
+			lm.id, lm.sender_id, lm.content, lm.timestamp,
+			(SELECT COUNT(*) FROM messages m
+			 WHERE m.conversation_id = c.id AND m.id > me.last_read_message_id
+			 	AND m.sender_id IS DISTINCT FROM $1 AND `+visibleTo("$1")+`)
+		FROM conversation_members me
+		JOIN conversations c ON c.id = me.conversation_id
+		LEFT JOIN LATERAL (
+			SELECT m.id, m.sender_id, m.content, m.timestamp FROM messages m
+			WHERE m.conversation_id = c.id AND `+visibleTo("$1")+`
+			ORDER BY m.id DESC
+			LIMIT 1
+		) lm ON true
+		WHERE me.user_id = $1 `+cond+`
+		ORDER BY c.last_activity DESC, c.id DESC
+		LIMIT `+strconv.Itoa(limit), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	convs := []conversation{}
+	for rows.Next() {
+		var c conversation
+		var last struct {
+			Id        *int
+			SenderId  *int
+			Content   *string
+			Timestamp *time.Time
+		}
+		if err := rows.Scan(&c.Id, &c.IsGroup, &c.Title, &c.LastActivity,
+			&last.Id, &last.SenderId, &last.Content, &last.Timestamp, &c.UnreadCount); err != nil {
+			return nil, err
+		}
+		if last.Id != nil {
+			c.LastMessage = &message{Id: *last.Id, ConversationId: c.Id, SenderId: last.SenderId, Content: *last.Content, Timestamp: *last.Timestamp}
+		}
+		convs = append(convs, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return convs, attachConversationMembers(db, convs)
+}
+
+func attachConversationMembers(db *sql.DB, convs []conversation) error {
+	if len(convs) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(convs))
+	for i, c := range convs {
+		ids[i] = int64(c.Id)
+	}
+
+	rows, err := db.Query(`
+		SELECT cm.conversation_id, u.id, u.first_name, u.last_name, COALESCE(u.avatar, ''), cm.last_read_message_id
+		FROM conversation_members cm
+		JOIN users u ON u.id = cm.user_id
+		WHERE cm.conversation_id = ANY($1)
+		ORDER BY cm.conversation_id, cm.joined_at, u.id`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	members := map[int][]conversationMember{}
+	for rows.Next() {
+		var convID int
+		var m conversationMember
+		if err := rows.Scan(&convID, &m.Id, &m.FirstName, &m.LastName, &m.Avatar, &m.LastReadMessageId); err != nil {
+			return err
+		}
+		members[convID] = append(members[convID], m)
+	}
+	for i := range convs {
+		convs[i].Members = members[convs[i].Id]
+	}
+	return rows.Err()
+}
+
+// requireConversationMember writes 404 unless the caller belongs to the
+// conversation, so non-members can't tell whether it exists. It returns
+// whether the conversation is a group.
+func requireConversationMember(w http.ResponseWriter, db *sql.DB, convID string, callerID int) (isGroup bool, ok bool) {
+	err := db.QueryRow(`
+		SELECT c.is_group FROM conversations c
+		JOIN conversation_members cm ON cm.conversation_id = c.id
+		WHERE c.id = $1 AND cm.user_id = $2`, convID, callerID).Scan(&isGroup)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return false, false
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		log.Println("Database error:", err)
+		return false, false
+	}
+	return isGroup, true
+}
+
+// createConversation handles POST /conversations with {"user_ids": [...]}
+// and, for groups, an optional "title". With a single other user it
+// returns their existing one-to-one conversation if there is one.
+func createConversation(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			UserIds []int  `json:"user_ids"`
+			Title   string `json:"title"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var others []int64
+		seen := map[int]bool{callerID: true}
+		for _, id := range req.UserIds {
+			if !seen[id] {
+				seen[id] = true
+				others = append(others, int64(id))
+			}
+		}
+		req.Title = strings.TrimSpace(req.Title)
+		switch {
+		case len(others) == 0:
+			http.Error(w, "user_ids must name at least one other user", http.StatusBadRequest)
+			return
+		case len(others)+1 > maxConversationMembers:
+			http.Error(w, fmt.Sprintf("A conversation can have at most %d members", maxConversationMembers), http.StatusBadRequest)
+			return
+		case len(req.Title) > maxConversationTitle:
+			http.Error(w, fmt.Sprintf("title must be at most %d characters", maxConversationTitle), http.StatusBadRequest)
+			return
+		}
+
+		var found int
+		if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE id = ANY($1)", pq.Array(others)).Scan(&found); err != nil {
+			http.Error(w, "Failed to create conversation", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		if found != len(others) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		blocked, err := blockedAmong(db, callerID, others)
+		if err != nil {
+			http.Error(w, "Failed to create conversation", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		if blocked {
+			http.Error(w, "You can't message a user you have blocked or who has blocked you", http.StatusForbidden)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to create conversation", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		defer tx.Rollback()
+
+		isGroup := len(others) > 1
+		var key, title interface{}
+		if isGroup {
+			title = nullIfEmpty(req.Title)
+		} else {
+			key = directKey(callerID, int(others[0]))
+		}
+		var convID int
+		err = tx.QueryRow(`
+			INSERT INTO conversations (is_group, title, direct_key, created_by) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (direct_key) DO NOTHING
+			RETURNING id`, isGroup, title, key, callerID).Scan(&convID)
+		status := http.StatusCreated
+		if err == sql.ErrNoRows {
+			// The two users already have a conversation
+			status = http.StatusOK
+			err = tx.QueryRow("SELECT id FROM conversations WHERE direct_key = $1", key).Scan(&convID)
+		} else if err == nil {
+			_, err = tx.Exec(`
+				INSERT INTO conversation_members (conversation_id, user_id)
+				SELECT $1, unnest($2::int[])`, convID, pq.Array(append(others, int64(callerID))))
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			http.Error(w, "Failed to create conversation", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		convs, err := queryConversations(db, "AND c.id = $2", queryArgs{callerID, convID}, 1)
+		if err != nil || len(convs) == 0 {
+			http.Error(w, "Failed to retrieve conversation", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(convs[0])
+	}
+}
+
+// getConversations lists the caller's conversations, most recently active
+// first, paginated with ?limit= and ?cursor=.
+func getConversations(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		limit, cursor, err := pageParams(r, "conversations", defaultConversationPageSize, maxConversationPageSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		args := queryArgs{callerID}
+		cond := ""
+		if cursor != nil {
+			cond = fmt.Sprintf("AND (c.last_activity, c.id) < (%s::timestamp, %s)", args.add(cursor.Value), args.add(cursor.Id))
+		}
+		convs, err := queryConversations(db, cond, args, limit+1)
+		if err != nil {
+			http.Error(w, "Failed to retrieve conversations", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		page := conversationPage{Conversations: convs}
+		// The extra row only tells us there is another page
+		if len(convs) > limit {
+			last := convs[limit-1]
+			page.Conversations = convs[:limit]
+			page.NextCursor = encodePostCursor(postCursor{Sort: "conversations", Value: cursorValue(last.LastActivity), Id: last.Id})
+		}
+
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// getMessages returns a conversation's history, newest first, paginated
+// with ?limit= and ?cursor= towards older messages. Each message lists
+// the members who have read it.
+func getMessages(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		convID := mux.Vars(r)["id"]
+		if _, ok := requireConversationMember(w, db, convID, callerID); !ok {
+			return
+		}
+		limit, cursor, err := pageParams(r, "messages", defaultMessagePageSize, maxMessagePageSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		args := queryArgs{convID, callerID}
+		before := ""
+		if cursor != nil {
+			before = "AND m.id < " + args.add(cursor.Id)
+		}
+		rows, err := db.Query(`
+			SELECT m.id, m.conversation_id, m.sender_id, m.content, m.timestamp
+			FROM messages m
+			WHERE m.conversation_id = $1 AND `+visibleTo("$2")+` `+before+`
+			ORDER BY m.id DESC
+			LIMIT `+strconv.Itoa(limit+1), args...)
+		if err != nil {
+			http.Error(w, "Failed to retrieve messages", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		defer rows.Close()
+
+		page := messagePage{Messages: []message{}}
+		for rows.Next() {
+			var m message
+			if err := rows.Scan(&m.Id, &m.ConversationId, &m.SenderId, &m.Content, &m.Timestamp); err != nil {
+				http.Error(w, "Error scanning message data", http.StatusInternalServerError)
+				log.Println("Scan error:", err)
+				return
+			}
+			// The extra row only tells us there is another page
+			if len(page.Messages) == limit {
+				last := page.Messages[limit-1]
+				page.NextCursor = encodePostCursor(postCursor{Sort: "messages", Value: cursorValue(last.Timestamp), Id: last.Id})
+				break
+			}
+			page.Messages = append(page.Messages, m)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error processing message data", http.StatusInternalServerError)
+			log.Println("Rows iteration error:", err)
+			return
+		}
+		rows.Close()
+
+		// Read receipts come from each member's last read message
+		convs := []conversation{{}}
+		convs[0].Id, _ = strconv.Atoi(convID)
+		if err := attachConversationMembers(db, convs); err != nil {
+			http.Error(w, "Failed to retrieve messages", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		for i, m := range page.Messages {
+			for _, member := range convs[0].Members {
+				if member.LastReadMessageId >= m.Id && (m.SenderId == nil || member.Id != *m.SenderId) {
+					page.Messages[i].ReadBy = append(page.Messages[i].ReadBy, member.Id)
+				}
+			}
+		}
+
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// sendMessage handles POST /conversations/{id}/messages with {"content"}.
+// Nobody can message someone who blocked them, or whom they blocked, in a
+// one-to-one conversation.
+func sendMessage(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		convID := mux.Vars(r)["id"]
+		isGroup, ok := requireConversationMember(w, db, convID, callerID)
+		if !ok {
+			return
+		}
+
+		var m message
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		m.Content = strings.TrimSpace(m.Content)
+		if m.Content == "" || len(m.Content) > maxMessageLength {
+			http.Error(w, fmt.Sprintf("content must be 1 to %d characters", maxMessageLength), http.StatusBadRequest)
+			return
+		}
+
+		if !isGroup {
+			var otherID int64
+			err := db.QueryRow("SELECT user_id FROM conversation_members WHERE conversation_id = $1 AND user_id <> $2", convID, callerID).Scan(&otherID)
+			blocked := false
+			if err == nil {
+				blocked, err = blockedAmong(db, callerID, []int64{otherID})
+			}
+			if err != nil && err != sql.ErrNoRows {
+				http.Error(w, "Failed to send message", http.StatusInternalServerError)
+				log.Println("Database error:", err)
+				return
+			}
+			if blocked {
+				http.Error(w, "You can't message a user you have blocked or who has blocked you", http.StatusForbidden)
+				return
+			}
+		}
+
+		// The sender has read their own message, and the conversation moves
+		// to the top of everyone's list
+		err = db.QueryRow(`
+			WITH sent AS (
+				INSERT INTO messages (conversation_id, sender_id, content) VALUES ($1, $2, $3)
+				RETURNING id, conversation_id, sender_id, content, timestamp
+			), activity AS (
+				UPDATE conversations SET last_activity = (SELECT timestamp FROM sent) WHERE id = $1
+			), receipt AS (
+				UPDATE conversation_members SET last_read_message_id = (SELECT id FROM sent)
+				WHERE conversation_id = $1 AND user_id = $2
+			)
+			SELECT id, conversation_id, sender_id, content, timestamp FROM sent`,
+			convID, callerID, m.Content,
+		).Scan(&m.Id, &m.ConversationId, &m.SenderId, &m.Content, &m.Timestamp)
+		if err != nil {
+			http.Error(w, "Failed to send message", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(m)
+	}
+}
+
+// markConversationRead handles POST /conversations/{id}/read: the caller
+// has read up to {"message_id"}, or everything when it is left out. The
+// other members are sent the read receipt over the event stream.
+func markConversationRead(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		convID := mux.Vars(r)["id"]
+		if _, ok := requireConversationMember(w, db, convID, callerID); !ok {
+			return
+		}
+
+		var req struct {
+			MessageId *int `json:"message_id"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Read receipts only move forward
+		_, err = db.Exec(`
+			WITH target AS (
+				SELECT LEAST(COALESCE($3::int, MAX(id)), MAX(id)) AS id FROM messages WHERE conversation_id = $1
+			), receipt AS (
+				UPDATE conversation_members cm SET last_read_message_id = target.id
+				FROM target
+				WHERE cm.conversation_id = $1 AND cm.user_id = $2 AND target.id > cm.last_read_message_id
+				RETURNING cm.last_read_message_id
+			)
+			INSERT INTO stream_events (user_id, type, data)
+			SELECT cm.user_id, 'read', json_build_object('conversation_id', cm.conversation_id, 'user_id', $2::int, 'last_read_message_id', receipt.last_read_message_id)
+			FROM receipt, conversation_members cm
+			WHERE cm.conversation_id = $1 AND cm.user_id <> $2`,
+			convID, callerID, req.MessageId)
+		if err != nil {
+			http.Error(w, "Failed to mark conversation read", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// getUnreadMessageCount returns the caller's unread messages and the number
+// of conversations they are in.
+func getUnreadMessageCount(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var counts struct {
+			Messages      int `json:"unread_count"`
+			Conversations int `json:"conversations"`
+		}
+		err = db.QueryRow(`
+			SELECT COUNT(*), COUNT(DISTINCT m.conversation_id)
+			FROM conversation_members me
+			JOIN messages m ON m.conversation_id = me.conversation_id AND m.id > me.last_read_message_id
+			WHERE me.user_id = $1 AND m.sender_id IS DISTINCT FROM $1 AND `+visibleTo("$1"), callerID,
+		).Scan(&counts.Messages, &counts.Conversations)
+		if err != nil {
+			http.Error(w, "Failed to count messages", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(counts)
+	}
+}
+
+// blockUser makes the caller block the user in the path.
+func blockUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		blockedID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		if blockedID == callerID {
+			http.Error(w, "You can't block yourself", http.StatusBadRequest)
+			return
+		}
+
+		_, err = db.Exec("INSERT INTO blocks (blocker_id, blocked_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", callerID, blockedID)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" { // foreign_key_violation
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to block user", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// unblockUser lifts the caller's block on the user in the path.
+func unblockUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if _, err := db.Exec("DELETE FROM blocks WHERE blocker_id = $1 AND blocked_id = $2", callerID, mux.Vars(r)["id"]); err != nil {
+			http.Error(w, "Failed to unblock user", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+import "testing"
+
+func TestDirectKey(t *testing.T) {
+	if got := directKey(7, 3); got != "3:7" {
+		t.Errorf("directKey(7, 3) = %q, want %q", got, "3:7")
+	}
+	if directKey(3, 7) != directKey(7, 3) {
+		t.Error("directKey should not depend on the order of the users")
+	}
+}
@@ -0,0 +1,46 @@
+-- Tables that used to be created by initializeDatabase. IF NOT EXISTS lets
+-- this migration adopt databases created before schema_migrations existed.
+CREATE TABLE IF NOT EXISTS users (
+	id SERIAL PRIMARY KEY,
+	first_name TEXT NOT NULL,
+	last_name TEXT NOT NULL,
+	email TEXT UNIQUE NOT NULL,
+	latitude FLOAT,
+	longitude FLOAT,
+	age INT CHECK (age >= 0),
+	password TEXT NOT NULL,
+	bio TEXT,
+	avatar TEXT
+);
+
+CREATE TABLE IF NOT EXISTS posts (
+	id SERIAL PRIMARY KEY,
+	user_id INT REFERENCES users(id) ON DELETE CASCADE,
+	title TEXT NOT NULL,
+	date TIMESTAMP NOT NULL,
+	latitude FLOAT,
+	longitude FLOAT,
+	depth FLOAT CHECK (depth >= 0),
+	visibility FLOAT CHECK (visibility >= 0),
+	activity TEXT,
+	description TEXT,
+	images TEXT[],  -- Array of image URLs
+	timestamp TIMESTAMP DEFAULT now(),
+	rating FLOAT CHECK (rating >= 0 AND rating <= 5),
+	likes INT DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS comments (
+	id SERIAL PRIMARY KEY,
+	post_id INT REFERENCES posts(id) ON DELETE CASCADE,
+	user_id INT REFERENCES users(id) ON DELETE CASCADE,
+	content TEXT NOT NULL,
+	timestamp TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS likes (
+	id SERIAL PRIMARY KEY,
+	post_id INT REFERENCES posts(id) ON DELETE CASCADE,
+	user_id INT REFERENCES users(id) ON DELETE CASCADE,
+	UNIQUE(post_id, user_id) -- Ensures a user can only like a post once
+);
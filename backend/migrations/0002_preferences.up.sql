@@ -0,0 +1,18 @@
+-- Saved map filters, mirroring the frontend FilterValues shape.
+CREATE TABLE IF NOT EXISTS preferences (
+	id SERIAL PRIMARY KEY,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	depth_min FLOAT NOT NULL DEFAULT 0,
+	depth_max FLOAT NOT NULL DEFAULT 0,
+	time_start TIMESTAMP,
+	time_end TIMESTAMP,
+	magnitude_min FLOAT NOT NULL DEFAULT 0,
+	magnitude_max FLOAT NOT NULL DEFAULT 0,
+	longitude_min FLOAT NOT NULL DEFAULT 0,
+	longitude_max FLOAT NOT NULL DEFAULT 0,
+	latitude_min FLOAT NOT NULL DEFAULT 0,
+	latitude_max FLOAT NOT NULL DEFAULT 0,
+	timestamp TIMESTAMP DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS preferences_user_id_idx ON preferences(user_id);
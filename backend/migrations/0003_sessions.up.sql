@@ -0,0 +1,23 @@
+-- A session is one login on one device. Every refresh token issued for it
+-- belongs to the same family, so replaying a rotated token can revoke them all.
+CREATE TABLE IF NOT EXISTS sessions (
+	id UUID PRIMARY KEY,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	user_agent TEXT,
+	created_at TIMESTAMP NOT NULL DEFAULT now(),
+	revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions(user_id) WHERE revoked_at IS NULL;
+
+-- Refresh tokens are stored as SHA-256 hashes, never in plain text.
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	id SERIAL PRIMARY KEY,
+	session_id UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+	token_hash TEXT UNIQUE NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT now(),
+	expires_at TIMESTAMP NOT NULL,
+	used_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_session_id_idx ON refresh_tokens(session_id);
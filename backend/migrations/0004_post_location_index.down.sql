@@ -0,0 +1,3 @@
+-- The extensions are left installed; other objects may depend on them.
+DROP INDEX IF EXISTS posts_latitude_longitude_idx;
+DROP INDEX IF EXISTS posts_location_idx;
@@ -0,0 +1,12 @@
+-- earthdistance (which needs cube) ships with Postgres contrib and gives us
+-- great-circle distances plus a GiST-indexable bounding box around a point.
+CREATE EXTENSION IF NOT EXISTS cube;
+CREATE EXTENSION IF NOT EXISTS earthdistance;
+
+-- Radius searches: earth_box(center, radius) @> ll_to_earth(lat, lon)
+CREATE INDEX IF NOT EXISTS posts_location_idx ON posts
+	USING gist (ll_to_earth(latitude, longitude))
+	WHERE latitude IS NOT NULL AND longitude IS NOT NULL;
+
+-- Bounding-box searches on plain latitude/longitude ranges
+CREATE INDEX IF NOT EXISTS posts_latitude_longitude_idx ON posts (latitude, longitude);
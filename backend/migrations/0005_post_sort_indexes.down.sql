@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS posts_depth_id_idx;
+DROP INDEX IF EXISTS posts_rating_id_idx;
+DROP INDEX IF EXISTS posts_likes_id_idx;
+DROP INDEX IF EXISTS posts_timestamp_id_idx;
+
+DROP TRIGGER IF EXISTS likes_count_trigger ON likes;
+DROP FUNCTION IF EXISTS posts_likes_counter();
+
+ALTER TABLE posts ALTER COLUMN likes DROP NOT NULL;
@@ -0,0 +1,26 @@
+-- posts.likes becomes a real counter kept in sync by a trigger, so feeds can
+-- sort by it through an index instead of counting likes per row.
+UPDATE posts SET likes = (SELECT COUNT(*) FROM likes WHERE likes.post_id = posts.id);
+UPDATE posts SET likes = 0 WHERE likes IS NULL;
+ALTER TABLE posts ALTER COLUMN likes SET NOT NULL;
+
+CREATE OR REPLACE FUNCTION posts_likes_counter() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'INSERT' THEN
+		UPDATE posts SET likes = likes + 1 WHERE id = NEW.post_id;
+	ELSIF TG_OP = 'DELETE' THEN
+		UPDATE posts SET likes = likes - 1 WHERE id = OLD.post_id;
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER likes_count_trigger
+	AFTER INSERT OR DELETE ON likes
+	FOR EACH ROW EXECUTE FUNCTION posts_likes_counter();
+
+-- Keyset pagination indexes, one per sort order (ties broken by id)
+CREATE INDEX IF NOT EXISTS posts_timestamp_id_idx ON posts (timestamp, id);
+CREATE INDEX IF NOT EXISTS posts_likes_id_idx ON posts (likes, id);
+CREATE INDEX IF NOT EXISTS posts_rating_id_idx ON posts ((COALESCE(rating, 0)), id);
+CREATE INDEX IF NOT EXISTS posts_depth_id_idx ON posts ((COALESCE(depth, 0)), id);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS comments_post_id_timestamp_idx;
@@ -0,0 +1,2 @@
+-- Comments are always loaded per post (or per page of posts), oldest first.
+CREATE INDEX IF NOT EXISTS comments_post_id_timestamp_idx ON comments(post_id, timestamp, id);
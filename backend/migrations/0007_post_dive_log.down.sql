@@ -0,0 +1,15 @@
+ALTER TABLE posts
+	DROP COLUMN IF EXISTS bottom_time,
+	DROP COLUMN IF EXISTS avg_depth,
+	DROP COLUMN IF EXISTS water_temp,
+	DROP COLUMN IF EXISTS air_temp,
+	DROP COLUMN IF EXISTS gas_mix,
+	DROP COLUMN IF EXISTS o2_percent,
+	DROP COLUMN IF EXISTS he_percent,
+	DROP COLUMN IF EXISTS tank_size,
+	DROP COLUMN IF EXISTS start_pressure,
+	DROP COLUMN IF EXISTS end_pressure,
+	DROP COLUMN IF EXISTS suit,
+	DROP COLUMN IF EXISTS weights,
+	DROP COLUMN IF EXISTS current,
+	DROP COLUMN IF EXISTS entry_type;
@@ -0,0 +1,16 @@
+-- Structured dive-log fields. All optional; posts.depth is the max depth.
+ALTER TABLE posts
+	ADD COLUMN IF NOT EXISTS bottom_time INT CHECK (bottom_time BETWEEN 0 AND 1440),
+	ADD COLUMN IF NOT EXISTS avg_depth FLOAT CHECK (avg_depth >= 0),
+	ADD COLUMN IF NOT EXISTS water_temp FLOAT CHECK (water_temp BETWEEN -2 AND 40),
+	ADD COLUMN IF NOT EXISTS air_temp FLOAT CHECK (air_temp BETWEEN -60 AND 60),
+	ADD COLUMN IF NOT EXISTS gas_mix TEXT CHECK (gas_mix IN ('air', 'nitrox', 'trimix')),
+	ADD COLUMN IF NOT EXISTS o2_percent FLOAT CHECK (o2_percent > 0 AND o2_percent <= 100),
+	ADD COLUMN IF NOT EXISTS he_percent FLOAT CHECK (he_percent >= 0 AND he_percent < 100),
+	ADD COLUMN IF NOT EXISTS tank_size FLOAT CHECK (tank_size > 0),
+	ADD COLUMN IF NOT EXISTS start_pressure FLOAT CHECK (start_pressure >= 0),
+	ADD COLUMN IF NOT EXISTS end_pressure FLOAT CHECK (end_pressure >= 0),
+	ADD COLUMN IF NOT EXISTS suit TEXT CHECK (suit IN ('none', 'rashguard', 'shorty', 'wetsuit', 'semidry', 'drysuit')),
+	ADD COLUMN IF NOT EXISTS weights FLOAT CHECK (weights >= 0),
+	ADD COLUMN IF NOT EXISTS current TEXT CHECK (current IN ('none', 'light', 'moderate', 'strong')),
+	ADD COLUMN IF NOT EXISTS entry_type TEXT CHECK (entry_type IN ('shore', 'boat', 'other'));
@@ -0,0 +1,11 @@
+-- Depth profile of a dive, one row per sample from the dive computer.
+CREATE TABLE IF NOT EXISTS dive_samples (
+	post_id INT NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+	time_offset INT NOT NULL CHECK (time_offset >= 0), -- seconds since the start of the dive
+	depth FLOAT NOT NULL CHECK (depth >= 0),
+	temperature FLOAT,
+	tank_pressure FLOAT CHECK (tank_pressure >= 0),
+	ndl INT CHECK (ndl >= 0), -- no-decompression limit in seconds
+	ceiling FLOAT CHECK (ceiling >= 0),
+	PRIMARY KEY (post_id, time_offset)
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS posts_site_id_date_idx;
+ALTER TABLE posts DROP COLUMN IF EXISTS site_id;
+DROP TABLE IF EXISTS dive_sites;
@@ -0,0 +1,22 @@
+-- Named dive sites that posts can be logged at, so every dive on the same
+-- reef shares one location.
+CREATE TABLE IF NOT EXISTS dive_sites (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL CHECK (name <> ''),
+	latitude FLOAT NOT NULL CHECK (latitude BETWEEN -90 AND 90),
+	longitude FLOAT NOT NULL CHECK (longitude BETWEEN -180 AND 180),
+	max_depth FLOAT CHECK (max_depth >= 0),
+	entry_type TEXT CHECK (entry_type IN ('shore', 'boat', 'other')),
+	description TEXT NOT NULL DEFAULT '',
+	aliases TEXT[] NOT NULL DEFAULT '{}', -- other names the site is known by
+	created_by INT REFERENCES users(id) ON DELETE SET NULL,
+	timestamp TIMESTAMP DEFAULT now()
+);
+
+-- Nearest-site lookups, as for posts
+CREATE INDEX IF NOT EXISTS dive_sites_location_idx ON dive_sites
+	USING gist (ll_to_earth(latitude, longitude));
+
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS site_id INT REFERENCES dive_sites(id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS posts_site_id_date_idx ON posts (site_id, date DESC, id DESC)
+	WHERE site_id IS NOT NULL;
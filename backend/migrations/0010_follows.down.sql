@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS posts_user_timestamp_id_idx;
+DROP TRIGGER IF EXISTS follows_count_trigger ON follows;
+DROP FUNCTION IF EXISTS users_follow_counter();
+ALTER TABLE users
+	DROP COLUMN IF EXISTS follower_count,
+	DROP COLUMN IF EXISTS following_count;
+DROP TABLE IF EXISTS follows;
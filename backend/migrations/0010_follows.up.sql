@@ -0,0 +1,37 @@
+-- Who follows whom. Follower and following counts on users are kept in
+-- sync by a trigger, like posts.likes.
+CREATE TABLE IF NOT EXISTS follows (
+	follower_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	followee_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	timestamp TIMESTAMP NOT NULL DEFAULT now(),
+	PRIMARY KEY (follower_id, followee_id),
+	CHECK (follower_id <> followee_id)
+);
+
+-- Follower and following lists, newest first
+CREATE INDEX IF NOT EXISTS follows_followee_timestamp_idx ON follows (followee_id, timestamp, follower_id);
+CREATE INDEX IF NOT EXISTS follows_follower_timestamp_idx ON follows (follower_id, timestamp, followee_id);
+
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS follower_count INT NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS following_count INT NOT NULL DEFAULT 0;
+
+CREATE OR REPLACE FUNCTION users_follow_counter() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'INSERT' THEN
+		UPDATE users SET follower_count = follower_count + 1 WHERE id = NEW.followee_id;
+		UPDATE users SET following_count = following_count + 1 WHERE id = NEW.follower_id;
+	ELSIF TG_OP = 'DELETE' THEN
+		UPDATE users SET follower_count = follower_count - 1 WHERE id = OLD.followee_id;
+		UPDATE users SET following_count = following_count - 1 WHERE id = OLD.follower_id;
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER follows_count_trigger
+	AFTER INSERT OR DELETE ON follows
+	FOR EACH ROW EXECUTE FUNCTION users_follow_counter();
+
+-- The feed reads each followed user's newest posts through this index
+CREATE INDEX IF NOT EXISTS posts_user_timestamp_id_idx ON posts (user_id, timestamp, id);
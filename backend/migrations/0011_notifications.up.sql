@@ -0,0 +1,18 @@
+-- Notifications tell a user what others did to their posts and profile.
+-- Each action is one row; rows sharing a group_key (likes of one post, new
+-- followers) are shown coalesced as "Maya and 4 others ...".
+CREATE TABLE IF NOT EXISTS notifications (
+	id SERIAL PRIMARY KEY,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- recipient
+	actor_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	type TEXT NOT NULL CHECK (type IN ('like', 'comment', 'follow', 'mention')),
+	post_id INT REFERENCES posts(id) ON DELETE CASCADE,
+	comment_id INT REFERENCES comments(id) ON DELETE CASCADE,
+	group_key TEXT NOT NULL,
+	read_at TIMESTAMP,
+	timestamp TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS notifications_user_timestamp_idx ON notifications (user_id, timestamp, id);
+-- Unread counts only look at unread rows
+CREATE INDEX IF NOT EXISTS notifications_unread_idx ON notifications (user_id, group_key) WHERE read_at IS NULL;
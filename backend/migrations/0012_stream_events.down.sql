@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS notifications_stream_trigger ON notifications;
+DROP FUNCTION IF EXISTS notifications_stream_event();
+DROP TRIGGER IF EXISTS posts_likes_stream_trigger ON posts;
+DROP FUNCTION IF EXISTS posts_likes_stream_event();
+DROP TRIGGER IF EXISTS comments_stream_trigger ON comments;
+DROP FUNCTION IF EXISTS comments_stream_event();
+DROP TABLE IF EXISTS stream_events;
+DROP FUNCTION IF EXISTS stream_events_notify();
@@ -0,0 +1,72 @@
+-- Events pushed to connected clients over GET /api/go/events. Triggers record
+-- them here and pg_notify every server instance, which relays each event
+-- to its own subscribers; clients that reconnect replay what they missed
+-- from this table. Old events are pruned by the server.
+CREATE TABLE IF NOT EXISTS stream_events (
+	id BIGSERIAL PRIMARY KEY,
+	user_id INT REFERENCES users(id) ON DELETE CASCADE, -- only this user receives the event
+	post_id INT, -- or everyone watching this post
+	type TEXT NOT NULL,
+	data JSONB NOT NULL,
+	timestamp TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS stream_events_timestamp_idx ON stream_events (timestamp);
+
+CREATE OR REPLACE FUNCTION stream_events_notify() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('stream_events', NEW.id::text);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER stream_events_notify_trigger
+	AFTER INSERT ON stream_events
+	FOR EACH ROW EXECUTE FUNCTION stream_events_notify();
+
+-- New comments, shaped like the comments of GET /posts/{id}
+CREATE OR REPLACE FUNCTION comments_stream_event() RETURNS trigger AS $$
+BEGIN
+	INSERT INTO stream_events (post_id, type, data)
+	SELECT NEW.post_id, 'comment', json_build_object(
+		'id', NEW.id, 'post_id', NEW.post_id, 'user_id', NEW.user_id,
+		'user_name', u.first_name || ' ' || u.last_name, 'user_avatar', u.avatar,
+		'content', NEW.content, 'timestamp', to_char(NEW.timestamp, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'))
+	FROM users u WHERE u.id = NEW.user_id;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER comments_stream_trigger
+	AFTER INSERT ON comments
+	FOR EACH ROW EXECUTE FUNCTION comments_stream_event();
+
+-- Like counts, as kept by posts_likes_counter
+CREATE OR REPLACE FUNCTION posts_likes_stream_event() RETURNS trigger AS $$
+BEGIN
+	INSERT INTO stream_events (post_id, type, data)
+	VALUES (NEW.id, 'likes', json_build_object('post_id', NEW.id, 'likes', NEW.likes));
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER posts_likes_stream_trigger
+	AFTER UPDATE OF likes ON posts
+	FOR EACH ROW WHEN (OLD.likes IS DISTINCT FROM NEW.likes)
+	EXECUTE FUNCTION posts_likes_stream_event();
+
+-- New notifications, with the recipient's new unread count
+CREATE OR REPLACE FUNCTION notifications_stream_event() RETURNS trigger AS $$
+BEGIN
+	INSERT INTO stream_events (user_id, type, data)
+	VALUES (NEW.user_id, 'notification', json_build_object(
+		'id', NEW.id, 'type', NEW.type, 'actor_id', NEW.actor_id,
+		'post_id', NEW.post_id, 'comment_id', NEW.comment_id,
+		'unread_count', (SELECT COUNT(DISTINCT group_key) FROM notifications WHERE user_id = NEW.user_id AND read_at IS NULL)));
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER notifications_stream_trigger
+	AFTER INSERT ON notifications
+	FOR EACH ROW EXECUTE FUNCTION notifications_stream_event();
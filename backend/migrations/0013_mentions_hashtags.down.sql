@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS mentions;
+DROP TABLE IF EXISTS hashtags;
+DROP INDEX IF EXISTS users_username_idx;
+DROP TRIGGER IF EXISTS users_default_username_trigger ON users;
+DROP FUNCTION IF EXISTS users_default_username();
+DROP FUNCTION IF EXISTS username_base(TEXT, TEXT);
+ALTER TABLE users DROP COLUMN IF EXISTS username;
@@ -0,0 +1,60 @@
+-- Usernames are the handles @mentions refer to. Existing and new users get
+-- one derived from their name, with their id appended when it is taken.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS username TEXT;
+
+CREATE OR REPLACE FUNCTION username_base(first_name TEXT, last_name TEXT) RETURNS TEXT AS $$
+	SELECT CASE WHEN length(base) < 2 THEN 'diver' ELSE base END
+	FROM (SELECT left(lower(regexp_replace(COALESCE(first_name, '') || '.' || COALESCE(last_name, ''), '[^A-Za-z0-9_.]', '', 'g')), 24) AS base) b;
+$$ LANGUAGE sql IMMUTABLE;
+
+WITH bases AS (
+	SELECT id, username_base(first_name, last_name) AS base,
+		row_number() OVER (PARTITION BY username_base(first_name, last_name) ORDER BY id) AS n
+	FROM users
+)
+UPDATE users SET username = CASE WHEN bases.n = 1 THEN bases.base ELSE bases.base || users.id END
+FROM bases WHERE bases.id = users.id AND users.username IS NULL;
+
+CREATE OR REPLACE FUNCTION users_default_username() RETURNS trigger AS $$
+BEGIN
+	IF COALESCE(NEW.username, '') = '' THEN
+		NEW.username := username_base(NEW.first_name, NEW.last_name);
+		IF EXISTS (SELECT 1 FROM users WHERE lower(username) = NEW.username) THEN
+			NEW.username := NEW.username || NEW.id;
+		END IF;
+	END IF;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_default_username_trigger
+	BEFORE INSERT ON users
+	FOR EACH ROW EXECUTE FUNCTION users_default_username();
+
+ALTER TABLE users ALTER COLUMN username SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_idx ON users (lower(username));
+
+-- Hashtags and mentions found in post descriptions (comment_id NULL) and
+-- comments. Rows are replaced when the text is edited.
+CREATE TABLE IF NOT EXISTS hashtags (
+	tag TEXT NOT NULL, -- lower case, without the #
+	post_id INT NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+	comment_id INT REFERENCES comments(id) ON DELETE CASCADE,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- who wrote it
+	timestamp TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS hashtags_tag_post_comment_idx ON hashtags (tag, post_id, COALESCE(comment_id, 0));
+CREATE INDEX IF NOT EXISTS hashtags_post_idx ON hashtags (post_id);
+-- Trending hashtags count recent uses
+CREATE INDEX IF NOT EXISTS hashtags_timestamp_idx ON hashtags (timestamp);
+
+CREATE TABLE IF NOT EXISTS mentions (
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- who was mentioned
+	post_id INT NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+	comment_id INT REFERENCES comments(id) ON DELETE CASCADE,
+	timestamp TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS mentions_user_post_comment_idx ON mentions (user_id, post_id, COALESCE(comment_id, 0));
+CREATE INDEX IF NOT EXISTS mentions_post_idx ON mentions (post_id);
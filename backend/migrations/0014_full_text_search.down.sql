@@ -0,0 +1,15 @@
+DROP TRIGGER IF EXISTS users_rename_search_trigger ON users;
+DROP TRIGGER IF EXISTS dive_sites_rename_search_trigger ON dive_sites;
+DROP FUNCTION IF EXISTS posts_search_rename();
+DROP TRIGGER IF EXISTS posts_search_trigger ON posts;
+DROP FUNCTION IF EXISTS posts_search_vector();
+DROP FUNCTION IF EXISTS post_search_vector(TEXT, TEXT, TEXT, INT, INT);
+ALTER TABLE posts DROP COLUMN IF EXISTS search_vector;
+
+DROP INDEX IF EXISTS dive_sites_name_trgm_idx;
+DROP TRIGGER IF EXISTS dive_sites_search_trigger ON dive_sites;
+DROP FUNCTION IF EXISTS dive_sites_search_vector();
+ALTER TABLE dive_sites DROP COLUMN IF EXISTS search_vector;
+
+DROP INDEX IF EXISTS users_name_trgm_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS search_vector;
@@ -0,0 +1,82 @@
+-- Full-text search over posts, dive sites and users, plus trigram matching
+-- so misspelled names still find people and sites.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- Users: their name and username
+ALTER TABLE users ADD COLUMN IF NOT EXISTS search_vector tsvector
+	GENERATED ALWAYS AS (
+		setweight(to_tsvector('english', COALESCE(first_name, '') || ' ' || COALESCE(last_name, '') || ' ' || COALESCE(username, '')), 'A') ||
+		setweight(to_tsvector('english', COALESCE(bio, '')), 'C')
+	) STORED;
+CREATE INDEX IF NOT EXISTS users_search_idx ON users USING gin (search_vector);
+CREATE INDEX IF NOT EXISTS users_name_trgm_idx ON users USING gin ((first_name || ' ' || last_name) gin_trgm_ops);
+
+-- Dive sites: name, aliases and description. Aliases are an array, which
+-- a generated column can't flatten, so a trigger keeps the vector.
+ALTER TABLE dive_sites ADD COLUMN IF NOT EXISTS search_vector tsvector;
+
+CREATE OR REPLACE FUNCTION dive_sites_search_vector() RETURNS trigger AS $$
+BEGIN
+	NEW.search_vector :=
+		setweight(to_tsvector('english', NEW.name || ' ' || array_to_string(NEW.aliases, ' ')), 'A') ||
+		setweight(to_tsvector('english', COALESCE(NEW.description, '')), 'C');
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER dive_sites_search_trigger
+	BEFORE INSERT OR UPDATE OF name, aliases, description ON dive_sites
+	FOR EACH ROW EXECUTE FUNCTION dive_sites_search_vector();
+
+UPDATE dive_sites SET name = name;
+CREATE INDEX IF NOT EXISTS dive_sites_search_idx ON dive_sites USING gin (search_vector);
+CREATE INDEX IF NOT EXISTS dive_sites_name_trgm_idx ON dive_sites USING gin (name gin_trgm_ops);
+
+-- Posts: title, activity and description, plus the names of the site and
+-- the author so "Casino Point" or a diver's name finds their dives. The
+-- triggers below refresh posts when a site or user is renamed.
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS search_vector tsvector;
+
+CREATE OR REPLACE FUNCTION post_search_vector(title TEXT, activity TEXT, description TEXT, site_id INT, user_id INT) RETURNS tsvector AS $$
+	SELECT
+		setweight(to_tsvector('english', COALESCE(title, '') || ' ' || COALESCE((SELECT name FROM dive_sites WHERE id = $4), '')), 'A') ||
+		setweight(to_tsvector('english', COALESCE(activity, '') || ' ' || COALESCE((SELECT first_name || ' ' || last_name FROM users WHERE id = $5), '')), 'B') ||
+		setweight(to_tsvector('english', COALESCE(description, '')), 'C');
+$$ LANGUAGE sql STABLE;
+
+CREATE OR REPLACE FUNCTION posts_search_vector() RETURNS trigger AS $$
+BEGIN
+	NEW.search_vector := post_search_vector(NEW.title, NEW.activity, NEW.description, NEW.site_id, NEW.user_id);
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER posts_search_trigger
+	BEFORE INSERT OR UPDATE OF title, activity, description, site_id, user_id ON posts
+	FOR EACH ROW EXECUTE FUNCTION posts_search_vector();
+
+CREATE OR REPLACE FUNCTION posts_search_rename() RETURNS trigger AS $$
+BEGIN
+	IF TG_TABLE_NAME = 'dive_sites' THEN
+		UPDATE posts p SET search_vector = post_search_vector(p.title, p.activity, p.description, p.site_id, p.user_id)
+		WHERE p.site_id = NEW.id;
+	ELSE
+		UPDATE posts p SET search_vector = post_search_vector(p.title, p.activity, p.description, p.site_id, p.user_id)
+		WHERE p.user_id = NEW.id;
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER dive_sites_rename_search_trigger
+	AFTER UPDATE OF name ON dive_sites
+	FOR EACH ROW WHEN (OLD.name IS DISTINCT FROM NEW.name)
+	EXECUTE FUNCTION posts_search_rename();
+
+CREATE TRIGGER users_rename_search_trigger
+	AFTER UPDATE OF first_name, last_name ON users
+	FOR EACH ROW WHEN (OLD.first_name IS DISTINCT FROM NEW.first_name OR OLD.last_name IS DISTINCT FROM NEW.last_name)
+	EXECUTE FUNCTION posts_search_rename();
+
+UPDATE posts SET search_vector = post_search_vector(title, activity, description, site_id, user_id);
+CREATE INDEX IF NOT EXISTS posts_search_idx ON posts USING gin (search_vector);
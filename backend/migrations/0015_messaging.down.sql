@@ -0,0 +1,6 @@
+DROP TRIGGER IF EXISTS messages_stream_trigger ON messages;
+DROP FUNCTION IF EXISTS messages_stream_event();
+DROP TABLE IF EXISTS blocks;
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS conversation_members;
+DROP TABLE IF EXISTS conversations;
@@ -0,0 +1,60 @@
+-- Direct messages between divers: one conversation per pair of users, plus
+-- small group conversations. Each member's last read message doubles as
+-- their read receipt.
+CREATE TABLE IF NOT EXISTS conversations (
+	id SERIAL PRIMARY KEY,
+	is_group BOOLEAN NOT NULL DEFAULT false,
+	title TEXT,
+	direct_key TEXT UNIQUE, -- "lowid:highid" for one-to-one conversations
+	created_by INT REFERENCES users(id) ON DELETE SET NULL,
+	last_activity TIMESTAMP NOT NULL DEFAULT now(),
+	timestamp TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS conversation_members (
+	conversation_id INT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	last_read_message_id INT NOT NULL DEFAULT 0,
+	joined_at TIMESTAMP NOT NULL DEFAULT now(),
+	PRIMARY KEY (conversation_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS conversation_members_user_idx ON conversation_members (user_id);
+
+CREATE TABLE IF NOT EXISTS messages (
+	id SERIAL PRIMARY KEY,
+	conversation_id INT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+	sender_id INT REFERENCES users(id) ON DELETE SET NULL,
+	content TEXT NOT NULL,
+	timestamp TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS messages_conversation_id_idx ON messages (conversation_id, id);
+
+-- A user who blocks another can't be messaged by them, and doesn't see
+-- their messages in group conversations.
+CREATE TABLE IF NOT EXISTS blocks (
+	blocker_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	blocked_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	timestamp TIMESTAMP NOT NULL DEFAULT now(),
+	PRIMARY KEY (blocker_id, blocked_id),
+	CHECK (blocker_id <> blocked_id)
+);
+
+-- New messages are streamed to every member who hasn't blocked the sender
+CREATE OR REPLACE FUNCTION messages_stream_event() RETURNS trigger AS $$
+BEGIN
+	INSERT INTO stream_events (user_id, type, data)
+	SELECT cm.user_id, 'message', json_build_object(
+		'id', NEW.id, 'conversation_id', NEW.conversation_id, 'sender_id', NEW.sender_id,
+		'content', NEW.content, 'timestamp', to_char(NEW.timestamp, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'))
+	FROM conversation_members cm
+	WHERE cm.conversation_id = NEW.conversation_id
+		AND NOT EXISTS (SELECT 1 FROM blocks b WHERE b.blocker_id = cm.user_id AND b.blocked_id = NEW.sender_id);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER messages_stream_trigger
+	AFTER INSERT ON messages
+	FOR EACH ROW EXECUTE FUNCTION messages_stream_event();
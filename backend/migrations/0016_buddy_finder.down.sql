@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS users_location_idx;
+ALTER TABLE users
+	DROP COLUMN IF EXISTS certification,
+	DROP COLUMN IF EXISTS location_visibility;
@@ -0,0 +1,12 @@
+-- Dive buddy finder. Users opt in to being found near their home location,
+-- either exactly or snapped to a coarse grid; until then it stays hidden.
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS certification TEXT
+		CHECK (certification IN ('open_water', 'advanced_open_water', 'rescue', 'divemaster', 'instructor')),
+	ADD COLUMN IF NOT EXISTS location_visibility TEXT NOT NULL DEFAULT 'hidden'
+		CHECK (location_visibility IN ('hidden', 'approximate', 'exact'));
+
+-- Radius searches: earth_box(center, radius) @> ll_to_earth(lat, lon)
+CREATE INDEX IF NOT EXISTS users_location_idx ON users
+	USING gist (ll_to_earth(latitude, longitude))
+	WHERE location_visibility <> 'hidden' AND latitude IS NOT NULL AND longitude IS NOT NULL;
@@ -0,0 +1,9 @@
+DROP TRIGGER IF EXISTS trips_capacity_promote_trigger ON trips;
+DROP FUNCTION IF EXISTS trips_capacity_promote();
+DROP TRIGGER IF EXISTS trip_rsvps_promote_trigger ON trip_rsvps;
+DROP FUNCTION IF EXISTS trip_rsvps_promote();
+DROP FUNCTION IF EXISTS promote_trip_waitlist(INT);
+DROP INDEX IF EXISTS posts_trip_id_idx;
+ALTER TABLE posts DROP COLUMN IF EXISTS trip_id;
+DROP TABLE IF EXISTS trip_rsvps;
+DROP TABLE IF EXISTS trips;
@@ -0,0 +1,80 @@
+-- Group dive trips. Divers RSVP until the trip is full and join a waitlist
+-- after that; afterwards they can link their post of the dive to the trip.
+CREATE TABLE IF NOT EXISTS trips (
+	id SERIAL PRIMARY KEY,
+	organizer_id INT REFERENCES users(id) ON DELETE SET NULL,
+	title TEXT NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	site_id INT REFERENCES dive_sites(id) ON DELETE SET NULL,
+	starts_at TIMESTAMP NOT NULL,
+	capacity INT NOT NULL CHECK (capacity > 0),
+	required_certification TEXT
+		CHECK (required_certification IN ('open_water', 'advanced_open_water', 'rescue', 'divemaster', 'instructor')),
+	timestamp TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS trips_starts_at_idx ON trips (starts_at, id);
+CREATE INDEX IF NOT EXISTS trips_site_id_idx ON trips (site_id);
+
+-- The waitlist is served in the order people joined it
+CREATE TABLE IF NOT EXISTS trip_rsvps (
+	trip_id INT NOT NULL REFERENCES trips(id) ON DELETE CASCADE,
+	user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	status TEXT NOT NULL CHECK (status IN ('going', 'waitlisted')),
+	timestamp TIMESTAMP NOT NULL DEFAULT now(),
+	PRIMARY KEY (trip_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS trip_rsvps_user_idx ON trip_rsvps (user_id);
+
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS trip_id INT REFERENCES trips(id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS posts_trip_id_idx ON posts (trip_id) WHERE trip_id IS NOT NULL;
+
+-- promote_trip_waitlist fills the open spots of an upcoming trip from its
+-- waitlist and tells the promoted divers over the event stream. It runs
+-- whenever a spot may have opened, however the RSVP went away.
+CREATE OR REPLACE FUNCTION promote_trip_waitlist(INT) RETURNS void AS $$
+BEGIN
+	WITH open AS (
+		SELECT t.capacity - (SELECT COUNT(*) FROM trip_rsvps WHERE trip_id = t.id AND status = 'going') AS spots
+		FROM trips t
+		WHERE t.id = $1 AND t.starts_at > now()
+	), promoted AS (
+		UPDATE trip_rsvps r SET status = 'going'
+		WHERE r.trip_id = $1 AND r.user_id IN (
+			SELECT w.user_id FROM trip_rsvps w
+			WHERE w.trip_id = $1 AND w.status = 'waitlisted'
+			ORDER BY w.timestamp, w.user_id
+			LIMIT GREATEST((SELECT spots FROM open), 0)
+		)
+		RETURNING r.user_id
+	)
+	INSERT INTO stream_events (user_id, type, data)
+	SELECT user_id, 'trip_promoted', json_build_object('trip_id', $1) FROM promoted;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION trip_rsvps_promote() RETURNS trigger AS $$
+BEGIN
+	IF OLD.status = 'going' THEN
+		PERFORM promote_trip_waitlist(OLD.trip_id);
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trip_rsvps_promote_trigger
+	AFTER DELETE ON trip_rsvps
+	FOR EACH ROW EXECUTE FUNCTION trip_rsvps_promote();
+
+CREATE OR REPLACE FUNCTION trips_capacity_promote() RETURNS trigger AS $$
+BEGIN
+	PERFORM promote_trip_waitlist(NEW.id);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trips_capacity_promote_trigger
+	AFTER UPDATE OF capacity ON trips
+	FOR EACH ROW WHEN (NEW.capacity > OLD.capacity)
+	EXECUTE FUNCTION trips_capacity_promote();
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS posts_conditions_version_trigger ON posts;
+DROP FUNCTION IF EXISTS posts_conditions_version();
+ALTER TABLE dive_sites DROP COLUMN IF EXISTS conditions_version;
@@ -0,0 +1,22 @@
+-- Bumped whenever a post at the site changes in a way its conditions
+-- depend on, so every server instance can tell when its cached
+-- conditions for the site are stale.
+ALTER TABLE dive_sites ADD COLUMN IF NOT EXISTS conditions_version BIGINT NOT NULL DEFAULT 0;
+
+CREATE OR REPLACE FUNCTION posts_conditions_version() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP <> 'INSERT' AND OLD.site_id IS NOT NULL THEN
+		UPDATE dive_sites SET conditions_version = conditions_version + 1 WHERE id = OLD.site_id;
+	END IF;
+	IF TG_OP <> 'DELETE' AND NEW.site_id IS NOT NULL
+		AND (TG_OP = 'INSERT' OR NEW.site_id IS DISTINCT FROM OLD.site_id) THEN
+		UPDATE dive_sites SET conditions_version = conditions_version + 1 WHERE id = NEW.site_id;
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Likes don't affect conditions, so like counts don't contend for the site
+CREATE TRIGGER posts_conditions_version_trigger
+	AFTER INSERT OR DELETE OR UPDATE OF site_id, user_id, date, visibility, rating, depth, water_temp, current ON posts
+	FOR EACH ROW EXECUTE FUNCTION posts_conditions_version();
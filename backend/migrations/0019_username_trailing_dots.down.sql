@@ -0,0 +1,5 @@
+-- Renamed users keep their new usernames
+CREATE OR REPLACE FUNCTION username_base(first_name TEXT, last_name TEXT) RETURNS TEXT AS $$
+	SELECT CASE WHEN length(base) < 2 THEN 'diver' ELSE base END
+	FROM (SELECT left(lower(regexp_replace(COALESCE(first_name, '') || '.' || COALESCE(last_name, ''), '[^A-Za-z0-9_.]', '', 'g')), 24) AS base) b;
+$$ LANGUAGE sql IMMUTABLE;
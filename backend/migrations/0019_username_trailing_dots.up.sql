@@ -0,0 +1,23 @@
+-- Mentions drop a trailing dot as punctuation, so usernames can't end in
+-- one. A user without a last name used to get a default like "john.".
+CREATE OR REPLACE FUNCTION username_base(first_name TEXT, last_name TEXT) RETURNS TEXT AS $$
+	SELECT CASE WHEN length(base) < 2 THEN 'diver' ELSE base END
+	FROM (SELECT rtrim(left(lower(regexp_replace(COALESCE(first_name, '') || '.' || COALESCE(last_name, ''), '[^A-Za-z0-9_.]', '', 'g')), 24), '.') AS base) b;
+$$ LANGUAGE sql IMMUTABLE;
+
+-- Existing usernames lose their trailing dots, with the user's id appended
+-- when the shorter name is taken
+WITH bases AS (
+	SELECT id, CASE WHEN length(rtrim(username, '.')) < 2 THEN 'diver' ELSE rtrim(username, '.') END AS base
+	FROM users
+	WHERE username LIKE '%.'
+), ranked AS (
+	SELECT id, base, row_number() OVER (PARTITION BY lower(base) ORDER BY id) AS n
+	FROM bases
+)
+UPDATE users SET username = CASE
+		WHEN ranked.n = 1 AND NOT EXISTS (SELECT 1 FROM users taken WHERE lower(taken.username) = lower(ranked.base))
+		THEN ranked.base
+		ELSE ranked.base || users.id
+	END
+FROM ranked WHERE ranked.id = users.id;
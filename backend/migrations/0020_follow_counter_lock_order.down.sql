@@ -0,0 +1,12 @@
+CREATE OR REPLACE FUNCTION users_follow_counter() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'INSERT' THEN
+		UPDATE users SET follower_count = follower_count + 1 WHERE id = NEW.followee_id;
+		UPDATE users SET following_count = following_count + 1 WHERE id = NEW.follower_id;
+	ELSIF TG_OP = 'DELETE' THEN
+		UPDATE users SET follower_count = follower_count - 1 WHERE id = OLD.followee_id;
+		UPDATE users SET following_count = following_count - 1 WHERE id = OLD.follower_id;
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,29 @@
+-- A follow and a follow back each updated the followee's row first, so the
+-- two could lock the pair of users in opposite orders and deadlock. Both
+-- rows are now locked in id order and updated in one statement.
+CREATE OR REPLACE FUNCTION users_follow_counter() RETURNS trigger AS $$
+DECLARE
+	delta INT;
+	follower INT;
+	followee INT;
+BEGIN
+	IF TG_OP = 'INSERT' THEN
+		delta := 1;
+		follower := NEW.follower_id;
+		followee := NEW.followee_id;
+	ELSIF TG_OP = 'DELETE' THEN
+		delta := -1;
+		follower := OLD.follower_id;
+		followee := OLD.followee_id;
+	ELSE
+		RETURN NULL;
+	END IF;
+
+	PERFORM 1 FROM users WHERE id IN (follower, followee) ORDER BY id FOR UPDATE;
+	UPDATE users SET
+		follower_count = follower_count + CASE WHEN id = followee THEN delta ELSE 0 END,
+		following_count = following_count + CASE WHEN id = follower THEN delta ELSE 0 END
+	WHERE id IN (follower, followee);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
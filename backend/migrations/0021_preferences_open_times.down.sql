@@ -0,0 +1,2 @@
+UPDATE preferences SET time_start = '0001-01-01 00:00:00' WHERE time_start IS NULL;
+UPDATE preferences SET time_end = '0001-01-01 00:00:00' WHERE time_end IS NULL;
@@ -0,0 +1,4 @@
+-- Preferences without a time range used to be saved with the zero time;
+-- an open range is now NULL
+UPDATE preferences SET time_start = NULL WHERE time_start = '0001-01-01 00:00:00';
+UPDATE preferences SET time_end = NULL WHERE time_end = '0001-01-01 00:00:00';
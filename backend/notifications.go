@@ -0,0 +1,329 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Notification types
+const (
+	notifyLike    = "like"
+	notifyComment = "comment"
+	notifyFollow  = "follow"
+	notifyMention = "mention"
+)
+
+const (
+	defaultNotificationPageSize = 20
+	maxNotificationPageSize     = 100
+	// notificationActors is how many actors a coalesced notification names.
+	notificationActors = 3
+)
+
+type notificationActor struct {
+	Id        int    `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Avatar    string `json:"avatar,omitempty"`
+}
+
+// notification is a group of notifications sharing a group key and read
+// state, such as the unread likes of one post, described by the most
+// recent of them.
+type notification struct {
+	Id         int                 `json:"id"` // the most recent notification in the group
+	Type       string              `json:"type"`
+	PostId     *int                `json:"post_id,omitempty"`
+	CommentId  *int                `json:"comment_id,omitempty"`
+	Actors     []notificationActor `json:"actors"` // most recent first
+	ActorCount int                 `json:"actor_count"`
+	Message    string              `json:"message"`
+	Read       bool                `json:"read"`
+	Timestamp  time.Time           `json:"timestamp"`
+}
+
+type notificationPage struct {
+	Notifications []notification `json:"notifications"`
+	UnreadCount   int            `json:"unread_count"`
+	NextCursor    string         `json:"next_cursor,omitempty"`
+}
+
+// notificationGroupKey decides which notifications are shown together.
+// Likes of a post coalesce, as do new followers; comments and mentions
+// each stand alone.
+func notificationGroupKey(kind string, postID, commentID *int) string {
+	switch {
+	case kind == notifyFollow:
+		return kind
+	case kind == notifyLike && postID != nil:
+		return fmt.Sprintf("%s:post:%d", kind, *postID)
+	case commentID != nil:
+		return fmt.Sprintf("%s:comment:%d", kind, *commentID)
+	case postID != nil:
+		return fmt.Sprintf("%s:post:%d", kind, *postID)
+	}
+	return kind
+}
+
+// notificationMessage describes a notification group, such as "Maya and 4
+// others liked your dive".
+func notificationMessage(n notification) string {
+	who := "Someone"
+	if len(n.Actors) > 0 {
+		who = n.Actors[0].FirstName
+	}
+	switch {
+	case n.ActorCount == 2 && len(n.Actors) > 1:
+		who += " and " + n.Actors[1].FirstName
+	case n.ActorCount == 2:
+		who += " and 1 other"
+	case n.ActorCount > 2:
+		who += fmt.Sprintf(" and %d others", n.ActorCount-1)
+	}
+
+	switch n.Type {
+	case notifyLike:
+		return who + " liked your dive"
+	case notifyComment:
+		return who + " commented on your dive"
+	case notifyFollow:
+		return who + " started following you"
+	case notifyMention:
+		if n.CommentId != nil {
+			return who + " mentioned you in a comment"
+		}
+		return who + " mentioned you in a dive"
+	}
+	return who + " did something"
+}
+
+// notify stores a notification for recipientID about something actorID
+// did. Nobody is notified of their own actions.
+func notify(db *sql.DB, kind string, recipientID, actorID int, postID, commentID *int) error {
+	if recipientID == actorID {
+		return nil
+	}
+	_, err := db.Exec(`
+		INSERT INTO notifications (user_id, actor_id, type, post_id, comment_id, group_key)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		recipientID, actorID, kind, postID, commentID, notificationGroupKey(kind, postID, commentID))
+	return err
+}
+
+// notifyPostAuthor notifies the author of a post that actorID liked or
+// commented on it.
+func notifyPostAuthor(db *sql.DB, kind string, actorID, postID int, commentID *int) error {
+	authorID, err := postOwner(db, strconv.Itoa(postID))
+	if err != nil {
+		return err
+	}
+	return notify(db, kind, authorID, actorID, &postID, commentID)
+}
+
+// unreadNotificationCount counts the caller's unread notification groups,
+// the number a badge would show.
+func unreadNotificationCount(db *sql.DB, userID int) (int, error) {
+	var n int
+	err := db.QueryRow(`
+		SELECT COUNT(DISTINCT group_key) FROM notifications
+		WHERE user_id = $1 AND read_at IS NULL`, userID).Scan(&n)
+	return n, err
+}
+
+// loadNotificationActors fills in the actors of each notification from
+// their ids, keeping the first notificationActors distinct ones.
+func loadNotificationActors(db *sql.DB, page []notification, actorIDs [][]int64) error {
+	var all []int64
+	for _, ids := range actorIDs {
+		all = append(all, ids...)
+	}
+	actors := map[int64]notificationActor{}
+	if len(all) > 0 {
+		rows, err := db.Query("SELECT id, first_name, last_name, COALESCE(avatar, '') FROM users WHERE id = ANY($1)", pq.Array(all))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var a notificationActor
+			if err := rows.Scan(&a.Id, &a.FirstName, &a.LastName, &a.Avatar); err != nil {
+				return err
+			}
+			actors[int64(a.Id)] = a
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	for i := range page {
+		page[i].Actors = []notificationActor{}
+		seen := map[int64]bool{}
+		for _, id := range actorIDs[i] {
+			a, ok := actors[id]
+			if !ok || seen[id] || len(page[i].Actors) == notificationActors {
+				continue
+			}
+			seen[id] = true
+			page[i].Actors = append(page[i].Actors, a)
+		}
+		page[i].Message = notificationMessage(page[i])
+	}
+	return nil
+}
+
+// getNotifications lists the caller's notifications, newest first, with
+// notifications that share a group key coalesced. ?unread=true lists only
+// unread ones; ?limit= and ?cursor= paginate.
+func getNotifications(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		limit, cursor, err := pageParams(r, "notifications", defaultNotificationPageSize, maxNotificationPageSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		args := queryArgs{callerID}
+		where, having := "n.user_id = $1", ""
+		if r.URL.Query().Get("unread") == "true" {
+			where += " AND n.read_at IS NULL"
+		}
+		if cursor != nil {
+			having = fmt.Sprintf(" HAVING (MAX(n.timestamp), MAX(n.id)) < (%s::timestamp, %s)", args.add(cursor.Value), args.add(cursor.Id))
+		}
+		rows, err := db.Query(`
+			SELECT MAX(n.id), MIN(n.type), MIN(n.post_id), MIN(n.comment_id),
+				(array_agg(n.actor_id ORDER BY n.timestamp DESC, n.id DESC))[1:20], COUNT(DISTINCT n.actor_id),
+				n.read_at IS NOT NULL, MAX(n.timestamp)
+			FROM notifications n
+			WHERE `+where+`
+			GROUP BY n.group_key, n.read_at IS NOT NULL`+having+`
+			ORDER BY MAX(n.timestamp) DESC, MAX(n.id) DESC
+			LIMIT `+strconv.Itoa(limit+1), args...)
+		if err != nil {
+			http.Error(w, "Failed to retrieve notifications", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		defer rows.Close()
+
+		page := notificationPage{Notifications: []notification{}}
+		var actorIDs [][]int64
+		for rows.Next() {
+			var n notification
+			var ids []int64
+			if err := rows.Scan(&n.Id, &n.Type, &n.PostId, &n.CommentId, pq.Array(&ids), &n.ActorCount, &n.Read, &n.Timestamp); err != nil {
+				http.Error(w, "Error scanning notification data", http.StatusInternalServerError)
+				log.Println("Scan error:", err)
+				return
+			}
+			// The extra row only tells us there is another page
+			if len(page.Notifications) == limit {
+				last := page.Notifications[limit-1]
+				page.NextCursor = encodePostCursor(postCursor{Sort: "notifications", Value: cursorValue(last.Timestamp), Id: last.Id})
+				break
+			}
+			page.Notifications = append(page.Notifications, n)
+			actorIDs = append(actorIDs, ids)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error processing notification data", http.StatusInternalServerError)
+			log.Println("Rows iteration error:", err)
+			return
+		}
+
+		if err := loadNotificationActors(db, page.Notifications, actorIDs); err == nil {
+			page.UnreadCount, err = unreadNotificationCount(db, callerID)
+		}
+		if err != nil {
+			http.Error(w, "Failed to retrieve notifications", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// getUnreadNotificationCount returns {"unread_count": n} for badges that
+// poll more often than the list is opened.
+func getUnreadNotificationCount(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		n, err := unreadNotificationCount(db, callerID)
+		if err != nil {
+			http.Error(w, "Failed to count notifications", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]int{"unread_count": n})
+	}
+}
+
+// markNotificationRead marks the notification in the path read, along
+// with the earlier unread ones coalesced with it.
+func markNotificationRead(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id := mux.Vars(r)["id"]
+
+		var groupKey string
+		err = db.QueryRow("SELECT group_key FROM notifications WHERE id = $1 AND user_id = $2", id, callerID).Scan(&groupKey)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Notification not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			_, err = db.Exec(`
+				UPDATE notifications SET read_at = now()
+				WHERE user_id = $1 AND group_key = $2 AND id <= $3 AND read_at IS NULL`, callerID, groupKey, id)
+		}
+		if err != nil {
+			http.Error(w, "Failed to update notification", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// markAllNotificationsRead marks every notification of the caller read.
+func markAllNotificationsRead(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if _, err := db.Exec("UPDATE notifications SET read_at = now() WHERE user_id = $1 AND read_at IS NULL", callerID); err != nil {
+			http.Error(w, "Failed to update notifications", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
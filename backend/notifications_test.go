@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestNotificationGroupKey(t *testing.T) {
+	for _, c := range []struct {
+		kind              string
+		postID, commentID *int
+		want              string
+	}{
+		{notifyLike, intPtr(4), nil, "like:post:4"},
+		{notifyFollow, nil, nil, "follow"},
+		{notifyComment, intPtr(4), intPtr(9), "comment:comment:9"},
+		{notifyMention, intPtr(4), nil, "mention:post:4"},
+		{notifyMention, intPtr(4), intPtr(9), "mention:comment:9"},
+	} {
+		if got := notificationGroupKey(c.kind, c.postID, c.commentID); got != c.want {
+			t.Errorf("notificationGroupKey(%s) = %q, want %q", c.kind, got, c.want)
+		}
+	}
+}
+
+func TestNotificationMessage(t *testing.T) {
+	maya, tom := notificationActor{FirstName: "Maya"}, notificationActor{FirstName: "Tom"}
+	for _, c := range []struct {
+		n    notification
+		want string
+	}{
+		{notification{Type: notifyLike, Actors: []notificationActor{maya}, ActorCount: 1}, "Maya liked your dive"},
+		{notification{Type: notifyLike, Actors: []notificationActor{maya, tom}, ActorCount: 2}, "Maya and Tom liked your dive"},
+		{notification{Type: notifyLike, Actors: []notificationActor{maya, tom}, ActorCount: 5}, "Maya and 4 others liked your dive"},
+		{notification{Type: notifyFollow, Actors: []notificationActor{maya}, ActorCount: 2}, "Maya and 1 other started following you"},
+		{notification{Type: notifyComment, Actors: []notificationActor{tom}, ActorCount: 1}, "Tom commented on your dive"},
+		{notification{Type: notifyMention, CommentId: intPtr(3), Actors: []notificationActor{tom}, ActorCount: 1}, "Tom mentioned you in a comment"},
+		{notification{Type: notifyMention, ActorCount: 1}, "Someone mentioned you in a dive"},
+	} {
+		if got := notificationMessage(c.n); got != c.want {
+			t.Errorf("notificationMessage(%+v) = %q, want %q", c.n, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// The policy layer decides whether the authenticated caller may mutate a
+// resource. Handlers call authorize* before touching the database; on
+// failure the response has already been written and they simply return.
+
+// ownerLookup returns the id of the user who owns the resource with the
+// given id, or sql.ErrNoRows if it doesn't exist.
+type ownerLookup func(db *sql.DB, id string) (int, error)
+
+func postOwner(db *sql.DB, id string) (int, error) {
+	var ownerID int
+	err := db.QueryRow("SELECT user_id FROM posts WHERE id = $1", id).Scan(&ownerID)
+	return ownerID, err
+}
+
+func commentOwner(db *sql.DB, id string) (int, error) {
+	var ownerID int
+	err := db.QueryRow("SELECT user_id FROM comments WHERE id = $1", id).Scan(&ownerID)
+	return ownerID, err
+}
+
+// commentModerator returns the owner of the post a comment belongs to, who
+// may remove comments left on their dive.
+func commentModerator(db *sql.DB, id string) (int, error) {
+	var ownerID int
+	err := db.QueryRow(`
+		SELECT p.user_id FROM comments c JOIN posts p ON p.id = c.post_id
+		WHERE c.id = $1`, id).Scan(&ownerID)
+	return ownerID, err
+}
+
+// siteOwner returns the user who added a dive site; a site whose creator
+// has left belongs to nobody.
+func siteOwner(db *sql.DB, id string) (int, error) {
+	var ownerID int
+	err := db.QueryRow("SELECT COALESCE(created_by, 0) FROM dive_sites WHERE id = $1", id).Scan(&ownerID)
+	return ownerID, err
+}
+
+func userOwner(db *sql.DB, id string) (int, error) {
+	var ownerID int
+	err := db.QueryRow("SELECT id FROM users WHERE id = $1", id).Scan(&ownerID)
+	return ownerID, err
+}
+
+// getCallerID returns the authenticated user's id as an int.
+func getCallerID(r *http.Request) (int, error) {
+	userID, err := getUserIDFromContext(r.Context())
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(userID)
+}
+
+// authorizeOwner checks that the caller owns the resource, or passes one of
+// the optional alternative lookups (e.g. a moderator). It writes 401, 404,
+// 403 or 500 and returns false when the request must stop. An id that isn't
+// a number names nothing, so it is a 404 rather than a failed cast in SQL.
+func authorizeOwner(w http.ResponseWriter, r *http.Request, db *sql.DB, id string, owner ownerLookup, alternatives ...ownerLookup) (int, bool) {
+	callerID, err := getCallerID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return 0, false
+	}
+	if _, err := strconv.Atoi(id); err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return callerID, false
+	}
+
+	for _, lookup := range append([]ownerLookup{owner}, alternatives...) {
+		ownerID, err := lookup(db, id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return callerID, false
+		}
+		if err != nil {
+			log.Println("Database error:", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return callerID, false
+		}
+		if ownerID == callerID {
+			return callerID, true
+		}
+	}
+
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return callerID, false
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeOwnerRejectsNonNumericIDs(t *testing.T) {
+	lookup := func(db *sql.DB, id string) (int, error) {
+		t.Fatalf("Expected no lookup for id %q", id)
+		return 0, nil
+	}
+
+	for _, id := range []string{"abc", "1abc", "", "1.5"} {
+		r := httptest.NewRequest("PUT", "/api/go/posts/"+id, nil)
+		r = r.WithContext(context.WithValue(r.Context(), "user_id", "7"))
+		rr := httptest.NewRecorder()
+		if _, ok := authorizeOwner(rr, r, nil, id, lookup); ok || rr.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for id %q, got %d", id, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSearchRadiusKm applies when a center point is given without a
+// radius. Logged coordinates for the same site rarely match exactly.
+const defaultSearchRadiusKm = 1.0
+
+const maxSearchRadiusKm = 20000.0
+
+const (
+	defaultPostPageSize = 20
+	maxPostPageSize     = 100
+)
+
+// postSort describes one sort order. Every order breaks ties on p.id in the
+// same direction, which makes (key, id) a stable keyset for pagination.
+type postSort struct {
+	Expr string // SQL for the sort key; empty means the search distance
+	Desc bool
+	// Type is the SQL type of the key. Cursor values are cast to it, so the
+	// comparison stays on the column and can use its index.
+	Type string
+}
+
+var postSorts = map[string]postSort{
+	"newest":        {Expr: "p.timestamp", Desc: true, Type: "timestamp"},
+	"oldest":        {Expr: "p.timestamp", Type: "timestamp"},
+	"most_liked":    {Expr: "p.likes", Desc: true, Type: "int"},
+	"highest_rated": {Expr: "COALESCE(p.rating, 0)", Desc: true, Type: "float8"},
+	"deepest":       {Expr: "COALESCE(p.depth, 0)", Desc: true, Type: "float8"},
+	"nearest":       {Type: "float8"},
+}
+
+// postCursor is the position after the last post of a page. Clients treat
+// it as an opaque string.
+type postCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	Id    int    `json:"id"`
+}
+
+func encodePostCursor(c postCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodePostCursor(raw string) (postCursor, error) {
+	var c postCursor
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	return c, nil
+}
+
+// cursorValue formats a scanned sort key for a cursor.
+func cursorValue(key interface{}) string {
+	switch v := key.(type) {
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// postSearchFilters is the JSON body of POST /api/go/posts/search. Location
+// filters are pointers so that 0 (the equator, the prime meridian) is a
+// real value rather than "unset".
+type postSearchFilters struct {
+	UserID   int    `json:"user_id"`
+	SiteID   int    `json:"site_id"`
+	Date     string `json:"date"`
+	Activity string `json:"activity"`
+
+	// Radius search around a center point
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	RadiusKm  float64  `json:"radius_km"`
+
+	// Bounding box, matching FilterValues on the frontend. A longitude_min
+	// greater than longitude_max means the box crosses the antimeridian.
+	LatitudeMin  *float64 `json:"latitude_min"`
+	LatitudeMax  *float64 `json:"latitude_max"`
+	LongitudeMin *float64 `json:"longitude_min"`
+	LongitudeMax *float64 `json:"longitude_max"`
+
+	// Dive-log filters. Ranges are inclusive and either end may be left out;
+	// depth is the maximum depth of the dive.
+	DepthMin      *float64 `json:"depth_min"`
+	DepthMax      *float64 `json:"depth_max"`
+	BottomTimeMin *int     `json:"bottom_time_min"`
+	BottomTimeMax *int     `json:"bottom_time_max"`
+	WaterTempMin  *float64 `json:"water_temp_min"`
+	WaterTempMax  *float64 `json:"water_temp_max"`
+	GasMix        string   `json:"gas_mix"`
+	Suit          string   `json:"suit"`
+	Current       string   `json:"current"`
+	EntryType     string   `json:"entry_type"`
+
+	// Sort is one of newest (default), oldest, most_liked, highest_rated,
+	// deepest or nearest. Limit caps the page size and Cursor continues
+	// from the next_cursor of a previous page.
+	Sort   string `json:"sort"`
+	Limit  int    `json:"limit"`
+	Cursor string `json:"cursor"`
+}
+
+// postSearchPage is the response envelope of a post search.
+type postSearchPage struct {
+	Posts      []CombinedPost `json:"posts"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// queryArgs collects positional arguments while a query is being built.
+type queryArgs []interface{}
+
+// add appends a value and returns its $n placeholder.
+func (a *queryArgs) add(v interface{}) string {
+	*a = append(*a, v)
+	return fmt.Sprintf("$%d", len(*a))
+}
+
+func validLatitude(v float64) bool  { return v >= -90 && v <= 90 }
+func validLongitude(v float64) bool { return v >= -180 && v <= 180 }
+
+func (f postSearchFilters) hasCenter() bool {
+	return f.Latitude != nil && f.Longitude != nil
+}
+
+func (f postSearchFilters) hasBoundingBox() bool {
+	return f.LatitudeMin != nil || f.LatitudeMax != nil || f.LongitudeMin != nil || f.LongitudeMax != nil
+}
+
+func (f postSearchFilters) validate() error {
+	if (f.Latitude == nil) != (f.Longitude == nil) {
+		return fmt.Errorf("latitude and longitude must be given together")
+	}
+	if f.hasCenter() {
+		if !validLatitude(*f.Latitude) || !validLongitude(*f.Longitude) {
+			return fmt.Errorf("center point is out of range")
+		}
+		if f.RadiusKm < 0 || f.RadiusKm > maxSearchRadiusKm {
+			return fmt.Errorf("radius_km must be between 0 and %.0f", maxSearchRadiusKm)
+		}
+		if f.hasBoundingBox() {
+			return fmt.Errorf("use either a center point and radius or a bounding box, not both")
+		}
+	} else if f.RadiusKm != 0 {
+		return fmt.Errorf("radius_km requires latitude and longitude")
+	}
+
+	for _, v := range []*float64{f.LatitudeMin, f.LatitudeMax} {
+		if v != nil && !validLatitude(*v) {
+			return fmt.Errorf("latitude bounds are out of range")
+		}
+	}
+	for _, v := range []*float64{f.LongitudeMin, f.LongitudeMax} {
+		if v != nil && !validLongitude(*v) {
+			return fmt.Errorf("longitude bounds are out of range")
+		}
+	}
+	if f.LatitudeMin != nil && f.LatitudeMax != nil && *f.LatitudeMin > *f.LatitudeMax {
+		return fmt.Errorf("latitude_min must not exceed latitude_max")
+	}
+
+	if f.DepthMin != nil && f.DepthMax != nil && *f.DepthMin > *f.DepthMax {
+		return fmt.Errorf("depth_min must not exceed depth_max")
+	}
+	if f.BottomTimeMin != nil && f.BottomTimeMax != nil && *f.BottomTimeMin > *f.BottomTimeMax {
+		return fmt.Errorf("bottom_time_min must not exceed bottom_time_max")
+	}
+	if f.WaterTempMin != nil && f.WaterTempMax != nil && *f.WaterTempMin > *f.WaterTempMax {
+		return fmt.Errorf("water_temp_min must not exceed water_temp_max")
+	}
+	for _, e := range []struct {
+		name, value string
+		allowed     []string
+	}{
+		{"gas_mix", f.GasMix, gasMixes},
+		{"suit", f.Suit, suitTypes},
+		{"current", f.Current, currents},
+		{"entry_type", f.EntryType, entryTypes},
+	} {
+		if e.value != "" && !oneOf(e.value, e.allowed) {
+			return fmt.Errorf("%s must be one of %s", e.name, strings.Join(e.allowed, ", "))
+		}
+	}
+
+	if _, ok := postSorts[f.sortName()]; !ok {
+		return fmt.Errorf("unknown sort %q", f.Sort)
+	}
+	if f.sortName() == "nearest" && !f.hasCenter() && !f.hasBoundingBox() {
+		return fmt.Errorf("sort nearest requires a location")
+	}
+	if f.Limit < 0 || f.Limit > maxPostPageSize {
+		return fmt.Errorf("limit must be between 1 and %d", maxPostPageSize)
+	}
+	return nil
+}
+
+func (f postSearchFilters) sortName() string {
+	if f.Sort == "" {
+		return "newest"
+	}
+	return f.Sort
+}
+
+func (f postSearchFilters) pageSize() int {
+	if f.Limit == 0 {
+		return defaultPostPageSize
+	}
+	return f.Limit
+}
+
+// postSearchQuery is the WHERE clause and extra columns for a post search.
+type postSearchQuery struct {
+	Conditions []string
+	Args       queryArgs
+	// DistanceExpr computes the distance in km from the search center, or
+	// is empty when the search has no location component. Read it through
+	// distance(), which fills it in for bounding box searches.
+	DistanceExpr string
+	// boxCenter is the middle of a bounding box search, ranked by distance
+	// from it.
+	boxCenter *[2]float64
+	// SortExpr is the sort key column, selected so the cursor can be built
+	// from the last row. Read it through sortKey(); it is the distance for
+	// the nearest sort.
+	SortExpr string
+	Sort     string
+	Desc     bool
+	PageSize int
+}
+
+// hasDistance reports whether the search has a center to measure from.
+func (q *postSearchQuery) hasDistance() bool {
+	return q.DistanceExpr != "" || q.boxCenter != nil
+}
+
+// distance returns DistanceExpr, adding the center of a bounding box to
+// Args the first time. Postgres can't type a parameter that the query
+// never uses, so queries that don't select the distance, like exports,
+// must not have the center among their args.
+func (q *postSearchQuery) distance() string {
+	if q.DistanceExpr == "" && q.boxCenter != nil {
+		center := fmt.Sprintf("ll_to_earth(%s, %s)", q.Args.add(q.boxCenter[0]), q.Args.add(q.boxCenter[1]))
+		q.DistanceExpr = fmt.Sprintf("earth_distance(%s, ll_to_earth(p.latitude, p.longitude)) / 1000.0", center)
+	}
+	return q.DistanceExpr
+}
+
+func (q postSearchQuery) where() string {
+	if len(q.Conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(q.Conditions, " AND ")
+}
+
+func (q *postSearchQuery) sortKey() string {
+	if q.SortExpr == "" {
+		q.SortExpr = "(" + q.distance() + ")"
+	}
+	return q.SortExpr
+}
+
+// orderBy fetches one row more than the page size so the handler can tell
+// whether another page exists.
+func (q *postSearchQuery) orderBy() string {
+	dir := "ASC"
+	if q.Desc {
+		dir = "DESC"
+	}
+	return fmt.Sprintf(" ORDER BY %s %s, p.id %s LIMIT %d", q.sortKey(), dir, dir, q.PageSize+1)
+}
+
+// buildPostSearch turns filters into SQL over posts aliased as p.
+func buildPostSearch(f postSearchFilters) (postSearchQuery, error) {
+	var q postSearchQuery
+	if err := f.validate(); err != nil {
+		return q, err
+	}
+
+	if f.UserID > 0 {
+		q.Conditions = append(q.Conditions, "p.user_id = "+q.Args.add(f.UserID))
+	}
+	if f.SiteID > 0 {
+		q.Conditions = append(q.Conditions, "p.site_id = "+q.Args.add(f.SiteID))
+	}
+	if f.Date != "" {
+		q.Conditions = append(q.Conditions, "p.date = "+q.Args.add(f.Date))
+	}
+	if f.Activity != "" {
+		q.Conditions = append(q.Conditions, "p.activity = "+q.Args.add(f.Activity))
+	}
+
+	for _, r := range []struct {
+		cond  string
+		value interface{}
+		set   bool
+	}{
+		{"p.depth >=", f.DepthMin, f.DepthMin != nil},
+		{"p.depth <=", f.DepthMax, f.DepthMax != nil},
+		{"p.bottom_time >=", f.BottomTimeMin, f.BottomTimeMin != nil},
+		{"p.bottom_time <=", f.BottomTimeMax, f.BottomTimeMax != nil},
+		{"p.water_temp >=", f.WaterTempMin, f.WaterTempMin != nil},
+		{"p.water_temp <=", f.WaterTempMax, f.WaterTempMax != nil},
+		{"p.gas_mix =", f.GasMix, f.GasMix != ""},
+		{"p.suit =", f.Suit, f.Suit != ""},
+		{"p.current =", f.Current, f.Current != ""},
+		{"p.entry_type =", f.EntryType, f.EntryType != ""},
+	} {
+		if r.set {
+			q.Conditions = append(q.Conditions, r.cond+" "+q.Args.add(r.value))
+		}
+	}
+
+	switch {
+	case f.hasCenter():
+		radiusMeters := f.RadiusKm * 1000
+		if radiusMeters == 0 {
+			radiusMeters = defaultSearchRadiusKm * 1000
+		}
+		center := fmt.Sprintf("ll_to_earth(%s, %s)", q.Args.add(*f.Latitude), q.Args.add(*f.Longitude))
+		radius := q.Args.add(radiusMeters)
+
+		// earth_box is a cheap, indexable superset of the circle; the
+		// earth_distance check trims its corners
+		q.Conditions = append(q.Conditions,
+			"p.latitude IS NOT NULL AND p.longitude IS NOT NULL",
+			fmt.Sprintf("earth_box(%s, %s) @> ll_to_earth(p.latitude, p.longitude)", center, radius),
+			fmt.Sprintf("earth_distance(%s, ll_to_earth(p.latitude, p.longitude)) <= %s", center, radius),
+		)
+		q.DistanceExpr = fmt.Sprintf("earth_distance(%s, ll_to_earth(p.latitude, p.longitude)) / 1000.0", center)
+
+	case f.hasBoundingBox():
+		latMin, latMax := -90.0, 90.0
+		if f.LatitudeMin != nil {
+			latMin = *f.LatitudeMin
+		}
+		if f.LatitudeMax != nil {
+			latMax = *f.LatitudeMax
+		}
+		lonMin, lonMax := -180.0, 180.0
+		if f.LongitudeMin != nil {
+			lonMin = *f.LongitudeMin
+		}
+		if f.LongitudeMax != nil {
+			lonMax = *f.LongitudeMax
+		}
+
+		q.Conditions = append(q.Conditions,
+			fmt.Sprintf("p.latitude BETWEEN %s AND %s", q.Args.add(latMin), q.Args.add(latMax)))
+
+		centerLon := (lonMin + lonMax) / 2
+		if lonMin <= lonMax {
+			q.Conditions = append(q.Conditions,
+				fmt.Sprintf("p.longitude BETWEEN %s AND %s", q.Args.add(lonMin), q.Args.add(lonMax)))
+		} else {
+			q.Conditions = append(q.Conditions,
+				fmt.Sprintf("(p.longitude >= %s OR p.longitude <= %s)", q.Args.add(lonMin), q.Args.add(lonMax)))
+			centerLon += 180
+			if centerLon > 180 {
+				centerLon -= 360
+			}
+		}
+
+		// Rank by distance from the middle of the box
+		q.boxCenter = &[2]float64{(latMin + latMax) / 2, centerLon}
+	}
+
+	// Location searches rank by distance unless another order is asked for
+	q.Sort = f.sortName()
+	if f.Sort == "" && q.hasDistance() {
+		q.Sort = "nearest"
+	}
+	sort := postSorts[q.Sort]
+	q.SortExpr, q.Desc, q.PageSize = sort.Expr, sort.Desc, f.pageSize()
+
+	if f.Cursor != "" {
+		cursor, err := decodePostCursor(f.Cursor)
+		if err != nil {
+			return q, err
+		}
+		if cursor.Sort != q.Sort {
+			return q, fmt.Errorf("cursor does not match sort %q", q.Sort)
+		}
+
+		op := ">"
+		if q.Desc {
+			op = "<"
+		}
+		q.Conditions = append(q.Conditions, fmt.Sprintf("(%s, p.id) %s (%s::%s, %s)",
+			q.sortKey(), op, q.Args.add(cursor.Value), sort.Type, q.Args.add(cursor.Id)))
+	}
+
+	return q, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func float64Ptr(v float64) *float64 { return &v }
+
+func TestBuildPostSearchRadius(t *testing.T) {
+	q, err := buildPostSearch(postSearchFilters{
+		Latitude:  float64Ptr(0),
+		Longitude: float64Ptr(0),
+		RadiusKm:  25,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if q.DistanceExpr == "" {
+		t.Error("Expected a distance expression for a radius search")
+	}
+	if !strings.Contains(q.where(), "earth_box(") {
+		t.Errorf("Expected an indexable earth_box condition, got %s", q.where())
+	}
+	if len(q.Args) != 3 || q.Args[2] != 25000.0 {
+		t.Errorf("Expected center and radius in meters as args, got %v", q.Args)
+	}
+}
+
+func TestBuildPostSearchBoundingBoxAcrossAntimeridian(t *testing.T) {
+	q, err := buildPostSearch(postSearchFilters{
+		LatitudeMin:  float64Ptr(-20),
+		LatitudeMax:  float64Ptr(-10),
+		LongitudeMin: float64Ptr(170),
+		LongitudeMax: float64Ptr(-170),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !strings.Contains(q.where(), "p.longitude >= $3 OR p.longitude <= $4") {
+		t.Errorf("Expected a wrapped longitude range, got %s", q.where())
+	}
+	q.distance()
+	if centerLon := q.Args[len(q.Args)-1]; centerLon != 180.0 {
+		t.Errorf("Expected box center on the antimeridian, got %v", centerLon)
+	}
+}
+
+func TestBuildPostSearchBoundingBoxCenterOnlyWhenUsed(t *testing.T) {
+	filters := postSearchFilters{LatitudeMin: float64Ptr(10), LongitudeMax: float64Ptr(20), Sort: "newest"}
+	q, err := buildPostSearch(filters)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Exports select neither the distance nor the sort key
+	if n := strings.Count(q.where(), "$"); len(q.Args) != n {
+		t.Errorf("Expected only the args the conditions use, got %v for %s", q.Args, q.where())
+	}
+
+	q.distance()
+	if len(q.Args) != 6 || q.Args[4] != 50.0 {
+		t.Errorf("Expected the box center added for the distance, got %v", q.Args)
+	}
+}
+
+func TestBuildPostSearchCursorCastsToKeyType(t *testing.T) {
+	for sort, want := range map[string]string{
+		"most_liked":    "(p.likes, p.id) < ($1::int, $2)",
+		"highest_rated": "(COALESCE(p.rating, 0), p.id) < ($1::float8, $2)",
+		"newest":        "(p.timestamp, p.id) < ($1::timestamp, $2)",
+	} {
+		cursor := encodePostCursor(postCursor{Sort: sort, Value: "3", Id: 9})
+		q, err := buildPostSearch(postSearchFilters{Sort: sort, Cursor: cursor})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", sort, err)
+		}
+		if !strings.Contains(q.where(), want) {
+			t.Errorf("Expected %s in the %s conditions, got %s", want, sort, q.where())
+		}
+	}
+}
+
+func TestBuildPostSearchValidation(t *testing.T) {
+	cases := map[string]postSearchFilters{
+		"latitude without longitude": {Latitude: float64Ptr(10)},
+		"radius without center":      {RadiusKm: 5},
+		"center out of range":        {Latitude: float64Ptr(95), Longitude: float64Ptr(0)},
+		"center and box":             {Latitude: float64Ptr(1), Longitude: float64Ptr(1), LatitudeMin: float64Ptr(0)},
+		"inverted latitude box":      {LatitudeMin: float64Ptr(10), LatitudeMax: float64Ptr(5)},
+		"inverted depth range":       {DepthMin: float64Ptr(30), DepthMax: float64Ptr(10)},
+		"unknown gas mix":            {GasMix: "heliox"},
+	}
+	for name, filters := range cases {
+		if _, err := buildPostSearch(filters); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Preference is a saved set of map filters. The range fields mirror the
+// FilterValues type used by the frontend; a time range left open is null.
+type Preference struct {
+	Id           int        `json:"id"`
+	UserId       int        `json:"user_id"`
+	DepthMin     float64    `json:"depth_min"`
+	DepthMax     float64    `json:"depth_max"`
+	TimeStart    *time.Time `json:"time_start"`
+	TimeEnd      *time.Time `json:"time_end"`
+	MagnitudeMin float64    `json:"magnitude_min"`
+	MagnitudeMax float64    `json:"magnitude_max"`
+	LongitudeMin float64    `json:"longitude_min"`
+	LongitudeMax float64    `json:"longitude_max"`
+	LatitudeMin  float64    `json:"latitude_min"`
+	LatitudeMax  float64    `json:"latitude_max"`
+	Timestamp    time.Time  `json:"timestamp"`
+}
+
+const preferenceColumns = `id, user_id, depth_min, depth_max, time_start, time_end,
+	magnitude_min, magnitude_max, longitude_min, longitude_max, latitude_min, latitude_max, timestamp`
+
+func scanPreference(row interface{ Scan(...any) error }, p *Preference) error {
+	return row.Scan(
+		&p.Id, &p.UserId, &p.DepthMin, &p.DepthMax, &p.TimeStart, &p.TimeEnd,
+		&p.MagnitudeMin, &p.MagnitudeMax, &p.LongitudeMin, &p.LongitudeMax,
+		&p.LatitudeMin, &p.LatitudeMax, &p.Timestamp,
+	)
+}
+
+// validatePreference checks that every min/max pair is ordered.
+func validatePreference(p Preference) string {
+	if p.DepthMin > p.DepthMax {
+		return "depth_min must not exceed depth_max"
+	}
+	if p.MagnitudeMin > p.MagnitudeMax {
+		return "magnitude_min must not exceed magnitude_max"
+	}
+	if p.LatitudeMin > p.LatitudeMax {
+		return "latitude_min must not exceed latitude_max"
+	}
+	if p.LongitudeMin > p.LongitudeMax {
+		return "longitude_min must not exceed longitude_max"
+	}
+	if p.TimeStart != nil && p.TimeEnd != nil && p.TimeStart.After(*p.TimeEnd) {
+		return "time_start must not be after time_end"
+	}
+	return ""
+}
+
+// Get all preferences for the authenticated user
+func getPreferences(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT `+preferenceColumns+`
+			FROM preferences
+			WHERE user_id = $1
+			ORDER BY timestamp DESC`, userID)
+		if err != nil {
+			http.Error(w, "Failed to retrieve preferences", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		defer rows.Close()
+
+		preferences := []Preference{}
+		for rows.Next() {
+			var p Preference
+			if err := scanPreference(rows, &p); err != nil {
+				http.Error(w, "Error scanning preference data", http.StatusInternalServerError)
+				log.Println("Scan error:", err)
+				return
+			}
+			preferences = append(preferences, p)
+		}
+
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error processing preference data", http.StatusInternalServerError)
+			log.Println("Rows iteration error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(preferences)
+	}
+}
+
+// Get a single preference owned by the authenticated user
+func getPreference(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+
+		var p Preference
+		err = scanPreference(db.QueryRow(`
+			SELECT `+preferenceColumns+`
+			FROM preferences
+			WHERE id = $1 AND user_id = $2`, id, userID), &p)
+		if err != nil {
+			http.Error(w, "Preference not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+func createPreference(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var p Preference
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if msg := validatePreference(p); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		p.UserId, err = strconv.Atoi(userID)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusInternalServerError)
+			return
+		}
+
+		err = scanPreference(db.QueryRow(`
+			INSERT INTO preferences
+			(user_id, depth_min, depth_max, time_start, time_end, magnitude_min, magnitude_max,
+			 longitude_min, longitude_max, latitude_min, latitude_max)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			RETURNING `+preferenceColumns,
+			p.UserId, p.DepthMin, p.DepthMax, p.TimeStart, p.TimeEnd, p.MagnitudeMin, p.MagnitudeMax,
+			p.LongitudeMin, p.LongitudeMax, p.LatitudeMin, p.LatitudeMax,
+		), &p)
+		if err != nil {
+			http.Error(w, "Failed to create preference", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+func updatePreference(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var p Preference
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if msg := validatePreference(p); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+
+		err = scanPreference(db.QueryRow(`
+			UPDATE preferences
+			SET depth_min = $1, depth_max = $2, time_start = $3, time_end = $4,
+				magnitude_min = $5, magnitude_max = $6, longitude_min = $7, longitude_max = $8,
+				latitude_min = $9, latitude_max = $10
+			WHERE id = $11 AND user_id = $12
+			RETURNING `+preferenceColumns,
+			p.DepthMin, p.DepthMax, p.TimeStart, p.TimeEnd, p.MagnitudeMin, p.MagnitudeMax,
+			p.LongitudeMin, p.LongitudeMax, p.LatitudeMin, p.LatitudeMax, id, userID,
+		), &p)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Preference not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to update preference", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+func deletePreference(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+
+		res, err := db.Exec("DELETE FROM preferences WHERE id = $1 AND user_id = $2", id, userID)
+		if err != nil {
+			http.Error(w, "Failed to delete preference", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Preference not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// maxDiveSamples caps a profile; three hours at one sample per second fits.
+const maxDiveSamples = 50000
+
+// Ascent rates are measured over at least ascentRateWindow so that sensor
+// noise between one-second samples doesn't register as a violation.
+const (
+	maxAscentRate    = 9.0 // m/min
+	ascentRateWindow = 20  // seconds
+)
+
+// A safety stop is at least safetyStopTime spent between safetyStopMinDepth
+// and safetyStopMaxDepth after the deepest point of the dive.
+const (
+	safetyStopMinDepth = 2.5
+	safetyStopMaxDepth = 6.5
+	safetyStopTime     = 3 * 60 // seconds
+)
+
+// diveSample is one point of a dive profile.
+type diveSample struct {
+	Time         int      `json:"time"`  // seconds since the start of the dive
+	Depth        float64  `json:"depth"` // in meters
+	Temperature  *float64 `json:"temperature,omitempty"`
+	TankPressure *float64 `json:"tank_pressure,omitempty"` // in bar
+	NDL          *int     `json:"ndl,omitempty"`           // no-decompression limit in seconds
+	Ceiling      *float64 `json:"ceiling,omitempty"`       // decompression ceiling in meters
+}
+
+type ascentViolation struct {
+	Start   int     `json:"start"` // seconds
+	End     int     `json:"end"`
+	Depth   float64 `json:"depth"`    // where the fast ascent began
+	MaxRate float64 `json:"max_rate"` // m/min
+}
+
+type safetyStop struct {
+	Performed bool    `json:"performed"`
+	Start     int     `json:"start,omitempty"`
+	Duration  int     `json:"duration,omitempty"` // seconds
+	Depth     float64 `json:"depth,omitempty"`    // average depth of the stop
+}
+
+// diveProfileStats is derived from the full-resolution samples.
+type diveProfileStats struct {
+	Duration             int               `json:"duration"` // seconds
+	MaxDepth             float64           `json:"max_depth"`
+	AvgDepth             float64           `json:"avg_depth"` // time-weighted
+	MinTemperature       *float64          `json:"min_temperature,omitempty"`
+	MaxAscentRate        float64           `json:"max_ascent_rate"` // m/min
+	AscentRateViolations []ascentViolation `json:"ascent_rate_violations"`
+	SafetyStop           safetyStop        `json:"safety_stop"`
+}
+
+type diveProfileSummary struct {
+	PostId int               `json:"post_id"`
+	Total  int               `json:"total"` // samples stored
+	Stats  *diveProfileStats `json:"stats,omitempty"`
+}
+
+type diveProfile struct {
+	diveProfileSummary
+	Samples []diveSample `json:"samples"`
+}
+
+// normalizeSamples sorts samples by time and drops repeated times, which
+// some dive computers write around gas switches.
+func normalizeSamples(samples []diveSample) []diveSample {
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time < samples[j].Time })
+	out := samples[:0]
+	for i, s := range samples {
+		if i > 0 && s.Time == samples[i-1].Time {
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func validateDiveSamples(samples []diveSample) error {
+	if len(samples) > maxDiveSamples {
+		return fmt.Errorf("at most %d samples per dive", maxDiveSamples)
+	}
+	for i, s := range samples {
+		switch {
+		case s.Time < 0:
+			return fmt.Errorf("sample %d: time must not be negative", i)
+		case i > 0 && s.Time <= samples[i-1].Time:
+			return fmt.Errorf("sample %d: times must be increasing", i)
+		case s.Depth < 0 || s.Depth > 350:
+			return fmt.Errorf("sample %d: depth must be between 0 and 350 meters", i)
+		case !inRange(s.Temperature, -2, 40):
+			return fmt.Errorf("sample %d: temperature must be between -2 and 40 °C", i)
+		case !inRange(s.TankPressure, 0, 400):
+			return fmt.Errorf("sample %d: tank_pressure must be between 0 and 400 bar", i)
+		case s.NDL != nil && *s.NDL < 0:
+			return fmt.Errorf("sample %d: ndl must not be negative", i)
+		case !inRange(s.Ceiling, 0, 350):
+			return fmt.Errorf("sample %d: ceiling must be between 0 and 350 meters", i)
+		}
+	}
+	return nil
+}
+
+// storeDiveSamples replaces the profile of a post.
+func storeDiveSamples(ctx context.Context, tx *sql.Tx, postID int, samples []diveSample) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM dive_samples WHERE post_id = $1", postID); err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("dive_samples",
+		"post_id", "time_offset", "depth", "temperature", "tank_pressure", "ndl", "ceiling"))
+	if err != nil {
+		return err
+	}
+	for _, s := range samples {
+		if _, err := stmt.ExecContext(ctx, postID, s.Time, s.Depth, s.Temperature, s.TankPressure, s.NDL, s.Ceiling); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	return stmt.Close()
+}
+
+func loadDiveSamples(ctx context.Context, db *sql.DB, postID int) ([]diveSample, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT time_offset, depth, temperature, tank_pressure, ndl, ceiling
+		FROM dive_samples WHERE post_id = $1 ORDER BY time_offset`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := []diveSample{}
+	for rows.Next() {
+		var s diveSample
+		if err := rows.Scan(&s.Time, &s.Depth, &s.Temperature, &s.TankPressure, &s.NDL, &s.Ceiling); err != nil {
+			return nil, err
+		}
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
+
+// downsampleSamples reduces a profile to at most n points for charting
+// using Largest-Triangle-Three-Buckets on depth over time, which keeps the
+// peaks and stops that a plain stride would skip.
+func downsampleSamples(samples []diveSample, n int) []diveSample {
+	if n >= len(samples) || n < 2 {
+		return samples
+	}
+	if n == 2 {
+		return []diveSample{samples[0], samples[len(samples)-1]}
+	}
+
+	out := make([]diveSample, 0, n)
+	out = append(out, samples[0])
+	bucket := float64(len(samples)-2) / float64(n-2)
+	a := 0
+
+	for i := 0; i < n-2; i++ {
+		// Average of the next bucket is the third corner of the triangle
+		nextStart := int(float64(i+1)*bucket) + 1
+		nextEnd := int(float64(i+2)*bucket) + 1
+		if nextEnd > len(samples) {
+			nextEnd = len(samples)
+		}
+		var avgT, avgD float64
+		for _, s := range samples[nextStart:nextEnd] {
+			avgT += float64(s.Time)
+			avgD += s.Depth
+		}
+		count := float64(nextEnd - nextStart)
+		avgT, avgD = avgT/count, avgD/count
+
+		start := int(float64(i)*bucket) + 1
+		end := int(float64(i+1)*bucket) + 1
+		best, bestArea := start, -1.0
+		for j := start; j < end; j++ {
+			area := math.Abs((float64(samples[a].Time)-avgT)*(samples[j].Depth-samples[a].Depth) -
+				(float64(samples[a].Time)-float64(samples[j].Time))*(avgD-samples[a].Depth))
+			if area > bestArea {
+				best, bestArea = j, area
+			}
+		}
+		out = append(out, samples[best])
+		a = best
+	}
+
+	return append(out, samples[len(samples)-1])
+}
+
+// profileStats computes the summary, ascent rate violations and safety stop
+// of a profile sorted by time. It returns nil for an empty profile.
+func profileStats(samples []diveSample) *diveProfileStats {
+	if len(samples) == 0 {
+		return nil
+	}
+	stats := &diveProfileStats{
+		Duration:             samples[len(samples)-1].Time - samples[0].Time,
+		AscentRateViolations: []ascentViolation{},
+	}
+
+	deepest := 0
+	var weighted float64
+	for i, s := range samples {
+		if s.Depth > stats.MaxDepth {
+			stats.MaxDepth, deepest = s.Depth, i
+		}
+		if s.Temperature != nil && (stats.MinTemperature == nil || *s.Temperature < *stats.MinTemperature) {
+			t := *s.Temperature
+			stats.MinTemperature = &t
+		}
+		if i > 0 {
+			weighted += (samples[i-1].Depth + s.Depth) / 2 * float64(s.Time-samples[i-1].Time)
+		}
+	}
+	if stats.Duration > 0 {
+		stats.AvgDepth = roundTo(weighted/float64(stats.Duration), 1)
+	}
+
+	// Ascent rate from each sample to the first one at least a window later
+	j := 0
+	for i, s := range samples {
+		if j <= i {
+			j = i + 1
+		}
+		for j < len(samples) && samples[j].Time-s.Time < ascentRateWindow {
+			j++
+		}
+		if j == len(samples) {
+			break
+		}
+		rate := (s.Depth - samples[j].Depth) * 60 / float64(samples[j].Time-s.Time)
+		stats.MaxAscentRate = math.Max(stats.MaxAscentRate, roundTo(rate, 1))
+		if rate <= maxAscentRate {
+			continue
+		}
+
+		// Merge overlapping windows into one violation
+		v := &stats.AscentRateViolations
+		if n := len(*v); n > 0 && s.Time <= (*v)[n-1].End {
+			last := &(*v)[n-1]
+			last.End = samples[j].Time
+			last.MaxRate = math.Max(last.MaxRate, roundTo(rate, 1))
+		} else {
+			*v = append(*v, ascentViolation{Start: s.Time, End: samples[j].Time, Depth: s.Depth, MaxRate: roundTo(rate, 1)})
+		}
+	}
+
+	// Longest stretch in the safety stop band after the deepest point
+	runStart := -1
+	for i := deepest; i <= len(samples); i++ {
+		inBand := i < len(samples) && samples[i].Depth >= safetyStopMinDepth && samples[i].Depth <= safetyStopMaxDepth
+		if inBand && runStart < 0 {
+			runStart = i
+		}
+		if inBand || runStart < 0 {
+			continue
+		}
+
+		duration := samples[i-1].Time - samples[runStart].Time
+		if duration > stats.SafetyStop.Duration {
+			var depth float64
+			for _, s := range samples[runStart:i] {
+				depth += s.Depth
+			}
+			stats.SafetyStop = safetyStop{
+				Start:    samples[runStart].Time,
+				Duration: duration,
+				Depth:    roundTo(depth/float64(i-runStart), 1),
+			}
+		}
+		runStart = -1
+	}
+	stats.SafetyStop.Performed = stats.SafetyStop.Duration >= safetyStopTime
+	if !stats.SafetyStop.Performed {
+		stats.SafetyStop = safetyStop{}
+	}
+
+	return stats
+}
+
+func postIDFromVars(r *http.Request) (int, error) {
+	return strconv.Atoi(mux.Vars(r)["id"])
+}
+
+// getDiveSamples returns a post's profile and stats. ?points=N downsamples
+// the samples for charting; the stats always use every sample.
+func getDiveSamples(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postID, err := postIDFromVars(r)
+		if err != nil {
+			http.Error(w, "Invalid post ID", http.StatusBadRequest)
+			return
+		}
+
+		points := 0
+		if raw := r.URL.Query().Get("points"); raw != "" {
+			if points, err = strconv.Atoi(raw); err != nil || points < 2 {
+				http.Error(w, "points must be a number of at least 2", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if _, err := postOwner(db, strconv.Itoa(postID)); err == sql.ErrNoRows {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to retrieve samples", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		samples, err := loadDiveSamples(r.Context(), db, postID)
+		if err != nil {
+			http.Error(w, "Failed to retrieve samples", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		profile := diveProfile{
+			diveProfileSummary: diveProfileSummary{PostId: postID, Total: len(samples), Stats: profileStats(samples)},
+			Samples:            samples,
+		}
+		if points > 0 {
+			profile.Samples = downsampleSamples(samples, points)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profile)
+	}
+}
+
+// putDiveSamples replaces a post's profile with the samples in the body,
+// {"samples": [...]}, and returns the derived stats.
+func putDiveSamples(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, ok := authorizeOwner(w, r, db, id, postOwner); !ok {
+			return
+		}
+		postID, _ := strconv.Atoi(id)
+
+		var body struct {
+			Samples []diveSample `json:"samples"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 10<<20)
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := validateDiveSamples(body.Samples); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			http.Error(w, "Failed to store samples", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := storeDiveSamples(r.Context(), tx, postID, body.Samples); err != nil {
+			http.Error(w, "Failed to store samples", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to store samples", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(diveProfileSummary{PostId: postID, Total: len(body.Samples), Stats: profileStats(body.Samples)})
+	}
+}
+
+func deleteDiveSamples(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, ok := authorizeOwner(w, r, db, id, postOwner); !ok {
+			return
+		}
+
+		if _, err := db.Exec("DELETE FROM dive_samples WHERE post_id = $1", id); err != nil {
+			http.Error(w, "Failed to delete samples", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+// profile builds samples every step seconds through the given depths.
+func profile(step int, depths ...float64) []diveSample {
+	samples := make([]diveSample, len(depths))
+	for i, d := range depths {
+		samples[i] = diveSample{Time: i * step, Depth: d}
+	}
+	return samples
+}
+
+func TestDownsampleSamplesKeepsPeaks(t *testing.T) {
+	depths := make([]float64, 1000)
+	for i := range depths {
+		depths[i] = 10
+	}
+	depths[437] = 31 // a short dip that a stride would miss
+
+	got := downsampleSamples(profile(1, depths...), 50)
+	if len(got) != 50 {
+		t.Fatalf("Expected 50 points, got %d", len(got))
+	}
+	if got[0].Time != 0 || got[len(got)-1].Time != 999 {
+		t.Errorf("Expected the first and last samples to be kept, got %d and %d", got[0].Time, got[len(got)-1].Time)
+	}
+	found := false
+	for _, s := range got {
+		found = found || s.Depth == 31
+	}
+	if !found {
+		t.Error("Expected the deepest point to survive downsampling")
+	}
+
+	if n := len(downsampleSamples(profile(1, 1, 2, 3), 10)); n != 3 {
+		t.Errorf("Expected short profiles to be returned whole, got %d points", n)
+	}
+}
+
+func TestProfileStatsDetectsFastAscentAndSafetyStop(t *testing.T) {
+	// Every 10 s: down to 20 m, a fast 20 -> 8 m in 40 s (18 m/min), then
+	// four minutes at 5 m and a slow finish
+	depths := []float64{0, 10, 20, 20, 20, 17, 14, 11, 8, 6}
+	for i := 0; i < 24; i++ {
+		depths = append(depths, 5)
+	}
+	depths = append(depths, 4, 3, 2, 1, 0)
+
+	stats := profileStats(profile(10, depths...))
+	if stats.MaxDepth != 20 || stats.Duration != (len(depths)-1)*10 {
+		t.Errorf("Expected 20 m over the whole profile, got %v m over %d s", stats.MaxDepth, stats.Duration)
+	}
+	if len(stats.AscentRateViolations) != 1 {
+		t.Fatalf("Expected one ascent rate violation, got %+v", stats.AscentRateViolations)
+	}
+	if v := stats.AscentRateViolations[0]; v.Start != 40 || v.MaxRate != 18 {
+		t.Errorf("Expected an 18 m/min ascent from 40 s, got %+v", v)
+	}
+	if !stats.SafetyStop.Performed || stats.SafetyStop.Duration < safetyStopTime || stats.SafetyStop.Depth > 6 {
+		t.Errorf("Expected a safety stop around 5 m, got %+v", stats.SafetyStop)
+	}
+
+	// Same dive straight up from 5 m
+	short := profileStats(profile(10, 0, 10, 20, 20, 15, 10, 5, 0))
+	if short.SafetyStop.Performed {
+		t.Errorf("Expected no safety stop, got %+v", short.SafetyStop)
+	}
+}
+
+func TestValidateDiveSamples(t *testing.T) {
+	if err := validateDiveSamples(profile(5, 0, 5, 10)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	backwards := []diveSample{{Time: 10, Depth: 1}, {Time: 5, Depth: 2}}
+	if err := validateDiveSamples(backwards); err == nil {
+		t.Error("Expected an error for samples out of order")
+	}
+	if got := normalizeSamples(backwards); got[0].Time != 5 {
+		t.Errorf("Expected normalizing to sort samples, got %+v", got)
+	}
+}
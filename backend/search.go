@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 50
+	maxSearchQueryLength  = 200
+	// fuzzyNameWeight scales the trigram similarity of a misspelled name
+	// into the range of full-text ranks.
+	fuzzyNameWeight = 0.1
+)
+
+// searchTypes are the kinds of result, in the order ties are broken.
+var searchTypes = []string{"post", "site", "user"}
+
+// Matches are wrapped in these by ts_headline, then turned into <mark>
+// elements once the rest of the snippet has been escaped.
+const (
+	highlightStart = "{{hl}}"
+	highlightStop  = "{{/hl}}"
+)
+
+var headlineOptions = fmt.Sprintf(`StartSel="%s", StopSel="%s", MaxWords=30, MinWords=10, MaxFragments=2, FragmentDelimiter=" … "`,
+	highlightStart, highlightStop)
+
+type searchResult struct {
+	Type     string  `json:"type"` // post, site or user
+	Id       int     `json:"id"`
+	Title    string  `json:"title"`              // the post title, site name or user's full name
+	Subtitle string  `json:"subtitle,omitempty"` // the author and site of a post, or a user's @username
+	Snippet  string  `json:"snippet"`            // HTML; the text is escaped and matches are in <mark>
+	Image    string  `json:"image,omitempty"`
+	Rank     float64 `json:"rank"`
+}
+
+type searchPage struct {
+	Results    []searchResult `json:"results"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// searchCursor is the position after the last result of a page: results
+// are ordered by rank, then type and id.
+type searchCursor struct {
+	Rank float64 `json:"r"`
+	Type string  `json:"t"`
+	Id   int     `json:"id"`
+}
+
+func encodeSearchCursor(c searchCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSearchCursor(raw string) (searchCursor, error) {
+	var c searchCursor
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil || json.Unmarshal(data, &c) != nil || !oneOf(c.Type, searchTypes) {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	return c, nil
+}
+
+// highlightSnippet escapes a ts_headline snippet for HTML and marks the
+// matches.
+func highlightSnippet(raw string) string {
+	escaped := html.EscapeString(raw)
+	return strings.NewReplacer(highlightStart, "<mark>", highlightStop, "</mark>").Replace(escaped)
+}
+
+// parseSearchTypes reads ?types=post,user; all types by default.
+func parseSearchTypes(raw string) ([]string, error) {
+	if raw == "" {
+		return searchTypes, nil
+	}
+	var types []string
+	for _, t := range strings.Split(raw, ",") {
+		t = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(t)), "s")
+		if !oneOf(t, searchTypes) {
+			return nil, fmt.Errorf("types must be a comma-separated list of %s", strings.Join(searchTypes, ", "))
+		}
+		if !oneOf(t, types) {
+			types = append(types, t)
+		}
+	}
+	return types, nil
+}
+
+// searchMatchQueries select the type, id and rank of each kind of result
+// for the tsquery q and the raw text $1. People and sites also match on a
+// misspelled name through trigram word similarity.
+var searchMatchQueries = map[string]string{
+	"post": `SELECT 'post' AS type, p.id, ts_rank(p.search_vector, q)::float8 AS rank
+		FROM posts p WHERE p.search_vector @@ q`,
+	"site": fmt.Sprintf(`SELECT 'site', s.id, (ts_rank(s.search_vector, q) + %[1]g * word_similarity($1, s.name))::float8
+		FROM dive_sites s WHERE s.search_vector @@ q OR $1 <%% s.name`, fuzzyNameWeight),
+	"user": fmt.Sprintf(`SELECT 'user', u.id, (ts_rank(u.search_vector, q) + %[1]g * word_similarity($1, u.first_name || ' ' || u.last_name))::float8
+		FROM users u WHERE u.search_vector @@ q OR $1 <%% (u.first_name || ' ' || u.last_name)`, fuzzyNameWeight),
+}
+
+// searchDetailQueries load the results of one type from the ids in $2,
+// with snippets highlighting the tsquery built from $1.
+var searchDetailQueries = map[string]string{
+	"post": `SELECT p.id, p.title, u.first_name || ' ' || u.last_name || COALESCE(' at ' || s.name, ''),
+			ts_headline('english', COALESCE(NULLIF(p.description, ''), p.title), q, $3), COALESCE(p.images[1], '')
+		FROM posts p JOIN users u ON u.id = p.user_id LEFT JOIN dive_sites s ON s.id = p.site_id
+		WHERE p.id = ANY($2)`,
+	"site": `SELECT s.id, s.name, '',
+			ts_headline('english', COALESCE(NULLIF(s.description, ''), s.name || ' ' || array_to_string(s.aliases, ', ')), q, $3), ''
+		FROM dive_sites s WHERE s.id = ANY($2)`,
+	"user": `SELECT u.id, u.first_name || ' ' || u.last_name, '@' || u.username,
+			ts_headline('english', COALESCE(NULLIF(u.bio, ''), u.first_name || ' ' || u.last_name), q, $3), COALESCE(u.avatar, '')
+		FROM users u WHERE u.id = ANY($2)`,
+}
+
+// searchTSQuery parses $1 like a web search box: quoted phrases, "or" and
+// -excluded words.
+const searchTSQuery = "websearch_to_tsquery('english', $1)"
+
+// loadSearchDetails fills in the titles and snippets of a page of results.
+func loadSearchDetails(db *sql.DB, text string, results []searchResult) error {
+	ids := map[string][]int64{}
+	for _, r := range results {
+		ids[r.Type] = append(ids[r.Type], int64(r.Id))
+	}
+
+	details := map[string]searchResult{}
+	for kind, kindIDs := range ids {
+		rows, err := db.Query("SELECT d.* FROM "+searchTSQuery+" q, LATERAL ("+searchDetailQueries[kind]+") d",
+			text, pq.Array(kindIDs), headlineOptions)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var d searchResult
+			if err := rows.Scan(&d.Id, &d.Title, &d.Subtitle, &d.Snippet, &d.Image); err != nil {
+				rows.Close()
+				return err
+			}
+			details[kind+":"+strconv.Itoa(d.Id)] = d
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	for i, r := range results {
+		d := details[r.Type+":"+strconv.Itoa(r.Id)]
+		results[i].Title, results[i].Subtitle, results[i].Image = d.Title, d.Subtitle, d.Image
+		results[i].Snippet = highlightSnippet(d.Snippet)
+	}
+	return nil
+}
+
+// searchAll handles GET /search?q=: posts, dive sites and users matching
+// q, most relevant first. ?types= limits the kinds of result, and ?limit=
+// and ?cursor= paginate.
+func searchAll(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		text := strings.TrimSpace(params.Get("q"))
+		if text == "" || len(text) > maxSearchQueryLength {
+			http.Error(w, fmt.Sprintf("q must be 1 to %d characters", maxSearchQueryLength), http.StatusBadRequest)
+			return
+		}
+		types, err := parseSearchTypes(params.Get("types"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit := defaultSearchPageSize
+		if raw := params.Get("limit"); raw != "" {
+			limit, err = strconv.Atoi(raw)
+			if err != nil || limit < 1 || limit > maxSearchPageSize {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxSearchPageSize), http.StatusBadRequest)
+				return
+			}
+		}
+
+		args := queryArgs{text}
+		branches := make([]string, len(types))
+		for i, t := range types {
+			branches[i] = searchMatchQueries[t]
+		}
+		after := ""
+		if raw := params.Get("cursor"); raw != "" {
+			cursor, err := decodeSearchCursor(raw)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rank, kind, id := args.add(cursor.Rank), args.add(cursor.Type), args.add(cursor.Id)
+			after = fmt.Sprintf(" WHERE rank < %[1]s OR (rank = %[1]s AND (type, id) > (%[2]s, %[3]s))", rank, kind, id)
+		}
+
+		rows, err := db.Query(`
+			WITH matches AS (
+				SELECT m.* FROM `+searchTSQuery+` q, LATERAL (`+strings.Join(branches, " UNION ALL ")+`) m
+			)
+			SELECT type, id, rank FROM matches`+after+`
+			ORDER BY rank DESC, type, id
+			LIMIT `+strconv.Itoa(limit+1), args...)
+		if err != nil {
+			http.Error(w, "Failed to search", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		defer rows.Close()
+
+		page := searchPage{Results: []searchResult{}}
+		for rows.Next() {
+			var result searchResult
+			if err := rows.Scan(&result.Type, &result.Id, &result.Rank); err != nil {
+				http.Error(w, "Error scanning search results", http.StatusInternalServerError)
+				log.Println("Scan error:", err)
+				return
+			}
+			// The extra row only tells us there is another page
+			if len(page.Results) == limit {
+				last := page.Results[limit-1]
+				page.NextCursor = encodeSearchCursor(searchCursor{Rank: last.Rank, Type: last.Type, Id: last.Id})
+				break
+			}
+			page.Results = append(page.Results, result)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error processing search results", http.StatusInternalServerError)
+			log.Println("Rows iteration error:", err)
+			return
+		}
+		rows.Close()
+
+		if err := loadSearchDetails(db, text, page.Results); err != nil {
+			http.Error(w, "Failed to search", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(page)
+	}
+}
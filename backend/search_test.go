@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHighlightSnippet(t *testing.T) {
+	raw := "Saw a {{hl}}manta{{/hl}} & <script>"
+	want := "Saw a <mark>manta</mark> &amp; &lt;script&gt;"
+	if got := highlightSnippet(raw); got != want {
+		t.Errorf("highlightSnippet(%q) = %q, want %q", raw, got, want)
+	}
+}
+
+func TestParseSearchTypes(t *testing.T) {
+	if types, err := parseSearchTypes(""); err != nil || !reflect.DeepEqual(types, searchTypes) {
+		t.Errorf("parseSearchTypes of nothing = %v, %v", types, err)
+	}
+	if types, err := parseSearchTypes("Users, post,user"); err != nil || !reflect.DeepEqual(types, []string{"user", "post"}) {
+		t.Errorf("parseSearchTypes = %v, %v", types, err)
+	}
+	if _, err := parseSearchTypes("posts,comments"); err == nil {
+		t.Error("parseSearchTypes should reject unknown types")
+	}
+}
+
+func TestSearchCursorRoundTrip(t *testing.T) {
+	c := searchCursor{Rank: 0.0607927106320858, Type: "site", Id: 12}
+	got, err := decodeSearchCursor(encodeSearchCursor(c))
+	if err != nil || got != c {
+		t.Errorf("decodeSearchCursor(encodeSearchCursor(%+v)) = %+v, %v", c, got, err)
+	}
+	if _, err := decodeSearchCursor(encodeSearchCursor(searchCursor{Type: "comment"})); err == nil {
+		t.Error("decodeSearchCursor should reject unknown types")
+	}
+}
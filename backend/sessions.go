@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Access tokens are short-lived JWTs carrying the session id in a "sid"
+// claim. Refresh tokens are opaque random strings that are rotated on every
+// use; only their hashes are stored.
+
+var (
+	errRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	errRefreshTokenReused  = errors.New("refresh token was already used")
+)
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(name); v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Warning: ignoring invalid %s=%q", name, v)
+	}
+	return fallback
+}
+
+func accessTokenTTL() time.Duration {
+	return durationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+}
+
+// sidlessTokenCutoff is when tokens without a "sid" claim stop being
+// accepted. They predate sessions, so logging out can't revoke them; they
+// were issued for 24h, so none minted before sessions shipped outlives it.
+var sidlessTokenCutoff = time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+
+// tokenSession returns the session behind a token's claims and whether the
+// token may still be used: its session must be live, or for a token from
+// before sessions, the cutoff must not have passed.
+func tokenSession(ctx context.Context, db *sql.DB, claims map[string]interface{}) (string, bool, error) {
+	sessionID, ok := claims["sid"].(string)
+	if !ok {
+		return "", time.Now().Before(sidlessTokenCutoff), nil
+	}
+	active, err := isSessionActive(ctx, db, sessionID)
+	return sessionID, active, err
+}
+
+func refreshTokenTTL() time.Duration {
+	return durationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateRefreshToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// insertRefreshToken stores a new refresh token for a session and returns
+// the plain value to hand to the client.
+func insertRefreshToken(ctx context.Context, tx *sql.Tx, sessionID string) (string, error) {
+	token, err := generateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (session_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)`,
+		sessionID, hashRefreshToken(token), time.Now().Add(refreshTokenTTL()),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// issueSession starts a new session for a user who just proved their
+// identity and returns the token pair for the login response.
+func issueSession(db *sql.DB, r *http.Request, user User) (map[string]string, error) {
+	ctx := r.Context()
+	sessionID := uuid.NewString()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO sessions (id, user_id, user_agent) VALUES ($1, $2, $3)`,
+		sessionID, user.Id, r.UserAgent(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := insertRefreshToken(ctx, tx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := createToken(user.Id, user.Email, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		"token":         accessToken,
+		"refresh_token": refreshToken,
+		"expires_in":    strconv.Itoa(int(accessTokenTTL().Seconds())),
+	}, nil
+}
+
+// rotateRefreshToken exchanges a refresh token for a new one in the same
+// session. Presenting a token that was already rotated means it leaked, so
+// the whole session is revoked.
+func rotateRefreshToken(ctx context.Context, db *sql.DB, token string) (User, string, string, error) {
+	var user User
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return user, "", "", err
+	}
+	defer tx.Rollback()
+
+	var (
+		tokenID   int
+		sessionID string
+		expiresAt time.Time
+		usedAt    sql.NullTime
+		revokedAt sql.NullTime
+	)
+	err = tx.QueryRowContext(ctx, `
+		SELECT rt.id, rt.session_id, rt.expires_at, rt.used_at, s.revoked_at, u.id, u.email
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		JOIN users u ON u.id = s.user_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE OF rt, s`, hashRefreshToken(token),
+	).Scan(&tokenID, &sessionID, &expiresAt, &usedAt, &revokedAt, &user.Id, &user.Email)
+	if err == sql.ErrNoRows {
+		return user, "", "", errRefreshTokenInvalid
+	}
+	if err != nil {
+		return user, "", "", err
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		return user, "", "", errRefreshTokenInvalid
+	}
+
+	if usedAt.Valid {
+		if _, err := tx.ExecContext(ctx, "UPDATE sessions SET revoked_at = now() WHERE id = $1", sessionID); err != nil {
+			return user, "", "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return user, "", "", err
+		}
+		log.Printf("Refresh token reuse detected for session %s, session revoked", sessionID)
+		return user, "", "", errRefreshTokenReused
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at = now() WHERE id = $1", tokenID); err != nil {
+		return user, "", "", err
+	}
+
+	newToken, err := insertRefreshToken(ctx, tx, sessionID)
+	if err != nil {
+		return user, "", "", err
+	}
+
+	return user, sessionID, newToken, tx.Commit()
+}
+
+// isSessionActive reports whether a session exists and has not been revoked.
+func isSessionActive(ctx context.Context, db *sql.DB, sessionID string) (bool, error) {
+	var active bool
+	err := db.QueryRowContext(ctx,
+		"SELECT revoked_at IS NULL FROM sessions WHERE id = $1", sessionID,
+	).Scan(&active)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return active, err
+}
+
+func getSessionIDFromContext(ctx context.Context) (string, error) {
+	sessionID, ok := ctx.Value("session_id").(string)
+	if !ok || sessionID == "" {
+		return "", errors.New("session ID not found in context")
+	}
+	return sessionID, nil
+}
+
+func handleRefreshToken(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			http.Error(w, "refresh_token is required", http.StatusBadRequest)
+			return
+		}
+
+		user, sessionID, refreshToken, err := rotateRefreshToken(r.Context(), db, req.RefreshToken)
+		if errors.Is(err, errRefreshTokenInvalid) || errors.Is(err, errRefreshTokenReused) {
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Println("Error rotating refresh token:", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		accessToken, err := createToken(user.Id, user.Email, sessionID)
+		if err != nil {
+			log.Println("Error generating token:", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"token":         accessToken,
+			"refresh_token": refreshToken,
+			"expires_in":    strconv.Itoa(int(accessTokenTTL().Seconds())),
+		})
+	}
+}
+
+// Revoke the session behind the caller's access token
+func handleLogout(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID, err := getSessionIDFromContext(r.Context())
+		if err != nil {
+			// Tokens issued before sessions existed have nothing to revoke
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		_, err = db.Exec("UPDATE sessions SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL", sessionID)
+		if err != nil {
+			log.Println("Error revoking session:", err)
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Revoke every session of the caller, logging out all devices
+func handleLogoutAll(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := getUserIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		res, err := db.Exec("UPDATE sessions SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+		if err != nil {
+			log.Println("Error revoking sessions:", err)
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+
+		revoked, _ := res.RowsAffected()
+		json.NewEncoder(w).Encode(map[string]int64{"revoked_sessions": revoked})
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Distances used to match posts and sites, in meters.
+const (
+	// siteSuggestRadius is how far from a site a new post may be and still
+	// have the site suggested to it.
+	siteSuggestRadius = 500.0
+	// siteDuplicateRadius is how close two sites may be before the second
+	// is taken to be the first one again. Within siteSuggestRadius a site
+	// with the same name or alias is a duplicate too.
+	siteDuplicateRadius = 100.0
+)
+
+const (
+	maxSiteAliases      = 20
+	maxSitesPerPage     = 50
+	maxSiteSuggestions  = 5
+	defaultSiteRadiusKm = 25.0
+	siteRecentPosts     = 20
+)
+
+// DiveSite is a named place that dives are logged at.
+type DiveSite struct {
+	Id          int       `json:"id"`
+	Name        string    `json:"name"`
+	Latitude    float64   `json:"latitude"`
+	Longitude   float64   `json:"longitude"`
+	MaxDepth    *float64  `json:"max_depth,omitempty"`  // in meters
+	EntryType   string    `json:"entry_type,omitempty"` // shore, boat or other
+	Description string    `json:"description"`
+	Aliases     []string  `json:"aliases"` // other names the site is known by
+	CreatedBy   *int      `json:"created_by,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	DistanceKm  *float64  `json:"distance_km,omitempty"` // set by location searches
+}
+
+const siteColumns = `s.id, s.name, s.latitude, s.longitude, s.max_depth, COALESCE(s.entry_type, ''),
+	s.description, s.aliases, s.created_by, s.timestamp`
+
+func (s *DiveSite) scanTargets() []interface{} {
+	return []interface{}{
+		&s.Id, &s.Name, &s.Latitude, &s.Longitude, &s.MaxDepth, &s.EntryType,
+		&s.Description, pq.Array(&s.Aliases), &s.CreatedBy, &s.Timestamp,
+	}
+}
+
+// validate normalizes the name, entry type and aliases and checks the
+// rest. Aliases repeating the name or each other are dropped.
+func (s *DiveSite) validate() error {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if !validLatitude(s.Latitude) || !validLongitude(s.Longitude) {
+		return fmt.Errorf("location is out of range")
+	}
+	if s.MaxDepth != nil && *s.MaxDepth < 0 {
+		return fmt.Errorf("max_depth must not be negative")
+	}
+	s.EntryType = strings.ToLower(strings.TrimSpace(s.EntryType))
+	if s.EntryType != "" && !oneOf(s.EntryType, entryTypes) {
+		return fmt.Errorf("entry_type must be one of %s", strings.Join(entryTypes, ", "))
+	}
+
+	seen := map[string]bool{strings.ToLower(s.Name): true}
+	aliases := []string{}
+	for _, alias := range s.Aliases {
+		alias = strings.TrimSpace(alias)
+		if alias == "" || seen[strings.ToLower(alias)] {
+			continue
+		}
+		seen[strings.ToLower(alias)] = true
+		aliases = append(aliases, alias)
+	}
+	if len(aliases) > maxSiteAliases {
+		return fmt.Errorf("a site can have at most %d aliases", maxSiteAliases)
+	}
+	s.Aliases = aliases
+	return nil
+}
+
+// names returns the site's name and aliases in lower case.
+func (s *DiveSite) names() []string {
+	names := []string{strings.ToLower(s.Name)}
+	for _, alias := range s.Aliases {
+		names = append(names, strings.ToLower(alias))
+	}
+	return names
+}
+
+// siteDistance is the distance in meters between sites aliased as s and
+// the point at the given placeholders.
+func siteDistance(lat, lon string) string {
+	return fmt.Sprintf("earth_distance(ll_to_earth(%s, %s), ll_to_earth(s.latitude, s.longitude))", lat, lon)
+}
+
+// siteWithin is an indexable condition for sites within radius meters of
+// the point; earth_box is a superset that the distance check trims.
+func siteWithin(lat, lon, radius string) string {
+	return fmt.Sprintf("earth_box(ll_to_earth(%s, %s), %s) @> ll_to_earth(s.latitude, s.longitude) AND %s <= %s",
+		lat, lon, radius, siteDistance(lat, lon), radius)
+}
+
+func scanSites(rows *sql.Rows) ([]DiveSite, error) {
+	defer rows.Close()
+	sites := []DiveSite{}
+	for rows.Next() {
+		var s DiveSite
+		var distanceKm sql.NullFloat64
+		if err := rows.Scan(append(s.scanTargets(), &distanceKm)...); err != nil {
+			return nil, err
+		}
+		if distanceKm.Valid {
+			d := roundTo(distanceKm.Float64, 3)
+			s.DistanceKm = &d
+		}
+		sites = append(sites, s)
+	}
+	return sites, rows.Err()
+}
+
+// findNearbySites returns up to limit sites within radius meters of a
+// point, nearest first.
+func findNearbySites(db *sql.DB, lat, lon, radius float64, limit int) ([]DiveSite, error) {
+	rows, err := db.Query(`
+		SELECT `+siteColumns+`, `+siteDistance("$1", "$2")+` / 1000.0
+		FROM dive_sites s
+		WHERE `+siteWithin("$1", "$2", "$3")+`
+		ORDER BY `+siteDistance("$1", "$2")+`, s.id
+		LIMIT $4`, lat, lon, radius, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanSites(rows)
+}
+
+// findDuplicateSite returns an existing site, other than excludeID, that
+// site would duplicate, or nil.
+func findDuplicateSite(db *sql.DB, site *DiveSite, excludeID int) (*DiveSite, error) {
+	rows, err := db.Query(`
+		SELECT `+siteColumns+`, `+siteDistance("$1", "$2")+` / 1000.0
+		FROM dive_sites s
+		WHERE s.id <> $5 AND `+siteWithin("$1", "$2", "$3")+` AND (
+			`+siteDistance("$1", "$2")+` <= $4
+			OR lower(s.name) = ANY($6)
+			OR EXISTS (SELECT 1 FROM unnest(s.aliases) a WHERE lower(a) = ANY($6))
+		)
+		ORDER BY `+siteDistance("$1", "$2")+`, s.id
+		LIMIT 1`,
+		site.Latitude, site.Longitude, siteSuggestRadius, siteDuplicateRadius, excludeID, pq.Array(site.names()))
+	if err != nil {
+		return nil, err
+	}
+	sites, err := scanSites(rows)
+	if err != nil || len(sites) == 0 {
+		return nil, err
+	}
+	return &sites[0], nil
+}
+
+// checkPostSite checks that the site a post links to exists. It writes
+// 400 or 500 and returns false when the request must stop.
+func checkPostSite(w http.ResponseWriter, db *sql.DB, siteID *int) bool {
+	if siteID == nil {
+		return true
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM dive_sites WHERE id = $1)", *siteID).Scan(&exists); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		log.Println("Database error:", err)
+		return false
+	}
+	if !exists {
+		http.Error(w, "site_id does not match a dive site", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// queryCenter reads an optional latitude/longitude pair from the query
+// string.
+func queryCenter(q url.Values) (lat, lon float64, ok bool, err error) {
+	rawLat, rawLon := q.Get("latitude"), q.Get("longitude")
+	if rawLat == "" && rawLon == "" {
+		return 0, 0, false, nil
+	}
+	lat, err1 := strconv.ParseFloat(rawLat, 64)
+	lon, err2 := strconv.ParseFloat(rawLon, 64)
+	if err1 != nil || err2 != nil || !validLatitude(lat) || !validLongitude(lon) {
+		return 0, 0, false, fmt.Errorf("latitude and longitude must be given together and in range")
+	}
+	return lat, lon, true, nil
+}
+
+// escapeLike escapes the LIKE wildcards in s, so it matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// getSites lists dive sites. ?q= matches names and aliases; ?latitude=
+// &longitude= limits the list to radius_km (default 25) around the point,
+// nearest first. Otherwise sites are listed by name.
+func getSites(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		lat, lon, hasCenter, err := queryCenter(params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var args queryArgs
+		var conditions []string
+		distance, order := "NULL::float", "s.name, s.id"
+		if hasCenter {
+			radiusKm := defaultSiteRadiusKm
+			if raw := params.Get("radius_km"); raw != "" {
+				radiusKm, err = strconv.ParseFloat(raw, 64)
+				if err != nil || radiusKm <= 0 || radiusKm > maxSearchRadiusKm {
+					http.Error(w, fmt.Sprintf("radius_km must be between 0 and %.0f", maxSearchRadiusKm), http.StatusBadRequest)
+					return
+				}
+			}
+			latArg, lonArg := args.add(lat), args.add(lon)
+			conditions = append(conditions, siteWithin(latArg, lonArg, args.add(radiusKm*1000)))
+			distance = siteDistance(latArg, lonArg) + " / 1000.0"
+			order = siteDistance(latArg, lonArg) + ", s.id"
+		}
+		if text := strings.TrimSpace(params.Get("q")); text != "" {
+			pattern := args.add("%" + escapeLike(text) + "%")
+			conditions = append(conditions, fmt.Sprintf(
+				"(s.name ILIKE %s OR EXISTS (SELECT 1 FROM unnest(s.aliases) a WHERE a ILIKE %s))", pattern, pattern))
+		}
+
+		where := ""
+		if len(conditions) > 0 {
+			where = " WHERE " + strings.Join(conditions, " AND ")
+		}
+		rows, err := db.Query("SELECT "+siteColumns+", "+distance+" FROM dive_sites s"+where+
+			" ORDER BY "+order+fmt.Sprintf(" LIMIT %d", maxSitesPerPage), args...)
+		if err != nil {
+			http.Error(w, "Failed to retrieve dive sites", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		sites, err := scanSites(rows)
+		if err != nil {
+			http.Error(w, "Error processing dive site data", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(sites)
+	}
+}
+
+// suggestSites returns the sites a dive at ?latitude=&longitude= was most
+// likely at: those within siteSuggestRadius, nearest first.
+func suggestSites(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lat, lon, ok, err := queryCenter(r.URL.Query())
+		if err != nil || !ok {
+			http.Error(w, "latitude and longitude are required", http.StatusBadRequest)
+			return
+		}
+
+		sites, err := findNearbySites(db, lat, lon, siteSuggestRadius, maxSiteSuggestions)
+		if err != nil {
+			http.Error(w, "Failed to retrieve dive sites", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(sites)
+	}
+}
+
+// siteStats aggregates the posts logged at a site. Averages leave out
+// posts that didn't record the value.
+type siteStats struct {
+	Dives         int            `json:"dives"`
+	Divers        int            `json:"divers"`
+	MaxDepth      *float64       `json:"max_depth,omitempty"` // deepest logged dive
+	AvgDepth      *float64       `json:"avg_depth,omitempty"`
+	AvgVisibility *float64       `json:"avg_visibility,omitempty"`
+	AvgRating     *float64       `json:"avg_rating,omitempty"`
+	AvgWaterTemp  *float64       `json:"avg_water_temp,omitempty"`
+	FirstDive     *time.Time     `json:"first_dive,omitempty"`
+	LastDive      *time.Time     `json:"last_dive,omitempty"`
+	Activities    map[string]int `json:"activities"`
+}
+
+// sitePost is a post as listed on a site's page. The full posts are
+// available from POST /posts/search with {"site_id": id}.
+type sitePost struct {
+	Id         int       `json:"id"`
+	UserId     int       `json:"user_id"`
+	UserName   string    `json:"user_name"`
+	Title      string    `json:"title"`
+	Date       time.Time `json:"date"`
+	Depth      float64   `json:"depth"`
+	Visibility float64   `json:"visibility"`
+	Rating     float64   `json:"rating,omitempty"`
+}
+
+type siteDetail struct {
+	DiveSite
+	Stats       siteStats  `json:"stats"`
+	RecentPosts []sitePost `json:"recent_posts"`
+}
+
+func roundOptional(v *float64) *float64 {
+	if v == nil {
+		return nil
+	}
+	r := roundTo(*v, 1)
+	return &r
+}
+
+func loadSiteStats(db *sql.DB, siteID int) (siteStats, error) {
+	stats := siteStats{Activities: map[string]int{}}
+	err := db.QueryRow(`
+		SELECT COUNT(*), COUNT(DISTINCT user_id), MAX(depth) FILTER (WHERE depth > 0),
+			AVG(depth) FILTER (WHERE depth > 0), AVG(visibility) FILTER (WHERE visibility > 0),
+			AVG(rating) FILTER (WHERE rating > 0), AVG(water_temp), MIN(date), MAX(date)
+		FROM posts WHERE site_id = $1`, siteID,
+	).Scan(&stats.Dives, &stats.Divers, &stats.MaxDepth, &stats.AvgDepth, &stats.AvgVisibility,
+		&stats.AvgRating, &stats.AvgWaterTemp, &stats.FirstDive, &stats.LastDive)
+	if err != nil {
+		return stats, err
+	}
+	stats.AvgDepth = roundOptional(stats.AvgDepth)
+	stats.AvgVisibility = roundOptional(stats.AvgVisibility)
+	stats.AvgRating = roundOptional(stats.AvgRating)
+	stats.AvgWaterTemp = roundOptional(stats.AvgWaterTemp)
+
+	rows, err := db.Query(`
+		SELECT activity, COUNT(*) FROM posts
+		WHERE site_id = $1 AND COALESCE(activity, '') <> ''
+		GROUP BY activity`, siteID)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var activity string
+		var n int
+		if err := rows.Scan(&activity, &n); err != nil {
+			return stats, err
+		}
+		stats.Activities[activity] = n
+	}
+	return stats, rows.Err()
+}
+
+func loadSitePosts(db *sql.DB, siteID int) ([]sitePost, error) {
+	rows, err := db.Query(`
+		SELECT p.id, p.user_id, u.first_name || ' ' || u.last_name, p.title, p.date,
+			COALESCE(p.depth, 0), COALESCE(p.visibility, 0), COALESCE(p.rating, 0)
+		FROM posts p
+		JOIN users u ON p.user_id = u.id
+		WHERE p.site_id = $1
+		ORDER BY p.date DESC, p.id DESC
+		LIMIT $2`, siteID, siteRecentPosts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []sitePost{}
+	for rows.Next() {
+		var p sitePost
+		if err := rows.Scan(&p.Id, &p.UserId, &p.UserName, &p.Title, &p.Date, &p.Depth, &p.Visibility, &p.Rating); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+// getSite returns a site with statistics over every post logged there and
+// the most recent of those posts.
+func getSite(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		var detail siteDetail
+		err := db.QueryRow("SELECT "+siteColumns+" FROM dive_sites s WHERE s.id = $1", id).Scan(detail.scanTargets()...)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Dive site not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to retrieve dive site", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		if detail.Stats, err = loadSiteStats(db, detail.Id); err == nil {
+			detail.RecentPosts, err = loadSitePosts(db, detail.Id)
+		}
+		if err != nil {
+			http.Error(w, "Failed to retrieve dive site posts", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(detail)
+	}
+}
+
+// rejectDuplicateSite writes 409 naming the existing site when site would
+// duplicate one, or 500, and returns false when the request must stop.
+func rejectDuplicateSite(w http.ResponseWriter, db *sql.DB, site *DiveSite, excludeID int) bool {
+	existing, err := findDuplicateSite(db, site, excludeID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		log.Println("Database error:", err)
+		return false
+	}
+	if existing != nil {
+		http.Error(w, fmt.Sprintf("This looks like the existing dive site %q (id %d)", existing.Name, existing.Id), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// createSite adds a dive site. A site close to an existing one, or near
+// one with the same name, is refused with 409 so the posts there end up
+// on a single site.
+func createSite(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var s DiveSite
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := s.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !rejectDuplicateSite(w, db, &s, 0) {
+			return
+		}
+
+		err = db.QueryRow(`
+			INSERT INTO dive_sites AS s (name, latitude, longitude, max_depth, entry_type, description, aliases, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			RETURNING `+siteColumns,
+			s.Name, s.Latitude, s.Longitude, s.MaxDepth, nullIfEmpty(s.EntryType), s.Description, pq.Array(s.Aliases), callerID,
+		).Scan(s.scanTargets()...)
+		if err != nil {
+			http.Error(w, "Failed to create dive site", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s)
+	}
+}
+
+// updateSite replaces a site's details. Only the user who added the site
+// may change it.
+func updateSite(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, ok := authorizeOwner(w, r, db, id, siteOwner); !ok {
+			return
+		}
+
+		var s DiveSite
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := s.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		siteID, _ := strconv.Atoi(id)
+		if !rejectDuplicateSite(w, db, &s, siteID) {
+			return
+		}
+
+		err := db.QueryRow(`
+			UPDATE dive_sites AS s
+			SET name = $1, latitude = $2, longitude = $3, max_depth = $4, entry_type = $5, description = $6, aliases = $7
+			WHERE s.id = $8
+			RETURNING `+siteColumns,
+			s.Name, s.Latitude, s.Longitude, s.MaxDepth, nullIfEmpty(s.EntryType), s.Description, pq.Array(s.Aliases), siteID,
+		).Scan(s.scanTargets()...)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Dive site not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to update dive site", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(s)
+	}
+}
+
+// deleteSite removes a site; posts logged there keep their own location
+// and are unlinked.
+func deleteSite(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, ok := authorizeOwner(w, r, db, id, siteOwner); !ok {
+			return
+		}
+
+		if _, err := db.Exec("DELETE FROM dive_sites WHERE id = $1", id); err != nil {
+			http.Error(w, "Failed to delete dive site", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		siteID, _ := strconv.Atoi(id)
+		siteConditionsCache.invalidate(&siteID)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
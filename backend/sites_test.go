@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestDiveSiteValidate(t *testing.T) {
+	s := DiveSite{
+		Name:      "  Blue Hole ",
+		Latitude:  17.3159,
+		Longitude: -87.535,
+		EntryType: "Boat",
+		Aliases:   []string{"Great Blue Hole", "blue hole", "", "great blue hole", " Lighthouse Reef Hole"},
+	}
+	if err := s.validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.Name != "Blue Hole" || s.EntryType != "boat" {
+		t.Errorf("Expected a trimmed name and lower-case entry type, got %q %q", s.Name, s.EntryType)
+	}
+	if len(s.Aliases) != 2 || s.Aliases[0] != "Great Blue Hole" || s.Aliases[1] != "Lighthouse Reef Hole" {
+		t.Errorf("Expected repeated and blank aliases to be dropped, got %q", s.Aliases)
+	}
+	if names := s.names(); len(names) != 3 || names[0] != "blue hole" {
+		t.Errorf("Expected lower-case names, got %q", names)
+	}
+
+	depth := -5.0
+	for _, bad := range []DiveSite{
+		{Name: " ", Latitude: 0, Longitude: 0},
+		{Name: "Reef", Latitude: 91, Longitude: 0},
+		{Name: "Reef", MaxDepth: &depth},
+		{Name: "Reef", EntryType: "helicopter"},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	if got := escapeLike(`100%_reef\`); got != `100\%\_reef\\` {
+		t.Errorf("Unexpected escaping: %s", got)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// streamChannel is the Postgres channel stream_events are announced on.
+	streamChannel = "stream_events"
+	// streamHeartbeat keeps idle connections from being closed by proxies.
+	streamHeartbeat = 25 * time.Second
+	// streamRetry is how long clients wait before reconnecting.
+	streamRetry = 3 * time.Second
+	// streamEventRetention is how far back reconnecting clients can replay.
+	streamEventRetention = 24 * time.Hour
+	// streamReplayLimit caps a replay; clients further behind get a reset.
+	streamReplayLimit = 500
+	// streamLookBack is how many ids before the newest seen are read again
+	// when catching up. Ids are taken when a transaction writes the event
+	// but become visible when it commits, so a lower id can appear after a
+	// higher one.
+	streamLookBack = 100
+	// streamBuffer is how many events a subscriber may fall behind by
+	// before the hub drops it. It reconnects and replays.
+	streamBuffer    = 64
+	maxStreamPosts  = 50
+	streamPruneTick = 10 * time.Minute
+)
+
+// streamEvent is a row of stream_events. Events with a user go to that
+// user only; the others go to everyone watching the post.
+type streamEvent struct {
+	Id     int64
+	UserId *int
+	PostId *int
+	Type   string
+	Data   []byte // JSON
+}
+
+const streamEventColumns = "id, user_id, post_id, type, data"
+
+func scanStreamEvents(rows *sql.Rows) ([]streamEvent, error) {
+	defer rows.Close()
+	var events []streamEvent
+	for rows.Next() {
+		var e streamEvent
+		if err := rows.Scan(&e.Id, &e.UserId, &e.PostId, &e.Type, &e.Data); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// writeStreamEvent writes e in the text/event-stream format.
+func writeStreamEvent(w io.Writer, e streamEvent) error {
+	var b strings.Builder
+	if e.Id > 0 {
+		fmt.Fprintf(&b, "id: %d\n", e.Id)
+	}
+	fmt.Fprintf(&b, "event: %s\n", e.Type)
+	for _, line := range strings.Split(string(e.Data), "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type streamSubscriber struct {
+	userID  int
+	posts   map[int]bool
+	events  chan streamEvent
+	dropped chan struct{} // closed when the hub gives up on the subscriber
+}
+
+func newStreamSubscriber(userID int, posts []int) *streamSubscriber {
+	s := &streamSubscriber{
+		userID:  userID,
+		posts:   map[int]bool{},
+		events:  make(chan streamEvent, streamBuffer),
+		dropped: make(chan struct{}),
+	}
+	for _, id := range posts {
+		s.posts[id] = true
+	}
+	return s
+}
+
+func (s *streamSubscriber) wants(e streamEvent) bool {
+	if e.UserId != nil {
+		return *e.UserId == s.userID
+	}
+	return e.PostId != nil && s.posts[*e.PostId]
+}
+
+// eventHub relays stream events to the clients connected to this
+// instance. Every instance listens on streamChannel, so an event reaches
+// its subscribers wherever it was written.
+type eventHub struct {
+	db          *sql.DB
+	mu          sync.Mutex
+	subscribers map[*streamSubscriber]bool
+	lastID      int64          // the newest event relayed
+	relayed     map[int64]bool // the ids relayed within streamLookBack of lastID
+}
+
+func newEventHub(db *sql.DB) *eventHub {
+	return &eventHub{db: db, subscribers: map[*streamSubscriber]bool{}, relayed: map[int64]bool{}}
+}
+
+func (h *eventHub) subscribe(s *streamSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscribers[s] = true
+}
+
+func (h *eventHub) unsubscribe(s *streamSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, s)
+}
+
+func (h *eventHub) latestID() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastID
+}
+
+// publish hands e to the subscribers that want it, unless it was already
+// relayed. A subscriber whose buffer is full is dropped rather than allowed
+// to hold up the others.
+func (h *eventHub) publish(e streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.relayed[e.Id] {
+		return
+	}
+	h.relayed[e.Id] = true
+	if e.Id > h.lastID {
+		h.lastID = e.Id
+		for id := range h.relayed {
+			if id <= h.lastID-streamLookBack {
+				delete(h.relayed, id)
+			}
+		}
+	}
+	for s := range h.subscribers {
+		if !s.wants(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			delete(h.subscribers, s)
+			close(s.dropped)
+		}
+	}
+}
+
+// relay loads the events matching where and publishes them in order.
+func (h *eventHub) relay(where string, arg int64) {
+	rows, err := h.db.Query("SELECT "+streamEventColumns+" FROM stream_events WHERE "+where+" ORDER BY id", arg)
+	if err != nil {
+		log.Println("Database error:", err)
+		return
+	}
+	events, err := scanStreamEvents(rows)
+	if err != nil {
+		log.Println("Database error:", err)
+		return
+	}
+	for _, e := range events {
+		h.publish(e)
+	}
+}
+
+// listen relays events as they are announced until the process exits.
+// After the listener reconnects it catches up on what it may have missed,
+// looking back streamLookBack ids for events that committed late.
+func (h *eventHub) listen(dsn string) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("Event listener error:", err)
+		}
+	})
+	if err := listener.Listen(streamChannel); err != nil {
+		log.Println("Failed to listen for stream events:", err)
+		return
+	}
+
+	// Events from before the hub started count as relayed, so catching up
+	// doesn't send them to anyone
+	var lastID int64
+	if err := h.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM stream_events").Scan(&lastID); err != nil {
+		log.Println("Database error:", err)
+	}
+	var earlier []int64
+	if err := h.db.QueryRow("SELECT COALESCE(array_agg(id), '{}') FROM stream_events WHERE id > $1", lastID-streamLookBack).Scan(pq.Array(&earlier)); err != nil {
+		log.Println("Database error:", err)
+	}
+	h.mu.Lock()
+	h.lastID = lastID
+	for _, id := range earlier {
+		h.relayed[id] = true
+	}
+	h.mu.Unlock()
+
+	prune := time.NewTicker(streamPruneTick)
+	defer prune.Stop()
+	for {
+		select {
+		case n := <-listener.Notify:
+			if n == nil {
+				h.relay("id > $1", h.latestID()-streamLookBack)
+				continue
+			}
+			id, err := strconv.ParseInt(n.Extra, 10, 64)
+			if err != nil {
+				log.Println("Invalid stream event id:", n.Extra)
+				continue
+			}
+			h.relay("id = $1", id)
+		case <-time.After(90 * time.Second):
+			go listener.Ping()
+		case <-prune.C:
+			cutoff := time.Now().Add(-streamEventRetention)
+			if _, err := h.db.Exec("DELETE FROM stream_events WHERE timestamp < $1", cutoff); err != nil {
+				log.Println("Database error:", err)
+			}
+		}
+	}
+}
+
+// replayStreamEvents returns the events after lastID that s wants, and
+// those within streamLookBack ids before it, which the client may have
+// missed if they committed late. When the client is too far behind to
+// replay everything it missed, reset is true and it should reload instead.
+func replayStreamEvents(db *sql.DB, s *streamSubscriber, lastID int64) (events []streamEvent, reset bool, err error) {
+	var oldest int64
+	if err := db.QueryRow("SELECT COALESCE(MIN(id), $1 + 1) FROM stream_events", lastID).Scan(&oldest); err != nil {
+		return nil, false, err
+	}
+	if lastID+1 < oldest {
+		return nil, true, nil
+	}
+
+	posts := make([]int64, 0, len(s.posts))
+	for id := range s.posts {
+		posts = append(posts, int64(id))
+	}
+	rows, err := db.Query(`
+		SELECT `+streamEventColumns+` FROM stream_events
+		WHERE id > $1 AND (user_id = $2 OR (user_id IS NULL AND post_id = ANY($3)))
+		ORDER BY id
+		LIMIT $4`, lastID-streamLookBack, s.userID, pq.Array(posts), streamReplayLimit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	if events, err = scanStreamEvents(rows); err != nil {
+		return nil, false, err
+	}
+	if len(events) > streamReplayLimit {
+		return nil, true, nil
+	}
+	return events, false, nil
+}
+
+// parseStreamPosts reads ?posts=1,2,3, the posts whose comments and likes
+// the client wants to follow.
+func parseStreamPosts(raw string) ([]int, error) {
+	var posts []int
+	if raw == "" {
+		return posts, nil
+	}
+	for _, part := range strings.Split(raw, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || id < 1 {
+			return nil, fmt.Errorf("posts must be a comma-separated list of post ids")
+		}
+		posts = append(posts, id)
+	}
+	if len(posts) > maxStreamPosts {
+		return nil, fmt.Errorf("at most %d posts can be watched", maxStreamPosts)
+	}
+	return posts, nil
+}
+
+// queryTokenAuth lets EventSource clients, which can't set headers, pass
+// their access token as ?access_token= instead.
+func queryTokenAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("access_token"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// streamEvents handles GET /api/go/events, a Server-Sent Events stream of
+// the caller's notifications and of new comments and like counts on the
+// posts in ?posts=. A client reconnecting with Last-Event-ID (or
+// ?last_event_id=) first receives the events it missed, or a reset event
+// when too much has happened to replay. The replay looks back
+// streamLookBack ids for events that committed late, so it can repeat
+// events the client has already seen; clients ignore ids they have had.
+func streamEvents(db *sql.DB, hub *eventHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		posts, err := parseStreamPosts(r.URL.Query().Get("posts"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rawLastID := r.Header.Get("Last-Event-ID")
+		if rawLastID == "" {
+			rawLastID = r.URL.Query().Get("last_event_id")
+		}
+		var lastID int64
+		if rawLastID != "" {
+			if lastID, err = strconv.ParseInt(rawLastID, 10, 64); err != nil || lastID < 0 {
+				http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Subscribe before replaying so nothing falls between the two
+		sub := newStreamSubscriber(callerID, posts)
+		hub.subscribe(sub)
+		defer hub.unsubscribe(sub)
+
+		var replay []streamEvent
+		reset := false
+		if rawLastID != "" {
+			if replay, reset, err = replayStreamEvents(db, sub, lastID); err != nil {
+				http.Error(w, "Failed to replay events", http.StatusInternalServerError)
+				log.Println("Database error:", err)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds())
+
+		if reset {
+			writeStreamEvent(w, streamEvent{Id: hub.latestID(), Type: "reset", Data: []byte("{}")})
+		}
+		replayed := map[int64]bool{}
+		for _, e := range replay {
+			writeStreamEvent(w, e)
+			replayed[e.Id] = true
+		}
+		flusher.Flush()
+
+		sessionID, _ := getSessionIDFromContext(r.Context())
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-sub.dropped:
+				return
+			case e := <-sub.events:
+				if replayed[e.Id] {
+					delete(replayed, e.Id)
+					continue
+				}
+				if err := writeStreamEvent(w, e); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-heartbeat.C:
+				// End streams of sessions that were logged out since
+				if sessionID != "" {
+					if active, err := isSessionActive(r.Context(), db, sessionID); err != nil || !active {
+						return
+					}
+				}
+				if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
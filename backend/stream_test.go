@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteStreamEvent(t *testing.T) {
+	var b strings.Builder
+	writeStreamEvent(&b, streamEvent{Id: 42, Type: "likes", Data: []byte(`{"post_id": 1, "likes": 3}`)})
+	want := "id: 42\nevent: likes\ndata: {\"post_id\": 1, \"likes\": 3}\n\n"
+	if b.String() != want {
+		t.Errorf("writeStreamEvent wrote %q, want %q", b.String(), want)
+	}
+
+	// Multi-line data becomes several data lines, and id is left out when unknown
+	b.Reset()
+	writeStreamEvent(&b, streamEvent{Type: "reset", Data: []byte("a\nb")})
+	if want := "event: reset\ndata: a\ndata: b\n\n"; b.String() != want {
+		t.Errorf("writeStreamEvent wrote %q, want %q", b.String(), want)
+	}
+}
+
+func TestParseStreamPosts(t *testing.T) {
+	if posts, err := parseStreamPosts("1, 2,3"); err != nil || len(posts) != 3 || posts[2] != 3 {
+		t.Errorf("parseStreamPosts = %v, %v", posts, err)
+	}
+	if posts, err := parseStreamPosts(""); err != nil || len(posts) != 0 {
+		t.Errorf("parseStreamPosts of nothing = %v, %v", posts, err)
+	}
+	for _, raw := range []string{"1,x", "0", strings.Repeat("1,", maxStreamPosts) + "1"} {
+		if _, err := parseStreamPosts(raw); err == nil {
+			t.Errorf("parseStreamPosts(%q) should fail", raw)
+		}
+	}
+}
+
+func TestEventHubRoutesAndDropsSlowSubscribers(t *testing.T) {
+	hub := newEventHub(nil)
+	alice := newStreamSubscriber(1, []int{10})
+	bob := newStreamSubscriber(2, nil)
+	hub.subscribe(alice)
+	hub.subscribe(bob)
+
+	hub.publish(streamEvent{Id: 1, PostId: intPtr(10), Type: "comment"})
+	hub.publish(streamEvent{Id: 2, PostId: intPtr(11), Type: "comment"})
+	hub.publish(streamEvent{Id: 3, UserId: intPtr(2), Type: "notification"})
+
+	if len(alice.events) != 1 || (<-alice.events).Id != 1 {
+		t.Error("Expected alice to receive only the comment on the post she watches")
+	}
+	if len(bob.events) != 1 || (<-bob.events).Id != 3 {
+		t.Error("Expected bob to receive only his notification")
+	}
+	if hub.latestID() != 3 {
+		t.Errorf("Expected the hub to remember event 3, got %d", hub.latestID())
+	}
+
+	// Bob stops reading; once his buffer is full he is dropped
+	for i := 0; i <= streamBuffer; i++ {
+		hub.publish(streamEvent{Id: int64(4 + i), UserId: intPtr(2), Type: "notification"})
+	}
+	select {
+	case <-bob.dropped:
+	default:
+		t.Error("Expected a subscriber with a full buffer to be dropped")
+	}
+	select {
+	case <-alice.dropped:
+		t.Error("Expected alice to stay subscribed")
+	default:
+	}
+}
+
+func TestEventHubRelaysLateEventsOnce(t *testing.T) {
+	hub := newEventHub(nil)
+	bob := newStreamSubscriber(2, nil)
+	hub.subscribe(bob)
+
+	// Event 5 commits before event 4; catching up relays both again
+	for _, id := range []int64{5, 4, 4, 5} {
+		hub.publish(streamEvent{Id: id, UserId: intPtr(2), Type: "notification"})
+	}
+	if len(bob.events) != 2 || (<-bob.events).Id != 5 || (<-bob.events).Id != 4 {
+		t.Error("Expected each event to be relayed once, late ones included")
+	}
+	if hub.latestID() != 5 {
+		t.Errorf("Expected the hub to remember event 5, got %d", hub.latestID())
+	}
+
+	// Ids further back than the look-back are forgotten
+	hub.publish(streamEvent{Id: 5 + streamLookBack, UserId: intPtr(2), Type: "notification"})
+	<-bob.events
+	if hub.relayed[4] || hub.relayed[5] || !hub.relayed[5+streamLookBack] {
+		t.Errorf("Expected only ids within the look-back to be kept, got %v", hub.relayed)
+	}
+}
+
+func TestQueryTokenAuth(t *testing.T) {
+	var got string
+	handler := queryTokenAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/go/events?access_token=abc", nil))
+	if got != "Bearer abc" {
+		t.Errorf("Expected the query token in the header, got %q", got)
+	}
+
+	req := httptest.NewRequest("GET", "/api/go/events?access_token=abc", nil)
+	req.Header.Set("Authorization", "Bearer header")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "Bearer header" {
+		t.Errorf("Expected the header to win over the query, got %q", got)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Token signing keys are configured with JWT_KEYS (a JSON array) or
+// JWT_KEYS_FILE (a path to the same JSON), for example:
+//
+//	[
+//	  {"kid": "2025-06", "alg": "EdDSA", "private_key_file": "/secrets/ed25519.pem"},
+//	  {"kid": "2025-01", "alg": "HS256", "secret": "..."}
+//	]
+//
+// JWT_ACTIVE_KID picks the key used to sign new tokens and defaults to the
+// first entry. Every other entry stays valid for verification, so a key can
+// be rotated by adding a new one in front and removing the old one after the
+// longest token lifetime has passed. JWT_SECRET is still honoured as a single
+// HS256 key for simple deployments.
+//
+// The server refuses to start without a key, since a per-process key would
+// log everyone out on each restart and split sessions between instances.
+// JWT_DEV_RANDOM_KEY=1 allows a random key for local development.
+
+type jwtKeyConfig struct {
+	Kid            string `json:"kid"`
+	Alg            string `json:"alg"`
+	Secret         string `json:"secret,omitempty"`
+	PrivateKey     string `json:"private_key,omitempty"`
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+	PublicKey      string `json:"public_key,omitempty"`
+	PublicKeyFile  string `json:"public_key_file,omitempty"`
+}
+
+type signingKey struct {
+	Kid       string
+	Method    jwt.SigningMethod
+	SignKey   interface{} // nil for verify-only keys
+	VerifyKey interface{}
+}
+
+type keyRing struct {
+	active *signingKey
+	keys   map[string]*signingKey
+	order  []string
+}
+
+var (
+	jwtKeyRing     *keyRing
+	jwtKeyRingOnce sync.Once
+)
+
+// getKeyRing returns the process-wide signing keys, loading them from the
+// environment on first use.
+func getKeyRing() *keyRing {
+	jwtKeyRingOnce.Do(func() {
+		var err error
+		jwtKeyRing, err = loadKeyRingFromEnv()
+		if err != nil {
+			log.Fatalf("Error loading JWT keys: %v", err)
+		}
+	})
+	return jwtKeyRing
+}
+
+func loadKeyRingFromEnv() (*keyRing, error) {
+	var configs []jwtKeyConfig
+
+	raw := os.Getenv("JWT_KEYS")
+	if path := os.Getenv("JWT_KEYS_FILE"); raw == "" && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		raw = string(data)
+	}
+
+	switch {
+	case raw != "":
+		if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+			return nil, fmt.Errorf("parsing JWT key config: %w", err)
+		}
+	case os.Getenv("JWT_SECRET") != "":
+		configs = []jwtKeyConfig{{Kid: "default", Alg: "HS256", Secret: os.Getenv("JWT_SECRET")}}
+	case os.Getenv("JWT_DEV_RANDOM_KEY") != "1":
+		return nil, errors.New("no JWT_KEYS, JWT_KEYS_FILE or JWT_SECRET configured (set JWT_DEV_RANDOM_KEY=1 to use a random key in development)")
+	default:
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		log.Println("Warning: no JWT_KEYS or JWT_SECRET configured; using a random key, tokens will not survive a restart")
+		configs = []jwtKeyConfig{{Kid: "ephemeral", Alg: "HS256", Secret: hex.EncodeToString(secret)}}
+	}
+
+	return newKeyRing(configs, os.Getenv("JWT_ACTIVE_KID"))
+}
+
+func newKeyRing(configs []jwtKeyConfig, activeKid string) (*keyRing, error) {
+	if len(configs) == 0 {
+		return nil, errors.New("no JWT keys configured")
+	}
+
+	ring := &keyRing{keys: map[string]*signingKey{}}
+	for _, c := range configs {
+		key, err := parseKeyConfig(c)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", c.Kid, err)
+		}
+		if _, dup := ring.keys[key.Kid]; dup {
+			return nil, fmt.Errorf("duplicate key id %q", key.Kid)
+		}
+		ring.keys[key.Kid] = key
+		ring.order = append(ring.order, key.Kid)
+	}
+
+	if activeKid == "" {
+		activeKid = ring.order[0]
+	}
+	ring.active = ring.keys[activeKid]
+	if ring.active == nil {
+		return nil, fmt.Errorf("active key %q is not configured", activeKid)
+	}
+	if ring.active.SignKey == nil {
+		return nil, fmt.Errorf("active key %q has no private key", activeKid)
+	}
+	return ring, nil
+}
+
+func readKeyMaterial(inline, path string) ([]byte, error) {
+	if inline != "" {
+		return []byte(inline), nil
+	}
+	if path != "" {
+		return os.ReadFile(path)
+	}
+	return nil, nil
+}
+
+func parseKeyConfig(c jwtKeyConfig) (*signingKey, error) {
+	if c.Kid == "" {
+		return nil, errors.New("kid is required")
+	}
+
+	key := &signingKey{Kid: c.Kid}
+
+	privatePEM, err := readKeyMaterial(c.PrivateKey, c.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	publicPEM, err := readKeyMaterial(c.PublicKey, c.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.Alg {
+	case "HS256", "HS384", "HS512":
+		if c.Secret == "" {
+			return nil, errors.New("secret is required for HMAC keys")
+		}
+		if len(c.Secret) < 32 {
+			log.Printf("Warning: JWT key %q uses a secret shorter than 32 bytes", c.Kid)
+		}
+		key.Method = jwt.GetSigningMethod(c.Alg)
+		key.SignKey = []byte(c.Secret)
+		key.VerifyKey = []byte(c.Secret)
+
+	case "RS256":
+		key.Method = jwt.SigningMethodRS256
+		if privatePEM != nil {
+			priv, err := jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+			if err != nil {
+				return nil, err
+			}
+			key.SignKey = priv
+			key.VerifyKey = &priv.PublicKey
+		} else if publicPEM != nil {
+			pub, err := jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+			if err != nil {
+				return nil, err
+			}
+			key.VerifyKey = pub
+		}
+
+	case "EdDSA":
+		key.Method = signingMethodEdDSA
+		if privatePEM != nil {
+			priv, err := parseEd25519PrivateKey(privatePEM)
+			if err != nil {
+				return nil, err
+			}
+			key.SignKey = priv
+			key.VerifyKey = priv.Public()
+		} else if publicPEM != nil {
+			pub, err := parseEd25519PublicKey(publicPEM)
+			if err != nil {
+				return nil, err
+			}
+			key.VerifyKey = pub
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported alg %q", c.Alg)
+	}
+
+	if key.VerifyKey == nil {
+		return nil, errors.New("a private or public key is required")
+	}
+	return key, nil
+}
+
+func parseEd25519PrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not Ed25519")
+	}
+	return priv, nil
+}
+
+func parseEd25519PublicKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM public key")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not Ed25519")
+	}
+	return pub, nil
+}
+
+// sign issues a token with the active key and stamps its kid in the header.
+func (k *keyRing) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.active.Method, claims)
+	token.Header["kid"] = k.active.Kid
+	return token.SignedString(k.active.SignKey)
+}
+
+// keyFunc resolves the verification key for a token by its kid. Tokens
+// issued before kids existed are checked against the active key. The
+// algorithm must match the key's, which rules out alg-confusion attacks.
+func (k *keyRing) keyFunc(token *jwt.Token) (interface{}, error) {
+	key := k.active
+	if kid, ok := token.Header["kid"].(string); ok {
+		key = k.keys[kid]
+		if key == nil {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %q", token.Method.Alg())
+	}
+	return key.VerifyKey, nil
+}
+
+// parseToken validates a token against the configured keys.
+func parseToken(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, getKeyRing().keyFunc)
+}
+
+// jwk is a public key in JSON Web Key format. Only asymmetric keys are ever
+// published; HMAC secrets stay private.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+func (k *keyRing) jwks() []jwk {
+	keys := []jwk{}
+	for _, kid := range k.order {
+		key := k.keys[kid]
+		switch pub := key.VerifyKey.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, jwk{
+				Kty: "RSA", Kid: kid, Alg: key.Method.Alg(), Use: "sig",
+				N: base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, jwk{
+				Kty: "OKP", Kid: kid, Alg: key.Method.Alg(), Use: "sig",
+				Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+	return keys
+}
+
+// Publish the public verification keys so other services can check
+// dive-net tokens
+func handleJWKS() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(time.Hour.Seconds())))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": getKeyRing().jwks(),
+		})
+	}
+}
+
+// signingMethodEdDSA adds Ed25519 support, which this jwt-go version lacks.
+var signingMethodEdDSA = &eddsaSigningMethod{}
+
+type eddsaSigningMethod struct{}
+
+func init() {
+	jwt.RegisterSigningMethod(signingMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return signingMethodEdDSA
+	})
+}
+
+func (m *eddsaSigningMethod) Alg() string { return "EdDSA" }
+
+func (m *eddsaSigningMethod) Sign(signingString string, key interface{}) (string, error) {
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(priv, []byte(signingString))), nil
+}
+
+func (m *eddsaSigningMethod) Verify(signingString, signature string, key interface{}) error {
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestKeyRotationKeepsOldTokensValid(t *testing.T) {
+	oldRing, err := newKeyRing([]jwtKeyConfig{
+		{Kid: "old", Alg: "HS256", Secret: "old-secret-old-secret-old-secret"},
+	}, "")
+	if err != nil {
+		t.Fatalf("Error building key ring: %v", err)
+	}
+
+	oldToken, err := oldRing.sign(jwt.MapClaims{"user_id": "1"})
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating Ed25519 key: %v", err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(priv)
+	privPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	// Rotate: a new EdDSA key signs, the old HMAC key only verifies
+	newRing, err := newKeyRing([]jwtKeyConfig{
+		{Kid: "new", Alg: "EdDSA", PrivateKey: privPEM},
+		{Kid: "old", Alg: "HS256", Secret: "old-secret-old-secret-old-secret"},
+	}, "new")
+	if err != nil {
+		t.Fatalf("Error building rotated key ring: %v", err)
+	}
+
+	if token, err := jwt.Parse(oldToken, newRing.keyFunc); err != nil || !token.Valid {
+		t.Errorf("Expected token from retired key to verify, got %v", err)
+	}
+
+	newToken, err := newRing.sign(jwt.MapClaims{"user_id": "1"})
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+	token, err := jwt.Parse(newToken, newRing.keyFunc)
+	if err != nil || !token.Valid {
+		t.Fatalf("Expected EdDSA token to verify, got %v", err)
+	}
+	if token.Header["kid"] != "new" {
+		t.Errorf("Expected kid header %q, got %v", "new", token.Header["kid"])
+	}
+
+	if _, err := jwt.Parse(newToken, oldRing.keyFunc); err == nil {
+		t.Error("Expected token with unknown kid to be rejected")
+	}
+
+	jwks := newRing.jwks()
+	if len(jwks) != 1 || jwks[0].Kid != "new" || jwks[0].Crv != "Ed25519" {
+		t.Errorf("Expected only the EdDSA key in JWKS, got %+v", jwks)
+	}
+}
+
+func TestKeyRingRejectsAlgorithmConfusion(t *testing.T) {
+	ring, err := newKeyRing([]jwtKeyConfig{
+		{Kid: "k1", Alg: "HS256", Secret: "some-secret-some-secret-some-sec"},
+	}, "")
+	if err != nil {
+		t.Fatalf("Error building key ring: %v", err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{"user_id": "1"})
+	token.Header["kid"] = "k1"
+	signed, _ := token.SignedString([]byte("some-secret-some-secret-some-sec"))
+
+	if _, err := jwt.Parse(signed, ring.keyFunc); err == nil {
+		t.Error("Expected token signed with a different algorithm to be rejected")
+	}
+}
+
+func TestKeyRingFromEnvRequiresAKey(t *testing.T) {
+	for _, name := range []string{"JWT_KEYS", "JWT_KEYS_FILE", "JWT_SECRET", "JWT_ACTIVE_KID", "JWT_DEV_RANDOM_KEY"} {
+		t.Setenv(name, "")
+	}
+	if _, err := loadKeyRingFromEnv(); err == nil {
+		t.Error("Expected an error without any configured key")
+	}
+
+	t.Setenv("JWT_DEV_RANDOM_KEY", "1")
+	if ring, err := loadKeyRingFromEnv(); err != nil || ring.active.Kid != "ephemeral" {
+		t.Errorf("Expected a random development key, got %v", err)
+	}
+
+	t.Setenv("JWT_SECRET", "shared-secret-shared-secret-shared")
+	if ring, err := loadKeyRingFromEnv(); err != nil || ring.active.Kid != "default" {
+		t.Errorf("Expected the JWT_SECRET key, got %v", err)
+	}
+}
@@ -0,0 +1,713 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// RSVP statuses
+const (
+	rsvpGoing      = "going"
+	rsvpWaitlisted = "waitlisted"
+)
+
+const (
+	maxTripCapacity     = 100
+	maxTripTitle        = 200
+	defaultTripPageSize = 20
+	maxTripPageSize     = 100
+)
+
+type Trip struct {
+	Id                    int       `json:"id"`
+	OrganizerId           *int      `json:"organizer_id,omitempty"` // nil once the organizer has left
+	Title                 string    `json:"title"`
+	Description           string    `json:"description"`
+	SiteId                *int      `json:"site_id,omitempty"`
+	SiteName              string    `json:"site_name,omitempty"`
+	StartsAt              time.Time `json:"starts_at"`
+	Capacity              int       `json:"capacity"`
+	RequiredCertification string    `json:"required_certification,omitempty"`
+	GoingCount            int       `json:"going_count"`
+	WaitlistCount         int       `json:"waitlist_count"`
+	RSVP                  string    `json:"rsvp,omitempty"` // the caller's: going or waitlisted
+	Timestamp             time.Time `json:"timestamp"`
+}
+
+type tripPage struct {
+	Trips      []Trip `json:"trips"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// tripSelect selects the columns scanned by scanTargets, with the RSVP of
+// the user at callerArg.
+func tripSelect(callerArg string) string {
+	return `SELECT t.id, t.organizer_id, t.title, t.description, t.site_id, COALESCE(s.name, ''), t.starts_at, t.capacity,
+			COALESCE(t.required_certification, ''),
+			(SELECT COUNT(*) FROM trip_rsvps WHERE trip_id = t.id AND status = '` + rsvpGoing + `'),
+			(SELECT COUNT(*) FROM trip_rsvps WHERE trip_id = t.id AND status = '` + rsvpWaitlisted + `'),
+			COALESCE((SELECT status FROM trip_rsvps WHERE trip_id = t.id AND user_id = ` + callerArg + `), ''),
+			t.timestamp
+		FROM trips t
+		LEFT JOIN dive_sites s ON s.id = t.site_id`
+}
+
+func (t *Trip) scanTargets() []interface{} {
+	return []interface{}{
+		&t.Id, &t.OrganizerId, &t.Title, &t.Description, &t.SiteId, &t.SiteName, &t.StartsAt, &t.Capacity,
+		&t.RequiredCertification, &t.GoingCount, &t.WaitlistCount, &t.RSVP, &t.Timestamp,
+	}
+}
+
+// validate normalizes the title and description and checks the rest.
+// Trips are planned ahead, so they must start in the future.
+func (t *Trip) validate() error {
+	t.Title = strings.TrimSpace(t.Title)
+	t.Description = strings.TrimSpace(t.Description)
+	switch {
+	case t.Title == "" || len(t.Title) > maxTripTitle:
+		return fmt.Errorf("title must be 1 to %d characters", maxTripTitle)
+	case t.StartsAt.IsZero() || !t.StartsAt.After(time.Now()):
+		return fmt.Errorf("starts_at must be in the future")
+	case t.Capacity < 1 || t.Capacity > maxTripCapacity:
+		return fmt.Errorf("capacity must be between 1 and %d", maxTripCapacity)
+	case t.RequiredCertification != "" && !oneOf(t.RequiredCertification, certificationLevels):
+		return fmt.Errorf("required_certification must be one of %s", strings.Join(certificationLevels, ", "))
+	}
+	return nil
+}
+
+// certificationMeets reports whether a diver certified at have may join a
+// trip requiring required; a trip requiring nothing is open to everyone.
+func certificationMeets(have, required string) bool {
+	if required == "" {
+		return true
+	}
+	allowed, err := certificationsFrom(required)
+	return err == nil && oneOf(have, allowed)
+}
+
+func tripOwner(db *sql.DB, id string) (int, error) {
+	var ownerID int
+	err := db.QueryRow("SELECT COALESCE(organizer_id, 0) FROM trips WHERE id = $1", id).Scan(&ownerID)
+	return ownerID, err
+}
+
+// loadTrip writes 404 or 500 and returns false when the trip can't be
+// loaded.
+func loadTrip(w http.ResponseWriter, db *sql.DB, id interface{}, callerID int) (Trip, bool) {
+	var t Trip
+	err := db.QueryRow(tripSelect("$2")+" WHERE t.id = $1", id, callerID).Scan(t.scanTargets()...)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Trip not found", http.StatusNotFound)
+		return t, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve trip", http.StatusInternalServerError)
+		log.Println("Database error:", err)
+		return t, false
+	}
+	return t, true
+}
+
+// createTrip handles POST /trips. The organizer is going.
+func createTrip(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var t Trip
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := t.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !checkPostSite(w, db, t.SiteId) {
+			return
+		}
+
+		err = db.QueryRow(`
+			WITH trip AS (
+				INSERT INTO trips (organizer_id, title, description, site_id, starts_at, capacity, required_certification)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)
+				RETURNING id
+			), organizer AS (
+				INSERT INTO trip_rsvps (trip_id, user_id, status) SELECT id, $1, '`+rsvpGoing+`' FROM trip
+			)
+			SELECT id FROM trip`,
+			callerID, t.Title, t.Description, t.SiteId, t.StartsAt.UTC(), t.Capacity, nullIfEmpty(t.RequiredCertification),
+		).Scan(&t.Id)
+		if err != nil {
+			http.Error(w, "Failed to create trip", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		created, ok := loadTrip(w, db, t.Id, callerID)
+		if !ok {
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	}
+}
+
+// getTrips lists upcoming trips, soonest first, or with ?past=true past
+// trips, latest first. ?site_id= keeps the trips to one site, and ?limit=
+// and ?cursor= paginate.
+func getTrips(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		params := r.URL.Query()
+		past := params.Get("past") == "true"
+		sortName := "trips"
+		if past {
+			sortName = "past_trips"
+		}
+		limit, cursor, err := pageParams(r, sortName, defaultTripPageSize, maxTripPageSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		args := queryArgs{callerID}
+		conditions := []string{"t.starts_at > now()"}
+		order, after := "t.starts_at, t.id", ">"
+		if past {
+			conditions = []string{"t.starts_at <= now()"}
+			order, after = "t.starts_at DESC, t.id DESC", "<"
+		}
+		if raw := params.Get("site_id"); raw != "" {
+			siteID, err := strconv.Atoi(raw)
+			if err != nil {
+				http.Error(w, "Invalid site_id", http.StatusBadRequest)
+				return
+			}
+			conditions = append(conditions, "t.site_id = "+args.add(siteID))
+		}
+		if cursor != nil {
+			conditions = append(conditions, fmt.Sprintf("(t.starts_at, t.id) %s (%s::timestamp, %s)", after, args.add(cursor.Value), args.add(cursor.Id)))
+		}
+
+		rows, err := db.Query(tripSelect("$1")+`
+			WHERE `+strings.Join(conditions, " AND ")+`
+			ORDER BY `+order+`
+			LIMIT `+strconv.Itoa(limit+1), args...)
+		if err != nil {
+			http.Error(w, "Failed to retrieve trips", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		defer rows.Close()
+
+		page := tripPage{Trips: []Trip{}}
+		for rows.Next() {
+			var t Trip
+			if err := rows.Scan(t.scanTargets()...); err != nil {
+				http.Error(w, "Error scanning trip data", http.StatusInternalServerError)
+				log.Println("Scan error:", err)
+				return
+			}
+			// The extra row only tells us there is another page
+			if len(page.Trips) == limit {
+				last := page.Trips[limit-1]
+				page.NextCursor = encodePostCursor(postCursor{Sort: sortName, Value: cursorValue(last.StartsAt), Id: last.Id})
+				break
+			}
+			page.Trips = append(page.Trips, t)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error processing trip data", http.StatusInternalServerError)
+			log.Println("Rows iteration error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+func getTrip(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if t, ok := loadTrip(w, db, mux.Vars(r)["id"], callerID); ok {
+			json.NewEncoder(w).Encode(t)
+		}
+	}
+}
+
+// updateTrip replaces a trip's details. Only the organizer may change it,
+// not below the number of divers already going, and not to a certification
+// that any diver going or waitlisted lacks; raising the capacity promotes
+// divers from the waitlist.
+func updateTrip(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		callerID, ok := authorizeOwner(w, r, db, id, tripOwner)
+		if !ok {
+			return
+		}
+
+		var t Trip
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := t.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !checkPostSite(w, db, t.SiteId) {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to update trip", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		defer tx.Rollback()
+
+		// Locking the trip, as an RSVP does, keeps a diver from taking a spot
+		// or joining between the checks below and the update
+		var required string
+		err = tx.QueryRow("SELECT COALESCE(required_certification, '') FROM trips WHERE id = $1 FOR UPDATE", id).Scan(&required)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Trip not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to update trip", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		var going int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM trip_rsvps WHERE trip_id = $1 AND status = '"+rsvpGoing+"'", id).Scan(&going); err != nil {
+			http.Error(w, "Failed to update trip", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		if t.Capacity < going {
+			http.Error(w, fmt.Sprintf("capacity can't be less than the %d divers going", going), http.StatusConflict)
+			return
+		}
+
+		if t.RequiredCertification != required {
+			unqualified, err := tripUnqualifiedRSVPs(tx, id, t.RequiredCertification)
+			if err != nil {
+				http.Error(w, "Failed to update trip", http.StatusInternalServerError)
+				log.Println("Database error:", err)
+				return
+			}
+			if unqualified > 0 {
+				http.Error(w, fmt.Sprintf("%d divers on this trip don't hold %s certification or above", unqualified, t.RequiredCertification), http.StatusConflict)
+				return
+			}
+		}
+
+		_, err = tx.Exec(`
+			UPDATE trips
+			SET title = $2, description = $3, site_id = $4, starts_at = $5, capacity = $6, required_certification = $7
+			WHERE id = $1`,
+			id, t.Title, t.Description, t.SiteId, t.StartsAt.UTC(), t.Capacity, nullIfEmpty(t.RequiredCertification),
+		)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			http.Error(w, "Failed to update trip", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		if updated, ok := loadTrip(w, db, id, callerID); ok {
+			json.NewEncoder(w).Encode(updated)
+		}
+	}
+}
+
+// tripUnqualifiedRSVPs counts the divers going or waitlisted for a trip
+// whose certification doesn't meet required. The organizer leads the trip
+// and isn't held to it.
+func tripUnqualifiedRSVPs(tx *sql.Tx, tripID, required string) (int, error) {
+	rows, err := tx.Query(`
+		SELECT COALESCE(u.certification, '')
+		FROM trip_rsvps r
+		JOIN trips t ON t.id = r.trip_id
+		JOIN users u ON u.id = r.user_id
+		WHERE r.trip_id = $1 AND r.user_id IS DISTINCT FROM t.organizer_id`, tripID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	unqualified := 0
+	for rows.Next() {
+		var certification string
+		if err := rows.Scan(&certification); err != nil {
+			return 0, err
+		}
+		if !certificationMeets(certification, required) {
+			unqualified++
+		}
+	}
+	return unqualified, rows.Err()
+}
+
+// deleteTrip cancels a trip. Only the organizer may.
+func deleteTrip(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, ok := authorizeOwner(w, r, db, id, tripOwner); !ok {
+			return
+		}
+
+		if _, err := db.Exec("DELETE FROM trips WHERE id = $1", id); err != nil {
+			http.Error(w, "Failed to delete trip", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type tripRSVP struct {
+	Status           string `json:"status"`                      // going or waitlisted
+	WaitlistPosition int    `json:"waitlist_position,omitempty"` // 1 for the next diver promoted
+}
+
+// rsvpTrip handles POST /trips/{id}/rsvp. The caller is going while there
+// is room and waitlisted after that. Answering again leaves their place as
+// it is.
+func rsvpTrip(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id := mux.Vars(r)["id"]
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to RSVP", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		defer tx.Rollback()
+
+		// Locking the trip keeps two last-minute RSVPs from both taking the
+		// final spot
+		var capacity int
+		var organizerID *int
+		var started bool
+		var required string
+		err = tx.QueryRow(`
+			SELECT capacity, organizer_id, starts_at <= now(), COALESCE(required_certification, '')
+			FROM trips WHERE id = $1
+			FOR UPDATE`, id).Scan(&capacity, &organizerID, &started, &required)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Trip not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to RSVP", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		if started {
+			http.Error(w, "This trip has already started", http.StatusConflict)
+			return
+		}
+
+		var certification string
+		if err := tx.QueryRow("SELECT COALESCE(certification, '') FROM users WHERE id = $1", callerID).Scan(&certification); err != nil {
+			http.Error(w, "Failed to RSVP", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		if !certificationMeets(certification, required) {
+			http.Error(w, "This trip requires "+required+" certification or above", http.StatusForbidden)
+			return
+		}
+		if organizerID != nil {
+			blocked, err := blockedAmong(db, callerID, []int64{int64(*organizerID)})
+			if err != nil {
+				http.Error(w, "Failed to RSVP", http.StatusInternalServerError)
+				log.Println("Database error:", err)
+				return
+			}
+			if blocked {
+				http.Error(w, "You can't join this trip", http.StatusForbidden)
+				return
+			}
+		}
+
+		res, err := tx.Exec(`
+			INSERT INTO trip_rsvps (trip_id, user_id, status)
+			SELECT $1, $2, CASE WHEN COUNT(*) < $3 THEN '`+rsvpGoing+`' ELSE '`+rsvpWaitlisted+`' END
+			FROM trip_rsvps WHERE trip_id = $1 AND status = '`+rsvpGoing+`'
+			ON CONFLICT DO NOTHING`, id, callerID, capacity)
+		var added int64
+		if err == nil {
+			added, err = res.RowsAffected()
+		}
+		var rsvp tripRSVP
+		if err == nil {
+			err = tx.QueryRow(`
+				SELECT r.status, CASE WHEN r.status = '`+rsvpWaitlisted+`' THEN (
+					SELECT COUNT(*) FROM trip_rsvps w
+					WHERE w.trip_id = r.trip_id AND w.status = r.status AND (w.timestamp, w.user_id) <= (r.timestamp, r.user_id)
+				) ELSE 0 END
+				FROM trip_rsvps r WHERE r.trip_id = $1 AND r.user_id = $2`, id, callerID).Scan(&rsvp.Status, &rsvp.WaitlistPosition)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			http.Error(w, "Failed to RSVP", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		if added == 1 {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(rsvp)
+	}
+}
+
+// cancelRSVP handles DELETE /trips/{id}/rsvp. A spot given up goes to the
+// first diver on the waitlist; see promote_trip_waitlist. Once the trip
+// has started the attendee list is a record of who went, and stays.
+func cancelRSVP(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callerID, err := getCallerID(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id := mux.Vars(r)["id"]
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to cancel RSVP", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		defer tx.Rollback()
+
+		// Wait for RSVPs in flight so the promotion counts them
+		var started bool
+		err = tx.QueryRow("SELECT starts_at <= now() FROM trips WHERE id = $1 FOR UPDATE", id).Scan(&started)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Trip not found", http.StatusNotFound)
+			return
+		}
+		if err == nil && started {
+			http.Error(w, "This trip has already started", http.StatusConflict)
+			return
+		}
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM trip_rsvps WHERE trip_id = $1 AND user_id = $2", id, callerID)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			http.Error(w, "Failed to cancel RSVP", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type tripAttendee struct {
+	Id        int       `json:"id"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Username  string    `json:"username"`
+	Avatar    string    `json:"avatar,omitempty"`
+	PostIds   []int64   `json:"post_ids,omitempty"` // their posts linked to the trip
+	RSVPedAt  time.Time `json:"rsvped_at"`
+}
+
+type tripAttendees struct {
+	Going    []tripAttendee `json:"going"`
+	Waitlist []tripAttendee `json:"waitlist"` // in the order they will be promoted
+}
+
+// getTripAttendees lists who is going and who is waiting for a spot.
+func getTripAttendees(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, err := tripOwner(db, id); err == sql.ErrNoRows {
+			http.Error(w, "Trip not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to retrieve attendees", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT r.status, u.id, u.first_name, u.last_name, u.username, COALESCE(u.avatar, ''),
+				COALESCE((SELECT array_agg(p.id ORDER BY p.id) FROM posts p WHERE p.trip_id = r.trip_id AND p.user_id = u.id), '{}'),
+				r.timestamp
+			FROM trip_rsvps r
+			JOIN users u ON u.id = r.user_id
+			WHERE r.trip_id = $1
+			ORDER BY r.timestamp, r.user_id`, id)
+		if err != nil {
+			http.Error(w, "Failed to retrieve attendees", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		defer rows.Close()
+
+		attendees := tripAttendees{Going: []tripAttendee{}, Waitlist: []tripAttendee{}}
+		for rows.Next() {
+			var status string
+			var a tripAttendee
+			if err := rows.Scan(&status, &a.Id, &a.FirstName, &a.LastName, &a.Username, &a.Avatar, pq.Array(&a.PostIds), &a.RSVPedAt); err != nil {
+				http.Error(w, "Error scanning attendee data", http.StatusInternalServerError)
+				log.Println("Scan error:", err)
+				return
+			}
+			if status == rsvpGoing {
+				attendees.Going = append(attendees.Going, a)
+			} else {
+				attendees.Waitlist = append(attendees.Waitlist, a)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error processing attendee data", http.StatusInternalServerError)
+			log.Println("Rows iteration error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(attendees)
+	}
+}
+
+// linkTripPost handles PUT /trips/{id}/posts/{post_id}: once a trip has
+// started, a diver who went can link their post of the dive to it.
+func linkTripPost(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		callerID, ok := authorizeOwner(w, r, db, vars["post_id"], postOwner)
+		if !ok {
+			return
+		}
+
+		var started, went bool
+		err := db.QueryRow(`
+			SELECT t.starts_at <= now(),
+				EXISTS (SELECT 1 FROM trip_rsvps WHERE trip_id = t.id AND user_id = $2 AND status = '`+rsvpGoing+`')
+			FROM trips t WHERE t.id = $1`, vars["id"], callerID).Scan(&started, &went)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Trip not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to link post", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		if !went {
+			http.Error(w, "Only divers who went on the trip can link posts to it", http.StatusForbidden)
+			return
+		}
+		if !started {
+			http.Error(w, "Posts can be linked once the trip has started", http.StatusConflict)
+			return
+		}
+
+		if _, err := db.Exec("UPDATE posts SET trip_id = $1 WHERE id = $2", vars["id"], vars["post_id"]); err != nil {
+			http.Error(w, "Failed to link post", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// unlinkTripPost handles DELETE /trips/{id}/posts/{post_id}.
+func unlinkTripPost(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if _, ok := authorizeOwner(w, r, db, vars["post_id"], postOwner); !ok {
+			return
+		}
+
+		if _, err := db.Exec("UPDATE posts SET trip_id = NULL WHERE id = $1 AND trip_id = $2", vars["post_id"], vars["id"]); err != nil {
+			http.Error(w, "Failed to unlink post", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// getTripPosts lists the posts linked to a trip, newest first, paginated
+// with ?limit= and ?cursor=.
+func getTripPosts(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, cursor, err := pageParams(r, newestCursorSort, defaultPostPageSize, maxPostPageSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		args := queryArgs{mux.Vars(r)["id"], limit + 1}
+		rows, err := db.Query(`
+			SELECT `+combinedPostColumns()+`
+			FROM posts p
+			JOIN users u ON p.user_id = u.id
+			WHERE p.trip_id = $1 `+newestPostsAfter(&args, cursor)+`
+			ORDER BY p.timestamp DESC, p.id DESC
+			LIMIT $2`, args...)
+		if err != nil {
+			http.Error(w, "Failed to retrieve posts", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+		page, err := scanNewestPosts(db, rows, limit)
+		if err != nil {
+			http.Error(w, "Failed to retrieve posts", http.StatusInternalServerError)
+			log.Println("Database error:", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(page)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCertificationMeets(t *testing.T) {
+	for _, c := range []struct {
+		have, required string
+		want           bool
+	}{
+		{"", "", true},
+		{"open_water", "", true},
+		{"", "open_water", false},
+		{"rescue", "advanced_open_water", true},
+		{"open_water", "advanced_open_water", false},
+		{"instructor", "instructor", true},
+	} {
+		if got := certificationMeets(c.have, c.required); got != c.want {
+			t.Errorf("certificationMeets(%q, %q) = %v, want %v", c.have, c.required, got, c.want)
+		}
+	}
+}
+
+func TestTripValidate(t *testing.T) {
+	valid := Trip{Title: "  Wreck weekend ", StartsAt: time.Now().Add(48 * time.Hour), Capacity: 8, RequiredCertification: "rescue"}
+	if err := valid.validate(); err != nil || valid.Title != "Wreck weekend" {
+		t.Errorf("validate() = %v with title %q", err, valid.Title)
+	}
+
+	for _, trip := range []Trip{
+		{StartsAt: time.Now().Add(time.Hour), Capacity: 4},
+		{Title: "Past", StartsAt: time.Now().Add(-time.Hour), Capacity: 4},
+		{Title: "Empty", StartsAt: time.Now().Add(time.Hour)},
+		{Title: "Huge", StartsAt: time.Now().Add(time.Hour), Capacity: maxTripCapacity + 1},
+		{Title: "Odd", StartsAt: time.Now().Add(time.Hour), Capacity: 4, RequiredCertification: "snorkeler"},
+	} {
+		if err := trip.validate(); err == nil {
+			t.Errorf("validate(%+v) should fail", trip)
+		}
+	}
+}
@@ -1,8 +1,9 @@
 "use client";
 
-import { useState, useEffect } from "react";
+import { useState, useEffect, useCallback, useRef } from "react";
 import { useAuth } from "@/context/AuthContext";
 import PostCard from "@/components/PostCard";
+import { getPostsPage } from "@/pages/api/posts";
 
 type Comment = {
   id: number;
@@ -36,39 +37,50 @@ type Post = {
 
 const Feed: React.FC = () => {
   const [posts, setPosts] = useState<Post[]>([]);
+  const [nextCursor, setNextCursor] = useState<string | undefined>(undefined);
+  const [hasMore, setHasMore] = useState(true);
+  const [loadingMore, setLoadingMore] = useState(false);
+  const sentinelRef = useRef<HTMLDivElement | null>(null);
   const { token } = useAuth();
-  const apiUrl = process.env.NEXT_PUBLIC_API_URL || "http://localhost:8080";
 
-  useEffect(() => {
-    if (!token) return;
+  const fetchPage = useCallback(
+    async (cursor?: string) => {
+      if (!token) return;
 
-    const fetchPosts = async () => {
+      setLoadingMore(true);
       try {
-        const res = await fetch(`${apiUrl}/api/go/posts/search`, {
-          method: "POST",
-          headers: {
-            "Content-Type": "application/json",
-            Authorization: `Bearer ${token}`,
-          },
-          body: JSON.stringify({}), // you can add filters later
-        });
-
-        if (!res.ok) {
-          const errorText = await res.text();
-          console.error("Failed to fetch posts:", errorText);
-          return;
-        }
-
-        const data = await res.json();
-        console.log("Fetched posts:", data);
-        setPosts(Array.isArray(data) ? data : []);
+        const page = await getPostsPage(token, { sort: "newest" }, cursor);
+        console.log("Fetched posts:", page);
+        setPosts((prev) => (cursor ? [...prev, ...page.posts] : page.posts));
+        setNextCursor(page.next_cursor);
+        setHasMore(Boolean(page.next_cursor));
       } catch (err) {
         console.error("Error fetching posts:", err);
+        setHasMore(false);
+      } finally {
+        setLoadingMore(false);
       }
-    };
+    },
+    [token]
+  );
+
+  useEffect(() => {
+    fetchPage();
+  }, [fetchPage]);
 
-    fetchPosts();
-  }, [token]);
+  // Load the next page when the bottom of the feed scrolls into view
+  useEffect(() => {
+    const sentinel = sentinelRef.current;
+    if (!sentinel || !hasMore) return;
+
+    const observer = new IntersectionObserver((entries) => {
+      if (entries[0].isIntersecting && !loadingMore && nextCursor) {
+        fetchPage(nextCursor);
+      }
+    });
+    observer.observe(sentinel);
+    return () => observer.disconnect();
+  }, [fetchPage, hasMore, loadingMore, nextCursor]);
 
   return (
     <div className="pt-8 pl-24">
@@ -76,12 +88,13 @@ const Feed: React.FC = () => {
         <h1 className="text-3xl font-bold mb-6">Dive Feed</h1>
 
         {posts.length > 0 ? (
-          [...posts]
-            .reverse()
-            .map((post) => <PostCard key={post.id} post={post} />)
+          posts.map((post) => <PostCard key={post.id} post={post} />)
         ) : (
-          <p className="text-gray-500">No posts found.</p>
+          !loadingMore && <p className="text-gray-500">No posts found.</p>
         )}
+
+        <div ref={sentinelRef} />
+        {loadingMore && <p className="text-gray-500">Loading more dives...</p>}
       </div>
     </div>
   );
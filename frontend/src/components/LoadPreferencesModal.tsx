@@ -101,11 +101,11 @@ const LoadPreferencesModal: React.FC<LoadPreferencesModalProps> = ({ onClose, on
                               </div>
                               <div>
                                  <p className="font-semibold text-sm">Start Date</p>
-                                 <p className="text-sm">{new Date(pref.time_start).toLocaleDateString()}</p>
+                                 <p className="text-sm">{pref.time_start ? new Date(pref.time_start).toLocaleDateString() : "Any"}</p>
                               </div>
                               <div>
                                  <p className="font-semibold text-sm">End Date</p>
-                                 <p className="text-sm">{new Date(pref.time_end).toLocaleDateString()}</p>
+                                 <p className="text-sm">{pref.time_end ? new Date(pref.time_end).toLocaleDateString() : "Any"}</p>
                               </div>
                            </div>
                         </div>
@@ -1,5 +1,6 @@
 import React, { useState, useEffect, useRef } from "react";
 import axios from "axios";
+import { storeSession } from "@/context/AuthContext";
 import Link from "next/link";
 
 const Login: React.FC = () => {
@@ -28,8 +29,7 @@ const Login: React.FC = () => {
         password,
       });
 
-      const { token } = response.data;
-      localStorage.setItem("token", token);
+      storeSession(response.data);
       window.location.href = "/";
     } catch (err: any) {
       console.log("Error response:", err.response); // Debug the error response
@@ -1,13 +1,15 @@
 import { useState, useEffect } from "react";
+import axios from "axios";
 import { FaSearch, FaHome, FaGlobe, FaPlus, FaCog, FaBars, FaTimes, FaSignOutAlt } from "react-icons/fa";
 import Link from "next/link";
-import { useAuth } from "@/context/AuthContext";
+import { useAuth, clearSession } from "@/context/AuthContext";
 import { useSidebar } from "@/context/SidebarContext";
 import { useRouter } from "next/router";
 
 export default function Sidebar() {
    const [isOpen, setIsOpen] = useState(false);
-   const { userId, user } = useAuth();
+   const { userId, user, token } = useAuth();
+   const apiUrl = process.env.NEXT_PUBLIC_API_URL || "http://localhost:8080";
    const [avatarKey, setAvatarKey] = useState(Date.now()); // Unique key for avatar updates
 
    const menuItems = [
@@ -24,8 +26,14 @@ export default function Sidebar() {
       setAvatarKey(Date.now()); // Update the key when user avatar changes
    }, [user?.avatar]);
 
-   const handleLogout = () => {
-      localStorage.removeItem("token");
+   const handleLogout = async () => {
+      try {
+         // End the session server-side so its refresh token stops working
+         await axios.post(`${apiUrl}/logout`, {}, { headers: { Authorization: `Bearer ${token}` } });
+      } catch (err) {
+         console.error("Error logging out:", err);
+      }
+      clearSession();
       window.location.reload(); // Refresh to apply logout state
    };
 
@@ -1,5 +1,6 @@
 import React, { useState, useEffect } from "react";
 import axios from "axios";
+import { storeSession } from "@/context/AuthContext";
 import Link from "next/link";
 import GlobeComponent from "./GlobeComponent";
 
@@ -66,7 +67,7 @@ const SignUp: React.FC = () => {
          const response = await axios.post(`${apiUrl}/sign-up`, payload);
          const { token, userId } = response.data;
 
-         localStorage.setItem("token", token);
+         storeSession(response.data);
 
          // STEP 2: Upload avatar if selected
          let avatarUrl = null;
@@ -20,6 +20,49 @@ interface AuthContextType {
 
 const AuthContext = createContext<AuthContextType | null>(null);
 
+const apiBaseUrl = process.env.NEXT_PUBLIC_API_URL || "http://localhost:8080";
+
+// Stores the token pair returned by /login, /sign-up and /token/refresh
+export const storeSession = (data: { token: string; refresh_token?: string }) => {
+   localStorage.setItem("token", data.token);
+   if (data.refresh_token) {
+      localStorage.setItem("refresh_token", data.refresh_token);
+   }
+};
+
+export const clearSession = () => {
+   localStorage.removeItem("token");
+   localStorage.removeItem("refresh_token");
+};
+
+let refreshing: Promise<string | null> | null = null;
+
+// Trades the refresh token for a new token pair. Concurrent callers share
+// one request, since each refresh token can only be used once. Resolves to
+// null when the session has ended.
+export const refreshAccessToken = (): Promise<string | null> => {
+   if (!refreshing) {
+      refreshing = (async () => {
+         const refreshToken = localStorage.getItem("refresh_token");
+         if (!refreshToken) return null;
+         try {
+            const response = await axios.post(`${apiBaseUrl}/token/refresh`, { refresh_token: refreshToken }, { skipAuthRefresh: true } as any);
+            storeSession(response.data);
+            return response.data.token as string;
+         } catch (err: any) {
+            if (err.response?.status === 401) clearSession();
+            return null;
+         }
+      })().finally(() => {
+         refreshing = null;
+      });
+   }
+   return refreshing;
+};
+
+// Refresh this long before the access token expires
+const refreshLeewayMs = 60 * 1000;
+
 export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
    const [token, setToken] = useState<string | null>(typeof window !== "undefined" ? localStorage.getItem("token") : null);
    const [isLoggedIn, setIsLoggedIn] = useState<boolean>(false);
@@ -44,12 +87,48 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
             setUserId(null);
          }
       } else {
-         localStorage.removeItem("token");
+         clearSession();
          setIsLoggedIn(false);
          setUserId(null); // Clear the user ID if no token
       }
    }, [token]);
 
+   // Retry requests rejected for an expired access token once with a
+   // refreshed one
+   useEffect(() => {
+      const interceptor = axios.interceptors.response.use(undefined, async (error) => {
+         const config = error.config;
+         if (error.response?.status !== 401 || !config || config.skipAuthRefresh || config._retried || !config.headers?.Authorization) {
+            return Promise.reject(error);
+         }
+         const newToken = await refreshAccessToken();
+         if (!newToken) return Promise.reject(error);
+         setToken(newToken);
+         config._retried = true;
+         config.headers.Authorization = `Bearer ${newToken}`;
+         return axios(config);
+      });
+      return () => axios.interceptors.response.eject(interceptor);
+   }, []);
+
+   // Refresh ahead of expiry, so requests made with fetch and the stored
+   // token keep working too
+   useEffect(() => {
+      if (!token) return;
+      let expiresAt: number;
+      try {
+         const decoded: any = jwtDecode(token);
+         expiresAt = decoded.exp * 1000;
+      } catch {
+         return;
+      }
+      const timer = setTimeout(async () => {
+         const newToken = await refreshAccessToken();
+         if (newToken) setToken(newToken);
+      }, Math.max(expiresAt - Date.now() - refreshLeewayMs, 0));
+      return () => clearTimeout(timer);
+   }, [token]);
+
    useEffect(() => {
       const verifyToken = async () => {
          if (router.pathname === "/sign-up" || router.pathname === "/login") {
@@ -65,7 +144,15 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
                setIsLoggedIn(true);
                await fetchUser(); // Fetch user data on successful token verification
             } catch (err) {
+               // An expired access token is renewed; the token change
+               // verifies again
+               const newToken = await refreshAccessToken();
+               if (newToken && newToken !== token) {
+                  setToken(newToken);
+                  return;
+               }
                console.error("Token invalid:", err);
+               clearSession();
                setToken(null);
                setIsLoggedIn(false);
                router.push("/login");
@@ -1,8 +1,13 @@
 import { axiosWithAuth } from "@/context/AuthContext";
 import { PostFilter } from "@/types/types";
 
-// Fetch posts with optional filters
-export async function getPosts(token: string, filters: { user_id?: number }) {
+export interface PostPage {
+  posts: any[];
+  next_cursor?: string;
+}
+
+// Fetch a single page of posts; pass the previous page's next_cursor to continue
+export async function getPostsPage(token: string, filters: Record<string, any>, cursor?: string): Promise<PostPage> {
   const apiUrl = process.env.NEXT_PUBLIC_API_URL || "http://localhost:8080";
 
   const res = await fetch(`${apiUrl}/api/go/posts/search`, {
@@ -11,13 +16,26 @@ export async function getPosts(token: string, filters: { user_id?: number }) {
       "Content-Type": "application/json",
       Authorization: `Bearer ${token}`,
     },
-    body: JSON.stringify(filters),
+    body: JSON.stringify({ ...filters, cursor }),
   });
 
   if (!res.ok) {
     throw new Error("Failed to fetch posts");
   }
 
-  const data = await res.json();
-  return data;
+  return res.json();
+}
+
+// Fetch all posts matching optional filters, following every page
+export async function getPosts(token: string, filters: { user_id?: number }) {
+  const posts: any[] = [];
+  let cursor: string | undefined;
+
+  do {
+    const page = await getPostsPage(token, { ...filters, limit: 100 }, cursor);
+    posts.push(...page.posts);
+    cursor = page.next_cursor;
+  } while (cursor);
+
+  return posts;
 }
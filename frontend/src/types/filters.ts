@@ -1,8 +1,8 @@
 export interface FilterValues {
    depth_min: number;
    depth_max: number;
-   time_start: Date;
-   time_end: Date;
+   time_start: Date | null;
+   time_end: Date | null;
    magnitude_min: number;
    magnitude_max: number;
    longitude_min: number;
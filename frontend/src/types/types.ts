@@ -26,6 +26,35 @@ export interface Post {
    rating?: number;
    likes: number;
    comments: Comment[];
+   site_id?: number;
+   // Dive log; depth above is the max depth
+   bottom_time?: number; // minutes
+   avg_depth?: number;
+   water_temp?: number; // °C
+   air_temp?: number; // °C
+   gas_mix?: "air" | "nitrox" | "trimix";
+   o2_percent?: number;
+   he_percent?: number;
+   tank_size?: number; // liters
+   start_pressure?: number; // bar
+   end_pressure?: number; // bar
+   suit?: "none" | "rashguard" | "shorty" | "wetsuit" | "semidry" | "drysuit";
+   weights?: number; // kg
+   current?: "none" | "light" | "moderate" | "strong";
+   entry_type?: "shore" | "boat" | "other";
+}
+export interface DiveSite {
+   id: number;
+   name: string;
+   latitude: number;
+   longitude: number;
+   max_depth?: number;
+   entry_type?: "shore" | "boat" | "other";
+   description: string;
+   aliases: string[];
+   created_by?: number;
+   timestamp: string;
+   distance_km?: number;
 }
 export interface PostFilter {
    user_id?: number;
@@ -39,10 +68,16 @@ export interface User {
    id: number;
    first_name: string;
    last_name: string;
+   username: string; // the handle @mentions refer to
    email: string;
    latitude: number;
    longitude: number;
    age: number;
    bio?: string;
    avatar?: string; // URL to profile picture
+   certification?: "open_water" | "advanced_open_water" | "rescue" | "divemaster" | "instructor";
+   location_visibility?: "hidden" | "approximate" | "exact"; // who sees the location
+   follower_count: number;
+   following_count: number;
+   following?: boolean; // whether the current user follows them
 }